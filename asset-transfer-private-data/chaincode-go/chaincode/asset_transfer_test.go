@@ -6,6 +6,7 @@ SPDX-License-Identifier: Apache-2.0
 package chaincode_test
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"os"
 	"testing"
@@ -368,7 +369,7 @@ func prepMocks(orgMSP, clientId string) (*mocks.TransactionContext, *mocks.Chain
 
 	clientIdentity := &mocks.ClientIdentity{}
 	clientIdentity.GetMSPIDReturns(orgMSP, nil)
-	clientIdentity.GetIDReturns(clientId, nil)
+	clientIdentity.GetIDReturns(base64.StdEncoding.EncodeToString([]byte(clientId)), nil)
 	//set matching msp ID using peer shim env variable
 	os.Setenv("CORE_PEER_LOCALMSPID", orgMSP)
 	transactionContext.GetClientIdentityReturns(clientIdentity)
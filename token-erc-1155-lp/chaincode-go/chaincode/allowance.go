@@ -0,0 +1,201 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const allowancePrefix = "account~operator~tokenId"
+
+// Allowance lets Operator transfer up to Amount of TokenID from Owner until Expiry,
+// seconds since the Unix epoch, or without time limit if Expiry is 0.
+// Transfers by the operator consume the allowance.
+type Allowance struct {
+	Owner    string `json:"owner"`
+	Operator string `json:"operator"`
+	TokenID  uint64 `json:"token_id"`
+	Amount   uint64 `json:"amount"`
+	Expiry   int64  `json:"expiry"`
+}
+
+// ApprovalForID MUST emit when the allowance of an operator over one token id of an owner is set.
+// An amount of 0 revokes the allowance.
+type ApprovalForID struct {
+	Owner    string `json:"owner"`
+	Operator string `json:"operator"`
+	ID       uint64 `json:"id"`
+	Amount   uint64 `json:"amount"`
+	Expiry   int64  `json:"expiry"`
+}
+
+// ApproveAmount allows operator to transfer up to amount of id from the caller until expiry,
+// seconds since the Unix epoch, or without time limit if expiry is 0. It replaces any previous
+// allowance of operator over id, an amount of 0 revokes it. Operators approved for all tokens with
+// SetApprovalForAll do not need an allowance. This function emits an ApprovalForID event.
+func (s *SmartContract) ApproveAmount(ctx contractapi.TransactionContextInterface, operator string, id uint64, amount uint64, expiry int64) error {
+
+	// Get ID of submitting client identity
+	account, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to get client id: %v", err)
+	}
+
+	if account == operator {
+		return fmt.Errorf("setting approval status for self")
+	}
+
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return fmt.Errorf("failed to get transaction timestamp: %v", err)
+	}
+	if amount != 0 && expiry != 0 && expiry <= txTimestamp.GetSeconds() {
+		return fmt.Errorf("allowance expiry %v is not in the future", expiry)
+	}
+
+	allowance := &Allowance{
+		Owner:    account,
+		Operator: operator,
+		TokenID:  id,
+		Amount:   amount,
+		Expiry:   expiry,
+	}
+	err = saveAllowance(ctx, allowance)
+	if err != nil {
+		return err
+	}
+
+	approvalEvent := ApprovalForID{Owner: account, Operator: operator, ID: id, Amount: amount, Expiry: expiry}
+	return emitEvent(ctx, "ApprovalForID", approvalEvent)
+}
+
+// AllowanceOf returns the amount of id that operator can still transfer from owner, which is 0
+// once the allowance expired. Operators approved for all tokens are not limited by it.
+func (s *SmartContract) AllowanceOf(ctx contractapi.TransactionContextInterface, owner string, operator string, id uint64) (uint64, error) {
+	allowance, err := readAllowance(ctx, owner, operator, id)
+	if err != nil {
+		return 0, err
+	}
+
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get transaction timestamp: %v", err)
+	}
+	if allowance.expired(txTimestamp.GetSeconds()) {
+		return 0, nil
+	}
+
+	return allowance.Amount, nil
+}
+
+// authorizeTransfer checks that operator can transfer amounts of ids from sender. The sender itself
+// and operators approved for all tokens always can, other operators consume their allowances.
+func authorizeTransfer(ctx contractapi.TransactionContextInterface, sender string, operator string, ids []uint64, amounts []uint64) error {
+	if operator == sender {
+		return nil
+	}
+
+	approved, err := _isApprovedForAll(ctx, sender, operator)
+	if err != nil {
+		return err
+	}
+	if approved {
+		return nil
+	}
+
+	// Sum the amounts per token id, as an allowance can only be updated once per transaction
+	necessaryAllowances := make(map[uint64]uint64) // token id -> necessary allowance
+	for i := 0; i < len(amounts); i++ {
+		necessaryAllowances[ids[i]], err = add(necessaryAllowances[ids[i]], amounts[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return fmt.Errorf("failed to get transaction timestamp: %v", err)
+	}
+
+	for _, id := range sortedKeys(necessaryAllowances) {
+		allowance, err := readAllowance(ctx, sender, operator, id)
+		if err != nil {
+			return err
+		}
+		if allowance.Amount == 0 || allowance.expired(txTimestamp.GetSeconds()) {
+			return fmt.Errorf("caller is not owner nor is approved")
+		}
+
+		needed := necessaryAllowances[id]
+		if allowance.Amount < needed {
+			return fmt.Errorf("operator has insufficient allowance for token %v, needed: %v, allowance: %v", id, needed, allowance.Amount)
+		}
+
+		allowance.Amount -= needed
+		err = saveAllowance(ctx, allowance)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (allowance *Allowance) expired(now int64) bool {
+	return allowance.Expiry != 0 && allowance.Expiry <= now
+}
+
+// readAllowance returns the allowance of operator over id of owner, with an amount of 0 if there is none
+func readAllowance(ctx contractapi.TransactionContextInterface, owner string, operator string, id uint64) (*Allowance, error) {
+	allowanceKey, err := ctx.GetStub().CreateCompositeKey(allowancePrefix, []string{owner, operator, strconv.FormatUint(id, 10)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the composite key for prefix %s: %v", allowancePrefix, err)
+	}
+
+	allowanceBytes, err := ctx.GetStub().GetState(allowanceKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read allowance of operator %s for account %s from world state: %v", operator, owner, err)
+	}
+
+	allowance := &Allowance{Owner: owner, Operator: operator, TokenID: id}
+	if allowanceBytes == nil {
+		return allowance, nil
+	}
+
+	err = json.Unmarshal(allowanceBytes, allowance)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode allowance JSON of operator %s for account %s: %v", operator, owner, err)
+	}
+
+	return allowance, nil
+}
+
+// saveAllowance stores allowance, or deletes it once its amount is 0
+func saveAllowance(ctx contractapi.TransactionContextInterface, allowance *Allowance) error {
+	allowanceKey, err := ctx.GetStub().CreateCompositeKey(allowancePrefix, []string{allowance.Owner, allowance.Operator, strconv.FormatUint(allowance.TokenID, 10)})
+	if err != nil {
+		return fmt.Errorf("failed to create the composite key for prefix %s: %v", allowancePrefix, err)
+	}
+
+	if allowance.Amount == 0 {
+		err = ctx.GetStub().DelState(allowanceKey)
+		if err != nil {
+			return fmt.Errorf("failed to delete the state of %v: %v", allowanceKey, err)
+		}
+		return nil
+	}
+
+	allowanceJSON, err := json.Marshal(allowance)
+	if err != nil {
+		return fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(allowanceKey, allowanceJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put state: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,271 @@
+package chaincode
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ReserveAudit compares what the pools record for one token with the balance of its LP account.
+// The LP account of a token is shared by every pool of the token and also holds their
+// unclaimed fees, so Expected is Reserve plus OtherReserves plus UnclaimedFees.
+// OtherPools is the number of other pools whose reserves are in OtherReserves.
+// Surplus and Deficit are how much the balance is above or below Expected.
+type ReserveAudit struct {
+	TokenID       uint64 `json:"token_id"`
+	Account       string `json:"account"`
+	Reserve       uint64 `json:"reserve"`
+	OtherPools    int    `json:"other_pools"`
+	OtherReserves uint64 `json:"other_reserves"`
+	UnclaimedFees uint64 `json:"unclaimed_fees"`
+	Expected      uint64 `json:"expected"`
+	Balance       uint64 `json:"balance"`
+	Surplus       uint64 `json:"surplus"`
+	Deficit       uint64 `json:"deficit"`
+}
+
+// PoolAudit is the result of AuditPool. Reserve is the reserve of the audited pool in each token.
+type PoolAudit struct {
+	TokenID     uint64        `json:"token_id"`
+	PairTokenID uint64        `json:"pair_token_id"`
+	Balanced    bool          `json:"balanced"`
+	Token       *ReserveAudit `json:"token"`
+	PairToken   *ReserveAudit `json:"pair_token"`
+}
+
+// PoolSynced MUST emit when SyncPool corrects the reserves of a pool.
+// The previous supplies are the reserves recorded before the correction.
+type PoolSynced struct {
+	Operator                    string `json:"operator"`
+	TokenID                     uint64 `json:"token_id"`
+	PairTokenID                 uint64 `json:"pair_token_id"`
+	PreviousTokenSupply         uint64 `json:"previous_token_supply"`
+	PreviousTokenPlatformSupply uint64 `json:"previous_token_platform_supply"`
+	TokenSupply                 uint64 `json:"token_supply"`
+	TokenPlatformSupply         uint64 `json:"token_platform_supply"`
+}
+
+// AuditPool compares the reserves recorded by the LP between tokenA and tokenB
+// with the balances of the LP accounts of both tokens
+func (s *SmartContract) AuditPool(ctx contractapi.TransactionContextInterface, tokenA uint64, tokenB uint64) (*PoolAudit, error) {
+	lp, err := s.GetLP(ctx, tokenA, tokenB)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.auditPool(ctx, lp)
+}
+
+// SyncPool sets the reserves of the LP between tokenA and tokenB so that the LP accounts
+// of both tokens balance, see AuditPool. Any surplus is added to the reserves of the pool
+// and any deficit is taken from them. A difference in an LP account that other pools share
+// cannot be attributed to this pool, so it is refused. Every platform pool shares the LP
+// account of the platform token, so once there are two platform pools SyncPool can only
+// repair the other token of a pool. Only the creator of the platform token can sync a pool.
+// It returns the audit after the correction. This function emits a PoolSynced event.
+func (s *SmartContract) SyncPool(ctx contractapi.TransactionContextInterface, tokenA uint64, tokenB uint64) (*PoolAudit, error) {
+
+	// Only the platform repairs pools
+	operatorId, err := s.authorizePlatform(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	lp, err := s.GetLP(ctx, tokenA, tokenB)
+	if err != nil {
+		return nil, err
+	}
+
+	audit, err := s.auditPool(ctx, lp)
+	if err != nil {
+		return nil, err
+	}
+	if audit.Balanced {
+		return nil, fmt.Errorf("lp of token id %v and %v is balanced", lp.TokenID, lp.PairTokenID)
+	}
+
+	syncedEvent := PoolSynced{
+		Operator:                    operatorId,
+		TokenID:                     lp.TokenID,
+		PairTokenID:                 lp.PairTokenID,
+		PreviousTokenSupply:         lp.TokenSupply,
+		PreviousTokenPlatformSupply: lp.TokenPlatformSupply,
+	}
+
+	err = audit.Token.sync()
+	if err != nil {
+		return nil, err
+	}
+	err = audit.PairToken.sync()
+	if err != nil {
+		return nil, err
+	}
+	audit.Balanced = true
+
+	lp.TokenSupply = audit.Token.Reserve
+	lp.TokenPlatformSupply = audit.PairToken.Reserve
+
+	err = s.saveLPState(ctx, lp)
+	if err != nil {
+		return nil, err
+	}
+
+	syncedEvent.TokenSupply = lp.TokenSupply
+	syncedEvent.TokenPlatformSupply = lp.TokenPlatformSupply
+	err = emitEvent(ctx, "PoolSynced", syncedEvent)
+	if err != nil {
+		return nil, err
+	}
+
+	return audit, nil
+}
+
+func (s *SmartContract) auditPool(ctx contractapi.TransactionContextInterface, lp *LiquidityPool) (*PoolAudit, error) {
+	lps, err := s.readAllLPs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	audit := &PoolAudit{TokenID: lp.TokenID, PairTokenID: lp.PairTokenID}
+
+	audit.Token, err = auditReserve(ctx, lp, lp.TokenID, lps)
+	if err != nil {
+		return nil, err
+	}
+	audit.PairToken, err = auditReserve(ctx, lp, lp.PairTokenID, lps)
+	if err != nil {
+		return nil, err
+	}
+
+	audit.Balanced = audit.Token.Surplus == 0 && audit.Token.Deficit == 0 &&
+		audit.PairToken.Surplus == 0 && audit.PairToken.Deficit == 0
+
+	return audit, nil
+}
+
+// auditReserve compares the reserves and unclaimed fees of every pool in tokenId with the balance of its LP account
+func auditReserve(ctx contractapi.TransactionContextInterface, lp *LiquidityPool, tokenId uint64, lps []*LiquidityPool) (*ReserveAudit, error) {
+	audit := &ReserveAudit{
+		TokenID: tokenId,
+		Account: lpTokenBalancePrefix + strconv.FormatUint(tokenId, 10),
+	}
+
+	for _, pool := range lps {
+		if pool.TokenID != tokenId && pool.PairTokenID != tokenId {
+			continue
+		}
+
+		reserve := pool.TokenSupply
+		if pool.PairTokenID == tokenId {
+			reserve = pool.TokenPlatformSupply
+		}
+
+		var err error
+		if newTokenPair(pool.TokenID, pool.PairTokenID) == newTokenPair(lp.TokenID, lp.PairTokenID) {
+			audit.Reserve = reserve
+		} else {
+			audit.OtherPools++
+			audit.OtherReserves, err = add(audit.OtherReserves, reserve)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		stats, err := readPoolFeeStats(ctx, pool)
+		if err != nil {
+			return nil, err
+		}
+		accrual := stats.TokenFees
+		if pool.PairTokenID == tokenId {
+			accrual = stats.PairTokenFees
+		}
+		audit.UnclaimedFees, err = add(audit.UnclaimedFees, accrual.unclaimed())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	audit.Expected, err = add(audit.Reserve, audit.OtherReserves)
+	if err != nil {
+		return nil, err
+	}
+	audit.Expected, err = add(audit.Expected, audit.UnclaimedFees)
+	if err != nil {
+		return nil, err
+	}
+
+	audit.Balance, err = balanceOfHelper(ctx, audit.Account, tokenId)
+	if err != nil {
+		return nil, err
+	}
+
+	if audit.Balance > audit.Expected {
+		audit.Surplus = audit.Balance - audit.Expected
+	} else {
+		audit.Deficit = audit.Expected - audit.Balance
+	}
+
+	return audit, nil
+}
+
+// sync sets the reserve of the audited pool to the amount that balances the LP account
+func (audit *ReserveAudit) sync() error {
+	if audit.Surplus == 0 && audit.Deficit == 0 {
+		return nil
+	}
+	if audit.OtherPools > 0 {
+		return fmt.Errorf("%v in token id %v is shared by %v other pools, its difference cannot be attributed to one pool", audit.Account, audit.TokenID, audit.OtherPools)
+	}
+
+	if audit.Deficit > audit.Reserve {
+		return fmt.Errorf("deficit of %v of %v in token id %v exceeds the reserve of %v of the pool", audit.Deficit, audit.Account, audit.TokenID, audit.Reserve)
+	}
+
+	var err error
+	audit.Reserve, err = add(audit.Reserve-audit.Deficit, audit.Surplus)
+	if err != nil {
+		return err
+	}
+	audit.Expected = audit.Balance
+	audit.Surplus = 0
+	audit.Deficit = 0
+
+	return nil
+}
+
+// unclaimed returns the fees that have been accrued and not claimed
+func (accrual *FeeAccrual) unclaimed() uint64 {
+	return accrual.PlatformAccrued - accrual.PlatformClaimed + accrual.ProviderAccrued - accrual.ProviderClaimed
+}
+
+// readAllLPs returns every liquidity pool
+func (s *SmartContract) readAllLPs(ctx contractapi.TransactionContextInterface) ([]*LiquidityPool, error) {
+	platformTokenId, err := s.GetPlatformTokenID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	lpIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(lpKeyPrefix, []string{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state for prefix %v: %v", lpKeyPrefix, err)
+	}
+	defer lpIterator.Close()
+
+	var lps []*LiquidityPool
+	for lpIterator.HasNext() {
+		queryResponse, err := lpIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the next state for prefix %v: %v", lpKeyPrefix, err)
+		}
+
+		lp, err := decodeLP(ctx, queryResponse.Key, queryResponse.Value, platformTokenId)
+		if err != nil {
+			return nil, err
+		}
+		lps = append(lps, lp)
+	}
+
+	return lps, nil
+}
@@ -0,0 +1,123 @@
+package chaincode
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+)
+
+// balanceCompactionThreshold is the number of balance fragments of an account and token id
+// above which removeBalance folds all of them into the self recipient key
+const balanceCompactionThreshold = 16
+
+// balanceFragment is one account~tokenId~sender key holding part of a balance
+type balanceFragment struct {
+	key    string
+	sender string
+	amount uint64
+}
+
+// CompactBalance folds all balance fragments of account in token id into a single key.
+// The balance does not change. It can be called by the account itself or by the minter,
+// which takes care of accounts without an owner such as the LP accounts.
+// It returns the number of fragments the balance was spread over.
+func (s *SmartContract) CompactBalance(ctx contractapi.TransactionContextInterface, account string, id uint64) (int, error) {
+
+	// Get ID of submitting client identity
+	clientID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get client id: %v", err)
+	}
+
+	if clientID != account {
+		err = authorizationHelper(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("%v is not allowed to compact the balance of %v: %v", clientID, account, err)
+		}
+	}
+
+	return compactBalance(ctx, account, id)
+}
+
+// compactBalance folds all balance fragments of account in token id into the self recipient key
+// and returns the number of fragments the balance was spread over
+func compactBalance(ctx contractapi.TransactionContextInterface, account string, id uint64) (int, error) {
+
+	if account == "0x0" {
+		return 0, fmt.Errorf("balance query for the zero address")
+	}
+
+	// Convert id to string
+	idString := strconv.FormatUint(uint64(id), 10)
+
+	balanceIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(balancePrefix, []string{account, idString})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get state for prefix %v: %v", balancePrefix, err)
+	}
+	defer balanceIterator.Close()
+
+	var fragments []balanceFragment
+	var balance uint64
+	selfRecipientKeyExists := false
+
+	for balanceIterator.HasNext() {
+		queryResponse, err := balanceIterator.Next()
+		if err != nil {
+			return 0, fmt.Errorf("failed to get the next state for prefix %v: %v", balancePrefix, err)
+		}
+
+		fragment, err := readBalanceFragment(ctx, queryResponse)
+		if err != nil {
+			return 0, err
+		}
+		balance, err = add(balance, fragment.amount)
+		if err != nil {
+			return 0, err
+		}
+
+		if fragment.sender == account {
+			selfRecipientKeyExists = true
+		}
+		fragments = append(fragments, fragment)
+	}
+
+	// A balance held in the self recipient key alone is already compact
+	if len(fragments) == 0 || (len(fragments) == 1 && selfRecipientKeyExists) {
+		return len(fragments), nil
+	}
+
+	for _, fragment := range fragments {
+		if fragment.sender == account && balance != 0 {
+			continue
+		}
+		err = ctx.GetStub().DelState(fragment.key)
+		if err != nil {
+			return 0, fmt.Errorf("failed to delete the state of %v: %v", fragment.key, err)
+		}
+	}
+
+	if balance != 0 {
+		err = setBalance(ctx, account, account, id, balance)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(fragments), nil
+}
+
+func readBalanceFragment(ctx contractapi.TransactionContextInterface, queryResponse *queryresult.KV) (balanceFragment, error) {
+	amount, err := parseAmount(queryResponse.Value)
+	if err != nil {
+		return balanceFragment{}, err
+	}
+
+	_, compositeKeyParts, err := ctx.GetStub().SplitCompositeKey(queryResponse.Key)
+	if err != nil {
+		return balanceFragment{}, err
+	}
+
+	return balanceFragment{key: queryResponse.Key, sender: compositeKeyParts[2], amount: amount}, nil
+}
@@ -0,0 +1,144 @@
+package chaincode
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"erc1155/chaincode/mocks"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	"github.com/stretchr/testify/require"
+)
+
+// prepStateMocks returns mocks backed by a map, so that writes are visible to later reads and iterators
+func prepStateMocks() (*mocks.TransactionContext, map[string][]byte) {
+	state := make(map[string][]byte)
+	keyStub := &shim.ChaincodeStub{}
+
+	chaincodeStub := &mocks.ChaincodeStub{}
+	chaincodeStub.CreateCompositeKeyCalls(keyStub.CreateCompositeKey)
+	chaincodeStub.SplitCompositeKeyCalls(keyStub.SplitCompositeKey)
+	chaincodeStub.GetStateCalls(func(key string) ([]byte, error) {
+		return state[key], nil
+	})
+	chaincodeStub.PutStateCalls(func(key string, value []byte) error {
+		state[key] = value
+		return nil
+	})
+	chaincodeStub.DelStateCalls(func(key string) error {
+		delete(state, key)
+		return nil
+	})
+	chaincodeStub.GetStateByPartialCompositeKeyCalls(func(objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+		prefix, err := keyStub.CreateCompositeKey(objectType, attributes)
+		if err != nil {
+			return nil, err
+		}
+
+		var results []*queryresult.KV
+		for key, value := range state {
+			if strings.HasPrefix(key, prefix) {
+				results = append(results, &queryresult.KV{Key: key, Value: value})
+			}
+		}
+		sort.Slice(results, func(i, j int) bool { return results[i].Key < results[j].Key })
+
+		iterator := &mocks.StateQueryIterator{}
+		iterator.HasNextCalls(func() bool { return len(results) > 0 })
+		iterator.NextCalls(func() (*queryresult.KV, error) {
+			next := results[0]
+			results = results[1:]
+			return next, nil
+		})
+		return iterator, nil
+	})
+
+	transactionContext := &mocks.TransactionContext{}
+	transactionContext.GetStubReturns(chaincodeStub)
+	return transactionContext, state
+}
+
+// fragmentBalance spreads amount of token id 1 over count fragments of account from different senders
+func fragmentBalance(t testing.TB, ctx *mocks.TransactionContext, account string, count int, amount uint64) {
+	for i := 0; i < count; i++ {
+		err := addBalance(ctx, fmt.Sprintf("sender%04d", i), account, 1, amount)
+		require.NoError(t, err)
+	}
+}
+
+func TestCompactBalance(t *testing.T) {
+	ctx, state := prepStateMocks()
+	fragmentBalance(t, ctx, "alice", 5, 10)
+
+	fragments, err := compactBalance(ctx, "alice", 1)
+	require.NoError(t, err)
+	require.Equal(t, 5, fragments)
+	require.Len(t, state, 1)
+
+	balance, err := balanceOfHelper(ctx, "alice", 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(50), balance)
+
+	// A compact balance is left alone
+	fragments, err = compactBalance(ctx, "alice", 1)
+	require.NoError(t, err)
+	require.Equal(t, 1, fragments)
+	require.Len(t, state, 1)
+}
+
+func TestRemoveBalanceCompaction(t *testing.T) {
+	// Below the threshold only the fragments needed for the withdrawal are folded
+	ctx, state := prepStateMocks()
+	fragmentBalance(t, ctx, "alice", balanceCompactionThreshold, 10)
+
+	err := removeBalance(ctx, "alice", []uint64{1}, []uint64{15})
+	require.NoError(t, err)
+	require.Len(t, state, balanceCompactionThreshold-1)
+
+	balance, err := balanceOfHelper(ctx, "alice", 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(balanceCompactionThreshold*10-15), balance)
+
+	// Above the threshold all fragments are folded into the self recipient key
+	ctx, state = prepStateMocks()
+	fragmentBalance(t, ctx, "alice", balanceCompactionThreshold+5, 10)
+
+	err = removeBalance(ctx, "alice", []uint64{1}, []uint64{15})
+	require.NoError(t, err)
+	require.Len(t, state, 1)
+
+	balance, err = balanceOfHelper(ctx, "alice", 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64((balanceCompactionThreshold+5)*10-15), balance)
+
+	err = removeBalance(ctx, "alice", []uint64{1}, []uint64{balance + 1})
+	require.Error(t, err)
+}
+
+func BenchmarkBalanceOf(b *testing.B) {
+	for _, count := range []int{10, 100, 1000} {
+		ctx, _ := prepStateMocks()
+		fragmentBalance(b, ctx, "alice", count, 10)
+
+		b.Run("fragments="+strconv.Itoa(count), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, err := balanceOfHelper(ctx, "alice", 1)
+				require.NoError(b, err)
+			}
+		})
+
+		_, err := compactBalance(ctx, "alice", 1)
+		require.NoError(b, err)
+
+		b.Run("compacted="+strconv.Itoa(count), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, err := balanceOfHelper(ctx, "alice", 1)
+				require.NoError(b, err)
+			}
+		})
+	}
+}
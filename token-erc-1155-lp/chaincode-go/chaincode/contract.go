@@ -17,6 +17,7 @@ import (
 )
 
 const uriKey = "uri"
+const tokenURIPrefix = "tokenId~uri"
 
 const balancePrefix = "account~tokenId~sender"
 const approvalPrefix = "account~operator"
@@ -26,8 +27,6 @@ const tokenNamePrefix = "tokenId~name"
 
 const minterMSPID = "Org1MSP"
 
-var tokenIdCount uint64 = 0
-
 // SmartContract provides functions for transferring tokens between accounts
 type SmartContract struct {
 	contractapi.Contract
@@ -44,11 +43,11 @@ type SmartContract struct {
 // When minting/creating tokens, the from argument MUST be set to `0x0` (i.e. zero address).
 // When burning/destroying tokens, the to argument MUST be set to `0x0` (i.e. zero address).
 type TransferSingle struct {
-	Operator string  `json:"operator"`
-	From     string  `json:"from"`
-	To       string  `json:"to"`
-	ID       uint64  `json:"id"`
-	Value    float64 `json:"value"`
+	Operator string `json:"operator"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	ID       uint64 `json:"id"`
+	Value    uint64 `json:"value"`
 }
 
 // TransferBatch MUST emit when tokens are transferred, including zero value
@@ -63,11 +62,11 @@ type TransferSingle struct {
 // When minting/creating tokens, the from argument MUST be set to `0x0` (i.e. zero address).
 // When burning/destroying tokens, the to argument MUST be set to `0x0` (i.e. zero address).
 type TransferBatch struct {
-	Operator string    `json:"operator"`
-	From     string    `json:"from"`
-	To       string    `json:"to"`
-	IDs      []uint64  `json:"ids"`
-	Values   []float64 `json:"values"`
+	Operator string   `json:"operator"`
+	From     string   `json:"from"`
+	To       string   `json:"to"`
+	IDs      []uint64 `json:"ids"`
+	Values   []uint64 `json:"values"`
 }
 
 // TransferBatchMultiRecipient MUST emit when tokens are transferred, including zero value
@@ -82,11 +81,11 @@ type TransferBatch struct {
 // When minting/creating tokens, the from argument MUST be set to `0x0` (i.e. zero address).
 // When burning/destroying tokens, the to argument MUST be set to `0x0` (i.e. zero address).
 type TransferBatchMultiRecipient struct {
-	Operator string    `json:"operator"`
-	From     string    `json:"from"`
-	To       []string  `json:"to"`
-	IDs      []uint64  `json:"ids"`
-	Values   []float64 `json:"values"`
+	Operator string   `json:"operator"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	IDs      []uint64 `json:"ids"`
+	Values   []uint64 `json:"values"`
 }
 
 // ApprovalForAll MUST emit when approval for a second party/operator address
@@ -99,9 +98,7 @@ type ApprovalForAll struct {
 }
 
 // URI MUST emit when the URI is updated for a token ID.
-// Note: This event is not used in this contract implementation because in this implementation,
-// only the programmatic way of setting URI is used. The URI should contain {id} as part of it
-// and the clients MUST replace this with the actual token ID.
+// The URI may contain {id}, which URI replaces with the hexadecimal token ID.
 type URI struct {
 	Value string `json:"value"`
 	ID    uint64 `json:"id"`
@@ -115,16 +112,49 @@ type ToID struct {
 }
 
 type CreateTokenResponse struct {
-	TokenId   uint64 `json:"token_id"`
-	TokenName string `json:"token_name"`
-	Creator   string `json:"creator"`
+	TokenId        uint64 `json:"token_id"`
+	TokenName      string `json:"token_name"`
+	TokenSymbol    string `json:"token_symbol"`
+	MaxSupply      uint64 `json:"max_supply"`
+	TransferPolicy string `json:"transfer_policy"`
+	Creator        string `json:"creator"`
 }
 
-func (s *SmartContract) CreateToken(ctx contractapi.TransactionContextInterface, tokenId uint64, tokenName string) (*CreateTokenResponse, error) {
+// CreateToken registers a new token id with the caller as its creator, who is the only one allowed to mint it.
+// Pass 0 as tokenId to allocate the next unused token id, and 0 as maxSupply for an uncapped supply.
+// Explicit token ids do not move the allocation forward, allocated ids skip them instead.
+// transferPolicy is one of TransferPolicyTransferable, TransferPolicyNonTransferable and TransferPolicyClawback,
+// an empty policy is transferable. The policy cannot be changed later.
+func (s *SmartContract) CreateToken(ctx contractapi.TransactionContextInterface, tokenId uint64, tokenName string, tokenSymbol string, maxSupply uint64, transferPolicy string) (*CreateTokenResponse, error) {
 	creatorId, err := ctx.GetClientIdentity().GetID()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get client id: %v", err)
 	}
+
+	if tokenName == "" {
+		return nil, fmt.Errorf("token name must not be empty")
+	}
+
+	transferPolicy, err = validTransferPolicy(transferPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	if tokenId == 0 {
+		tokenId, err = s.allocateTokenID(ctx)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		existingCreator, err := s.GetTokenCreator(ctx, tokenId)
+		if err != nil {
+			return nil, err
+		}
+		if existingCreator != "" {
+			return nil, fmt.Errorf("token with id %v already exists", tokenId)
+		}
+	}
+
 	tokenIdString := strconv.FormatUint(uint64(tokenId), 10)
 	// Save token creator by token id
 	// Save as mapping of prefix-tokenId => creatorId
@@ -150,10 +180,32 @@ func (s *SmartContract) CreateToken(ctx contractapi.TransactionContextInterface,
 		return nil, err
 	}
 
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transaction timestamp: %v", err)
+	}
+
+	tokenInfo := &TokenInfo{
+		ID:             tokenId,
+		Name:           tokenName,
+		Symbol:         tokenSymbol,
+		Creator:        creatorId,
+		CreatedAt:      txTimestamp.GetSeconds(),
+		MaxSupply:      maxSupply,
+		TransferPolicy: transferPolicy,
+	}
+	err = saveTokenInfo(ctx, tokenInfo)
+	if err != nil {
+		return nil, err
+	}
+
 	return &CreateTokenResponse{
-		TokenId:   tokenId,
-		TokenName: tokenName,
-		Creator:   creatorId,
+		TokenId:        tokenId,
+		TokenName:      tokenName,
+		TokenSymbol:    tokenSymbol,
+		MaxSupply:      maxSupply,
+		TransferPolicy: transferPolicy,
+		Creator:        creatorId,
 	}, nil
 }
 
@@ -189,7 +241,7 @@ func (s *SmartContract) GetTokenName(ctx contractapi.TransactionContextInterface
 
 // Mint creates amount tokens of token type id and assigns them to account.
 // This function emits a TransferSingle event.
-func (s *SmartContract) Mint(ctx contractapi.TransactionContextInterface, account string, id uint64, amount float64) error {
+func (s *SmartContract) Mint(ctx contractapi.TransactionContextInterface, account string, id uint64, amount uint64) error {
 
 	// Check minter authorization - this sample assumes Org1 is the central banker with privilege to mint new tokens
 	// err := authorizationHelper(ctx)
@@ -213,6 +265,12 @@ func (s *SmartContract) Mint(ctx contractapi.TransactionContextInterface, accoun
 		return err
 	}
 
+	// Contract accounts must accept the tokens
+	err = checkOnERC1155Received(ctx, operator, "0x0", account, id, amount)
+	if err != nil {
+		return err
+	}
+
 	// Emit TransferSingle event
 	transferSingleEvent := TransferSingle{operator, "0x0", account, id, amount}
 	return emitTransferSingle(ctx, transferSingleEvent)
@@ -220,7 +278,7 @@ func (s *SmartContract) Mint(ctx contractapi.TransactionContextInterface, accoun
 
 // MintBatch creates amount tokens for each token type id and assigns them to account.
 // This function emits a TransferBatch event.
-func (s *SmartContract) MintBatch(ctx contractapi.TransactionContextInterface, account string, ids []uint64, amounts []float64) error {
+func (s *SmartContract) MintBatch(ctx contractapi.TransactionContextInterface, account string, ids []uint64, amounts []uint64) error {
 
 	if len(ids) != len(amounts) {
 		return fmt.Errorf("ids and amounts must have the same length")
@@ -239,10 +297,13 @@ func (s *SmartContract) MintBatch(ctx contractapi.TransactionContextInterface, a
 	}
 
 	// Group amount by token id because we can only send token to a recipient only one time in a block. This prevents key conflicts
-	amountToSend := make(map[uint64]float64) // token id => amount
+	amountToSend := make(map[uint64]uint64) // token id => amount
 
 	for i := 0; i < len(amounts); i++ {
-		amountToSend[ids[i]] += amounts[i]
+		amountToSend[ids[i]], err = add(amountToSend[ids[i]], amounts[i])
+		if err != nil {
+			return err
+		}
 	}
 
 	// Copy the map keys and sort it. This is necessary because iterating maps in Go is not deterministic
@@ -257,6 +318,12 @@ func (s *SmartContract) MintBatch(ctx contractapi.TransactionContextInterface, a
 		}
 	}
 
+	// Contract accounts must accept the tokens
+	err = checkOnERC1155BatchReceived(ctx, operator, "0x0", account, ids, amounts)
+	if err != nil {
+		return err
+	}
+
 	// Emit TransferBatch event
 	transferBatchEvent := TransferBatch{operator, "0x0", account, ids, amounts}
 	return emitTransferBatch(ctx, transferBatchEvent)
@@ -264,7 +331,7 @@ func (s *SmartContract) MintBatch(ctx contractapi.TransactionContextInterface, a
 
 // Burn destroys amount tokens of token type id from account.
 // This function triggers a TransferSingle event.
-func (s *SmartContract) Burn(ctx contractapi.TransactionContextInterface, account string, id uint64, amount float64) error {
+func (s *SmartContract) Burn(ctx contractapi.TransactionContextInterface, account string, id uint64, amount uint64) error {
 
 	if account == "0x0" {
 		return fmt.Errorf("burn to the zero address")
@@ -283,7 +350,12 @@ func (s *SmartContract) Burn(ctx contractapi.TransactionContextInterface, accoun
 	}
 
 	// Burn tokens
-	err = removeBalance(ctx, account, []uint64{id}, []float64{amount})
+	err = removeBalance(ctx, account, []uint64{id}, []uint64{amount})
+	if err != nil {
+		return err
+	}
+
+	err = changeSupply(ctx, []uint64{id}, []uint64{amount}, false)
 	if err != nil {
 		return err
 	}
@@ -294,7 +366,7 @@ func (s *SmartContract) Burn(ctx contractapi.TransactionContextInterface, accoun
 
 // BurnBatch destroys amount tokens of for each token type id from account.
 // This function emits a TransferBatch event.
-func (s *SmartContract) BurnBatch(ctx contractapi.TransactionContextInterface, account string, ids []uint64, amounts []float64) error {
+func (s *SmartContract) BurnBatch(ctx contractapi.TransactionContextInterface, account string, ids []uint64, amounts []uint64) error {
 
 	if account == "0x0" {
 		return fmt.Errorf("burn to the zero address")
@@ -321,14 +393,20 @@ func (s *SmartContract) BurnBatch(ctx contractapi.TransactionContextInterface, a
 		return err
 	}
 
+	err = changeSupply(ctx, ids, amounts, false)
+	if err != nil {
+		return err
+	}
+
 	transferBatchEvent := TransferBatch{operator, account, "0x0", ids, amounts}
 	return emitTransferBatch(ctx, transferBatchEvent)
 }
 
 // TransferFrom transfers tokens from sender account to recipient account
-// recipient account must be a valid clientID as returned by the ClientID() function
+// recipient account must be a valid clientID as returned by the ClientID() function,
+// or a contract account whose chaincode acknowledges the transfer, see RegisterContractAccount
 // This function triggers a TransferSingle event
-func (s *SmartContract) TransferFrom(ctx contractapi.TransactionContextInterface, sender string, recipient string, id uint64, amount float64) error {
+func (s *SmartContract) TransferFrom(ctx contractapi.TransactionContextInterface, sender string, recipient string, id uint64, amount uint64) error {
 	if sender == recipient {
 		return fmt.Errorf("transfer to self")
 	}
@@ -339,19 +417,19 @@ func (s *SmartContract) TransferFrom(ctx contractapi.TransactionContextInterface
 		return fmt.Errorf("failed to get client id: %v", err)
 	}
 
-	// Check whether operator is owner or approved
-	if operator != sender {
-		approved, err := _isApprovedForAll(ctx, sender, operator)
-		if err != nil {
-			return err
-		}
-		if !approved {
-			return fmt.Errorf("caller is not owner nor is approved")
-		}
+	// Check whether operator is owner, approved for all tokens or has enough allowance
+	err = authorizeTransfer(ctx, sender, operator, []uint64{id}, []uint64{amount})
+	if err != nil {
+		return err
+	}
+
+	err = requireTransferable(ctx, []uint64{id})
+	if err != nil {
+		return err
 	}
 
 	// Withdraw the funds from the sender address
-	err = removeBalance(ctx, sender, []uint64{id}, []float64{amount})
+	err = removeBalance(ctx, sender, []uint64{id}, []uint64{amount})
 	if err != nil {
 		return err
 	}
@@ -366,15 +444,22 @@ func (s *SmartContract) TransferFrom(ctx contractapi.TransactionContextInterface
 		return err
 	}
 
+	// Contract accounts must accept the tokens
+	err = checkOnERC1155Received(ctx, operator, sender, recipient, id, amount)
+	if err != nil {
+		return err
+	}
+
 	// Emit TransferSingle event
 	transferSingleEvent := TransferSingle{operator, sender, recipient, id, amount}
 	return emitTransferSingle(ctx, transferSingleEvent)
 }
 
 // BatchTransferFrom transfers multiple tokens from sender account to recipient account
-// recipient account must be a valid clientID as returned by the ClientID() function
+// recipient account must be a valid clientID as returned by the ClientID() function,
+// or a contract account whose chaincode acknowledges the transfer, see RegisterContractAccount
 // This function triggers a TransferBatch event
-func (s *SmartContract) BatchTransferFrom(ctx contractapi.TransactionContextInterface, sender string, recipient string, ids []uint64, amounts []float64) error {
+func (s *SmartContract) BatchTransferFrom(ctx contractapi.TransactionContextInterface, sender string, recipient string, ids []uint64, amounts []uint64) error {
 	if sender == recipient {
 		return fmt.Errorf("transfer to self")
 	}
@@ -389,15 +474,15 @@ func (s *SmartContract) BatchTransferFrom(ctx contractapi.TransactionContextInte
 		return fmt.Errorf("failed to get client id: %v", err)
 	}
 
-	// Check whether operator is owner or approved
-	if operator != sender {
-		approved, err := _isApprovedForAll(ctx, sender, operator)
-		if err != nil {
-			return err
-		}
-		if !approved {
-			return fmt.Errorf("caller is not owner nor is approved")
-		}
+	// Check whether operator is owner, approved for all tokens or has enough allowance
+	err = authorizeTransfer(ctx, sender, operator, ids, amounts)
+	if err != nil {
+		return err
+	}
+
+	err = requireTransferable(ctx, ids)
+	if err != nil {
+		return err
 	}
 
 	// Withdraw the funds from the sender address
@@ -411,10 +496,13 @@ func (s *SmartContract) BatchTransferFrom(ctx contractapi.TransactionContextInte
 	}
 
 	// Group amount by token id because we can only send token to a recipient only one time in a block. This prevents key conflicts
-	amountToSend := make(map[uint64]float64) // token id => amount
+	amountToSend := make(map[uint64]uint64) // token id => amount
 
 	for i := 0; i < len(amounts); i++ {
-		amountToSend[ids[i]] += amounts[i]
+		amountToSend[ids[i]], err = add(amountToSend[ids[i]], amounts[i])
+		if err != nil {
+			return err
+		}
 	}
 
 	// Copy the map keys and sort it. This is necessary because iterating maps in Go is not deterministic
@@ -429,14 +517,21 @@ func (s *SmartContract) BatchTransferFrom(ctx contractapi.TransactionContextInte
 		}
 	}
 
+	// Contract accounts must accept the tokens
+	err = checkOnERC1155BatchReceived(ctx, operator, sender, recipient, ids, amounts)
+	if err != nil {
+		return err
+	}
+
 	transferBatchEvent := TransferBatch{operator, sender, recipient, ids, amounts}
 	return emitTransferBatch(ctx, transferBatchEvent)
 }
 
 // BatchTransferFromMultiRecipient transfers multiple tokens from sender account to multiple recipient accounts
-// recipient account must be a valid clientID as returned by the ClientID() function
+// recipient account must be a valid clientID as returned by the ClientID() function,
+// or a contract account whose chaincode acknowledges the transfer, see RegisterContractAccount
 // This function triggers a TransferBatchMultiRecipient event
-func (s *SmartContract) BatchTransferFromMultiRecipient(ctx contractapi.TransactionContextInterface, sender string, recipients []string, ids []uint64, amounts []float64) error {
+func (s *SmartContract) BatchTransferFromMultiRecipient(ctx contractapi.TransactionContextInterface, sender string, recipients []string, ids []uint64, amounts []uint64) error {
 
 	if len(recipients) != len(ids) || len(ids) != len(amounts) {
 		return fmt.Errorf("recipients, ids, and amounts must have the same length")
@@ -454,15 +549,15 @@ func (s *SmartContract) BatchTransferFromMultiRecipient(ctx contractapi.Transact
 		return fmt.Errorf("failed to get client id: %v", err)
 	}
 
-	// Check whether operator is owner or approved
-	if operator != sender {
-		approved, err := _isApprovedForAll(ctx, sender, operator)
-		if err != nil {
-			return err
-		}
-		if !approved {
-			return fmt.Errorf("caller is not owner nor is approved")
-		}
+	// Check whether operator is owner, approved for all tokens or has enough allowance
+	err = authorizeTransfer(ctx, sender, operator, ids, amounts)
+	if err != nil {
+		return err
+	}
+
+	err = requireTransferable(ctx, ids)
+	if err != nil {
+		return err
 	}
 
 	// Withdraw the funds from the sender address
@@ -472,10 +567,14 @@ func (s *SmartContract) BatchTransferFromMultiRecipient(ctx contractapi.Transact
 	}
 
 	// Group amount by (recipient, id ) pair because we can only send token to a recipient only one time in a block. This prevents key conflicts
-	amountToSend := make(map[ToID]float64) // (recipient, id ) => amount
+	amountToSend := make(map[ToID]uint64) // (recipient, id ) => amount
 
 	for i := 0; i < len(amounts); i++ {
-		amountToSend[ToID{recipients[i], ids[i]}] += amounts[i]
+		key := ToID{recipients[i], ids[i]}
+		amountToSend[key], err = add(amountToSend[key], amounts[i])
+		if err != nil {
+			return err
+		}
 	}
 
 	// Copy the map keys and sort it. This is necessary because iterating maps in Go is not deterministic
@@ -495,6 +594,12 @@ func (s *SmartContract) BatchTransferFromMultiRecipient(ctx contractapi.Transact
 		}
 	}
 
+	// Contract accounts must accept the tokens sent to them
+	err = checkMultiRecipientReceived(ctx, operator, sender, recipients, ids, amounts)
+	if err != nil {
+		return err
+	}
+
 	// Emit TransferBatchMultiRecipient event
 	transferBatchMultiRecipientEvent := TransferBatchMultiRecipient{operator, sender, recipients, ids, amounts}
 	return emitTransferBatchMultiRecipient(ctx, transferBatchMultiRecipientEvent)
@@ -570,18 +675,43 @@ func (s *SmartContract) SetApprovalForAll(ctx contractapi.TransactionContextInte
 	return nil
 }
 
+// TotalSupply returns the amount of token id that has been minted and not burned
+func (s *SmartContract) TotalSupply(ctx contractapi.TransactionContextInterface, id uint64) (uint64, error) {
+	tokenInfo, err := s.GetTokenInfo(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+
+	return tokenInfo.Supply, nil
+}
+
+// TotalSupplyBatch returns the total supply of multiple token ids
+func (s *SmartContract) TotalSupplyBatch(ctx contractapi.TransactionContextInterface, ids []uint64) ([]uint64, error) {
+	supplies := make([]uint64, len(ids))
+
+	for i := 0; i < len(ids); i++ {
+		var err error
+		supplies[i], err = s.TotalSupply(ctx, ids[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return supplies, nil
+}
+
 // BalanceOf returns the balance of the given account
-func (s *SmartContract) BalanceOf(ctx contractapi.TransactionContextInterface, account string, id uint64) (float64, error) {
+func (s *SmartContract) BalanceOf(ctx contractapi.TransactionContextInterface, account string, id uint64) (uint64, error) {
 	return balanceOfHelper(ctx, account, id)
 }
 
 // BalanceOfBatch returns the balance of multiple account/token pairs
-func (s *SmartContract) BalanceOfBatch(ctx contractapi.TransactionContextInterface, accounts []string, ids []uint64) ([]float64, error) {
+func (s *SmartContract) BalanceOfBatch(ctx contractapi.TransactionContextInterface, accounts []string, ids []uint64) ([]uint64, error) {
 	if len(accounts) != len(ids) {
 		return nil, fmt.Errorf("accounts and ids must have the same length")
 	}
 
-	balances := make([]float64, len(accounts))
+	balances := make([]uint64, len(accounts))
 
 	for i := 0; i < len(accounts); i++ {
 		var err error
@@ -595,7 +725,7 @@ func (s *SmartContract) BalanceOfBatch(ctx contractapi.TransactionContextInterfa
 }
 
 // ClientAccountBalance returns the balance of the requesting client's account
-func (s *SmartContract) ClientAccountBalance(ctx contractapi.TransactionContextInterface, id uint64) (float64, error) {
+func (s *SmartContract) ClientAccountBalance(ctx contractapi.TransactionContextInterface, id uint64) (uint64, error) {
 
 	// Get ID of submitting client identity
 	clientID, err := ctx.GetClientIdentity().GetID()
@@ -620,8 +750,8 @@ func (s *SmartContract) ClientAccountID(ctx contractapi.TransactionContextInterf
 	return clientAccountID, nil
 }
 
-// SetURI set the URI value
-// This function triggers URI event for each token id
+// SetURI sets the URI of the token ids that have no URI of their own.
+// The uri should contain {id}, which URI replaces with the token ID.
 func (s *SmartContract) SetURI(ctx contractapi.TransactionContextInterface, uri string) error {
 
 	// Check minter authorization - this sample assumes Org1 is the central banker with privilege to mint new tokens
@@ -642,19 +772,61 @@ func (s *SmartContract) SetURI(ctx contractapi.TransactionContextInterface, uri
 	return nil
 }
 
-// URI returns the URI
+// SetTokenURI sets the URI of token id, overriding the URI set by SetURI.
+// This function triggers a URI event.
+func (s *SmartContract) SetTokenURI(ctx contractapi.TransactionContextInterface, id uint64, uri string) error {
+
+	// Only the creator of the token id can set its URI
+	err := s.AuthorizedToMint(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if uri == "" {
+		return fmt.Errorf("failed to set uri of token id %v, uri is empty", id)
+	}
+
+	tokenURIKey, err := ctx.GetStub().CreateCompositeKey(tokenURIPrefix, []string{strconv.FormatUint(id, 10)})
+	if err != nil {
+		return fmt.Errorf("failed to create the composite key for prefix %s: %v", tokenURIPrefix, err)
+	}
+
+	err = ctx.GetStub().PutState(tokenURIKey, []byte(uri))
+	if err != nil {
+		return fmt.Errorf("failed to set uri of token id %v: %v", id, err)
+	}
+
+	uriEvent := URI{Value: uri, ID: id}
+	return emitEvent(ctx, "URI", uriEvent)
+}
+
+// URI returns the URI of token id, falling back to the URI set by SetURI.
+// {id} in the URI is replaced with the token ID in lowercase hexadecimal,
+// zero-padded to 64 characters as described in the ERC-1155 metadata extension.
 func (s *SmartContract) URI(ctx contractapi.TransactionContextInterface, id uint64) (string, error) {
 
-	uriBytes, err := ctx.GetStub().GetState(uriKey)
+	tokenURIKey, err := ctx.GetStub().CreateCompositeKey(tokenURIPrefix, []string{strconv.FormatUint(id, 10)})
+	if err != nil {
+		return "", fmt.Errorf("failed to create the composite key for prefix %s: %v", tokenURIPrefix, err)
+	}
+
+	uriBytes, err := ctx.GetStub().GetState(tokenURIKey)
 	if err != nil {
-		return "", fmt.Errorf("failed to get uri: %v", err)
+		return "", fmt.Errorf("failed to get uri of token id %v: %v", id, err)
 	}
 
 	if uriBytes == nil {
-		return "", fmt.Errorf("no uri is set: %v", err)
+		uriBytes, err = ctx.GetStub().GetState(uriKey)
+		if err != nil {
+			return "", fmt.Errorf("failed to get uri: %v", err)
+		}
 	}
 
-	return string(uriBytes), nil
+	if uriBytes == nil {
+		return "", fmt.Errorf("no uri is set for token id %v", id)
+	}
+
+	return strings.ReplaceAll(string(uriBytes), "{id}", fmt.Sprintf("%064x", id)), nil
 }
 
 func (s *SmartContract) BroadcastTokenExistance(ctx contractapi.TransactionContextInterface, id uint64) error {
@@ -710,7 +882,7 @@ func authorizationHelper(ctx contractapi.TransactionContextInterface) error {
 	return nil
 }
 
-func mintHelper(ctx contractapi.TransactionContextInterface, operator string, account string, id uint64, amount float64) error {
+func mintHelper(ctx contractapi.TransactionContextInterface, operator string, account string, id uint64, amount uint64) error {
 	if account == "0x0" {
 		return fmt.Errorf("mint to the zero address")
 	}
@@ -724,23 +896,21 @@ func mintHelper(ctx contractapi.TransactionContextInterface, operator string, ac
 		return err
 	}
 
-	return nil
+	return changeSupply(ctx, []uint64{id}, []uint64{amount}, true)
 }
 
-func addBalance(ctx contractapi.TransactionContextInterface, sender string, recipient string, id uint64, amount float64) error {
+func addBalance(ctx contractapi.TransactionContextInterface, sender string, recipient string, id uint64, amount uint64) error {
+	err := recordSnapshotBalance(ctx, recipient, id)
+	if err != nil {
+		return err
+	}
+
 	// Convert id to string
 	idString := strconv.FormatUint(uint64(id), 10)
 
 	balanceKey, err := ctx.GetStub().CreateCompositeKey(balancePrefix, []string{recipient, idString, sender})
 	if err != nil {
-		fmt.Println("error here")
-		fmt.Println("recipient", recipient)
-		fmt.Println("idString", idString)
-		fmt.Println("sender", sender)
-		return fmt.Errorf(
-			"failed to create the composite key for prefix %s: %v", 
-			balancePrefix, 
-			err)
+		return fmt.Errorf("failed to create the composite key for prefix %s: %v", balancePrefix, err)
 	}
 
 	balanceBytes, err := ctx.GetStub().GetState(balanceKey)
@@ -748,14 +918,20 @@ func addBalance(ctx contractapi.TransactionContextInterface, sender string, reci
 		return fmt.Errorf("failed to read account %s from world state: %v", recipient, err)
 	}
 
-	var balance float64 = 0
+	var balance uint64 = 0
 	if balanceBytes != nil {
-		balance, _ = strconv.ParseFloat(string(balanceBytes), 64)
+		balance, err = parseAmount(balanceBytes)
+		if err != nil {
+			return err
+		}
 	}
 
-	balance += amount
+	balance, err = add(balance, amount)
+	if err != nil {
+		return err
+	}
 
-	err = ctx.GetStub().PutState(balanceKey, []byte(strconv.FormatUint(uint64(balance), 10)))
+	err = ctx.GetStub().PutState(balanceKey, []byte(strconv.FormatUint(balance, 10)))
 	if err != nil {
 		return err
 	}
@@ -763,7 +939,7 @@ func addBalance(ctx contractapi.TransactionContextInterface, sender string, reci
 	return nil
 }
 
-func setBalance(ctx contractapi.TransactionContextInterface, sender string, recipient string, id uint64, amount float64) error {
+func setBalance(ctx contractapi.TransactionContextInterface, sender string, recipient string, id uint64, amount uint64) error {
 	// Convert id to string
 	idString := strconv.FormatUint(uint64(id), 10)
 
@@ -772,7 +948,7 @@ func setBalance(ctx contractapi.TransactionContextInterface, sender string, reci
 		return fmt.Errorf("failed to create the composite key for prefix %s: %v", balancePrefix, err)
 	}
 
-	err = ctx.GetStub().PutState(balanceKey, []byte(strconv.FormatFloat(amount, 'e', 2, 64)))
+	err = ctx.GetStub().PutState(balanceKey, []byte(strconv.FormatUint(amount, 10)))
 	if err != nil {
 		return err
 	}
@@ -780,12 +956,22 @@ func setBalance(ctx contractapi.TransactionContextInterface, sender string, reci
 	return nil
 }
 
-func removeBalance(ctx contractapi.TransactionContextInterface, sender string, ids []uint64, amounts []float64) error {
+func removeBalance(ctx contractapi.TransactionContextInterface, sender string, ids []uint64, amounts []uint64) error {
+	return spendBalance(ctx, sender, ids, amounts, nil)
+}
+
+// spendBalance withdraws amounts of ids from sender, which must not dip into the held balance of sender.
+// released maps token ids to the part of the held balance that the transaction releases, it is spendable.
+func spendBalance(ctx contractapi.TransactionContextInterface, sender string, ids []uint64, amounts []uint64, released map[uint64]uint64) error {
 	// Calculate the total amount of each token to withdraw
-	necessaryFunds := make(map[uint64]float64) // token id -> necessary amount
+	necessaryFunds := make(map[uint64]uint64) // token id -> necessary amount
 
 	for i := 0; i < len(amounts); i++ {
-		necessaryFunds[ids[i]] += amounts[i]
+		var err error
+		necessaryFunds[ids[i]], err = add(necessaryFunds[ids[i]], amounts[i])
+		if err != nil {
+			return err
+		}
 	}
 
 	// Copy the map keys and sort it. This is necessary because iterating maps in Go is not deterministic
@@ -796,10 +982,51 @@ func removeBalance(ctx contractapi.TransactionContextInterface, sender string, i
 		neededAmount := necessaryFunds[tokenId]
 		idString := strconv.FormatUint(uint64(tokenId), 10)
 
-		var partialBalance float64
+		err := recordSnapshotBalance(ctx, sender, tokenId)
+		if err != nil {
+			return err
+		}
+
+		// Held funds stay in the balance, so the balance has to cover them on top of the withdrawal
+		held, err := heldBalance(ctx, sender, tokenId)
+		if err != nil {
+			return err
+		}
+		held, err = sub(held, released[tokenId])
+		if err != nil {
+			return err
+		}
+		requiredAmount, err := add(neededAmount, held)
+		if err != nil {
+			return err
+		}
+
+		var partialBalance uint64
 		var selfRecipientKeyNeedsToBeRemoved bool
 		var selfRecipientKey string
 
+		// withdraw adds a fragment to partialBalance and deletes its key, except for the self recipient key
+		// which is overwritten with the remainder below
+		withdraw := func(fragment balanceFragment) error {
+			var err error
+			partialBalance, err = add(partialBalance, fragment.amount)
+			if err != nil {
+				return err
+			}
+
+			if fragment.sender == sender {
+				selfRecipientKeyNeedsToBeRemoved = true
+				selfRecipientKey = fragment.key
+				return nil
+			}
+
+			err = ctx.GetStub().DelState(fragment.key)
+			if err != nil {
+				return fmt.Errorf("failed to delete the state of %v: %v", fragment.key, err)
+			}
+			return nil
+		}
+
 		balanceIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(balancePrefix, []string{sender, idString})
 		if err != nil {
 			return fmt.Errorf("failed to get state for prefix %v: %v", balancePrefix, err)
@@ -807,34 +1034,51 @@ func removeBalance(ctx contractapi.TransactionContextInterface, sender string, i
 		defer balanceIterator.Close()
 
 		// Iterate over keys that store balances and add them to partialBalance until
-		// either the necessary amount is reached or the keys ended
-		for balanceIterator.HasNext() && partialBalance < neededAmount {
+		// either the necessary amount is reached or the keys ended.
+		// Up to balanceCompactionThreshold fragments are read past the necessary amount. If the balance
+		// is spread over more fragments, all of them are folded into the self recipient key.
+		var spareFragments []balanceFragment
+		fragmentCount := 0
+		compact := false
+		for balanceIterator.HasNext() && (partialBalance < requiredAmount || compact || fragmentCount <= balanceCompactionThreshold) {
 			queryResponse, err := balanceIterator.Next()
 			if err != nil {
 				return fmt.Errorf("failed to get the next state for prefix %v: %v", balancePrefix, err)
 			}
+			fragmentCount++
 
-			partBalAmount, _ := strconv.ParseFloat(string(queryResponse.Value), 64)
-			partialBalance += partBalAmount
-
-			_, compositeKeyParts, err := ctx.GetStub().SplitCompositeKey(queryResponse.Key)
+			fragment, err := readBalanceFragment(ctx, queryResponse)
 			if err != nil {
 				return err
 			}
 
-			if compositeKeyParts[2] == sender {
-				selfRecipientKeyNeedsToBeRemoved = true
-				selfRecipientKey = queryResponse.Key
-			} else {
-				err = ctx.GetStub().DelState(queryResponse.Key)
+			if partialBalance < requiredAmount || compact {
+				err = withdraw(fragment)
 				if err != nil {
-					return fmt.Errorf("failed to delete the state of %v: %v", queryResponse.Key, err)
+					return err
+				}
+			} else {
+				spareFragments = append(spareFragments, fragment)
+			}
+
+			if !compact && fragmentCount > balanceCompactionThreshold {
+				compact = true
+				for _, spareFragment := range spareFragments {
+					err = withdraw(spareFragment)
+					if err != nil {
+						return err
+					}
 				}
+				spareFragments = nil
 			}
 		}
 
-		if partialBalance < neededAmount {
-			return fmt.Errorf("sender has insufficient funds for token %v, needed funds: %v, available fund: %v", tokenId, neededAmount, partialBalance)
+		if partialBalance < requiredAmount {
+			var available uint64
+			if partialBalance > held {
+				available = partialBalance - held
+			}
+			return fmt.Errorf("sender has insufficient funds for token %v, needed funds: %v, available fund: %v", tokenId, neededAmount, available)
 		} else if partialBalance > neededAmount {
 			// Send the remainder back to the sender
 			remainder := partialBalance - neededAmount
@@ -851,7 +1095,7 @@ func removeBalance(ctx contractapi.TransactionContextInterface, sender string, i
 				}
 			}
 
-		} else {
+		} else if selfRecipientKeyNeedsToBeRemoved {
 			// Delete self recipient key
 			err = ctx.GetStub().DelState(selfRecipientKey)
 			if err != nil {
@@ -904,7 +1148,7 @@ func emitTransferBatchMultiRecipient(ctx contractapi.TransactionContextInterface
 }
 
 // balanceOfHelper returns the balance of the given account
-func balanceOfHelper(ctx contractapi.TransactionContextInterface, account string, id uint64) (float64, error) {
+func balanceOfHelper(ctx contractapi.TransactionContextInterface, account string, id uint64) (uint64, error) {
 
 	if account == "0x0" {
 		return 0, fmt.Errorf("balance query for the zero address")
@@ -913,7 +1157,7 @@ func balanceOfHelper(ctx contractapi.TransactionContextInterface, account string
 	// Convert id to string
 	idString := strconv.FormatUint(uint64(id), 10)
 
-	var balance float64
+	var balance uint64
 
 	balanceIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(balancePrefix, []string{account, idString})
 	if err != nil {
@@ -927,15 +1171,21 @@ func balanceOfHelper(ctx contractapi.TransactionContextInterface, account string
 			return 0, fmt.Errorf("failed to get the next state for prefix %v: %v", balancePrefix, err)
 		}
 
-		balAmount, _ := strconv.ParseFloat(string(queryResponse.Value), 64)
-		balance += balAmount
+		balAmount, err := parseAmount(queryResponse.Value)
+		if err != nil {
+			return 0, err
+		}
+		balance, err = add(balance, balAmount)
+		if err != nil {
+			return 0, err
+		}
 	}
 
 	return balance, nil
 }
 
 // Returns the sorted slice ([]uint64) copied from the keys of map[uint64]uint64
-func sortedKeys(m map[uint64]float64) []uint64 {
+func sortedKeys(m map[uint64]uint64) []uint64 {
 	// Copy map keys to slice
 	keys := make([]uint64, len(m))
 	i := 0
@@ -949,7 +1199,7 @@ func sortedKeys(m map[uint64]float64) []uint64 {
 }
 
 // Returns the sorted slice ([]ToID) copied from the keys of map[ToID]uint64
-func sortedKeysToID(m map[ToID]float64) []ToID {
+func sortedKeysToID(m map[ToID]uint64) []ToID {
 	// Copy map keys to slice
 	keys := make([]ToID, len(m))
 	i := 0
@@ -1,13 +1,17 @@
 package chaincode_test
 
 import (
+	"math"
 	"os"
+	"strings"
 	"testing"
 
 	"erc1155/chaincode"
 	"erc1155/chaincode/mocks"
 
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	"github.com/hyperledger/fabric-protos-go/peer"
 	"github.com/stretchr/testify/require"
 )
 
@@ -58,7 +62,7 @@ func TestCreateToken(t *testing.T) {
 
 	expectedCreator := minterClientId
 
-	_, err := chaincode.CreateToken(transactionContext, "token1Name")
+	_, err := chaincode.CreateToken(transactionContext, 1, "token1Name", "TK1", 0, "")
 	require.NoError(t, err)
 
 	chaincodeStub.GetStateReturns([]byte(expectedCreator), nil)
@@ -79,12 +83,159 @@ func TestMint(t *testing.T) {
 
 	transactionContext.GetStubReturns(chaincodeStub)
 
-	_, err := chaincode.CreateToken(transactionContext, "token1Name")
+	_, err := chaincode.CreateToken(transactionContext, 1, "token1Name", "TK1", 0, "")
 	require.NoError(t, err)
 
 	minter := minterClientId
-	// Mock return state creator is minter
-	chaincodeStub.GetStateReturns([]byte(minter), nil)
+	// Mock return state creator is minter, the token has no snapshot, the minter has no balance yet and the token is registered
+	chaincodeStub.GetStateReturnsOnCall(1, []byte(minter), nil)
+	chaincodeStub.GetStateReturnsOnCall(2, nil, nil)
+	chaincodeStub.GetStateReturnsOnCall(3, nil, nil)
+	chaincodeStub.GetStateReturnsOnCall(4, []byte(`{"id":1,"name":"token1Name","creator":"OrgClientId"}`), nil)
 	err = chaincode.Mint(transactionContext, minter, 1, 1000000)
 	require.NoError(t, err)
+
+	// The supply is stored apart from the registry entry, which is not written again
+	_, supply := chaincodeStub.PutStateArgsForCall(chaincodeStub.PutStateCallCount() - 1)
+	require.Equal(t, "1000000", string(supply))
+}
+
+func TestMintExceedingMaxSupply(t *testing.T) {
+	transactionContext, chaincodeStub := prepMocksAsMinterMSP()
+	chaincode := chaincode.SmartContract{}
+
+	minter := minterClientId
+	// Mock return state creator is minter, the token has no snapshot, the minter has no balance yet and the token is capped
+	chaincodeStub.GetStateReturnsOnCall(0, []byte(minter), nil)
+	chaincodeStub.GetStateReturnsOnCall(1, nil, nil)
+	chaincodeStub.GetStateReturnsOnCall(2, nil, nil)
+	chaincodeStub.GetStateReturnsOnCall(3, []byte(`{"id":1,"name":"token1Name","creator":"OrgClientId","supply":900,"max_supply":1000}`), nil)
+	err := chaincode.Mint(transactionContext, minter, 1, 101)
+	require.EqualError(t, err, "minting 101 of token id 1 exceeds its max supply of 1000")
+
+	// Mock return state registry entry, creator and supply of each token id.
+	// Entries registered before the supply had a key of its own hold the supply themselves.
+	transactionContext, chaincodeStub = prepMocksAsMinterMSP()
+	chaincodeStub.GetStateReturnsOnCall(0, []byte(`{"id":1,"name":"token1Name","creator":"OrgClientId","max_supply":1000}`), nil)
+	chaincodeStub.GetStateReturnsOnCall(1, []byte(minter), nil)
+	chaincodeStub.GetStateReturnsOnCall(2, []byte("900"), nil)
+	chaincodeStub.GetStateReturnsOnCall(3, []byte(`{"id":2,"name":"token2Name","creator":"OrgClientId","supply":700}`), nil)
+	chaincodeStub.GetStateReturnsOnCall(4, []byte(minter), nil)
+	chaincodeStub.GetStateReturnsOnCall(5, nil, nil)
+	supplies, err := chaincode.TotalSupplyBatch(transactionContext, []uint64{1, 2})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{900, 700}, supplies)
+}
+
+func TestCreateTokenRejectsExistingID(t *testing.T) {
+	transactionContext, chaincodeStub := prepMocksAsOrg1()
+	chaincode := chaincode.SmartContract{}
+
+	// Mock return state token 1 already has a creator
+	chaincodeStub.GetStateReturnsOnCall(0, []byte(minterClientId), nil)
+	_, err := chaincode.CreateToken(transactionContext, 1, "token1Name", "TK1", 0, "")
+	require.EqualError(t, err, "token with id 1 already exists")
+
+	// Token id 0 allocates the id after the last one, skipping token 2 created with an explicit id
+	chaincodeStub.GetStateReturnsOnCall(1, []byte("1"), nil)
+	chaincodeStub.GetStateReturnsOnCall(2, []byte(minterClientId), nil)
+	chaincodeStub.GetStateReturnsOnCall(3, nil, nil)
+	response, err := chaincode.CreateToken(transactionContext, 0, "token3Name", "TK3", 0, "")
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), response.TokenId)
+	require.Equal(t, myOrg1Clientid, response.Creator)
+	lastTokenIdKey, lastTokenId := chaincodeStub.PutStateArgsForCall(0)
+	require.Equal(t, "lastTokenId", lastTokenIdKey)
+	require.Equal(t, "3", string(lastTokenId))
+}
+
+func TestCreateTokenExplicitIDKeepsAllocation(t *testing.T) {
+	transactionContext, chaincodeStub := prepMocksAsOrg1()
+	chaincode := chaincode.SmartContract{}
+
+	// A token created with the highest id does not exhaust the allocated ids
+	response, err := chaincode.CreateToken(transactionContext, math.MaxUint64, "maxName", "MAX", 0, "")
+	require.NoError(t, err)
+	require.Equal(t, uint64(math.MaxUint64), response.TokenId)
+	for i := 0; i < chaincodeStub.PutStateCallCount(); i++ {
+		key, _ := chaincodeStub.PutStateArgsForCall(i)
+		require.NotEqual(t, "lastTokenId", key)
+	}
+}
+
+func TestURI(t *testing.T) {
+	transactionContext, chaincodeStub := prepMocksAsMinterMSP()
+	chaincode := chaincode.SmartContract{}
+
+	// Mock return state creator is minter
+	chaincodeStub.GetStateReturnsOnCall(0, []byte(minterClientId), nil)
+	err := chaincode.SetTokenURI(transactionContext, 1, "https://example.com/{id}.json")
+	require.NoError(t, err)
+
+	eventName, eventJSON := chaincodeStub.SetEventArgsForCall(0)
+	require.Equal(t, "URI", eventName)
+	require.JSONEq(t, `{"value":"https://example.com/{id}.json","id":1}`, string(eventJSON))
+
+	// Mock return state token id 26 has its own uri
+	chaincodeStub.GetStateReturnsOnCall(1, []byte("https://example.com/{id}.json"), nil)
+	uri, err := chaincode.URI(transactionContext, 26)
+	require.NoError(t, err)
+	require.Equal(t, "https://example.com/000000000000000000000000000000000000000000000000000000000000001a.json", uri)
+
+	// Mock return state token id 2 has no uri of its own and falls back to the global uri
+	chaincodeStub.GetStateReturnsOnCall(2, nil, nil)
+	chaincodeStub.GetStateReturnsOnCall(3, []byte("https://example.com/default/{id}"), nil)
+	uri, err = chaincode.URI(transactionContext, 2)
+	require.NoError(t, err)
+	require.Equal(t, "https://example.com/default/0000000000000000000000000000000000000000000000000000000000000002", uri)
+
+	// Mock return state another client is the creator
+	chaincodeStub.GetStateReturnsOnCall(4, []byte(myOrg1Clientid), nil)
+	err = chaincode.SetTokenURI(transactionContext, 1, "https://example.com/{id}.json")
+	require.Error(t, err)
+}
+
+func TestPortfolioOf(t *testing.T) {
+	transactionContext, chaincodeStub := prepMocksAsOrg1()
+	chaincode := chaincode.SmartContract{}
+
+	chaincodeStub.SplitCompositeKeyCalls(func(key string) (string, []string, error) {
+		return "account~tokenId~sender", strings.Split(key, "~"), nil
+	})
+
+	// Mock return state the page starts with the last fragment of token id 1, which the previous page listed
+	pageIterator := &mocks.StateQueryIterator{}
+	pageIterator.HasNextReturnsOnCall(0, true)
+	pageIterator.HasNextReturnsOnCall(1, true)
+	pageIterator.HasNextReturnsOnCall(2, true)
+	pageIterator.HasNextReturnsOnCall(3, false)
+	pageIterator.NextReturnsOnCall(0, &queryresult.KV{Key: myOrg1Clientid + "~1~sender3", Value: []byte("1")}, nil)
+	pageIterator.NextReturnsOnCall(1, &queryresult.KV{Key: myOrg1Clientid + "~2~sender1", Value: []byte("5")}, nil)
+	pageIterator.NextReturnsOnCall(2, &queryresult.KV{Key: myOrg1Clientid + "~2~sender2", Value: []byte("7")}, nil)
+	chaincodeStub.GetStateByPartialCompositeKeyWithPaginationReturns(pageIterator, &peer.QueryResponseMetadata{FetchedRecordsCount: 3, Bookmark: "nextFragment"}, nil)
+
+	// Mock return state the balance of token id 2 is made of two fragments
+	balanceIterator := &mocks.StateQueryIterator{}
+	balanceIterator.HasNextReturnsOnCall(0, true)
+	balanceIterator.HasNextReturnsOnCall(1, true)
+	balanceIterator.HasNextReturnsOnCall(2, false)
+	balanceIterator.NextReturnsOnCall(0, &queryresult.KV{Key: myOrg1Clientid + "~2~sender1", Value: []byte("5")}, nil)
+	balanceIterator.NextReturnsOnCall(1, &queryresult.KV{Key: myOrg1Clientid + "~2~sender2", Value: []byte("7")}, nil)
+	chaincodeStub.GetStateByPartialCompositeKeyReturns(balanceIterator, nil)
+
+	chaincodeStub.GetStateReturns([]byte("token2Name"), nil)
+
+	portfolio, err := chaincode.PortfolioOf(transactionContext, myOrg1Clientid, 3, "1~fragment")
+	require.NoError(t, err)
+	require.Len(t, portfolio.Records, 1)
+	require.Equal(t, uint64(2), portfolio.Records[0].TokenID)
+	require.Equal(t, "token2Name", portfolio.Records[0].TokenName)
+	require.Equal(t, uint64(12), portfolio.Records[0].Balance)
+	require.Equal(t, "2~nextFragment", portfolio.Bookmark)
+
+	_, _, _, fragmentBookmark := chaincodeStub.GetStateByPartialCompositeKeyWithPaginationArgsForCall(0)
+	require.Equal(t, "fragment", fragmentBookmark)
+
+	_, err = chaincode.PortfolioOf(transactionContext, myOrg1Clientid, 3, "fragment")
+	require.EqualError(t, err, "invalid bookmark fragment")
 }
@@ -0,0 +1,69 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Fabric keeps only the last event set by a transaction, so the liquidity pool
+// transactions emit a single event that describes every token movement they make.
+
+// PoolCreated MUST emit when a liquidity pool is created.
+// The supplies are taken from the creator and the exchange rate is the number of
+// PairTokenID per TokenID, scaled by RateScale.
+type PoolCreated struct {
+	Creator         string `json:"creator"`
+	TokenID         uint64 `json:"token_id"`
+	PairTokenID     uint64 `json:"pair_token_id"`
+	TokenSupply     uint64 `json:"token_supply"`
+	PairTokenSupply uint64 `json:"pair_token_supply"`
+	ExchangeRate    uint64 `json:"exchange_rate"`
+}
+
+// LiquidityChanged is emitted as LiquidityAdded when the provider adds liquidity to a
+// pool and as LiquidityRemoved when the provider withdraws liquidity from a pool.
+// The amounts are the amounts moved, the supplies are the reserves of the pool afterwards.
+type LiquidityChanged struct {
+	Provider            string `json:"provider"`
+	TokenID             uint64 `json:"token_id"`
+	PairTokenID         uint64 `json:"pair_token_id"`
+	TokenAmount         uint64 `json:"token_amount"`
+	PairTokenAmount     uint64 `json:"pair_token_amount"`
+	TokenSupply         uint64 `json:"token_supply"`
+	TokenPlatformSupply uint64 `json:"token_platform_supply"`
+}
+
+// Swap MUST emit when tokens are exchanged through one or more liquidity pools.
+// The operator is the caller, the owner is the account the tokens were taken from and
+// the recipient the account the output was sent to, both are the operator unless the
+// exchange was made with ExchangeFrom. Route lists the token ids the exchange went through
+// and Hops describes the swap and the fees of every pool of the route.
+type Swap struct {
+	Operator        string        `json:"operator"`
+	Owner           string        `json:"owner"`
+	Recipient       string        `json:"recipient"`
+	FromTokenID     uint64        `json:"from_token_id"`
+	FromTokenAmount uint64        `json:"from_token_amount"`
+	ToTokenID       uint64        `json:"to_token_id"`
+	ToTokenAmount   uint64        `json:"to_token_amount"`
+	Fee             uint64        `json:"fee"`
+	ExchangeRate    uint64        `json:"exchange_rate"`
+	Route           []uint64      `json:"route"`
+	Hops            []ExchangeHop `json:"hops"`
+}
+
+func emitEvent(ctx contractapi.TransactionContextInterface, eventName string, event interface{}) error {
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+
+	err = ctx.GetStub().SetEvent(eventName, eventJSON)
+	if err != nil {
+		return fmt.Errorf("failed to set event: %v", err)
+	}
+
+	return nil
+}
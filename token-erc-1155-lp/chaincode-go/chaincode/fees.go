@@ -0,0 +1,264 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"erc1155/chaincode/pricing"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const lpFeesPrefix = "lpfees"
+
+// BasisPoints is the denominator of fee rates and fee shares
+const BasisPoints = pricing.BasisPoints
+
+// PoolFeeConfig configures the fee an LP charges on every swap.
+// The fee is SwapFeeBps of the gross output, or the SwapFeeBps of the highest tier
+// whose MinAmount the gross output reaches, but never less than MinimumFee.
+// MinimumFee is in platform tokens and is converted into the output token.
+// ProviderShareBps of every fee goes to the liquidity provider, the rest to the platform.
+type PoolFeeConfig struct {
+	SwapFeeBps       uint64    `json:"swap_fee_bps"`
+	MinimumFee       uint64    `json:"minimum_fee"`
+	Tiers            []FeeTier `json:"tiers,omitempty"`
+	ProviderShareBps uint64    `json:"provider_share_bps"`
+}
+
+// FeeTier applies SwapFeeBps to swaps whose gross output is at least MinAmount of the output token
+type FeeTier struct {
+	MinAmount  uint64 `json:"min_amount"`
+	SwapFeeBps uint64 `json:"swap_fee_bps"`
+}
+
+// FeeAccrual tracks the fees of one token of an LP. Accrued amounts only grow,
+// the unclaimed fees are the accrued minus the claimed amounts.
+type FeeAccrual struct {
+	PlatformAccrued uint64 `json:"platform_accrued"`
+	PlatformClaimed uint64 `json:"platform_claimed"`
+	ProviderAccrued uint64 `json:"provider_accrued"`
+	ProviderClaimed uint64 `json:"provider_claimed"`
+}
+
+// PoolFeeStats holds the fees an LP has collected in each of its tokens
+type PoolFeeStats struct {
+	TokenID       uint64     `json:"token_id"`
+	PairTokenID   uint64     `json:"pair_token_id"`
+	TokenFees     FeeAccrual `json:"token_fees"`
+	PairTokenFees FeeAccrual `json:"pair_token_fees"`
+}
+
+// ClaimFeesResult lists the amounts paid out by ClaimFees
+type ClaimFeesResult struct {
+	TokenID           uint64 `json:"token_id"`
+	TokenAmount       uint64 `json:"token_amount"`
+	PairTokenID       uint64 `json:"pair_token_id"`
+	PairTokenAmount   uint64 `json:"pair_token_amount"`
+	ClaimedAsPlatform bool   `json:"claimed_as_platform"`
+	ClaimedAsProvider bool   `json:"claimed_as_provider"`
+}
+
+// SetPoolFeeConfig sets the fee configuration of the LP between tokenA and tokenB.
+// Only the creator of the platform token can set it.
+func (s *SmartContract) SetPoolFeeConfig(ctx contractapi.TransactionContextInterface, tokenA uint64, tokenB uint64, config PoolFeeConfig) (*LiquidityPool, error) {
+
+	// Only the platform sets the fees of a pool
+	_, err := s.authorizePlatform(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.pricingConfig().Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	lp, err := s.GetLP(ctx, tokenA, tokenB)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tiers are kept sorted so that the applicable tier is found deterministically
+	sort.Slice(config.Tiers, func(i, j int) bool { return config.Tiers[i].MinAmount < config.Tiers[j].MinAmount })
+	lp.FeeConfig = &config
+
+	err = s.saveLPState(ctx, lp)
+	if err != nil {
+		return nil, err
+	}
+
+	return lp, nil
+}
+
+// PoolFeeStats returns the fees collected by the LP between tokenA and tokenB
+func (s *SmartContract) PoolFeeStats(ctx contractapi.TransactionContextInterface, tokenA uint64, tokenB uint64) (*PoolFeeStats, error) {
+	lp, err := s.GetLP(ctx, tokenA, tokenB)
+	if err != nil {
+		return nil, err
+	}
+
+	return readPoolFeeStats(ctx, lp)
+}
+
+// ClaimFees pays out the unclaimed fees of the LP between tokenA and tokenB to the caller.
+// The creator of the platform token claims the platform share and the creator of the LP
+// claims the liquidity provider share.
+func (s *SmartContract) ClaimFees(ctx contractapi.TransactionContextInterface, tokenA uint64, tokenB uint64) (*ClaimFeesResult, error) {
+
+	// Get ID of submitting client identity
+	claimerId, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client id: %v", err)
+	}
+
+	lp, err := s.GetLP(ctx, tokenA, tokenB)
+	if err != nil {
+		return nil, err
+	}
+
+	platformId, err := s.platformID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ClaimFeesResult{
+		TokenID:           lp.TokenID,
+		PairTokenID:       lp.PairTokenID,
+		ClaimedAsPlatform: claimerId == platformId,
+		ClaimedAsProvider: claimerId == lp.CreatorID,
+	}
+	if !result.ClaimedAsPlatform && !result.ClaimedAsProvider {
+		return nil, fmt.Errorf("%v is neither the platform nor the liquidity provider of lp of token id %v and %v", claimerId, lp.TokenID, lp.PairTokenID)
+	}
+
+	stats, err := readPoolFeeStats(ctx, lp)
+	if err != nil {
+		return nil, err
+	}
+
+	result.TokenAmount = stats.TokenFees.claim(result.ClaimedAsPlatform, result.ClaimedAsProvider)
+	result.PairTokenAmount = stats.PairTokenFees.claim(result.ClaimedAsPlatform, result.ClaimedAsProvider)
+
+	err = payFromLP(ctx, lp.TokenID, map[string]uint64{claimerId: result.TokenAmount})
+	if err != nil {
+		return nil, err
+	}
+	err = payFromLP(ctx, lp.PairTokenID, map[string]uint64{claimerId: result.PairTokenAmount})
+	if err != nil {
+		return nil, err
+	}
+
+	err = savePoolFeeStats(ctx, stats)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// pricingConfig returns config without the minimum fee, which has to be converted
+// into the output token of every swap
+func (config *PoolFeeConfig) pricingConfig() *pricing.FeeConfig {
+	tiers := make([]pricing.FeeTier, len(config.Tiers))
+	for i, tier := range config.Tiers {
+		tiers[i] = pricing.FeeTier{MinAmount: tier.MinAmount, SwapFeeBps: tier.SwapFeeBps}
+	}
+
+	return &pricing.FeeConfig{
+		SwapFeeBps:       config.SwapFeeBps,
+		Tiers:            tiers,
+		ProviderShareBps: config.ProviderShareBps,
+	}
+}
+
+// feeConfig returns the fee configuration of lp. Pools without one charge the
+// global platform fee, all of which goes to the platform.
+func (lp *LiquidityPool) feeConfig(platformFee uint64) *PoolFeeConfig {
+	if lp.FeeConfig != nil {
+		return lp.FeeConfig
+	}
+	return &PoolFeeConfig{MinimumFee: platformFee}
+}
+
+// accrue adds the fees of hop to the side of the pool they were collected in
+func (stats *PoolFeeStats) accrue(hop ExchangeHop) error {
+	accrual := &stats.TokenFees
+	if hop.ToTokenID == stats.PairTokenID {
+		accrual = &stats.PairTokenFees
+	}
+
+	var err error
+	accrual.PlatformAccrued, err = add(accrual.PlatformAccrued, hop.PlatformFee)
+	if err != nil {
+		return err
+	}
+	accrual.ProviderAccrued, err = add(accrual.ProviderAccrued, hop.ProviderFee)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// claim marks the unclaimed platform and/or provider fees as claimed and returns their sum
+func (accrual *FeeAccrual) claim(asPlatform bool, asProvider bool) uint64 {
+	var amount uint64
+	if asPlatform {
+		amount += accrual.PlatformAccrued - accrual.PlatformClaimed
+		accrual.PlatformClaimed = accrual.PlatformAccrued
+	}
+	if asProvider {
+		amount += accrual.ProviderAccrued - accrual.ProviderClaimed
+		accrual.ProviderClaimed = accrual.ProviderAccrued
+	}
+	return amount
+}
+
+func poolFeeStatsKey(ctx contractapi.TransactionContextInterface, tokenA uint64, tokenB uint64) (string, error) {
+	pair := newTokenPair(tokenA, tokenB)
+	key, err := ctx.GetStub().CreateCompositeKey(lpFeesPrefix, []string{strconv.FormatUint(pair.A, 10), strconv.FormatUint(pair.B, 10)})
+	if err != nil {
+		return "", fmt.Errorf("failed to create the composite key for prefix %s: %v", lpFeesPrefix, err)
+	}
+	return key, nil
+}
+
+func readPoolFeeStats(ctx contractapi.TransactionContextInterface, lp *LiquidityPool) (*PoolFeeStats, error) {
+	key, err := poolFeeStatsKey(ctx, lp.TokenID, lp.PairTokenID)
+	if err != nil {
+		return nil, err
+	}
+
+	statsBytes, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fee stats of lp of token id %v and %v from world state: %v", lp.TokenID, lp.PairTokenID, err)
+	}
+
+	stats := &PoolFeeStats{TokenID: lp.TokenID, PairTokenID: lp.PairTokenID}
+	if statsBytes == nil {
+		return stats, nil
+	}
+
+	err = json.Unmarshal(statsBytes, stats)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode fee stats of lp of token id %v and %v: %v", lp.TokenID, lp.PairTokenID, err)
+	}
+
+	return stats, nil
+}
+
+func savePoolFeeStats(ctx contractapi.TransactionContextInterface, stats *PoolFeeStats) error {
+	key, err := poolFeeStatsKey(ctx, stats.TokenID, stats.PairTokenID)
+	if err != nil {
+		return err
+	}
+
+	statsJSON, err := json.Marshal(stats)
+	if err != nil {
+		return fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+
+	return ctx.GetStub().PutState(key, statsJSON)
+}
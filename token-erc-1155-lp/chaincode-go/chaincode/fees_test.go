@@ -0,0 +1,21 @@
+package chaincode
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFeeAccrualClaim(t *testing.T) {
+	stats := &PoolFeeStats{TokenID: 2, PairTokenID: 1}
+
+	require.NoError(t, stats.accrue(ExchangeHop{ToTokenID: 1, PlatformFee: 75, ProviderFee: 25}))
+	require.NoError(t, stats.accrue(ExchangeHop{ToTokenID: 2, PlatformFee: 3, ProviderFee: 1}))
+	require.Equal(t, FeeAccrual{PlatformAccrued: 75, ProviderAccrued: 25}, stats.PairTokenFees)
+	require.Equal(t, FeeAccrual{PlatformAccrued: 3, ProviderAccrued: 1}, stats.TokenFees)
+
+	require.Equal(t, uint64(75), stats.PairTokenFees.claim(true, false))
+	require.Equal(t, uint64(0), stats.PairTokenFees.claim(true, false))
+	require.Equal(t, uint64(25), stats.PairTokenFees.claim(false, true))
+	require.Equal(t, uint64(4), stats.TokenFees.claim(true, true))
+}
@@ -0,0 +1,68 @@
+package chaincode
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"erc1155/chaincode/pricing"
+)
+
+// RateScale is the fixed-point scale of exchange rates. A rate of 10 platform
+// tokens per pool token is stored as 10 * RateScale.
+const RateScale = pricing.RateScale
+
+// add returns a + b, or an error if the sum overflows uint64
+func add(a uint64, b uint64) (uint64, error) {
+	return pricing.Add(a, b)
+}
+
+// sub returns a - b, or an error if b is greater than a
+func sub(a uint64, b uint64) (uint64, error) {
+	return pricing.Sub(a, b)
+}
+
+// mulDivDown returns floor(a * b / d). Amounts paid out of a pool are rounded down.
+func mulDivDown(a uint64, b uint64, d uint64) (uint64, error) {
+	return pricing.MulDivDown(a, b, d)
+}
+
+// mulDivUp returns ceil(a * b / d). Amounts charged by a pool are rounded up.
+func mulDivUp(a uint64, b uint64, d uint64) (uint64, error) {
+	return pricing.MulDivUp(a, b, d)
+}
+
+// parseAmount decodes an amount stored in the world state as a base 10 integer
+func parseAmount(value []byte) (uint64, error) {
+	amount, err := strconv.ParseUint(string(value), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("amount %q is not integer-encoded, run MigrateFloatState first: %v", string(value), err)
+	}
+	return amount, nil
+}
+
+// parseLegacyAmount decodes an amount written by the float64 version of this
+// contract and truncates any fractional part
+func parseLegacyAmount(value []byte) (uint64, error) {
+	amount, err := strconv.ParseFloat(string(value), 64)
+	if err != nil {
+		return 0, err
+	}
+	return legacyAmount(amount)
+}
+
+func legacyAmount(amount float64) (uint64, error) {
+	if amount < 0 || math.IsNaN(amount) || amount >= math.MaxUint64 {
+		return 0, fmt.Errorf("legacy amount %v is out of range", amount)
+	}
+	return uint64(math.Floor(amount)), nil
+}
+
+// legacyRate converts a float64 exchange rate into a RateScale fixed-point rate
+func legacyRate(rate float64) (uint64, error) {
+	scaled := math.Round(rate * float64(RateScale))
+	if scaled <= 0 || math.IsNaN(scaled) || scaled >= math.MaxUint64 {
+		return 0, fmt.Errorf("legacy exchange rate %v is out of range", rate)
+	}
+	return uint64(scaled), nil
+}
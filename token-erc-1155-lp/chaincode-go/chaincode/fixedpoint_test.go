@@ -0,0 +1,27 @@
+package chaincode
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLegacyEncoding(t *testing.T) {
+	amount, err := parseLegacyAmount([]byte("1.97e+06"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1970000), amount)
+
+	amount, err = parseLegacyAmount([]byte("202.7"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(202), amount)
+
+	_, err = parseAmount([]byte("1.97e+06"))
+	require.Error(t, err)
+
+	rate, err := legacyRate(0.005)
+	require.NoError(t, err)
+	require.Equal(t, uint64(500000), rate)
+
+	_, err = legacyRate(0)
+	require.Error(t, err)
+}
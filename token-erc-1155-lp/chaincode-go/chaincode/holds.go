@@ -0,0 +1,364 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const holdPrefix = "hold"
+
+const heldBalancePrefix = "heldbalance"
+
+// Hold reserves Amount of TokenID in the balance of Account for Holder. Held funds stay in the
+// balance of the account but cannot be spent by it. The holder can capture them until Expiry,
+// seconds since the Unix epoch, and release them at any time. From Expiry on anyone can release them.
+type Hold struct {
+	ID        string `json:"id"`
+	Account   string `json:"account"`
+	TokenID   uint64 `json:"token_id"`
+	Amount    uint64 `json:"amount"`
+	Holder    string `json:"holder"`
+	Expiry    int64  `json:"expiry"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// HoldEvent is emitted as HoldPlaced, HoldCaptured and HoldReleased.
+// Recipient and Amount are the recipient and the amount of a capture, the rest of the hold is released.
+type HoldEvent struct {
+	Operator  string `json:"operator"`
+	Hold      *Hold  `json:"hold"`
+	Recipient string `json:"recipient,omitempty"`
+	Amount    uint64 `json:"amount,omitempty"`
+}
+
+// Hold reserves amount of id in the balance of account for holder until expiry, seconds since the Unix epoch.
+// It can be called by the account or an operator approved by it. The ID of the hold is the ID of the transaction.
+// This function emits a HoldPlaced event.
+func (s *SmartContract) Hold(ctx contractapi.TransactionContextInterface, account string, id uint64, amount uint64, holder string, expiry int64) (*Hold, error) {
+
+	// Get ID of submitting client identity
+	operator, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client id: %v", err)
+	}
+
+	// Check whether operator is owner or approved
+	if operator != account {
+		approved, err := _isApprovedForAll(ctx, account, operator)
+		if err != nil {
+			return nil, err
+		}
+		if !approved {
+			return nil, fmt.Errorf("caller is not owner nor is approved")
+		}
+	}
+
+	// Holds are captured by transfers
+	err = requireTransferable(ctx, []uint64{id})
+	if err != nil {
+		return nil, err
+	}
+
+	if amount == 0 {
+		return nil, fmt.Errorf("amount must be a positive integer")
+	}
+	if holder == "" || holder == "0x0" {
+		return nil, fmt.Errorf("hold for the zero address")
+	}
+	if holder == account {
+		return nil, fmt.Errorf("hold for self")
+	}
+
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transaction timestamp: %v", err)
+	}
+	if expiry <= txTimestamp.GetSeconds() {
+		return nil, fmt.Errorf("expiry must be after %v", txTimestamp.GetSeconds())
+	}
+
+	available, err := availableBalance(ctx, account, id)
+	if err != nil {
+		return nil, err
+	}
+	if available < amount {
+		return nil, fmt.Errorf("account has insufficient funds for token %v, needed funds: %v, available fund: %v", id, amount, available)
+	}
+
+	hold := &Hold{
+		ID:        ctx.GetStub().GetTxID(),
+		Account:   account,
+		TokenID:   id,
+		Amount:    amount,
+		Holder:    holder,
+		Expiry:    expiry,
+		CreatedAt: txTimestamp.GetSeconds(),
+	}
+
+	err = putHold(ctx, hold)
+	if err != nil {
+		return nil, err
+	}
+
+	held, err := heldBalance(ctx, account, id)
+	if err != nil {
+		return nil, err
+	}
+	held, err = add(held, amount)
+	if err != nil {
+		return nil, err
+	}
+	err = setHeldBalance(ctx, account, id, held)
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitEvent(ctx, "HoldPlaced", HoldEvent{Operator: operator, Hold: hold})
+	if err != nil {
+		return nil, err
+	}
+
+	return hold, nil
+}
+
+// Capture transfers amount of the held funds of holdId to recipient and releases the rest of the hold.
+// Only the holder can capture a hold, and only before it expires. This function emits a HoldCaptured event.
+func (s *SmartContract) Capture(ctx contractapi.TransactionContextInterface, holdId string, recipient string, amount uint64) (*Hold, error) {
+
+	// Get ID of submitting client identity
+	operator, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client id: %v", err)
+	}
+
+	hold, err := s.GetHold(ctx, holdId)
+	if err != nil {
+		return nil, err
+	}
+
+	if operator != hold.Holder {
+		return nil, fmt.Errorf("%v is not the holder of hold %v", operator, holdId)
+	}
+
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transaction timestamp: %v", err)
+	}
+	if hold.expired(txTimestamp.GetSeconds()) {
+		return nil, fmt.Errorf("hold %v expired at %v", holdId, hold.Expiry)
+	}
+
+	if amount == 0 {
+		return nil, fmt.Errorf("amount must be a positive integer")
+	}
+	if amount > hold.Amount {
+		return nil, fmt.Errorf("amount %v exceeds the held amount %v of hold %v", amount, hold.Amount, holdId)
+	}
+	if recipient == hold.Account {
+		return nil, fmt.Errorf("transfer to self")
+	}
+	if recipient == "" || recipient == "0x0" {
+		return nil, fmt.Errorf("transfer to the zero address")
+	}
+
+	// The hold is released in this transaction, so its funds are spendable
+	err = spendBalance(ctx, hold.Account, []uint64{hold.TokenID}, []uint64{amount}, map[uint64]uint64{hold.TokenID: hold.Amount})
+	if err != nil {
+		return nil, err
+	}
+
+	err = addBalance(ctx, hold.Account, recipient, hold.TokenID, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	// Contract accounts must accept the tokens
+	err = checkOnERC1155Received(ctx, operator, hold.Account, recipient, hold.TokenID, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	err = releaseHold(ctx, hold)
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitEvent(ctx, "HoldCaptured", HoldEvent{Operator: operator, Hold: hold, Recipient: recipient, Amount: amount})
+	if err != nil {
+		return nil, err
+	}
+
+	return hold, nil
+}
+
+// Release returns the held funds of holdId to the spendable balance of the account. The holder can
+// release a hold at any time and anyone can release an expired hold. This function emits a HoldReleased event.
+func (s *SmartContract) Release(ctx contractapi.TransactionContextInterface, holdId string) (*Hold, error) {
+
+	// Get ID of submitting client identity
+	operator, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client id: %v", err)
+	}
+
+	hold, err := s.GetHold(ctx, holdId)
+	if err != nil {
+		return nil, err
+	}
+
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transaction timestamp: %v", err)
+	}
+	if operator != hold.Holder && !hold.expired(txTimestamp.GetSeconds()) {
+		return nil, fmt.Errorf("%v is not the holder of hold %v", operator, holdId)
+	}
+
+	err = releaseHold(ctx, hold)
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitEvent(ctx, "HoldReleased", HoldEvent{Operator: operator, Hold: hold})
+	if err != nil {
+		return nil, err
+	}
+
+	return hold, nil
+}
+
+// GetHold returns the open hold holdId
+func (s *SmartContract) GetHold(ctx contractapi.TransactionContextInterface, holdId string) (*Hold, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(holdPrefix, []string{holdId})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the composite key for prefix %s: %v", holdPrefix, err)
+	}
+
+	holdBytes, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hold %v from world state: %v", holdId, err)
+	}
+	if holdBytes == nil {
+		return nil, fmt.Errorf("hold %v does not exist", holdId)
+	}
+
+	var hold Hold
+	err = json.Unmarshal(holdBytes, &hold)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode hold %v: %v", holdId, err)
+	}
+
+	return &hold, nil
+}
+
+// AvailableBalance returns the balance of account in id that is not held, which is what the account can spend
+func (s *SmartContract) AvailableBalance(ctx contractapi.TransactionContextInterface, account string, id uint64) (uint64, error) {
+	return availableBalance(ctx, account, id)
+}
+
+func availableBalance(ctx contractapi.TransactionContextInterface, account string, id uint64) (uint64, error) {
+	balance, err := balanceOfHelper(ctx, account, id)
+	if err != nil {
+		return 0, err
+	}
+
+	held, err := heldBalance(ctx, account, id)
+	if err != nil {
+		return 0, err
+	}
+
+	if balance < held {
+		return 0, nil
+	}
+	return balance - held, nil
+}
+
+func (hold *Hold) expired(now int64) bool {
+	return hold.Expiry <= now
+}
+
+func putHold(ctx contractapi.TransactionContextInterface, hold *Hold) error {
+	key, err := ctx.GetStub().CreateCompositeKey(holdPrefix, []string{hold.ID})
+	if err != nil {
+		return fmt.Errorf("failed to create the composite key for prefix %s: %v", holdPrefix, err)
+	}
+
+	holdJSON, err := json.Marshal(hold)
+	if err != nil {
+		return fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(key, holdJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put state: %v", err)
+	}
+
+	return nil
+}
+
+// releaseHold deletes hold and takes its amount off the held balance of its account
+func releaseHold(ctx contractapi.TransactionContextInterface, hold *Hold) error {
+	key, err := ctx.GetStub().CreateCompositeKey(holdPrefix, []string{hold.ID})
+	if err != nil {
+		return fmt.Errorf("failed to create the composite key for prefix %s: %v", holdPrefix, err)
+	}
+
+	err = ctx.GetStub().DelState(key)
+	if err != nil {
+		return fmt.Errorf("failed to delete the state of %v: %v", key, err)
+	}
+
+	held, err := heldBalance(ctx, hold.Account, hold.TokenID)
+	if err != nil {
+		return err
+	}
+	held, err = sub(held, hold.Amount)
+	if err != nil {
+		return err
+	}
+
+	return setHeldBalance(ctx, hold.Account, hold.TokenID, held)
+}
+
+// heldBalance returns the sum of the open holds on the balance of account in id
+func heldBalance(ctx contractapi.TransactionContextInterface, account string, id uint64) (uint64, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(heldBalancePrefix, []string{account, strconv.FormatUint(id, 10)})
+	if err != nil {
+		return 0, fmt.Errorf("failed to create the composite key for prefix %s: %v", heldBalancePrefix, err)
+	}
+
+	heldBytes, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the held balance of %v from world state: %v", account, err)
+	}
+	if heldBytes == nil {
+		return 0, nil
+	}
+
+	return parseAmount(heldBytes)
+}
+
+func setHeldBalance(ctx contractapi.TransactionContextInterface, account string, id uint64, held uint64) error {
+	key, err := ctx.GetStub().CreateCompositeKey(heldBalancePrefix, []string{account, strconv.FormatUint(id, 10)})
+	if err != nil {
+		return fmt.Errorf("failed to create the composite key for prefix %s: %v", heldBalancePrefix, err)
+	}
+
+	if held == 0 {
+		err = ctx.GetStub().DelState(key)
+		if err != nil {
+			return fmt.Errorf("failed to delete the state of %v: %v", key, err)
+		}
+		return nil
+	}
+
+	err = ctx.GetStub().PutState(key, []byte(strconv.FormatUint(held, 10)))
+	if err != nil {
+		return fmt.Errorf("failed to put state: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,351 @@
+package chaincode
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const lpOutflowPrefix = "lpoutflow"
+
+const lpUserOutflowPrefix = "lpuseroutflow"
+
+// secondsPerDay is the length of the windows the daily outflow caps apply to
+const secondsPerDay = 24 * 60 * 60
+
+// PoolLimitConfig caps the value an LP pays out per day, in platform tokens.
+// DailyOutflowCap applies to all swaps through the pool and UserDailyOutflowCap to
+// the swaps of each caller. A cap of 0 is no limit. Outflows of a token without an LP
+// against the platform token cannot be priced and count in units of that token.
+// Days are UTC days of the transaction timestamp.
+type PoolLimitConfig struct {
+	DailyOutflowCap     uint64 `json:"daily_outflow_cap"`
+	UserDailyOutflowCap uint64 `json:"user_daily_outflow_cap"`
+}
+
+// PoolLimits describes the circuit breaker of an LP for the current day.
+// The outflows are what the pool paid out so far, the remaining amounts are the
+// headroom left under the caps, or the maximum uint64 if the cap is 0.
+type PoolLimits struct {
+	TokenID              uint64 `json:"token_id"`
+	PairTokenID          uint64 `json:"pair_token_id"`
+	Paused               bool   `json:"paused"`
+	Day                  int64  `json:"day"`
+	DailyOutflowCap      uint64 `json:"daily_outflow_cap"`
+	DailyOutflow         uint64 `json:"daily_outflow"`
+	RemainingOutflow     uint64 `json:"remaining_outflow"`
+	Account              string `json:"account"`
+	UserDailyOutflowCap  uint64 `json:"user_daily_outflow_cap"`
+	UserDailyOutflow     uint64 `json:"user_daily_outflow"`
+	UserRemainingOutflow uint64 `json:"user_remaining_outflow"`
+}
+
+// PoolPauseChanged is emitted as PoolPaused when swaps through a pool are stopped
+// and as PoolResumed when they are allowed again
+type PoolPauseChanged struct {
+	Operator    string `json:"operator"`
+	TokenID     uint64 `json:"token_id"`
+	PairTokenID uint64 `json:"pair_token_id"`
+}
+
+// PausePool stops all swaps through the LP between tokenA and tokenB, including routes
+// going through it. Liquidity can still be added and removed. It can be called by the
+// creator of the LP or the creator of the platform token. This function emits a PoolPaused event.
+func (s *SmartContract) PausePool(ctx contractapi.TransactionContextInterface, tokenA uint64, tokenB uint64) (*LiquidityPool, error) {
+	return s.setPoolPaused(ctx, tokenA, tokenB, true)
+}
+
+// ResumePool allows swaps through the LP between tokenA and tokenB again. It can be called by
+// the creator of the LP or the creator of the platform token. This function emits a PoolResumed event.
+func (s *SmartContract) ResumePool(ctx contractapi.TransactionContextInterface, tokenA uint64, tokenB uint64) (*LiquidityPool, error) {
+	return s.setPoolPaused(ctx, tokenA, tokenB, false)
+}
+
+// SetPoolLimits sets the daily outflow caps of the LP between tokenA and tokenB, in platform tokens.
+// It can be called by the creator of the LP or the creator of the platform token.
+func (s *SmartContract) SetPoolLimits(ctx contractapi.TransactionContextInterface, tokenA uint64, tokenB uint64, config PoolLimitConfig) (*LiquidityPool, error) {
+	lp, err := s.GetLP(ctx, tokenA, tokenB)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.authorizePoolAdmin(ctx, lp)
+	if err != nil {
+		return nil, err
+	}
+
+	lp.Limits = &config
+
+	err = s.saveLPState(ctx, lp)
+	if err != nil {
+		return nil, err
+	}
+
+	return lp, nil
+}
+
+// PoolLimits returns whether the LP between tokenA and tokenB is paused and how much it
+// can still pay out today, in total and to account
+func (s *SmartContract) PoolLimits(ctx contractapi.TransactionContextInterface, tokenA uint64, tokenB uint64, account string) (*PoolLimits, error) {
+	lp, err := s.GetLP(ctx, tokenA, tokenB)
+	if err != nil {
+		return nil, err
+	}
+
+	day, err := currentDay(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	config := lp.limitConfig()
+	limits := &PoolLimits{
+		TokenID:             lp.TokenID,
+		PairTokenID:         lp.PairTokenID,
+		Paused:              lp.Paused,
+		Day:                 day,
+		DailyOutflowCap:     config.DailyOutflowCap,
+		Account:             account,
+		UserDailyOutflowCap: config.UserDailyOutflowCap,
+	}
+
+	poolKey, userKey, err := outflowKeys(ctx, lp, day, account)
+	if err != nil {
+		return nil, err
+	}
+	limits.DailyOutflow, err = readOutflow(ctx, poolKey)
+	if err != nil {
+		return nil, err
+	}
+	limits.UserDailyOutflow, err = readOutflow(ctx, userKey)
+	if err != nil {
+		return nil, err
+	}
+
+	limits.RemainingOutflow = remainingOutflow(config.DailyOutflowCap, limits.DailyOutflow)
+	limits.UserRemainingOutflow = remainingOutflow(config.UserDailyOutflowCap, limits.UserDailyOutflow)
+
+	return limits, nil
+}
+
+func (s *SmartContract) setPoolPaused(ctx contractapi.TransactionContextInterface, tokenA uint64, tokenB uint64, paused bool) (*LiquidityPool, error) {
+	lp, err := s.GetLP(ctx, tokenA, tokenB)
+	if err != nil {
+		return nil, err
+	}
+
+	operatorId, err := s.authorizePoolAdmin(ctx, lp)
+	if err != nil {
+		return nil, err
+	}
+
+	if lp.Paused == paused {
+		if paused {
+			return nil, fmt.Errorf("lp of token id %v and %v is already paused", lp.TokenID, lp.PairTokenID)
+		}
+		return nil, fmt.Errorf("lp of token id %v and %v is not paused", lp.TokenID, lp.PairTokenID)
+	}
+	lp.Paused = paused
+
+	err = s.saveLPState(ctx, lp)
+	if err != nil {
+		return nil, err
+	}
+
+	eventName := "PoolPaused"
+	if !paused {
+		eventName = "PoolResumed"
+	}
+	err = emitEvent(ctx, eventName, PoolPauseChanged{Operator: operatorId, TokenID: lp.TokenID, PairTokenID: lp.PairTokenID})
+	if err != nil {
+		return nil, err
+	}
+
+	return lp, nil
+}
+
+// authorizePoolAdmin checks that the caller is the creator of lp or of the platform token and returns its id
+func (s *SmartContract) authorizePoolAdmin(ctx contractapi.TransactionContextInterface, lp *LiquidityPool) (string, error) {
+
+	// Get ID of submitting client identity
+	operatorId, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return "", fmt.Errorf("failed to get client id: %v", err)
+	}
+
+	if operatorId == lp.CreatorID {
+		return operatorId, nil
+	}
+
+	platformId, err := s.platformID(ctx)
+	if err != nil {
+		return "", err
+	}
+	if operatorId != platformId {
+		return "", fmt.Errorf("%v is neither the platform nor the liquidity provider of lp of token id %v and %v", operatorId, lp.TokenID, lp.PairTokenID)
+	}
+
+	return operatorId, nil
+}
+
+// limitConfig returns the outflow caps of lp, pools without any are not limited
+func (lp *LiquidityPool) limitConfig() *PoolLimitConfig {
+	if lp.Limits != nil {
+		return lp.Limits
+	}
+	return &PoolLimitConfig{}
+}
+
+// recordOutflows adds what every hop of result took out of the reserves of its pool to
+// the outflows of the pool and of exchangerId today, and fails if that exceeds a cap.
+// Outflows are valued in platform tokens at the exchange rates before the swap and
+// are only tracked for pools with a cap.
+func (s *SmartContract) recordOutflows(ctx contractapi.TransactionContextInterface, state *routeState, exchangerId string, result *ExchangeResult) error {
+	day, err := currentDay(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, hop := range result.Hops {
+		lp, err := state.lpForPair(ctx, s, hop.FromTokenID, hop.ToTokenID)
+		if err != nil {
+			return err
+		}
+
+		config := lp.limitConfig()
+		if config.DailyOutflowCap == 0 && config.UserDailyOutflowCap == 0 {
+			continue
+		}
+
+		// The fees leave the reserves as well, they stay in the LP account until claimed
+		outflow, err := add(hop.ToTokenAmount, hop.PlatformFee)
+		if err != nil {
+			return err
+		}
+		outflow, err = add(outflow, hop.ProviderFee)
+		if err != nil {
+			return err
+		}
+		outflow, err = state.convertToPlatformAmount(ctx, s, outflow, hop.ToTokenID)
+		if err != nil {
+			return err
+		}
+
+		poolKey, userKey, err := outflowKeys(ctx, lp, day, exchangerId)
+		if err != nil {
+			return err
+		}
+
+		err = addOutflow(ctx, poolKey, outflow, config.DailyOutflowCap,
+			fmt.Sprintf("daily outflow cap of %v of lp of token id %v and %v", config.DailyOutflowCap, lp.TokenID, lp.PairTokenID))
+		if err != nil {
+			return err
+		}
+		err = addOutflow(ctx, userKey, outflow, config.UserDailyOutflowCap,
+			fmt.Sprintf("daily outflow cap of %v per user of lp of token id %v and %v", config.UserDailyOutflowCap, lp.TokenID, lp.PairTokenID))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// convertToPlatformAmount converts amount of tokenId into platform tokens, rounded up.
+// Tokens other than the platform token are converted at the exchange rate of the
+// pool between that token and the platform token. Tokens that are only paired with
+// other tokens have no such rate, their amount is returned as it is.
+func (rs *routeState) convertToPlatformAmount(ctx contractapi.TransactionContextInterface, s *SmartContract, amount uint64, tokenId uint64) (uint64, error) {
+	if tokenId == rs.platformTokenId || amount == 0 {
+		return amount, nil
+	}
+
+	pair := newTokenPair(tokenId, rs.platformTokenId)
+	if _, ok := rs.committed[pair]; !ok {
+		platformLp, err := s.readLP(ctx, pair.A, pair.B)
+		if err != nil {
+			return 0, fmt.Errorf("failed to price %v of token id %v in platform tokens: %v", amount, tokenId, err)
+		}
+		if platformLp == nil {
+			return amount, nil
+		}
+	}
+
+	lp, err := rs.committedLP(ctx, s, pair)
+	if err != nil {
+		return 0, fmt.Errorf("failed to price %v of token id %v in platform tokens: %v", amount, tokenId, err)
+	}
+
+	return lp.pricingPool().Convert(amount, rs.platformTokenId)
+}
+
+// addOutflow adds amount to the outflow stored under key, failing if it would exceed a non-zero limit
+func addOutflow(ctx contractapi.TransactionContextInterface, key string, amount uint64, limit uint64, limitName string) error {
+	outflow, err := readOutflow(ctx, key)
+	if err != nil {
+		return err
+	}
+	outflow, err = add(outflow, amount)
+	if err != nil {
+		return err
+	}
+	if limit != 0 && outflow > limit {
+		return fmt.Errorf("outflow of %v platform tokens exceeds the %v, %v remaining today", amount, limitName, remainingOutflow(limit, outflow-amount))
+	}
+
+	err = ctx.GetStub().PutState(key, []byte(strconv.FormatUint(outflow, 10)))
+	if err != nil {
+		return fmt.Errorf("failed to put state: %v", err)
+	}
+
+	return nil
+}
+
+func readOutflow(ctx contractapi.TransactionContextInterface, key string) (uint64, error) {
+	outflowBytes, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read outflow %v from world state: %v", key, err)
+	}
+	if outflowBytes == nil {
+		return 0, nil
+	}
+
+	return parseAmount(outflowBytes)
+}
+
+func remainingOutflow(limit uint64, outflow uint64) uint64 {
+	if limit == 0 {
+		return math.MaxUint64
+	}
+	if outflow >= limit {
+		return 0
+	}
+	return limit - outflow
+}
+
+// outflowKeys returns the keys of the outflows of lp and of account in lp on day
+func outflowKeys(ctx contractapi.TransactionContextInterface, lp *LiquidityPool, day int64, account string) (string, string, error) {
+	pair := newTokenPair(lp.TokenID, lp.PairTokenID)
+	attributes := []string{strconv.FormatUint(pair.A, 10), strconv.FormatUint(pair.B, 10), strconv.FormatInt(day, 10)}
+
+	poolKey, err := ctx.GetStub().CreateCompositeKey(lpOutflowPrefix, attributes)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create the composite key for prefix %s: %v", lpOutflowPrefix, err)
+	}
+	userKey, err := ctx.GetStub().CreateCompositeKey(lpUserOutflowPrefix, append(attributes, account))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create the composite key for prefix %s: %v", lpUserOutflowPrefix, err)
+	}
+	return poolKey, userKey, nil
+}
+
+// currentDay returns the number of days between the Unix epoch and the transaction timestamp
+func currentDay(ctx contractapi.TransactionContextInterface) (int64, error) {
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get transaction timestamp: %v", err)
+	}
+
+	return txTimestamp.GetSeconds() / secondsPerDay, nil
+}
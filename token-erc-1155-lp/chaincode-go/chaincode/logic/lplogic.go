@@ -1,342 +1,238 @@
+// Command lplogic simulates exchanges through the liquidity pools off-chain.
+// It prices every swap with the pricing package used by the chaincode, so its
+// results match what Exchange would do with the same pools.
+//
+// Usage:
+//
+//	go run ./chaincode/logic [-scenario scenario.json]
+//
+// Without a scenario it runs the BUMNPoin, LivinPoin and MilesPoin example.
 package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io/ioutil"
+	"os"
+
+	"erc1155/chaincode/pricing"
 )
 
-type LP struct {
-	ID                  uint64
-	CreatorID           string
-	TokenID             uint64
-	TokenSupply         float64
-	TokenPlatformSupply float64
-	ExchangeRate        float64 // 1 TokenId * ExchangeRate
+// Scenario describes the pools to simulate and the swaps to run through them, in order.
+// PlatformFee is the minimum fee in platform tokens of pools without a fee configuration.
+type Scenario struct {
+	PlatformTokenID uint64         `json:"platform_token_id"`
+	PlatformFee     uint64         `json:"platform_fee"`
+	Pools           []ScenarioPool `json:"pools"`
+	Swaps           []ScenarioSwap `json:"swaps"`
 }
 
-type User struct {
-	ID string
+// ScenarioPool is a liquidity pool. ExchangeRate is the number of PairTokenID per TokenID,
+// scaled by pricing.RateScale. MinimumFee is in platform tokens.
+type ScenarioPool struct {
+	TokenID          uint64         `json:"token_id"`
+	PairTokenID      uint64         `json:"pair_token_id"`
+	TokenReserve     uint64         `json:"token_reserve"`
+	PairTokenReserve uint64         `json:"pair_token_reserve"`
+	ExchangeRate     uint64         `json:"exchange_rate"`
+	SwapFeeBps       uint64         `json:"swap_fee_bps"`
+	Tiers            []ScenarioTier `json:"tiers,omitempty"`
+	ProviderShareBps uint64         `json:"provider_share_bps"`
+	MinimumFee       *uint64        `json:"minimum_fee,omitempty"`
+	pool             *pricing.Pool
+	config           *pricing.FeeConfig
 }
 
-type Token struct {
-	ID        uint64
-	CreatorID string
-	Name      string
-	State     map[string]float64
+// ScenarioTier is a fee tier of a pool
+type ScenarioTier struct {
+	MinAmount  uint64 `json:"min_amount"`
+	SwapFeeBps uint64 `json:"swap_fee_bps"`
 }
 
-const PLATFORM_FEE float64 = 1000 // 1000 BUMNPoin exchange fee
-
-var tokens map[uint64]*Token = make(map[uint64]*Token)
-
-func balanceOf(tokenId uint64, userId string) float64 {
-	return tokens[tokenId].State[userId]
+// ScenarioSwap exchanges Amount of Path[0] for Path[len(Path)-1] through the pools between the tokens of Path
+type ScenarioSwap struct {
+	Path   []uint64 `json:"path"`
+	Amount uint64   `json:"amount"`
 }
 
-var lps map[uint64]LP = make(map[uint64]LP)
-
-var lastLpId uint64 = 0
-
-const TOKEN_PLATFORM_ID uint64 = 1 // BUMN Poin
+// SwapResult is the outcome of a swap, or the reason it failed
+type SwapResult struct {
+	Path          []uint64        `json:"path"`
+	Amount        uint64          `json:"amount"`
+	ToTokenAmount uint64          `json:"to_token_amount,omitempty"`
+	Hops          []pricing.Quote `json:"hops,omitempty"`
+	Error         string          `json:"error,omitempty"`
+}
 
-const LP_PREFIX_ID = "lp"
+// exampleScenario is the BUMNPoin (1), LivinPoin (2) and MilesPoin (3) example:
+// 1 Livin = 10 BUMN, 1 Miles = 200 BUMN and a flat fee of 1000 BUMN
+var exampleScenario = Scenario{
+	PlatformTokenID: 1,
+	PlatformFee:     1000,
+	Pools: []ScenarioPool{
+		{TokenID: 2, PairTokenID: 1, TokenReserve: 200000, PairTokenReserve: 2000000, ExchangeRate: 10 * pricing.RateScale},
+		{TokenID: 3, PairTokenID: 1, TokenReserve: 150000, PairTokenReserve: 3000000, ExchangeRate: 200 * pricing.RateScale},
+	},
+	Swaps: []ScenarioSwap{
+		{Path: []uint64{2, 1}, Amount: 3000},
+		{Path: []uint64{1, 2}, Amount: 3000},
+		{Path: []uint64{2, 1, 3}, Amount: 3000},
+	},
+}
 
-func createLP(creatorId string, tokenId uint64, tokenSupply float64, tokenPlatformSupply float64, exchangeRate float64) (*LP, error) {
-	// Check if user have enough token to supply
-	if balanceOf(tokenId, creatorId) < tokenSupply {
-		return nil, fmt.Errorf("User does not have enough %v", tokens[tokenId].Name)
-	}
-	// Check if user have enough token platform to supply
-	if balanceOf(TOKEN_PLATFORM_ID, creatorId) < tokenPlatformSupply {
-		return nil, fmt.Errorf("User does not have enough %v", tokens[TOKEN_PLATFORM_ID].Name)
+func main() {
+	scenarioPath := flag.String("scenario", "", "JSON file describing the pools and the swaps to simulate")
+	flag.Parse()
+
+	scenario := exampleScenario
+	if *scenarioPath != "" {
+		scenarioJSON, err := ioutil.ReadFile(*scenarioPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read scenario: %v\n", err)
+			os.Exit(1)
+		}
+		scenario = Scenario{}
+		err = json.Unmarshal(scenarioJSON, &scenario)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to decode scenario: %v\n", err)
+			os.Exit(1)
+		}
 	}
 
-	lpId := lastLpId + 1
-
-	lp := LP{
-		ID:                  lpId,
-		CreatorID:           creatorId,
-		TokenID:             tokenId,
-		TokenSupply:         tokenSupply,
-		TokenPlatformSupply: tokenPlatformSupply,
-		ExchangeRate:        exchangeRate,
+	err := scenario.preparePools()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 
-	// transfer tokenId from creator to lp
-	// lpIdKey := LP_PREFIX_ID + strconv.FormatUint(uint64(lpId), 10)
-	// transferFrom(tokenId, creatorId, lpIdKey, tokenSupply)
-	// transfer TOKEN_PLATFORM_ID from creator to lp
-	// transferFrom(TOKEN_PLATFORM_ID, creatorId, lpIdKey, tokenPlatformSupply)
-	tokens[tokenId].State[creatorId] -= tokenSupply
-	tokens[TOKEN_PLATFORM_ID].State[creatorId] -= tokenPlatformSupply
+	fmt.Println("Pools before the swaps")
+	pprint(scenario.pricingPools())
 
-	lps[lpId] = lp
-	lastLpId++
+	for _, swap := range scenario.Swaps {
+		pprint(scenario.run(swap))
+	}
 
-	return &lp, nil
+	fmt.Println("Pools after the swaps")
+	pprint(scenario.pricingPools())
 }
 
-func pprint(data interface{}) {
-	bytes, _ := json.MarshalIndent(data, "", " ")
-	fmt.Println(string(bytes))
-}
+func (scenario *Scenario) preparePools() error {
+	for i := range scenario.Pools {
+		scenarioPool := &scenario.Pools[i]
+		if scenarioPool.ExchangeRate == 0 {
+			return fmt.Errorf("exchange rate of lp of token id %v and %v must be positive", scenarioPool.TokenID, scenarioPool.PairTokenID)
+		}
 
-func exchange(userId string, fromTokenId uint64, toTokenId uint64, amount float64) {
-	// TODO: Check if amount covers platform fee
+		scenarioPool.pool = &pricing.Pool{
+			TokenID:          scenarioPool.TokenID,
+			PairTokenID:      scenarioPool.PairTokenID,
+			TokenReserve:     scenarioPool.TokenReserve,
+			PairTokenReserve: scenarioPool.PairTokenReserve,
+			ExchangeRate:     scenarioPool.ExchangeRate,
+		}
 
-	// TODO: Check if user has enough balance of fromTokenId
+		scenarioPool.config = &pricing.FeeConfig{SwapFeeBps: scenarioPool.SwapFeeBps, ProviderShareBps: scenarioPool.ProviderShareBps}
+		for _, tier := range scenarioPool.Tiers {
+			scenarioPool.config.Tiers = append(scenarioPool.config.Tiers, pricing.FeeTier{MinAmount: tier.MinAmount, SwapFeeBps: tier.SwapFeeBps})
+		}
+		err := scenarioPool.config.Validate()
+		if err != nil {
+			return fmt.Errorf("invalid fee configuration of lp of token id %v and %v: %v", scenarioPool.TokenID, scenarioPool.PairTokenID, err)
+		}
+	}
+	return nil
+}
 
-	// TODO: Check if LP has enough balance of toTokenId
+func (scenario *Scenario) pricingPools() []pricing.Pool {
+	pools := make([]pricing.Pool, len(scenario.Pools))
+	for i, scenarioPool := range scenario.Pools {
+		pools[i] = *scenarioPool.pool
+	}
+	return pools
+}
 
-	// Find the LP
-	var lpTokenId uint64
-	var exchangeRate float64
-	if fromTokenId == 1 || toTokenId == 1 {
-		// -------------------
-		// Token X -> BUMNPoin
-		// -------------------
-		if toTokenId == 1 {
-			lpTokenId = fromTokenId
-			lp := findLPByTokenId(lpTokenId)
-			exchangeRate = lp.ExchangeRate
+// findPool returns the pool between tokenA and tokenB
+func (scenario *Scenario) findPool(tokenA uint64, tokenB uint64) (*ScenarioPool, error) {
+	for i := range scenario.Pools {
+		pool := &scenario.Pools[i]
+		if (pool.TokenID == tokenA && pool.PairTokenID == tokenB) || (pool.TokenID == tokenB && pool.PairTokenID == tokenA) {
+			return pool, nil
+		}
+	}
+	return nil, fmt.Errorf("lp of token id %v and %v does not exist", tokenA, tokenB)
+}
 
-			// Send toTokenId to exchanger
-			grossExchangeAmount := amount * exchangeRate
-			platformFeeAmount := PLATFORM_FEE * 1
-			toTokenAmount := grossExchangeAmount - platformFeeAmount
+// run swaps through every pool of the path. The swap is all or nothing,
+// the pools are only updated if every hop succeeds.
+func (scenario *Scenario) run(swap ScenarioSwap) SwapResult {
+	result := SwapResult{Path: swap.Path, Amount: swap.Amount}
+	if len(swap.Path) < 2 {
+		result.Error = "path must contain at least two token ids"
+		return result
+	}
 
-			// send fromToken amount from user to LP
-			tokens[fromTokenId].State[userId] -= amount
-			lp.TokenSupply += amount
+	updatedPools := make(map[*ScenarioPool]pricing.Pool)
 
-			// send toToken amount from LP to user
-			tokens[toTokenId].State[userId] += toTokenAmount
-			lp.TokenPlatformSupply -= toTokenAmount
+	hopAmount := swap.Amount
+	for i := 0; i < len(swap.Path)-1; i++ {
+		scenarioPool, err := scenario.findPool(swap.Path[i], swap.Path[i+1])
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
 
-			// send toToken as fees to platformProvider
-			platformProviderID := tokens[TOKEN_PLATFORM_ID].CreatorID
-			tokens[TOKEN_PLATFORM_ID].State[platformProviderID] += platformFeeAmount
+		pool, ok := updatedPools[scenarioPool]
+		if !ok {
+			pool = *scenarioPool.pool
+		}
 
-			lps[lp.ID] = *lp
+		minimumFee, err := scenario.minimumFee(scenarioPool, swap.Path[i+1])
+		if err != nil {
+			result.Error = err.Error()
+			return result
 		}
 
-		// --------------------
-		// BUMNPoin -> Token X
-		// --------------------
-		if fromTokenId == 1 {
-			lpTokenId = toTokenId
-			lp := findLPByTokenId(lpTokenId)
-			exchangeRate = 1 / lp.ExchangeRate
-
-			// Calculate amounts of each token to be given to user and platform provider
-			grossExchangeAmount := amount * exchangeRate
-			platformFeeAmount := PLATFORM_FEE * exchangeRate
-			toTokenAmount := grossExchangeAmount - platformFeeAmount
-
-			// User:BUMN (amt) --> LP
-			// Add amount to supply from user
-			tokens[fromTokenId].State[userId] -= amount
-			lp.TokenPlatformSupply += amount
-
-			// LP --> User:TokenX (amt - fee)
-			//	\--> Platform:TokenX (fee)
-			// Take out exchangeAmount from supply
-			lp.TokenSupply -= grossExchangeAmount
-			// send exchangeAmount - platformFeeAmount to user
-			tokens[toTokenId].State[userId] += toTokenAmount
-			// send platformFeeAmount to provider
-			platformProviderID := tokens[TOKEN_PLATFORM_ID].CreatorID
-			tokens[TOKEN_PLATFORM_ID].State[platformProviderID] += platformFeeAmount
-
-			lps[lp.ID] = *lp
+		quote, err := pool.Swap(scenarioPool.config, swap.Path[i], hopAmount, minimumFee)
+		if err != nil {
+			result.Error = err.Error()
+			return result
 		}
 
+		updatedPools[scenarioPool] = pool
+		result.Hops = append(result.Hops, *quote)
+		hopAmount = quote.ToTokenAmount
 	}
 
-	// ---------------
-	// Route to 2 LPs
-	// ---------------
-	if fromTokenId != 1 && toTokenId != 1 {
-		// -----
-		// First Exchange
-		// ---------
-		finalTokenId := toTokenId
-		toTokenId = 1 // Set toTokenId to platformToken for the first exchange
-		lpTokenId = fromTokenId
-		lp := findLPByTokenId(lpTokenId)
-		exchangeRate = lp.ExchangeRate
-
-		// No Fees for first exchange
-		grossExchangeAmount := amount * exchangeRate
-		platformFeeAmount := PLATFORM_FEE * 0
-		toTokenAmount := grossExchangeAmount - platformFeeAmount
-
-		// send fromToken amount from user to LP
-		tokens[fromTokenId].State[userId] -= amount
-		lp.TokenSupply += amount
-
-		// send toToken amount from LP to user
-		tokens[toTokenId].State[userId] += toTokenAmount
-		lp.TokenPlatformSupply -= toTokenAmount
-
-		// send toToken as fees to platformProvider
-		platformProviderID := tokens[TOKEN_PLATFORM_ID].CreatorID
-		tokens[TOKEN_PLATFORM_ID].State[platformProviderID] += platformFeeAmount
-
-		lps[lp.ID] = *lp
-
-		// ----
-		// Second Exchange
-		// ----------
-		// amount now the result of the first exchange
-		amount = toTokenAmount
-
-		// Switch tokenIds
-		// temp := fromTokenId
-		fromTokenId = toTokenId
-		toTokenId = finalTokenId
-
-		lpTokenId = toTokenId
-		lp = findLPByTokenId(lpTokenId)
-		exchangeRate = 1 / lp.ExchangeRate
-
-		// User:BUMN (amt) --> LP
-		// Add amount to supply from user
-		tokens[fromTokenId].State[userId] -= amount
-		lp.TokenPlatformSupply += amount
-
-		// Calculate amounts of each token to be given to user and platform provider
-		grossExchangeAmount = amount * exchangeRate
-		platformFeeAmount = PLATFORM_FEE * exchangeRate
-		toTokenAmount = grossExchangeAmount - platformFeeAmount
-
-		// LP --> User:TokenX (amt - fee)
-		//	\--> Platform:TokenX (fee)
-		// Take out exchangeAmount from supply
-		lp.TokenSupply -= grossExchangeAmount
-		// send exchangeAmount - platformFeeAmount to user
-		tokens[toTokenId].State[userId] += toTokenAmount
-		// send platformFeeAmount to provider
-		platformProviderID = tokens[TOKEN_PLATFORM_ID].CreatorID
-		tokens[toTokenId].State[platformProviderID] += platformFeeAmount
-
-		lps[lp.ID] = *lp
+	for scenarioPool, pool := range updatedPools {
+		*scenarioPool.pool = pool
 	}
-}
+	result.ToTokenAmount = hopAmount
 
-func findLPByTokenId(tokenId uint64) *LP {
-	for _, lp := range lps {
-		if lp.TokenID == tokenId {
-			return &lp
-		}
-	}
-	return nil
+	return result
 }
 
-func main() {
-	adminBUMN := &User{ID: "adminBUMN"}
-	adminLivin := &User{ID: "adminLivin"}
-	adminMiles := &User{ID: "adminMiles"}
-
-	user1 := &User{ID: "user1"}
-	user2 := &User{ID: "user2"}
-
-	bumnToken := &Token{
-		ID:        1,
-		CreatorID: adminBUMN.ID,
-		Name:      "BUMNPoin",
-		State:     make(map[string]float64),
+// minimumFee converts the minimum fee of scenarioPool into tokenId at the exchange
+// rate of the pool between tokenId and the platform token, as of before the swap
+func (scenario *Scenario) minimumFee(scenarioPool *ScenarioPool, tokenId uint64) (uint64, error) {
+	minimumFee := scenario.PlatformFee
+	if scenarioPool.MinimumFee != nil {
+		minimumFee = *scenarioPool.MinimumFee
 	}
-	bumnToken.State[adminBUMN.ID] = 5000000  // 5 juta
-	bumnToken.State[adminLivin.ID] = 2000000 // 2 juta
-	bumnToken.State[adminMiles.ID] = 3000000 // 3 juta
-	bumnToken.State[user1.ID] = 0
-	bumnToken.State[user2.ID] = 0
-
-	livinToken := &Token{
-		ID:        2,
-		CreatorID: adminLivin.ID,
-		Name:      "LivinPoin",
-		State:     make(map[string]float64),
+
+	if tokenId == scenario.PlatformTokenID || minimumFee == 0 {
+		return minimumFee, nil
 	}
-	livinToken.State[adminBUMN.ID] = 0
-	livinToken.State[adminLivin.ID] = 1000000 // 1 juta
-	livinToken.State[adminMiles.ID] = 0       // 3 juta
-	livinToken.State[user1.ID] = 10000        // 10 ribu
-	livinToken.State[user2.ID] = 10000        // 10 ribu
-
-	milesToken := &Token{
-		ID:        3,
-		CreatorID: adminMiles.ID,
-		Name:      "MilesPoin",
-		State:     make(map[string]float64),
+
+	platformPool, err := scenario.findPool(tokenId, scenario.PlatformTokenID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to price %v platform tokens in token id %v: %v", minimumFee, tokenId, err)
 	}
-	milesToken.State[adminBUMN.ID] = 0
-	milesToken.State[adminLivin.ID] = 0
-	milesToken.State[adminMiles.ID] = 200000 // 200 ribu
-	milesToken.State[user1.ID] = 10000       // 10 ribu
-	milesToken.State[user2.ID] = 10000       // 10 ribu
-
-	tokens[1] = bumnToken
-	tokens[2] = livinToken
-	tokens[3] = milesToken
-
-	// Create liquidity pool
-	// 200 ribu LivinPoin
-	// 2 juta BUMNPoin
-	// Rate 1 Livin = 10 BUMN
-	createLP(adminLivin.ID, livinToken.ID, 200000, 2000000, 10)
-
-	// Create liquidity pool
-	// 150 ribu MilesPoin
-	// 3 juta BUMNPoin
-	// Rate 1 Miles = 200 BUMN
-	createLP(adminMiles.ID, milesToken.ID, 150000, 3000000, 200)
-
-	fmt.Println("LP Original State")
-	pprint(lps[1]) // LP Livin -> BUMN
-	pprint(lps[2]) // LP Miles -> BUMN
-
-	exchange(user1.ID, livinToken.ID, bumnToken.ID, 3000)
-	pprint(lps[1])
-	fmt.Println("LP Livin TokenSupply harus nya nambah 3000 => 203000 == ", lps[1].TokenSupply)
-	fmt.Printf("LP Livin TokenPlatformSupply harusnya berkurang (3000 * 10) - 1000 = 29000 => 1971000 == %.0f\n", lps[1].TokenPlatformSupply)
-
-	fmt.Println("user1 Livin balance harusnya berkurang 3000 => 7000 == ", livinToken.State[user1.ID])
-	fmt.Println("user1 BUMN balance harusnya bertambah 29000 => 29000 == ", bumnToken.State[user1.ID])
-
-	fmt.Printf("adminBUMN BUMN balance harusnya bertambah 1000 => 5001000 == %.0f\n", bumnToken.State[adminBUMN.ID])
-
-	exchange(user1.ID, bumnToken.ID, livinToken.ID, 3000)
-	fmt.Println("sesudah")
-	pprint(lps[1])
-	fmt.Println("User:BUMN -> LP")
-	fmt.Println("user1 BUMN balance harusnya berkurang 3000 => 26000 == ", bumnToken.State[user1.ID])
-	fmt.Printf("LP Livin BUMN Supply harusnya bertambah 3000 => 1974000 == %.0f\n", lps[1].TokenPlatformSupply)
-
-	fmt.Println("LP --> USER:Livin")
-	fmt.Println("  \\--> adminBUMN:Livin")
-	fmt.Println("LP Livin TokenSupply harus nya berkurang 3000 * (1/10) = 300 => 202700 ==", lps[1].TokenSupply)
-	fmt.Println("user1 Livin balance harusnya bertambah 200 => 7200 == ", livinToken.State[user1.ID])
-	fmt.Printf("adminBUMN Livin balance harusnya bertambah 100 => 5001100 == %.0f\n", bumnToken.State[adminBUMN.ID])
-
-	fmt.Printf("user1 Livin balance %.0f\n", livinToken.State[user1.ID])
-	fmt.Printf("LP1 Livin supply  %.0f\n", lps[1].TokenSupply)
-	fmt.Printf("LP1 BUMN supply  %0.f\n", lps[1].TokenPlatformSupply)
-	fmt.Printf("LP2 Miles supply %0.f\n", lps[2].TokenSupply)
-	fmt.Printf("LP2 BUMN supply %0.f\n", lps[2].TokenPlatformSupply)
-	fmt.Printf("user1 Miles balance %0.f\n", milesToken.State[user1.ID])
-	fmt.Printf("bumnAdmin Miles balance %0.f\n", milesToken.State[adminBUMN.ID])
-
-	exchange(user1.ID, livinToken.ID, milesToken.ID, 3000)
-	fmt.Println("User:Livin -> LP -> User:BUMN -> LP -> User:Miles")
-	fmt.Println("                                     \\-> adminBumn:Miles")
-	fmt.Printf("user1 Livin balance berkurang 3000 -> 7200 - 3000 = 4200 == %.0f\n", livinToken.State[user1.ID])
-	fmt.Printf("LP1 Livin supply bertambah 3000 -> 202700 + 3000 = 205700 == %.0f\n", lps[1].TokenSupply)
-	fmt.Printf("LP2 BUMN supply berkurang 3000 * 10 -> 1974000 - 30000 = 1944000 == %0.f\n", lps[1].TokenPlatformSupply)
-	fmt.Printf("LP2 Miles supply berkurang 30000 * 1/200 -> 150000 - 150 = 149850 == %0.f\n", lps[2].TokenSupply)
-	fmt.Printf("LP2 BUMN supply bertambah 30000 -> 3000000 + 30000 = 3030000 == %0.f\n", lps[2].TokenPlatformSupply)
-	fmt.Printf("user1 Miles balance bertambah (150 - (1000 * 1/200)) = 10000 + 145 = 10145 == %0.f\n", milesToken.State[user1.ID])
-	fmt.Printf("bumnAdmin Miles balance bertambah (1000 * 1/200) = 0 + 5 = 5 == %0.f\n", milesToken.State[adminBUMN.ID])
 
+	return platformPool.pool.Convert(minimumFee, tokenId)
+}
+
+func pprint(data interface{}) {
+	bytes, _ := json.MarshalIndent(data, "", " ")
+	fmt.Println(string(bytes))
 }
@@ -3,16 +3,12 @@ package chaincode
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strconv"
 
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
 )
 
-func pprint(data interface{}) {
-	bytes, _ := json.MarshalIndent(data, "", " ")
-	fmt.Println(string(bytes))
-}
-
 const lpKeyPrefix = "lp"
 
 const PLATFORM_FEE_KEY = "lp~platformFee"
@@ -21,7 +17,70 @@ const PLATFORM_TOKEN_ID_KEY = "lp~platformTokenId"
 
 const lpTokenBalancePrefix = "lpbalance"
 
+// lpPairIndexPrefix indexes every liquidity pool under both of its token ids, see tokenNeighbours
+const lpPairIndexPrefix = "lptoken~pair"
+
+const floatStateMigratedKey = "lp~floatStateMigrated"
+
+// LiquidityPool holds the reserves of a pair of tokens. Pools created with CreateLP
+// pair a token with the platform token.
+// TokenSupply is the reserve of TokenID and TokenPlatformSupply is the reserve of PairTokenID.
+// ExchangeRate is the number of PairTokenID per TokenID, scaled by RateScale.
+// Swaps through a Paused pool are refused and Limits caps what it pays out per day.
+// PendingRate is a proposed exchange rate that has not been applied yet.
 type LiquidityPool struct {
+	TokenID             uint64           `json:"token_id"`
+	PairTokenID         uint64           `json:"pair_token_id"`
+	TokenSupply         uint64           `json:"token_supply"`
+	TokenPlatformSupply uint64           `json:"token_platform_supply"`
+	CreatorID           string           `json:"creator_id"`
+	ExchangeRate        uint64           `json:"exchange_rate"`
+	FeeConfig           *PoolFeeConfig   `json:"fee_config,omitempty"`
+	Paused              bool             `json:"paused,omitempty"`
+	Limits              *PoolLimitConfig `json:"limits,omitempty"`
+	PendingRate         *RateChange      `json:"pending_rate,omitempty"`
+}
+
+// LPQueryResult structure used for returning paginated liquidity pools
+type LPQueryResult struct {
+	Records             []*LiquidityPool `json:"records"`
+	FetchedRecordsCount int32            `json:"fetchedRecordsCount"`
+	Bookmark            string           `json:"bookmark"`
+}
+
+// ExchangeResult describes a completed exchange.
+// ExchangeRate is the effective number of ToTokenID received per FromTokenID, scaled by RateScale.
+// PlatformFee is the total fee charged on the last hop in ToTokenID, the fees of every hop are listed in Hops.
+type ExchangeResult struct {
+	FromTokenID     uint64
+	FromTokenAmount uint64
+	ToTokenID       uint64
+	ToTokenAmount   uint64
+	ExchangeRate    uint64
+	PlatformFee     uint64
+	Path            []uint64
+	Hops            []ExchangeHop
+}
+
+// ExchangeHop describes the swap through a single liquidity pool of an exchange.
+// The pool is identified by LPTokenID and LPPairTokenID.
+// ExchangeRate is the number of ToTokenID per FromTokenID of the pool, scaled by RateScale.
+// PlatformFee and ProviderFee are the shares of the fee of the hop that accrue to the
+// platform and to the liquidity provider. ToTokenAmount is the amount received after both are deducted.
+type ExchangeHop struct {
+	LPTokenID       uint64
+	LPPairTokenID   uint64
+	FromTokenID     uint64
+	FromTokenAmount uint64
+	ToTokenID       uint64
+	ToTokenAmount   uint64
+	ExchangeRate    uint64
+	PlatformFee     uint64
+	ProviderFee     uint64
+}
+
+// legacyLiquidityPool is the float64 encoding of LiquidityPool used before MigrateFloatState
+type legacyLiquidityPool struct {
 	TokenID             uint64  `json:"token_id"`
 	TokenSupply         float64 `json:"token_supply"`
 	TokenPlatformSupply float64 `json:"token_platform_supply"`
@@ -29,16 +88,20 @@ type LiquidityPool struct {
 	ExchangeRate        float64 `json:"exchange_rate"`
 }
 
-type ExchangeResult struct {
-	FromTokenID     uint64
-	FromTokenAmount float64
-	ToTokenID       uint64
-	ToTokenAmount   float64
-	ExchangeRate    float64
-	PlatformFee     float64
+// CreateLP creates a liquidity pool between tokenId and the platform token.
+// exchangeRate is the number of platform tokens per tokenId, scaled by RateScale.
+func (s *SmartContract) CreateLP(ctx contractapi.TransactionContextInterface, tokenId uint64, tokenSupply uint64, tokenPlatformSupply uint64, exchangeRate uint64) (*LiquidityPool, error) {
+	platformTokenId, err := s.GetPlatformTokenID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.CreatePairLP(ctx, tokenId, platformTokenId, tokenSupply, tokenPlatformSupply, exchangeRate)
 }
 
-func (s *SmartContract) CreateLP(ctx contractapi.TransactionContextInterface, tokenId uint64, tokenSupply float64, tokenPlatformSupply float64, exchangeRate float64) (*LiquidityPool, error) {
+// CreatePairLP creates a liquidity pool between tokenId and pairTokenId, funded by the caller.
+// exchangeRate is the number of pairTokenId per tokenId, scaled by RateScale.
+func (s *SmartContract) CreatePairLP(ctx contractapi.TransactionContextInterface, tokenId uint64, pairTokenId uint64, tokenSupply uint64, pairTokenSupply uint64, exchangeRate uint64) (*LiquidityPool, error) {
 
 	// Get ID of submitting client identity
 	lpCreatorId, err := ctx.GetClientIdentity().GetID()
@@ -46,51 +109,188 @@ func (s *SmartContract) CreateLP(ctx contractapi.TransactionContextInterface, to
 		return nil, fmt.Errorf("failed to get client id: %v", err)
 	}
 
-	token1Name, err := s.GetTokenName(ctx, tokenId)
+	if tokenId == pairTokenId {
+		return nil, fmt.Errorf("cannot create an lp between token id %v and itself", tokenId)
+	}
+
+	for _, id := range []uint64{tokenId, pairTokenId} {
+		tokenName, err := s.GetTokenName(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if tokenName == "" {
+			return nil, fmt.Errorf("token with id %v does not exist", id)
+		}
+	}
+
+	// Pools pay out to any trader, so they only take transferable tokens
+	err = requireTransferable(ctx, []uint64{tokenId, pairTokenId})
+	if err != nil {
+		return nil, err
+	}
+
+	if exchangeRate == 0 {
+		return nil, fmt.Errorf("exchange rate must be a positive integer")
+	}
+
+	existingLp, err := s.readLP(ctx, tokenId, pairTokenId)
 	if err != nil {
 		return nil, err
 	}
-	if token1Name == "" {
-		return nil, fmt.Errorf("token with id %v does not exist", tokenId)
+	if existingLp != nil {
+		return nil, fmt.Errorf("lp between token id %v and token id %v already exists", tokenId, pairTokenId)
 	}
 
 	lp := &LiquidityPool{
 		CreatorID:           lpCreatorId,
 		TokenID:             tokenId,
+		PairTokenID:         pairTokenId,
 		TokenSupply:         tokenSupply,
-		TokenPlatformSupply: tokenPlatformSupply,
+		TokenPlatformSupply: pairTokenSupply,
 		ExchangeRate:        exchangeRate,
 	}
 
-	// LP is identified by tokenId
-	lpIdString := strconv.FormatUint(uint64(tokenId), 10)
-	lpKey, err := ctx.GetStub().CreateCompositeKey(lpKeyPrefix, []string{lpIdString})
+	err = s.saveLPState(ctx, lp)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create the composite key for prefix %s: %v", lpKeyPrefix, err)
+		return nil, err
 	}
 
-	lpJson, err := json.Marshal(lp)
+	err = recordRate(ctx, lp)
 	if err != nil {
 		return nil, err
 	}
 
-	err = ctx.GetStub().PutState(lpKey, lpJson)
+	err = observePrice(ctx, lp)
 	if err != nil {
 		return nil, err
 	}
 
 	// Add token balance to LP
-	err = s.AddToLP(ctx, lpCreatorId, tokenId, tokenSupply)
+	err = addToLP(ctx, lpCreatorId, tokenId, tokenSupply)
+	if err != nil {
+		return nil, err
+	}
+
+	// Add pair token balance to LP
+	err = addToLP(ctx, lpCreatorId, pairTokenId, pairTokenSupply)
+	if err != nil {
+		return nil, err
+	}
+
+	poolCreatedEvent := PoolCreated{
+		Creator:         lpCreatorId,
+		TokenID:         tokenId,
+		PairTokenID:     pairTokenId,
+		TokenSupply:     tokenSupply,
+		PairTokenSupply: pairTokenSupply,
+		ExchangeRate:    exchangeRate,
+	}
+	err = emitEvent(ctx, "PoolCreated", poolCreatedEvent)
+	if err != nil {
+		return nil, err
+	}
+
+	return lp, nil
+}
+
+// AddLiquidity adds tokenAmount of tokenId and pairTokenAmount of pairTokenId from the
+// caller to the liquidity pool between tokenId and pairTokenId. Only the creator of
+// the pool provides its liquidity. This function emits a LiquidityAdded event.
+func (s *SmartContract) AddLiquidity(ctx contractapi.TransactionContextInterface, tokenId uint64, pairTokenId uint64, tokenAmount uint64, pairTokenAmount uint64) (*LiquidityPool, error) {
+	return s.changeLiquidity(ctx, tokenId, pairTokenId, tokenAmount, pairTokenAmount, true)
+}
+
+// RemoveLiquidity withdraws tokenAmount of tokenId and pairTokenAmount of pairTokenId from
+// the liquidity pool between tokenId and pairTokenId to the caller. Only the creator of
+// the pool can withdraw its liquidity. This function emits a LiquidityRemoved event.
+func (s *SmartContract) RemoveLiquidity(ctx contractapi.TransactionContextInterface, tokenId uint64, pairTokenId uint64, tokenAmount uint64, pairTokenAmount uint64) (*LiquidityPool, error) {
+	return s.changeLiquidity(ctx, tokenId, pairTokenId, tokenAmount, pairTokenAmount, false)
+}
+
+func (s *SmartContract) changeLiquidity(ctx contractapi.TransactionContextInterface, tokenId uint64, pairTokenId uint64, tokenAmount uint64, pairTokenAmount uint64, adding bool) (*LiquidityPool, error) {
+
+	// Get ID of submitting client identity
+	providerId, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client id: %v", err)
+	}
+
+	lp, err := s.GetLP(ctx, tokenId, pairTokenId)
+	if err != nil {
+		return nil, err
+	}
+
+	if providerId != lp.CreatorID {
+		return nil, fmt.Errorf("%v is not the liquidity provider of lp of token id %v and %v", providerId, lp.TokenID, lp.PairTokenID)
+	}
+
+	// Amounts are given in the order of the arguments, which may differ from the order of the pool
+	if lp.TokenID != tokenId {
+		tokenAmount, pairTokenAmount = pairTokenAmount, tokenAmount
+	}
+
+	if adding {
+		lp.TokenSupply, err = add(lp.TokenSupply, tokenAmount)
+		if err != nil {
+			return nil, err
+		}
+		lp.TokenPlatformSupply, err = add(lp.TokenPlatformSupply, pairTokenAmount)
+		if err != nil {
+			return nil, err
+		}
+
+		err = addToLP(ctx, providerId, lp.TokenID, tokenAmount)
+		if err != nil {
+			return nil, err
+		}
+		err = addToLP(ctx, providerId, lp.PairTokenID, pairTokenAmount)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		lp.TokenSupply, err = sub(lp.TokenSupply, tokenAmount)
+		if err != nil {
+			return nil, fmt.Errorf("lp of token id %v and %v has insufficient liquidity of token id %v: %v", lp.TokenID, lp.PairTokenID, lp.TokenID, err)
+		}
+		lp.TokenPlatformSupply, err = sub(lp.TokenPlatformSupply, pairTokenAmount)
+		if err != nil {
+			return nil, fmt.Errorf("lp of token id %v and %v has insufficient liquidity of token id %v: %v", lp.TokenID, lp.PairTokenID, lp.PairTokenID, err)
+		}
+
+		err = payFromLP(ctx, lp.TokenID, map[string]uint64{providerId: tokenAmount})
+		if err != nil {
+			return nil, err
+		}
+		err = payFromLP(ctx, lp.PairTokenID, map[string]uint64{providerId: pairTokenAmount})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = s.saveLPState(ctx, lp)
 	if err != nil {
 		return nil, err
 	}
 
-	// Add token platform balance to LP
-	tokenPlatformId, err := s.GetPlatformTokenID(ctx)
+	err = observePrice(ctx, lp)
 	if err != nil {
 		return nil, err
 	}
-	err = s.AddToLP(ctx, lpCreatorId, tokenPlatformId, tokenPlatformSupply)
+
+	liquidityEvent := LiquidityChanged{
+		Provider:            providerId,
+		TokenID:             lp.TokenID,
+		PairTokenID:         lp.PairTokenID,
+		TokenAmount:         tokenAmount,
+		PairTokenAmount:     pairTokenAmount,
+		TokenSupply:         lp.TokenSupply,
+		TokenPlatformSupply: lp.TokenPlatformSupply,
+	}
+	eventName := "LiquidityAdded"
+	if !adding {
+		eventName = "LiquidityRemoved"
+	}
+	err = emitEvent(ctx, eventName, liquidityEvent)
 	if err != nil {
 		return nil, err
 	}
@@ -98,56 +298,210 @@ func (s *SmartContract) CreateLP(ctx contractapi.TransactionContextInterface, to
 	return lp, nil
 }
 
-func (s *SmartContract) AddToLP(ctx contractapi.TransactionContextInterface, adderId string, tokenId uint64, amount float64) error {
-	tokenIdString := strconv.FormatUint(uint64(tokenId), 10)
+// addToLP moves amount of tokenId from adderId to the LP token account of tokenId
+func addToLP(ctx contractapi.TransactionContextInterface, adderId string, tokenId uint64, amount uint64) error {
+	if amount == 0 {
+		return nil
+	}
 
-	lpTokenBalanceKey := lpTokenBalancePrefix + tokenIdString
+	lpTokenBalanceKey := lpTokenBalancePrefix + strconv.FormatUint(tokenId, 10)
 
 	err := addBalance(ctx, adderId, lpTokenBalanceKey, tokenId, amount)
 	if err != nil {
 		return err
 	}
-	err = removeBalance(ctx, adderId, []uint64{tokenId}, []float64{amount})
+	err = removeBalance(ctx, adderId, []uint64{tokenId}, []uint64{amount})
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (s *SmartContract) TakeFromLP(ctx contractapi.TransactionContextInterface, takerId string, tokenId uint64, amount float64) error {
-	tokenIdString := strconv.FormatUint(uint64(tokenId), 10)
-	lpTokenBalanceKey := lpTokenBalancePrefix + tokenIdString
-	err := addBalance(ctx, lpTokenBalanceKey, takerId, tokenId, amount)
-	if err != nil {
-		return err
+// payFromLP withdraws the sum of payouts of tokenId from the LP token account
+// once and deposits each payout to its recipient
+func payFromLP(ctx contractapi.TransactionContextInterface, tokenId uint64, payouts map[string]uint64) error {
+	return payFromAccount(ctx, lpTokenBalancePrefix+strconv.FormatUint(tokenId, 10), tokenId, payouts)
+}
+
+// payFromAccount withdraws the sum of payouts of tokenId from account once and deposits
+// each payout to its recipient. A transaction does not see its own writes, so an account
+// must not be paid from more than once per transaction and token id.
+func payFromAccount(ctx contractapi.TransactionContextInterface, account string, tokenId uint64, payouts map[string]uint64) error {
+	recipients := make([]string, 0, len(payouts))
+	var total uint64
+	for recipient, amount := range payouts {
+		if amount == 0 {
+			continue
+		}
+		recipients = append(recipients, recipient)
+
+		var err error
+		total, err = add(total, amount)
+		if err != nil {
+			return err
+		}
+	}
+	if total == 0 {
+		return nil
 	}
-	err = removeBalance(ctx, lpTokenBalanceKey, []uint64{tokenId}, []float64{amount})
+	sort.Strings(recipients)
+
+	err := removeBalance(ctx, account, []uint64{tokenId}, []uint64{total})
 	if err != nil {
 		return err
 	}
+
+	for _, recipient := range recipients {
+		err = addBalance(ctx, account, recipient, tokenId, payouts[recipient])
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// GetLPByTokenID returns the liquidity pool between tokenId and the platform token
 func (s *SmartContract) GetLPByTokenID(ctx contractapi.TransactionContextInterface, tokenId uint64) (*LiquidityPool, error) {
-	lpIdString := strconv.FormatUint(uint64(tokenId), 10)
-	lpKey, err := ctx.GetStub().CreateCompositeKey(lpKeyPrefix, []string{lpIdString})
+	platformTokenId, err := s.GetPlatformTokenID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetLP(ctx, tokenId, platformTokenId)
+}
+
+// GetLP returns the liquidity pool between tokenA and tokenB, in either order
+func (s *SmartContract) GetLP(ctx contractapi.TransactionContextInterface, tokenA uint64, tokenB uint64) (*LiquidityPool, error) {
+	lp, err := s.readLP(ctx, tokenA, tokenB)
+	if err != nil {
+		return nil, err
+	}
+	if lp == nil {
+		return nil, fmt.Errorf("lp between token id %v and token id %v does not exist", tokenA, tokenB)
+	}
+
+	return lp, nil
+}
+
+// ListLPs returns a page of liquidity pools. Pass an empty bookmark to get the first page.
+func (s *SmartContract) ListLPs(ctx contractapi.TransactionContextInterface, pageSize int32, bookmark string) (*LPQueryResult, error) {
+	lpIterator, responseMetadata, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination(lpKeyPrefix, []string{}, pageSize, bookmark)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state for prefix %v: %v", lpKeyPrefix, err)
+	}
+	defer lpIterator.Close()
+
+	platformTokenId, err := s.GetPlatformTokenID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	lps := []*LiquidityPool{}
+	for lpIterator.HasNext() {
+		queryResponse, err := lpIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the next state for prefix %v: %v", lpKeyPrefix, err)
+		}
+
+		lp, err := decodeLP(ctx, queryResponse.Key, queryResponse.Value, platformTokenId)
+		if err != nil {
+			return nil, err
+		}
+		lps = append(lps, lp)
+	}
+
+	return &LPQueryResult{
+		Records:             lps,
+		FetchedRecordsCount: responseMetadata.FetchedRecordsCount,
+		Bookmark:            responseMetadata.Bookmark,
+	}, nil
+}
+
+// readLP returns the liquidity pool between tokenA and tokenB, or nil if there is none.
+// Pools created before pair pools existed are stored under the token id only and are
+// read from there until they are saved again.
+func (s *SmartContract) readLP(ctx contractapi.TransactionContextInterface, tokenA uint64, tokenB uint64) (*LiquidityPool, error) {
+	key, err := lpKey(ctx, tokenA, tokenB)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create the composite key for prefix %s: %v", lpKeyPrefix, err)
+		return nil, err
+	}
+	lpBytes, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lp between token id %v and token id %v from world state: %v", tokenA, tokenB, err)
 	}
-	lpBytes, err := ctx.GetStub().GetState(lpKey)
+
+	platformTokenId, err := s.GetPlatformTokenID(ctx)
 	if err != nil {
 		return nil, err
 	}
+
+	if lpBytes == nil && (tokenA == platformTokenId || tokenB == platformTokenId) {
+		lpTokenId := tokenA
+		if tokenA == platformTokenId {
+			lpTokenId = tokenB
+		}
+		key, err = legacyLPKey(ctx, lpTokenId)
+		if err != nil {
+			return nil, err
+		}
+		lpBytes, err = ctx.GetStub().GetState(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read lp of token id %v from world state: %v", lpTokenId, err)
+		}
+	}
+
+	if lpBytes == nil {
+		return nil, nil
+	}
+
+	return decodeLP(ctx, key, lpBytes, platformTokenId)
+}
+
+// decodeLP decodes a liquidity pool read from key. Pools stored under a legacy
+// key are always paired with the platform token.
+func decodeLP(ctx contractapi.TransactionContextInterface, key string, lpBytes []byte, platformTokenId uint64) (*LiquidityPool, error) {
 	var lp LiquidityPool
-	err = json.Unmarshal(lpBytes, &lp)
+	err := json.Unmarshal(lpBytes, &lp)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode approval JSON of lp tokenId of %v: %v", tokenId, err)
+		return nil, fmt.Errorf("failed to decode lp %v: %v", key, err)
 	}
+
+	_, compositeKeyParts, err := ctx.GetStub().SplitCompositeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(compositeKeyParts) == 1 {
+		lp.PairTokenID = platformTokenId
+	}
+
 	return &lp, nil
 }
 
-func (s *SmartContract) SetPlatformFeeAmount(ctx contractapi.TransactionContextInterface, platformFee float64) (float64, error) {
-	err := ctx.GetStub().PutState(PLATFORM_FEE_KEY, []byte(strconv.FormatFloat(platformFee, 'e', 2, 64)))
+// lpKey returns the key of the liquidity pool between tokenA and tokenB. The
+// token ids are ordered, so both orders yield the same key.
+func lpKey(ctx contractapi.TransactionContextInterface, tokenA uint64, tokenB uint64) (string, error) {
+	if tokenA > tokenB {
+		tokenA, tokenB = tokenB, tokenA
+	}
+	key, err := ctx.GetStub().CreateCompositeKey(lpKeyPrefix, []string{strconv.FormatUint(tokenA, 10), strconv.FormatUint(tokenB, 10)})
+	if err != nil {
+		return "", fmt.Errorf("failed to create the composite key for prefix %s: %v", lpKeyPrefix, err)
+	}
+	return key, nil
+}
+
+// legacyLPKey returns the key a pool between tokenId and the platform token was stored under before pair pools
+func legacyLPKey(ctx contractapi.TransactionContextInterface, tokenId uint64) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(lpKeyPrefix, []string{strconv.FormatUint(tokenId, 10)})
+	if err != nil {
+		return "", fmt.Errorf("failed to create the composite key for prefix %s: %v", lpKeyPrefix, err)
+	}
+	return key, nil
+}
+
+func (s *SmartContract) SetPlatformFeeAmount(ctx contractapi.TransactionContextInterface, platformFee uint64) (uint64, error) {
+	err := ctx.GetStub().PutState(PLATFORM_FEE_KEY, []byte(strconv.FormatUint(platformFee, 10)))
 	if err != nil {
 		return 0, err
 	}
@@ -155,13 +509,16 @@ func (s *SmartContract) SetPlatformFeeAmount(ctx contractapi.TransactionContextI
 	return platformFee, nil
 }
 
-func (s *SmartContract) GetPlatformFeeAmount(ctx contractapi.TransactionContextInterface) (float64, error) {
+func (s *SmartContract) GetPlatformFeeAmount(ctx contractapi.TransactionContextInterface) (uint64, error) {
 	feeBytes, err := ctx.GetStub().GetState(PLATFORM_FEE_KEY)
 	if err != nil {
 		return 0, err
 	}
+	if feeBytes == nil {
+		return 0, nil
+	}
 
-	return strconv.ParseFloat(string(feeBytes), 64)
+	return parseAmount(feeBytes)
 }
 
 func (s *SmartContract) SetPlatformTokenID(ctx contractapi.TransactionContextInterface, tokenId uint64) (uint64, error) {
@@ -182,302 +539,296 @@ func (s *SmartContract) GetPlatformTokenID(ctx contractapi.TransactionContextInt
 	return strconv.ParseUint(string(tokenIdBytes), 10, 64)
 }
 
-func (s *SmartContract) SaveLPState(ctx contractapi.TransactionContextInterface, lp *LiquidityPool) error {
-	lpIdString := strconv.FormatUint(uint64(lp.TokenID), 10)
-	lpKey, err := ctx.GetStub().CreateCompositeKey(lpKeyPrefix, []string{lpIdString})
+// platformID returns the id of the platform, the creator of the platform token
+func (s *SmartContract) platformID(ctx contractapi.TransactionContextInterface) (string, error) {
+	platformTokenId, err := s.GetPlatformTokenID(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return s.GetTokenCreator(ctx, platformTokenId)
+}
+
+// authorizePlatform checks that the caller is the platform and returns its id
+func (s *SmartContract) authorizePlatform(ctx contractapi.TransactionContextInterface) (string, error) {
+
+	// Get ID of submitting client identity
+	operatorId, err := ctx.GetClientIdentity().GetID()
 	if err != nil {
-		return fmt.Errorf("failed to create the composite key for prefix %s: %v", lpKeyPrefix, err)
+		return "", fmt.Errorf("failed to get client id: %v", err)
+	}
+
+	platformId, err := s.platformID(ctx)
+	if err != nil {
+		return "", err
+	}
+	if operatorId != platformId {
+		return "", fmt.Errorf("%v is not the platform", operatorId)
+	}
+
+	return operatorId, nil
+}
+
+// saveLPState writes lp to the world state. It is not a transaction of the contract,
+// pools only change through the transactions that check who may change them.
+func (s *SmartContract) saveLPState(ctx contractapi.TransactionContextInterface, lp *LiquidityPool) error {
+	key, err := lpKey(ctx, lp.TokenID, lp.PairTokenID)
+	if err != nil {
+		return err
 	}
 	lpJson, err := json.Marshal(lp)
 	if err != nil {
 		return err
 	}
-	err = ctx.GetStub().PutState(lpKey, lpJson)
+	err = ctx.GetStub().PutState(key, lpJson)
 	if err != nil {
 		return err
 	}
-	return nil
-}
 
-func (s *SmartContract) Exchange(
-	ctx contractapi.TransactionContextInterface,
-	fromTokenId uint64,
-	toTokenId uint64,
-	amount float64,
-) (result *ExchangeResult, err error) {
-	fmt.Println("here")
-	// Get ID of submitting client identity
-	exchangerId, err := ctx.GetClientIdentity().GetID()
+	_, err = indexLP(ctx, lp)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
+	// Remove the legacy key of the pool, if any, now that it is stored under its pair key
 	platformTokenId, err := s.GetPlatformTokenID(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	fmt.Println("platformTokenId", platformTokenId)
+	if lp.PairTokenID == platformTokenId {
+		legacyKey, err := legacyLPKey(ctx, lp.TokenID)
+		if err != nil {
+			return err
+		}
+		legacyBytes, err := ctx.GetStub().GetState(legacyKey)
+		if err != nil {
+			return err
+		}
+		if legacyBytes != nil {
+			err = ctx.GetStub().DelState(legacyKey)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// IndexLPs adds the liquidity pools that were last saved before pools were indexed by
+// token id to the index, so that routes can go through them. It returns the number of
+// pools that were added.
+func (s *SmartContract) IndexLPs(ctx contractapi.TransactionContextInterface) (int, error) {
 
-	PLATFORM_FEE, err := s.GetPlatformFeeAmount(ctx)
+	// Check minter authorization - this sample assumes Org1 is the central banker with privilege to index pools
+	err := authorizationHelper(ctx)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	exchangeResult := &ExchangeResult{
-		FromTokenID:     fromTokenId,
-		FromTokenAmount: amount,
-		ToTokenID:       toTokenId,
-		ToTokenAmount:   0,
-		ExchangeRate:    0,
-		PlatformFee:     0,
-	}
-
-	if fromTokenId == platformTokenId || toTokenId == platformTokenId {
-		fmt.Println("fromTokenId", fromTokenId)
-		fmt.Println("toTokenId", toTokenId)
-		fmt.Println("platformTokenId", platformTokenId)
-		if toTokenId == platformTokenId {
-			fmt.Println("Token X -> BUMNPoin")
-			// -------------------
-			// Token X -> BUMNPoin
-			// -------------------
-			lp, err := s.GetLPByTokenID(ctx, fromTokenId)
-			if err != nil {
-				return nil, err
-			}
-
-			// Calculate amounts of each token to be given to user and platform provider
-			exchangeRate := lp.ExchangeRate
-			grossExchangeAmount := amount * exchangeRate
-			platformFeeAmount := PLATFORM_FEE * 1
-			toTokenAmount := grossExchangeAmount - platformFeeAmount
-
-			exchangeResult.ToTokenAmount = toTokenAmount
-			exchangeResult.ExchangeRate = exchangeRate
-			exchangeResult.PlatformFee = platformFeeAmount
-
-			// Check if amount covers platformFeeAmount
-			if toTokenAmount < 0 {
-				return nil, fmt.Errorf(
-					"amount %v of tokenId %v to exchange does not cover platform fee %v of tokenId %v",
-					amount, fromTokenId, platformFeeAmount, toTokenId,
-				)
-			}
+	lps, err := s.readAllLPs(ctx)
+	if err != nil {
+		return 0, err
+	}
 
-			// Send fromToken amount to LP
-			err = s.AddToLP(ctx, exchangerId, fromTokenId, amount)
-			if err != nil {
-				return nil, err
-			}
+	indexed := 0
+	for _, lp := range lps {
+		added, err := indexLP(ctx, lp)
+		if err != nil {
+			return 0, err
+		}
+		if added {
+			indexed++
+		}
+	}
 
-			// send toToken amount from LP to user
-			err = s.TakeFromLP(ctx, exchangerId, toTokenId, toTokenAmount)
-			if err != nil {
-				return nil, err
-			}
+	return indexed, nil
+}
 
-			// send toToken as fees to platformProvider
-			platformTokenCreatorId, err := s.GetTokenCreator(ctx, platformTokenId)
-			if err != nil {
-				return nil, err
-			}
-			err = s.TakeFromLP(ctx, platformTokenCreatorId, toTokenId, platformFeeAmount)
-			if err != nil {
-				return nil, err
-			}
+// indexLP adds lp to the index of the pools of both of its token ids and reports whether
+// it was missing. Index keys are only written once, so that looking up the pools of a
+// token does not conflict with swaps.
+func indexLP(ctx contractapi.TransactionContextInterface, lp *LiquidityPool) (bool, error) {
+	added := false
+	for _, attributes := range [][]string{
+		{strconv.FormatUint(lp.TokenID, 10), strconv.FormatUint(lp.PairTokenID, 10)},
+		{strconv.FormatUint(lp.PairTokenID, 10), strconv.FormatUint(lp.TokenID, 10)},
+	} {
+		key, err := ctx.GetStub().CreateCompositeKey(lpPairIndexPrefix, attributes)
+		if err != nil {
+			return false, fmt.Errorf("failed to create the composite key for prefix %s: %v", lpPairIndexPrefix, err)
+		}
+		indexBytes, err := ctx.GetStub().GetState(key)
+		if err != nil {
+			return false, err
+		}
+		if indexBytes != nil {
+			continue
+		}
 
-			lp.TokenSupply += amount
-			lp.TokenPlatformSupply -= grossExchangeAmount
-			err = s.SaveLPState(ctx, lp)
-			if err != nil {
-				return nil, err
-			}
+		// An empty value would represent a delete, so we simply insert the null character
+		err = ctx.GetStub().PutState(key, []byte{0x00})
+		if err != nil {
+			return false, err
 		}
+		added = true
+	}
 
-		if fromTokenId == platformTokenId {
-			fmt.Println("BUMNPoin -> Token X")
-			lp, err := s.GetLPByTokenID(ctx, toTokenId)
-			if err != nil {
-				return nil, err
-			}
-			exchangeRate := 1 / lp.ExchangeRate
-
-			// Calculate amounts of each token to be given to user and platform provider
-			grossExchangeAmount := amount * exchangeRate
-			platformFeeAmount := PLATFORM_FEE * exchangeRate
-			toTokenAmount := grossExchangeAmount - platformFeeAmount
-
-			exchangeResult.ToTokenAmount = toTokenAmount
-			exchangeResult.ExchangeRate = exchangeRate
-			exchangeResult.PlatformFee = platformFeeAmount
-
-			// Check if amount covers platformFeeAmount
-			if toTokenAmount < 0 {
-				return nil, fmt.Errorf(
-					"amount %v of tokenId %v to exchange does not cover platform fee %v of tokenId %v",
-					amount, fromTokenId, platformFeeAmount, toTokenId,
-				)
-			}
+	return added, nil
+}
 
-			// User:BUMN (amt) --> LP
-			// Add amount to supply from user
-			err = s.AddToLP(ctx, exchangerId, fromTokenId, amount)
-			if err != nil {
-				return nil, err
-			}
+// Exchange swaps amount of fromTokenId into toTokenId along the route that yields
+// the largest output. See ExchangeBestRoute.
+func (s *SmartContract) Exchange(
+	ctx contractapi.TransactionContextInterface,
+	fromTokenId uint64,
+	toTokenId uint64,
+	amount uint64,
+) (result *ExchangeResult, err error) {
+	return s.ExchangeBestRoute(ctx, fromTokenId, toTokenId, amount)
+}
 
-			// LP --> User:TokenX (amt - fee)
-			//	\--> Platform:TokenX (fee)
-			// Take out exchangeAmount from supply and send (exchangeAmount - platformFeeAmount) to user
-			err = s.TakeFromLP(ctx, exchangerId, toTokenId, toTokenAmount)
-			if err != nil {
-				return nil, err
-			}
-			// send platformFeeAmount to provider
-			platformTokenCreatorId, err := s.GetTokenCreator(ctx, platformTokenId)
-			if err != nil {
-				return nil, err
-			}
-			err = s.TakeFromLP(ctx, platformTokenCreatorId, toTokenId, platformFeeAmount)
-			if err != nil {
-				return nil, err
-			}
+// MigrateFloatState rewrites balances, LP states and the platform fee that were
+// stored by the float64 version of this contract as integers. Fractional amounts
+// are truncated and exchange rates are converted to RateScale fixed-point rates.
+// It must be submitted once, right after upgrading the chaincode. Balances and LPs
+// that are already stored as integers, like pools created or saved since the upgrade,
+// are left as they are. It returns the number of keys that were rewritten.
+func (s *SmartContract) MigrateFloatState(ctx contractapi.TransactionContextInterface) (int, error) {
 
-			lp.TokenPlatformSupply += amount
-			lp.TokenSupply -= grossExchangeAmount
-			err = s.SaveLPState(ctx, lp)
-			if err != nil {
-				return nil, err
-			}
-		}
+	// Check minter authorization - this sample assumes Org1 is the central banker with privilege to migrate state
+	err := authorizationHelper(ctx)
+	if err != nil {
+		return 0, err
 	}
 
-	if fromTokenId != platformTokenId && toTokenId != platformTokenId {
-		fmt.Printf("routing fromTokenId: %v to toTokenId %v \n", fromTokenId, toTokenId)
-		// -----
-		// First Exchange
-		// ---------
-		finalTokenId := toTokenId
-		toTokenId = platformTokenId // Set toTokenId to platformToken for the first exchange
-		lp, err := s.GetLPByTokenID(ctx, fromTokenId)
-		if err != nil {
-			return nil, err
-		}
-		exchangeRate := lp.ExchangeRate
-		fmt.Println("First LP")
-		pprint(lp)
+	migratedBytes, err := ctx.GetStub().GetState(floatStateMigratedKey)
+	if err != nil {
+		return 0, err
+	}
+	if migratedBytes != nil {
+		return 0, fmt.Errorf("float state has already been migrated")
+	}
+
+	platformTokenId, err := s.GetPlatformTokenID(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
 
-		// No Fees for first exchange
-		grossExchangeAmount := amount * exchangeRate
-		platformFeeAmount := PLATFORM_FEE * 0
-		toTokenAmount := grossExchangeAmount - platformFeeAmount
+	balanceIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(balancePrefix, []string{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get state for prefix %v: %v", balancePrefix, err)
+	}
+	defer balanceIterator.Close()
 
-		// Check if amount covers platformFeeAmount
-		finalLp, err := s.GetLPByTokenID(ctx, finalTokenId)
+	for balanceIterator.HasNext() {
+		queryResponse, err := balanceIterator.Next()
 		if err != nil {
-			return nil, err
+			return 0, fmt.Errorf("failed to get the next state for prefix %v: %v", balancePrefix, err)
 		}
-		finalExchangeRate := 1 / finalLp.ExchangeRate
-		finalGrossExchangeAmount := grossExchangeAmount * finalExchangeRate
-		finalPlatformFeeAmount := PLATFORM_FEE * finalExchangeRate
-		finalToTokenAmount := finalGrossExchangeAmount - finalPlatformFeeAmount
-		if finalToTokenAmount < 0 {
-			return nil, fmt.Errorf(
-				"amount %v of tokenId %v to exchange does not cover platform fee %v of tokenId %v",
-				amount, fromTokenId, finalPlatformFeeAmount, finalTokenId,
-			)
+
+		if _, err := parseAmount(queryResponse.Value); err == nil {
+			continue
 		}
 
-		// send fromToken amount from user to LP
-		err = s.AddToLP(ctx, exchangerId, fromTokenId, amount)
+		balance, err := parseLegacyAmount(queryResponse.Value)
 		if err != nil {
-			fmt.Printf("s.AddToLP - routing LP error : %v\n with params: exchangerId = %v\n fromTokenId = %v\n amount = %v", err, exchangerId, fromTokenId, amount)
-			return nil, fmt.Errorf("s.AddToLP - routing LP error : %v\n with params: exchangerId = %v\n fromTokenId = %v\n amount = %v", err, exchangerId, fromTokenId, amount)
+			return 0, fmt.Errorf("failed to migrate balance key %v: %v", queryResponse.Key, err)
 		}
 
-		// send toToken amount from LP to user
-		err = s.TakeFromLP(ctx, exchangerId, toTokenId, toTokenAmount)
-		if err != nil {
-			fmt.Printf("s.TakeFromLP - routing LP error : %v\n with params: exchangerId = %v\n fromTokenId = %v\n amount = %v", err, exchangerId, fromTokenId, amount)
-			return nil, fmt.Errorf("s.TakeFromLP - routing LP error : %v\n with params: exchangerId = %v\n fromTokenId = %v\n amount = %v", err, exchangerId, fromTokenId, amount)
-		}
-
-		// send toToken as fees to platformProvider
-		// platformTokenCreatorId, err := s.GetTokenCreator(ctx, platformTokenId)
-		// if err != nil {
-		// 	return nil, err
-		// }
-		// fmt.Println("platformTokenCreatorId", platformTokenCreatorId)
-		// err = s.TakeFromLP(ctx, platformTokenCreatorId, toTokenId, platformFeeAmount)
-		// if err != nil {
-		// 	return nil, err
-		// }
-
-		lp.TokenSupply += amount
-		lp.TokenPlatformSupply -= grossExchangeAmount
-		err = s.SaveLPState(ctx, lp)
+		if balance == 0 {
+			err = ctx.GetStub().DelState(queryResponse.Key)
+		} else {
+			err = ctx.GetStub().PutState(queryResponse.Key, []byte(strconv.FormatUint(balance, 10)))
+		}
 		if err != nil {
-			return nil, err
+			return 0, err
 		}
+		migrated++
+	}
 
-		// ----
-		// Second Exchange
-		// ----------
-		// amount is now the result of the first exchange
-		amount = toTokenAmount
-
-		// Switch tokenIds
-		fromTokenId = toTokenId
-		toTokenId = finalTokenId
+	lpIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(lpKeyPrefix, []string{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get state for prefix %v: %v", lpKeyPrefix, err)
+	}
+	defer lpIterator.Close()
 
-		lpTokenId := toTokenId
-		lp, err = s.GetLPByTokenID(ctx, lpTokenId)
+	for lpIterator.HasNext() {
+		queryResponse, err := lpIterator.Next()
 		if err != nil {
-			return nil, err
+			return 0, fmt.Errorf("failed to get the next state for prefix %v: %v", lpKeyPrefix, err)
 		}
-		exchangeRate = 1 / lp.ExchangeRate
 
-		// User:BUMN (amt) --> LP
-		// Add amount to supply from user
-		err = s.AddToLP(ctx, exchangerId, fromTokenId, amount)
-		if err != nil {
-			return nil, err
+		if isMigratedLP(queryResponse.Value) {
+			continue
 		}
 
-		// Calculate amounts of each token to be given to user and platform provider
-		grossExchangeAmount = amount * exchangeRate
-		platformFeeAmount = PLATFORM_FEE * exchangeRate
-		toTokenAmount = grossExchangeAmount - platformFeeAmount
-
-		exchangeResult.ToTokenAmount = toTokenAmount
-		exchangeResult.ExchangeRate = exchangeRate
-		exchangeResult.PlatformFee = platformFeeAmount
+		var legacyLp legacyLiquidityPool
+		err = json.Unmarshal(queryResponse.Value, &legacyLp)
+		if err != nil {
+			return 0, fmt.Errorf("failed to decode legacy lp %v: %v", queryResponse.Key, err)
+		}
 
-		// LP --> User:TokenX (amt - fee)
-		//	\--> Platform:TokenX (fee)
-		// Take out exchangeAmount from supply
-		// send (exchangeAmount - platformFeeAmount) to user
-		err = s.TakeFromLP(ctx, exchangerId, toTokenId, toTokenAmount)
+		lp := LiquidityPool{
+			TokenID:     legacyLp.TokenID,
+			PairTokenID: platformTokenId,
+			CreatorID:   legacyLp.CreatorID,
+		}
+		lp.TokenSupply, err = legacyAmount(legacyLp.TokenSupply)
 		if err != nil {
-			return nil, err
+			return 0, err
 		}
-		// send platformFeeAmount to provider
-		platformTokenCreatorId, err := s.GetTokenCreator(ctx, platformTokenId)
+		lp.TokenPlatformSupply, err = legacyAmount(legacyLp.TokenPlatformSupply)
 		if err != nil {
-			return nil, err
+			return 0, err
 		}
-		err = s.TakeFromLP(ctx, platformTokenCreatorId, toTokenId, platformFeeAmount)
+		lp.ExchangeRate, err = legacyRate(legacyLp.ExchangeRate)
 		if err != nil {
-			return nil, err
+			return 0, err
 		}
 
-		lp.TokenPlatformSupply += amount
-		lp.TokenSupply -= grossExchangeAmount
-		err = s.SaveLPState(ctx, lp)
+		err = s.saveLPState(ctx, &lp)
 		if err != nil {
-			return nil, err
+			return 0, err
 		}
+		migrated++
 	}
 
-	return exchangeResult, nil
+	feeBytes, err := ctx.GetStub().GetState(PLATFORM_FEE_KEY)
+	if err != nil {
+		return 0, err
+	}
+	if feeBytes != nil {
+		if _, err := parseAmount(feeBytes); err != nil {
+			fee, err := parseLegacyAmount(feeBytes)
+			if err != nil {
+				return 0, fmt.Errorf("failed to migrate platform fee: %v", err)
+			}
+			_, err = s.SetPlatformFeeAmount(ctx, fee)
+			if err != nil {
+				return 0, err
+			}
+			migrated++
+		}
+	}
+
+	err = ctx.GetStub().PutState(floatStateMigratedKey, []byte(ctx.GetStub().GetTxID()))
+	if err != nil {
+		return 0, err
+	}
+
+	return migrated, nil
+}
+
+// isMigratedLP reports whether value already is an integer LiquidityPool. Legacy pools
+// have no pair token id and may have fractional amounts that do not decode as integers.
+func isMigratedLP(value []byte) bool {
+	var lp struct {
+		LiquidityPool
+		PairTokenID *uint64 `json:"pair_token_id"`
+	}
+	err := json.Unmarshal(value, &lp)
+	return err == nil && lp.PairTokenID != nil
 }
@@ -0,0 +1,1270 @@
+package chaincode_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"erc1155/chaincode"
+	"erc1155/chaincode/mocks"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/stretchr/testify/require"
+)
+
+const platformAdmin = "bumnAdmin"
+const livinAdmin = "livinAdmin"
+const milesAdmin = "milesAdmin"
+const user1 = "user1"
+
+// memoryContext returns a transaction context of clientId in orgMSP on top of stub
+func memoryContext(stub *mocks.MemoryStub, orgMSP string, clientId string) *mocks.TransactionContext {
+	transactionContext := &mocks.TransactionContext{}
+	transactionContext.GetStubReturns(stub)
+	transactionContext.GetClientIdentityReturns(&mocks.FakeClientIdentity{ID: clientId, MSPID: orgMSP})
+	return transactionContext
+}
+
+// prepPlatform sets up the BUMNPoin platform token (1), LivinPoin (2) and MilesPoin (3),
+// and pools of 1 Livin = 10 BUMN and 1 Miles = 200 BUMN with a flat fee of 1000 BUMN.
+// It returns the stub and a function that submits a transaction as the given client.
+func prepPlatform(t *testing.T) (*mocks.MemoryStub, func(clientId string, fn func(ctx *mocks.TransactionContext) error) error) {
+	stub := mocks.NewMemoryStub()
+	txCount := 0
+	submit := func(clientId string, fn func(ctx *mocks.TransactionContext) error) error {
+		txCount++
+		orgMSP := myOrg2Msp
+		if clientId == platformAdmin {
+			orgMSP = minterMSPID
+		}
+		ctx := memoryContext(stub, orgMSP, clientId)
+		return stub.MockTransaction(fmt.Sprintf("tx%d", txCount), func() error { return fn(ctx) })
+	}
+
+	contract := chaincode.SmartContract{}
+	createToken := func(creator string, id uint64, name string, symbol string) {
+		err := submit(creator, func(ctx *mocks.TransactionContext) error {
+			_, err := contract.CreateToken(ctx, id, name, symbol, 0, "")
+			return err
+		})
+		require.NoError(t, err)
+	}
+	mint := func(creator string, account string, id uint64, amount uint64) {
+		err := submit(creator, func(ctx *mocks.TransactionContext) error {
+			return contract.Mint(ctx, account, id, amount)
+		})
+		require.NoError(t, err)
+	}
+
+	createToken(platformAdmin, 1, "BUMNPoin", "BUMN")
+	createToken(livinAdmin, 2, "LivinPoin", "LIVIN")
+	createToken(milesAdmin, 3, "MilesPoin", "MILES")
+
+	mint(platformAdmin, livinAdmin, 1, 2000000)
+	mint(platformAdmin, milesAdmin, 1, 3000000)
+	mint(livinAdmin, livinAdmin, 2, 1000000)
+	mint(livinAdmin, user1, 2, 10000)
+	mint(milesAdmin, milesAdmin, 3, 200000)
+
+	err := submit(platformAdmin, func(ctx *mocks.TransactionContext) error {
+		_, err := contract.SetPlatformTokenID(ctx, 1)
+		if err != nil {
+			return err
+		}
+		_, err = contract.SetPlatformFeeAmount(ctx, 1000)
+		return err
+	})
+	require.NoError(t, err)
+
+	err = submit(livinAdmin, func(ctx *mocks.TransactionContext) error {
+		_, err := contract.CreateLP(ctx, 2, 200000, 2000000, 10*chaincode.RateScale)
+		return err
+	})
+	require.NoError(t, err)
+
+	err = submit(milesAdmin, func(ctx *mocks.TransactionContext) error {
+		_, err := contract.CreateLP(ctx, 3, 150000, 3000000, 200*chaincode.RateScale)
+		return err
+	})
+	require.NoError(t, err)
+
+	return stub, submit
+}
+
+func requireBalance(t *testing.T, stub *mocks.MemoryStub, account string, id uint64, expected uint64) {
+	contract := chaincode.SmartContract{}
+	balance, err := contract.BalanceOf(memoryContext(stub, myOrg1Msp, myOrg1Clientid), account, id)
+	require.NoError(t, err)
+	require.Equal(t, expected, balance, "balance of %v in token id %v", account, id)
+}
+
+func TestExchangeScenario(t *testing.T) {
+	stub, submit := prepPlatform(t)
+	contract := chaincode.SmartContract{}
+
+	requireBalance(t, stub, livinAdmin, 1, 0)
+	requireBalance(t, stub, livinAdmin, 2, 800000)
+	requireBalance(t, stub, "lpbalance2", 2, 200000)
+	requireBalance(t, stub, "lpbalance1", 1, 5000000)
+
+	// Livin -> BUMN
+	var result *chaincode.ExchangeResult
+	err := submit(user1, func(ctx *mocks.TransactionContext) error {
+		var err error
+		result, err = contract.Exchange(ctx, 2, 1, 3000)
+		return err
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(29000), result.ToTokenAmount)
+	require.Equal(t, []uint64{2, 1}, result.Path)
+
+	require.Equal(t, "Swap", stub.LastEvent().EventName)
+	var swapEvent chaincode.Swap
+	require.NoError(t, json.Unmarshal(stub.LastEvent().Payload, &swapEvent))
+	require.Equal(t, user1, swapEvent.Operator)
+	require.Equal(t, uint64(1000), swapEvent.Fee)
+
+	requireBalance(t, stub, user1, 2, 7000)
+	requireBalance(t, stub, user1, 1, 29000)
+	requireBalance(t, stub, "lpbalance2", 2, 203000)
+	requireBalance(t, stub, "lpbalance1", 1, 5000000-29000)
+
+	lp, err := contract.GetLP(memoryContext(stub, myOrg1Msp, myOrg1Clientid), 1, 2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(203000), lp.TokenSupply)
+	require.Equal(t, uint64(1970000), lp.TokenPlatformSupply)
+
+	// Livin -> BUMN -> Miles, the first hop charges its fee in BUMN and the second in Miles
+	err = submit(user1, func(ctx *mocks.TransactionContext) error {
+		var err error
+		result, err = contract.Exchange(ctx, 2, 3, 3000)
+		return err
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{2, 1, 3}, result.Path)
+	require.Equal(t, uint64(140), result.ToTokenAmount)
+	requireBalance(t, stub, user1, 2, 4000)
+	requireBalance(t, stub, user1, 3, 140)
+
+	// The platform claims the fees of the Livin pool
+	var claimed *chaincode.ClaimFeesResult
+	err = submit(platformAdmin, func(ctx *mocks.TransactionContext) error {
+		var err error
+		claimed, err = contract.ClaimFees(ctx, 2, 1)
+		return err
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2000), claimed.PairTokenAmount)
+	requireBalance(t, stub, platformAdmin, 1, 2000)
+
+	// A failed transaction leaves the state untouched
+	keys := stub.Keys()
+	err = submit(user1, func(ctx *mocks.TransactionContext) error {
+		_, err := contract.Exchange(ctx, 2, 1, 5000)
+		return err
+	})
+	require.Error(t, err)
+	require.Equal(t, keys, stub.Keys())
+	requireBalance(t, stub, user1, 2, 4000)
+}
+
+func TestMigrateFloatState(t *testing.T) {
+	stub, submit := prepPlatform(t)
+	contract := chaincode.SmartContract{}
+
+	// Pools saved since the upgrade: a paused platform pool and a pair pool
+	err := submit(livinAdmin, func(ctx *mocks.TransactionContext) error {
+		_, err := contract.PausePool(ctx, 1, 2)
+		return err
+	})
+	require.NoError(t, err)
+	err = submit(milesAdmin, func(ctx *mocks.TransactionContext) error {
+		return contract.Mint(ctx, livinAdmin, 3, 2000)
+	})
+	require.NoError(t, err)
+	err = submit(livinAdmin, func(ctx *mocks.TransactionContext) error {
+		_, err := contract.CreatePairLP(ctx, 2, 3, 1000, 2000, 2*chaincode.RateScale)
+		return err
+	})
+	require.NoError(t, err)
+
+	// A pool and a balance left by the float64 version of the contract
+	legacyKey, _ := stub.CreateCompositeKey("lp", []string{"4"})
+	require.NoError(t, stub.PutState(legacyKey, []byte(`{"token_id":4,"token_supply":100.5,"token_platform_supply":1000.75,"creator_id":"legacyAdmin","exchange_rate":10}`)))
+	legacyBalanceKey, _ := stub.CreateCompositeKey("account~tokenId~sender", []string{user1, "4", "legacyAdmin"})
+	require.NoError(t, stub.PutState(legacyBalanceKey, []byte("12.5")))
+
+	poolKeys := make(map[string][]byte)
+	for _, pair := range [][]string{{"1", "2"}, {"1", "3"}, {"2", "3"}} {
+		key, _ := stub.CreateCompositeKey("lp", pair)
+		poolKeys[key], _ = stub.GetState(key)
+		require.NotNil(t, poolKeys[key])
+	}
+
+	var migrated int
+	err = submit(platformAdmin, func(ctx *mocks.TransactionContext) error {
+		var err error
+		migrated, err = contract.MigrateFloatState(ctx)
+		return err
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, migrated)
+
+	// Pools already stored as integers are untouched
+	for key, lpBytes := range poolKeys {
+		current, _ := stub.GetState(key)
+		require.Equal(t, string(lpBytes), string(current))
+	}
+
+	// The legacy pool moved to its pair key with integer amounts and a fixed-point rate
+	legacyBytes, _ := stub.GetState(legacyKey)
+	require.Nil(t, legacyBytes)
+	lp, err := contract.GetLP(memoryContext(stub, myOrg1Msp, myOrg1Clientid), 4, 1)
+	require.NoError(t, err)
+	require.Equal(t, &chaincode.LiquidityPool{TokenID: 4, PairTokenID: 1, TokenSupply: 100, TokenPlatformSupply: 1000, CreatorID: "legacyAdmin", ExchangeRate: 10 * chaincode.RateScale}, lp)
+	requireBalance(t, stub, user1, 4, 12)
+
+	pools, err := contract.ListLPs(memoryContext(stub, myOrg1Msp, myOrg1Clientid), 10, "")
+	require.NoError(t, err)
+	require.Len(t, pools.Records, 4)
+}
+
+func TestIndexLPs(t *testing.T) {
+	stub, submit := prepPlatform(t)
+	contract := chaincode.SmartContract{}
+	exchange := func() error {
+		return submit(user1, func(ctx *mocks.TransactionContext) error {
+			_, err := contract.Exchange(ctx, 2, 3, 3000)
+			return err
+		})
+	}
+	indexLPs := func(clientId string) (int, error) {
+		var indexed int
+		err := submit(clientId, func(ctx *mocks.TransactionContext) error {
+			var err error
+			indexed, err = contract.IndexLPs(ctx)
+			return err
+		})
+		return indexed, err
+	}
+
+	// A pool saved before pools were indexed cannot be routed through
+	for _, attributes := range [][]string{{"1", "3"}, {"3", "1"}} {
+		key, _ := stub.CreateCompositeKey("lptoken~pair", attributes)
+		require.NoError(t, stub.DelState(key))
+	}
+	require.EqualError(t, exchange(), "no route from token id 2 to token id 3")
+
+	_, err := indexLPs(user1)
+	require.EqualError(t, err, "client is not authorized to mint new tokens")
+
+	indexed, err := indexLPs(platformAdmin)
+	require.NoError(t, err)
+	require.Equal(t, 1, indexed)
+	require.NoError(t, exchange())
+
+	indexed, err = indexLPs(platformAdmin)
+	require.NoError(t, err)
+	require.Equal(t, 0, indexed)
+}
+
+func TestPoolCircuitBreaker(t *testing.T) {
+	stub, submit := prepPlatform(t)
+	contract := chaincode.SmartContract{}
+	exchange := func(clientId string, fromTokenId uint64, toTokenId uint64, amount uint64) error {
+		return submit(clientId, func(ctx *mocks.TransactionContext) error {
+			_, err := contract.Exchange(ctx, fromTokenId, toTokenId, amount)
+			return err
+		})
+	}
+	pause := func(clientId string, paused bool) error {
+		return submit(clientId, func(ctx *mocks.TransactionContext) error {
+			var err error
+			if paused {
+				_, err = contract.PausePool(ctx, 1, 2)
+			} else {
+				_, err = contract.ResumePool(ctx, 1, 2)
+			}
+			return err
+		})
+	}
+
+	// Only the pool creator and the platform can pause a pool
+	require.Error(t, pause(user1, true))
+	require.NoError(t, pause(livinAdmin, true))
+	require.Equal(t, "PoolPaused", stub.LastEvent().EventName)
+	require.EqualError(t, pause(platformAdmin, true), "lp of token id 2 and 1 is already paused")
+
+	// Neither direct swaps nor routes go through a paused pool
+	require.EqualError(t, exchange(user1, 2, 1, 3000), "lp of token id 2 and 1 is paused")
+	require.EqualError(t, exchange(user1, 2, 3, 3000), "lp of token id 2 and 1 is paused")
+
+	require.NoError(t, pause(platformAdmin, false))
+	require.Equal(t, "PoolResumed", stub.LastEvent().EventName)
+
+	err := submit(livinAdmin, func(ctx *mocks.TransactionContext) error {
+		_, err := contract.SetPoolLimits(ctx, 2, 1, chaincode.PoolLimitConfig{DailyOutflowCap: 50000, UserDailyOutflowCap: 30000})
+		return err
+	})
+	require.NoError(t, err)
+
+	// The outflow includes the fee of 1000 BUMN that leaves the reserve
+	require.NoError(t, exchange(user1, 2, 1, 3000))
+	limits, err := contract.PoolLimits(memoryContext(stub, myOrg1Msp, myOrg1Clientid), 1, 2, user1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(30000), limits.DailyOutflow)
+	require.Equal(t, uint64(20000), limits.RemainingOutflow)
+	require.Equal(t, uint64(0), limits.UserRemainingOutflow)
+
+	require.EqualError(t, exchange(user1, 2, 1, 200), "outflow of 2000 platform tokens exceeds the daily outflow cap of 30000 per user of lp of token id 2 and 1, 0 remaining today")
+	require.EqualError(t, exchange(livinAdmin, 2, 1, 2500), "outflow of 25000 platform tokens exceeds the daily outflow cap of 50000 of lp of token id 2 and 1, 20000 remaining today")
+	require.NoError(t, exchange(livinAdmin, 2, 1, 2000))
+
+	// Outflows from the platform token into Livin are valued in platform tokens as well
+	require.EqualError(t, exchange(livinAdmin, 1, 2, 10000), "outflow of 10000 platform tokens exceeds the daily outflow cap of 50000 of lp of token id 2 and 1, 0 remaining today")
+
+	// The caps apply per day
+	stub.TxTimestamp = stub.TxTimestamp.Add(24 * time.Hour)
+	limits, err = contract.PoolLimits(memoryContext(stub, myOrg1Msp, myOrg1Clientid), 1, 2, user1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), limits.DailyOutflow)
+	require.Equal(t, uint64(30000), limits.UserRemainingOutflow)
+	require.NoError(t, exchange(user1, 2, 1, 200))
+
+	// Pools without caps report unlimited headroom
+	limits, err = contract.PoolLimits(memoryContext(stub, myOrg1Msp, myOrg1Clientid), 1, 3, user1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(math.MaxUint64), limits.RemainingOutflow)
+
+	// Tokens without a pool against the platform token count in their own units
+	err = submit(livinAdmin, func(ctx *mocks.TransactionContext) error {
+		_, err := contract.CreateToken(ctx, 4, "Voucher", "", 0, "")
+		return err
+	})
+	require.NoError(t, err)
+	err = submit(livinAdmin, func(ctx *mocks.TransactionContext) error {
+		return contract.Mint(ctx, livinAdmin, 4, 1000)
+	})
+	require.NoError(t, err)
+	err = submit(livinAdmin, func(ctx *mocks.TransactionContext) error {
+		_, err := contract.CreatePairLP(ctx, 2, 4, 10000, 1000, chaincode.RateScale/10)
+		return err
+	})
+	require.NoError(t, err)
+	err = submit(livinAdmin, func(ctx *mocks.TransactionContext) error {
+		_, err := contract.SetPoolLimits(ctx, 2, 4, chaincode.PoolLimitConfig{DailyOutflowCap: 50})
+		return err
+	})
+	require.NoError(t, err)
+	setFees := func(clientId string) error {
+		return submit(clientId, func(ctx *mocks.TransactionContext) error {
+			_, err := contract.SetPoolFeeConfig(ctx, 2, 4, chaincode.PoolFeeConfig{SwapFeeBps: 100, ProviderShareBps: 5000})
+			return err
+		})
+	}
+	require.EqualError(t, setFees(livinAdmin), livinAdmin+" is not the platform")
+	require.NoError(t, setFees(platformAdmin))
+	require.EqualError(t, exchange(user1, 2, 4, 1000), "outflow of 100 platform tokens exceeds the daily outflow cap of 50 of lp of token id 2 and 4, 50 remaining today")
+	require.NoError(t, exchange(user1, 2, 4, 300))
+	limits, err = contract.PoolLimits(memoryContext(stub, myOrg1Msp, myOrg1Clientid), 2, 4, user1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(30), limits.DailyOutflow)
+}
+
+func TestRateChange(t *testing.T) {
+	stub, submit := prepPlatform(t)
+	contract := chaincode.SmartContract{}
+	propose := func(clientId string, exchangeRate uint64) error {
+		return submit(clientId, func(ctx *mocks.TransactionContext) error {
+			_, err := contract.ProposeRateChange(ctx, 2, 1, exchangeRate)
+			return err
+		})
+	}
+	apply := func() error {
+		return submit(user1, func(ctx *mocks.TransactionContext) error {
+			_, err := contract.ApplyRateChange(ctx, 2, 1)
+			return err
+		})
+	}
+	veto := func(clientId string) error {
+		return submit(clientId, func(ctx *mocks.TransactionContext) error {
+			_, err := contract.VetoRateChange(ctx, 1, 2)
+			return err
+		})
+	}
+
+	// Only the liquidity provider proposes rates
+	require.EqualError(t, propose(platformAdmin, 12*chaincode.RateScale), "bumnAdmin is not the liquidity provider of lp of token id 2 and 1")
+	require.NoError(t, propose(livinAdmin, 12*chaincode.RateScale))
+	require.Equal(t, "RateChangeProposed", stub.LastEvent().EventName)
+
+	// The rate does not change before the timelock has passed
+	require.EqualError(t, apply(), "rate change of lp of token id 2 and 1 cannot be applied before 1600172800")
+	lp, err := contract.GetLP(memoryContext(stub, myOrg1Msp, myOrg1Clientid), 1, 2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10*chaincode.RateScale), lp.ExchangeRate)
+	require.Equal(t, uint64(12*chaincode.RateScale), lp.PendingRate.ExchangeRate)
+
+	// The platform vetoes the proposal
+	require.EqualError(t, veto(livinAdmin), "livinAdmin is not the platform and cannot veto rate changes")
+	require.NoError(t, veto(platformAdmin))
+	require.Equal(t, "RateChangeVetoed", stub.LastEvent().EventName)
+	stub.TxTimestamp = stub.TxTimestamp.Add(72 * time.Hour)
+	require.EqualError(t, apply(), "lp of token id 2 and 1 has no pending rate change")
+
+	require.NoError(t, propose(livinAdmin, 11*chaincode.RateScale))
+	stub.TxTimestamp = stub.TxTimestamp.Add(48 * time.Hour)
+	require.NoError(t, apply())
+	require.Equal(t, "RateChangeApplied", stub.LastEvent().EventName)
+
+	lp, err = contract.GetLP(memoryContext(stub, myOrg1Msp, myOrg1Clientid), 1, 2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(11*chaincode.RateScale), lp.ExchangeRate)
+	require.Nil(t, lp.PendingRate)
+
+	// The history of a token lists the rates of its pools, the platform token has both pools
+	history, err := contract.RateHistory(memoryContext(stub, myOrg1Msp, myOrg1Clientid), 2)
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	require.Equal(t, uint64(10*chaincode.RateScale), history[0].ExchangeRate)
+	require.Equal(t, uint64(11*chaincode.RateScale), history[1].ExchangeRate)
+	require.Equal(t, stub.TxTimestamp.Unix(), history[1].AppliedAt)
+	require.NotEqual(t, history[0].TxID, history[1].TxID)
+
+	history, err = contract.RateHistory(memoryContext(stub, myOrg1Msp, myOrg1Clientid), 1)
+	require.NoError(t, err)
+	require.Len(t, history, 3)
+	require.Equal(t, uint64(3), history[2].TokenID)
+}
+
+func TestAuditPool(t *testing.T) {
+	stub, submit := prepPlatform(t)
+	contract := chaincode.SmartContract{}
+
+	// Fees stay in the LP accounts and are accounted for until they are claimed
+	err := submit(user1, func(ctx *mocks.TransactionContext) error {
+		_, err := contract.Exchange(ctx, 2, 1, 3000)
+		return err
+	})
+	require.NoError(t, err)
+
+	audit, err := contract.AuditPool(memoryContext(stub, myOrg1Msp, myOrg1Clientid), 2, 1)
+	require.NoError(t, err)
+	require.True(t, audit.Balanced)
+	require.Equal(t, uint64(1970000), audit.PairToken.Reserve)
+	require.Equal(t, uint64(3000000), audit.PairToken.OtherReserves)
+	require.Equal(t, uint64(1000), audit.PairToken.UnclaimedFees)
+	require.Equal(t, uint64(4971000), audit.PairToken.Balance)
+
+	// Tokens sent to the LP account directly are not part of the reserves
+	err = submit(livinAdmin, func(ctx *mocks.TransactionContext) error {
+		return contract.Mint(ctx, "lpbalance2", 2, 500)
+	})
+	require.NoError(t, err)
+
+	audit, err = contract.AuditPool(memoryContext(stub, myOrg1Msp, myOrg1Clientid), 2, 1)
+	require.NoError(t, err)
+	require.False(t, audit.Balanced)
+	require.Equal(t, uint64(500), audit.Token.Surplus)
+
+	sync := func(clientId string) (*chaincode.PoolAudit, error) {
+		var audit *chaincode.PoolAudit
+		err := submit(clientId, func(ctx *mocks.TransactionContext) error {
+			var err error
+			audit, err = contract.SyncPool(ctx, 2, 1)
+			return err
+		})
+		return audit, err
+	}
+
+	_, err = sync(user1)
+	require.Error(t, err)
+
+	// Being in the minter organization does not make a client the platform
+	_, err = contract.SyncPool(memoryContext(stub, myOrg1Msp, myOrg1Clientid), 2, 1)
+	require.EqualError(t, err, myOrg1Clientid+" is not the platform")
+
+	audit, err = sync(platformAdmin)
+	require.NoError(t, err)
+	require.True(t, audit.Balanced)
+	require.Equal(t, uint64(203500), audit.Token.Reserve)
+
+	require.Equal(t, "PoolSynced", stub.LastEvent().EventName)
+	var syncedEvent chaincode.PoolSynced
+	require.NoError(t, json.Unmarshal(stub.LastEvent().Payload, &syncedEvent))
+	require.Equal(t, uint64(203000), syncedEvent.PreviousTokenSupply)
+	require.Equal(t, uint64(203500), syncedEvent.TokenSupply)
+	require.Equal(t, uint64(1970000), syncedEvent.TokenPlatformSupply)
+
+	lp, err := contract.GetLPByTokenID(memoryContext(stub, myOrg1Msp, myOrg1Clientid), 2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(203500), lp.TokenSupply)
+
+	_, err = sync(platformAdmin)
+	require.EqualError(t, err, "lp of token id 2 and 1 is balanced")
+
+	// The platform token is shared by the platform pools of Livin and Miles, so its surplus is refused
+	err = submit(platformAdmin, func(ctx *mocks.TransactionContext) error {
+		return contract.Mint(ctx, "lpbalance1", 1, 700)
+	})
+	require.NoError(t, err)
+	audit, err = contract.AuditPool(memoryContext(stub, myOrg1Msp, myOrg1Clientid), 3, 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(700), audit.PairToken.Surplus)
+	require.Equal(t, 1, audit.PairToken.OtherPools)
+	_, err = sync(platformAdmin)
+	require.EqualError(t, err, "lpbalance1 in token id 1 is shared by 1 other pools, its difference cannot be attributed to one pool")
+	lp, err = contract.GetLPByTokenID(memoryContext(stub, myOrg1Msp, myOrg1Clientid), 2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1970000), lp.TokenPlatformSupply)
+
+	// Pair pools are audited as well, their LP accounts are shared with the platform pools
+	err = submit(milesAdmin, func(ctx *mocks.TransactionContext) error {
+		return contract.Mint(ctx, livinAdmin, 3, 2000)
+	})
+	require.NoError(t, err)
+	err = submit(livinAdmin, func(ctx *mocks.TransactionContext) error {
+		_, err := contract.CreatePairLP(ctx, 2, 3, 1000, 2000, 2*chaincode.RateScale)
+		return err
+	})
+	require.NoError(t, err)
+
+	audit, err = contract.AuditPool(memoryContext(stub, myOrg1Msp, myOrg1Clientid), 3, 2)
+	require.NoError(t, err)
+	require.True(t, audit.Balanced)
+	require.Equal(t, uint64(1000), audit.Token.Reserve)
+	require.Equal(t, 1, audit.Token.OtherPools)
+	require.Equal(t, uint64(203500), audit.Token.OtherReserves)
+
+	// A surplus in a shared LP account cannot be attributed to one pool
+	err = submit(livinAdmin, func(ctx *mocks.TransactionContext) error {
+		return contract.Mint(ctx, "lpbalance2", 2, 500)
+	})
+	require.NoError(t, err)
+	_, err = sync(platformAdmin)
+	require.EqualError(t, err, "lpbalance2 in token id 2 is shared by 1 other pools, its difference cannot be attributed to one pool")
+}
+
+func TestOrderBook(t *testing.T) {
+	stub, submit := prepPlatform(t)
+	contract := chaincode.SmartContract{}
+	placeOrder := func(clientId string, sellId uint64, buyId uint64, amount uint64, price uint64, expiry int64) (*chaincode.PlaceOrderResult, error) {
+		var result *chaincode.PlaceOrderResult
+		err := submit(clientId, func(ctx *mocks.TransactionContext) error {
+			var err error
+			result, err = contract.PlaceOrder(ctx, sellId, buyId, amount, price, expiry)
+			return err
+		})
+		return result, err
+	}
+	cancelOrder := func(clientId string, orderId string) error {
+		return submit(clientId, func(ctx *mocks.TransactionContext) error {
+			_, err := contract.CancelOrder(ctx, orderId)
+			return err
+		})
+	}
+	queryContext := memoryContext(stub, myOrg1Msp, myOrg1Clientid)
+
+	// Two asks of Miles for Livin at 20 and 25 Livin per Miles, the tokens go into escrow
+	_, err := placeOrder(milesAdmin, 3, 2, 100, 25*chaincode.RateScale, 0)
+	require.NoError(t, err)
+	_, err = placeOrder(milesAdmin, 3, 2, 100, 20*chaincode.RateScale, 0)
+	require.NoError(t, err)
+	require.Equal(t, "OrderPlaced", stub.LastEvent().EventName)
+	requireBalance(t, stub, milesAdmin, 3, 49800)
+	requireBalance(t, stub, "orderescrow3", 3, 200)
+
+	_, err = placeOrder(user1, 2, 3, 100000, chaincode.RateScale/25, 0)
+	require.Error(t, err)
+
+	// Selling 3000 Livin for at least 1/25 Miles each fills the cheaper ask and part of the other
+	result, err := placeOrder(user1, 2, 3, 3000, chaincode.RateScale/25, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), result.Order.Remaining)
+	require.Len(t, result.Fills, 2)
+	require.Equal(t, uint64(100), result.Fills[0].SellAmount)
+	require.Equal(t, uint64(2000), result.Fills[0].BuyAmount)
+	require.Equal(t, uint64(40), result.Fills[1].SellAmount)
+	require.Equal(t, uint64(1000), result.Fills[1].BuyAmount)
+
+	require.Equal(t, "OrderFilled", stub.LastEvent().EventName)
+	var filledEvent chaincode.OrderEvent
+	require.NoError(t, json.Unmarshal(stub.LastEvent().Payload, &filledEvent))
+	require.Equal(t, result.Fills, filledEvent.Fills)
+
+	requireBalance(t, stub, user1, 2, 7000)
+	requireBalance(t, stub, user1, 3, 140)
+	requireBalance(t, stub, milesAdmin, 2, 3000)
+	requireBalance(t, stub, "orderescrow3", 3, 60)
+
+	book, err := contract.OrderBook(queryContext, 3, 2)
+	require.NoError(t, err)
+	require.Len(t, book.Sells, 1)
+	require.Equal(t, uint64(60), book.Sells[0].Remaining)
+	require.Empty(t, book.Buys)
+
+	// A bid that does not cross rests in the book
+	result, err = placeOrder(user1, 2, 3, 1000, chaincode.RateScale/10, 0)
+	require.NoError(t, err)
+	require.Empty(t, result.Fills)
+	requireBalance(t, stub, user1, 2, 6000)
+
+	orders, err := contract.OrdersOf(queryContext, user1)
+	require.NoError(t, err)
+	require.Len(t, orders, 1)
+	book, err = contract.OrderBook(queryContext, 3, 2)
+	require.NoError(t, err)
+	require.Len(t, book.Buys, 1)
+
+	require.EqualError(t, cancelOrder(milesAdmin, result.Order.ID), fmt.Sprintf("milesAdmin is not the owner of order %v", result.Order.ID))
+	require.NoError(t, cancelOrder(user1, result.Order.ID))
+	require.Equal(t, "OrderCancelled", stub.LastEvent().EventName)
+	requireBalance(t, stub, user1, 2, 7000)
+	orders, err = contract.OrdersOf(queryContext, user1)
+	require.NoError(t, err)
+	require.Empty(t, orders)
+
+	// Expired orders leave the book and can be cancelled by anyone
+	expiry := stub.TxTimestamp.Unix() + 3600
+	result, err = placeOrder(milesAdmin, 3, 2, 50, 10*chaincode.RateScale, expiry)
+	require.NoError(t, err)
+	stub.TxTimestamp = stub.TxTimestamp.Add(2 * time.Hour)
+
+	book, err = contract.OrderBook(queryContext, 3, 2)
+	require.NoError(t, err)
+	require.Len(t, book.Sells, 1)
+	require.NoError(t, cancelOrder(user1, result.Order.ID))
+	requireBalance(t, stub, milesAdmin, 3, 49800)
+
+	_, err = placeOrder(user1, 2, 3, 100, chaincode.RateScale, expiry)
+	require.EqualError(t, err, fmt.Sprintf("order expiry %v is not in the future", expiry))
+}
+
+func TestOrderBookRounding(t *testing.T) {
+	stub, submit := prepPlatform(t)
+	contract := chaincode.SmartContract{}
+	placeOrder := func(amount uint64) (*chaincode.PlaceOrderResult, error) {
+		var result *chaincode.PlaceOrderResult
+		err := submit(user1, func(ctx *mocks.TransactionContext) error {
+			var err error
+			result, err = contract.PlaceOrder(ctx, 2, 3, amount, 2*chaincode.RateScale/3, 0)
+			return err
+		})
+		return result, err
+	}
+
+	// An ask of Miles at 1.5 Livin per Miles crosses a bid of just under 2/3 Miles per Livin
+	err := submit(milesAdmin, func(ctx *mocks.TransactionContext) error {
+		_, err := contract.PlaceOrder(ctx, 3, 2, 100, 3*chaincode.RateScale/2, 0)
+		return err
+	})
+	require.NoError(t, err)
+
+	// 1 Miles costs 2 Livin rounded up, which is below the price of the bid, so it rests unfilled
+	result, err := placeOrder(2)
+	require.NoError(t, err)
+	require.Empty(t, result.Fills)
+	require.Equal(t, uint64(2), result.Order.Remaining)
+	requireBalance(t, stub, user1, 3, 0)
+
+	// 2 Miles cost exactly 3 Livin, which meets both prices
+	result, err = placeOrder(3)
+	require.NoError(t, err)
+	require.Len(t, result.Fills, 1)
+	require.Equal(t, uint64(2), result.Fills[0].SellAmount)
+	require.Equal(t, uint64(3), result.Fills[0].BuyAmount)
+	require.Equal(t, uint64(0), result.Order.Remaining)
+	requireBalance(t, stub, user1, 3, 2)
+}
+
+func TestExchangeFrom(t *testing.T) {
+	stub, submit := prepPlatform(t)
+	contract := chaincode.SmartContract{}
+	const merchant = "merchant"
+	exchangeFrom := func(clientId string) (*chaincode.ExchangeResult, error) {
+		var result *chaincode.ExchangeResult
+		err := submit(clientId, func(ctx *mocks.TransactionContext) error {
+			var err error
+			result, err = contract.ExchangeFrom(ctx, user1, milesAdmin, 2, 3, 3000)
+			return err
+		})
+		return result, err
+	}
+
+	_, err := exchangeFrom(merchant)
+	require.EqualError(t, err, "caller is not owner nor is approved")
+
+	err = submit(user1, func(ctx *mocks.TransactionContext) error {
+		return contract.SetApprovalForAll(ctx, merchant, true)
+	})
+	require.NoError(t, err)
+
+	// The merchant swaps Livin of user1 and pays the output in Miles to the Miles brand
+	result, err := exchangeFrom(merchant)
+	require.NoError(t, err)
+	require.Equal(t, uint64(140), result.ToTokenAmount)
+	requireBalance(t, stub, user1, 2, 7000)
+	requireBalance(t, stub, user1, 3, 0)
+	requireBalance(t, stub, milesAdmin, 3, 50140)
+	requireBalance(t, stub, merchant, 3, 0)
+
+	var swapEvent chaincode.Swap
+	require.NoError(t, json.Unmarshal(stub.LastEvent().Payload, &swapEvent))
+	require.Equal(t, merchant, swapEvent.Operator)
+	require.Equal(t, user1, swapEvent.Owner)
+	require.Equal(t, milesAdmin, swapEvent.Recipient)
+}
+
+func TestTWAP(t *testing.T) {
+	stub, submit := prepPlatform(t)
+	contract := chaincode.SmartContract{}
+	queryContext := memoryContext(stub, myOrg1Msp, myOrg1Clientid)
+
+	stub.TxTimestamp = stub.TxTimestamp.Add(time.Hour)
+	err := submit(user1, func(ctx *mocks.TransactionContext) error {
+		_, err := contract.Exchange(ctx, 2, 1, 3000)
+		return err
+	})
+	require.NoError(t, err)
+
+	err = submit(livinAdmin, func(ctx *mocks.TransactionContext) error {
+		_, err := contract.ProposeRateChange(ctx, 2, 1, 12*chaincode.RateScale)
+		return err
+	})
+	require.NoError(t, err)
+	stub.TxTimestamp = stub.TxTimestamp.Add(48 * time.Hour)
+	err = submit(user1, func(ctx *mocks.TransactionContext) error {
+		_, err := contract.ApplyRateChange(ctx, 2, 1)
+		return err
+	})
+	require.NoError(t, err)
+
+	// A trade does not move the average, a rate change moves it in proportion to the time it applied
+	stub.TxTimestamp = stub.TxTimestamp.Add(time.Hour)
+	twap, err := contract.TWAP(queryContext, 2, 7200)
+	require.NoError(t, err)
+	require.Equal(t, uint64(11*chaincode.RateScale), twap.Price)
+
+	twap, err = contract.TWAP(queryContext, 2, 3600)
+	require.NoError(t, err)
+	require.Equal(t, uint64(12*chaincode.RateScale), twap.Price)
+
+	twap, err = contract.TWAP(queryContext, 3, 3600)
+	require.NoError(t, err)
+	require.Equal(t, uint64(200*chaincode.RateScale), twap.Price)
+
+	_, err = contract.TWAP(queryContext, 2, 51*3600)
+	require.EqualError(t, err, "window of 183600 seconds starts before the first price observation of lp of token id 2 and 1")
+
+	// Creation, exchange and rate change
+	observations, err := contract.PriceObservations(queryContext, 2, 2, "")
+	require.NoError(t, err)
+	require.Len(t, observations.Records, 2)
+	require.Equal(t, uint64(10*chaincode.RateScale), observations.Records[1].ExchangeRate)
+	require.Equal(t, uint64(3600*10*chaincode.RateScale), observations.Records[1].PriceCumulative)
+
+	observations, err = contract.PriceObservations(queryContext, 2, 2, observations.Bookmark)
+	require.NoError(t, err)
+	require.Len(t, observations.Records, 1)
+	require.Equal(t, uint64(12*chaincode.RateScale), observations.Records[0].ExchangeRate)
+	require.Equal(t, "", observations.Bookmark)
+}
+
+func TestHold(t *testing.T) {
+	stub, submit := prepPlatform(t)
+	contract := chaincode.SmartContract{}
+	const merchant = "merchant"
+	availableBalance := func(account string, id uint64) uint64 {
+		available, err := contract.AvailableBalance(memoryContext(stub, myOrg1Msp, myOrg1Clientid), account, id)
+		require.NoError(t, err)
+		return available
+	}
+	hold := func(amount uint64, expiry int64) (*chaincode.Hold, error) {
+		var hold *chaincode.Hold
+		err := submit(user1, func(ctx *mocks.TransactionContext) error {
+			var err error
+			hold, err = contract.Hold(ctx, user1, 2, amount, merchant, expiry)
+			return err
+		})
+		return hold, err
+	}
+	now := stub.TxTimestamp.Unix()
+
+	_, err := hold(6000, now)
+	require.EqualError(t, err, fmt.Sprintf("expiry must be after %v", now))
+	_, err = hold(10001, now+3600)
+	require.EqualError(t, err, "account has insufficient funds for token 2, needed funds: 10001, available fund: 10000")
+
+	firstHold, err := hold(6000, now+3600)
+	require.NoError(t, err)
+	require.Equal(t, "HoldPlaced", stub.LastEvent().EventName)
+	requireBalance(t, stub, user1, 2, 10000)
+	require.Equal(t, uint64(4000), availableBalance(user1, 2))
+
+	// Held funds cannot be spent
+	err = submit(user1, func(ctx *mocks.TransactionContext) error {
+		return contract.TransferFrom(ctx, user1, livinAdmin, 2, 5000)
+	})
+	require.EqualError(t, err, "sender has insufficient funds for token 2, needed funds: 5000, available fund: 4000")
+	err = submit(user1, func(ctx *mocks.TransactionContext) error {
+		return contract.TransferFrom(ctx, user1, livinAdmin, 2, 3000)
+	})
+	require.NoError(t, err)
+	requireBalance(t, stub, user1, 2, 7000)
+	require.Equal(t, uint64(1000), availableBalance(user1, 2))
+
+	// Only the holder captures, and the rest of the hold is released
+	capture := func(clientId string, holdId string, amount uint64) error {
+		return submit(clientId, func(ctx *mocks.TransactionContext) error {
+			_, err := contract.Capture(ctx, holdId, merchant, amount)
+			return err
+		})
+	}
+	err = capture(user1, firstHold.ID, 2500)
+	require.EqualError(t, err, fmt.Sprintf("%v is not the holder of hold %v", user1, firstHold.ID))
+	err = capture(merchant, firstHold.ID, 6001)
+	require.EqualError(t, err, fmt.Sprintf("amount 6001 exceeds the held amount 6000 of hold %v", firstHold.ID))
+	err = capture(merchant, firstHold.ID, 2500)
+	require.NoError(t, err)
+	require.Equal(t, "HoldCaptured", stub.LastEvent().EventName)
+	requireBalance(t, stub, user1, 2, 4500)
+	requireBalance(t, stub, merchant, 2, 2500)
+	require.Equal(t, uint64(4500), availableBalance(user1, 2))
+	err = capture(merchant, firstHold.ID, 1)
+	require.EqualError(t, err, fmt.Sprintf("hold %v does not exist", firstHold.ID))
+
+	// Expired holds cannot be captured and can be released by anyone
+	secondHold, err := hold(4000, now+3600)
+	require.NoError(t, err)
+	require.Equal(t, uint64(500), availableBalance(user1, 2))
+	release := func(clientId string) error {
+		return submit(clientId, func(ctx *mocks.TransactionContext) error {
+			_, err := contract.Release(ctx, secondHold.ID)
+			return err
+		})
+	}
+	err = release(livinAdmin)
+	require.EqualError(t, err, fmt.Sprintf("%v is not the holder of hold %v", livinAdmin, secondHold.ID))
+
+	stub.TxTimestamp = stub.TxTimestamp.Add(time.Hour)
+	err = capture(merchant, secondHold.ID, 1000)
+	require.EqualError(t, err, fmt.Sprintf("hold %v expired at %v", secondHold.ID, now+3600))
+	err = release(livinAdmin)
+	require.NoError(t, err)
+	require.Equal(t, "HoldReleased", stub.LastEvent().EventName)
+	requireBalance(t, stub, user1, 2, 4500)
+	require.Equal(t, uint64(4500), availableBalance(user1, 2))
+}
+
+func TestTransferPolicy(t *testing.T) {
+	stub, submit := prepPlatform(t)
+	contract := chaincode.SmartContract{}
+	createToken := func(id uint64, policy string) error {
+		return submit(livinAdmin, func(ctx *mocks.TransactionContext) error {
+			_, err := contract.CreateToken(ctx, id, fmt.Sprintf("Token%d", id), "", 0, policy)
+			return err
+		})
+	}
+	mint := func(id uint64, amount uint64) {
+		err := submit(livinAdmin, func(ctx *mocks.TransactionContext) error {
+			return contract.Mint(ctx, user1, id, amount)
+		})
+		require.NoError(t, err)
+	}
+	transfer := func(id uint64, amount uint64) error {
+		return submit(user1, func(ctx *mocks.TransactionContext) error {
+			return contract.TransferFrom(ctx, user1, milesAdmin, id, amount)
+		})
+	}
+
+	err := createToken(4, "bound")
+	require.EqualError(t, err, `unknown transfer policy "bound", expected transferable, non_transferable or clawback`)
+
+	// Badges can be minted but not transferred, pooled or traded
+	require.NoError(t, createToken(4, chaincode.TransferPolicyNonTransferable))
+	mint(4, 1)
+	requireBalance(t, stub, user1, 4, 1)
+	require.EqualError(t, transfer(4, 1), "token id 4 is not transferable")
+	err = submit(user1, func(ctx *mocks.TransactionContext) error {
+		return contract.BatchTransferFrom(ctx, user1, milesAdmin, []uint64{2, 4}, []uint64{1, 1})
+	})
+	require.EqualError(t, err, "token id 4 is not transferable")
+	err = submit(user1, func(ctx *mocks.TransactionContext) error {
+		_, err := contract.PlaceOrder(ctx, 4, 1, 1, chaincode.RateScale, 0)
+		return err
+	})
+	require.EqualError(t, err, "token id 4 is not transferable")
+	err = submit(livinAdmin, func(ctx *mocks.TransactionContext) error {
+		_, err := contract.CreatePairLP(ctx, 2, 4, 1000, 1, chaincode.RateScale)
+		return err
+	})
+	require.EqualError(t, err, "token id 4 is not transferable")
+	requireBalance(t, stub, user1, 4, 1)
+
+	// Promo credits can be transferred and taken back by their creator
+	require.NoError(t, createToken(5, chaincode.TransferPolicyClawback))
+	mint(5, 1000)
+	require.NoError(t, transfer(5, 400))
+	clawback := func(clientId string, id uint64) error {
+		return submit(clientId, func(ctx *mocks.TransactionContext) error {
+			return contract.Clawback(ctx, milesAdmin, id, 300, "promo abuse")
+		})
+	}
+	require.EqualError(t, clawback(milesAdmin, 5), fmt.Sprintf("%v is not the creator of token id 5", milesAdmin))
+	require.EqualError(t, clawback(livinAdmin, 2), "token id 2 does not allow clawback")
+	require.NoError(t, clawback(livinAdmin, 5))
+	requireBalance(t, stub, milesAdmin, 5, 100)
+	requireBalance(t, stub, livinAdmin, 5, 300)
+
+	require.Equal(t, "Clawback", stub.LastEvent().EventName)
+	var clawbackEvent chaincode.Clawback
+	require.NoError(t, json.Unmarshal(stub.LastEvent().Payload, &clawbackEvent))
+	require.Equal(t, chaincode.Clawback{Operator: livinAdmin, From: milesAdmin, To: livinAdmin, ID: 5, Value: 300, Reason: "promo abuse"}, clawbackEvent)
+
+	// The LP account backs the reserves of the pool, its tokens cannot be taken back
+	err = submit(livinAdmin, func(ctx *mocks.TransactionContext) error {
+		_, err := contract.CreatePairLP(ctx, 2, 5, 100, 100, chaincode.RateScale)
+		return err
+	})
+	require.NoError(t, err)
+	err = submit(livinAdmin, func(ctx *mocks.TransactionContext) error {
+		return contract.Clawback(ctx, "lpbalance5", 5, 100, "promo abuse")
+	})
+	require.EqualError(t, err, "cannot claw back from contract account lpbalance5")
+	requireBalance(t, stub, "lpbalance5", 5, 100)
+}
+
+func TestTokenRegistry(t *testing.T) {
+	stub, submit := prepPlatform(t)
+	contract := chaincode.SmartContract{}
+	tokenInfoKey, err := stub.CreateCompositeKey("tokenId~info", []string{"2"})
+	require.NoError(t, err)
+	registered, err := stub.GetState(tokenInfoKey)
+	require.NoError(t, err)
+
+	// Minting and transferring the ownership leave the registry entry as it was
+	err = submit(livinAdmin, func(ctx *mocks.TransactionContext) error {
+		return contract.Mint(ctx, livinAdmin, 2, 5000)
+	})
+	require.NoError(t, err)
+	err = submit(livinAdmin, func(ctx *mocks.TransactionContext) error {
+		return contract.TransferTokenOwnership(ctx, 2, milesAdmin)
+	})
+	require.NoError(t, err)
+	require.Equal(t, "TokenOwnershipTransferred", stub.LastEvent().EventName)
+
+	current, err := stub.GetState(tokenInfoKey)
+	require.NoError(t, err)
+	require.Equal(t, registered, current)
+
+	tokenInfo, err := contract.GetTokenInfo(memoryContext(stub, myOrg1Msp, myOrg1Clientid), 2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1015000), tokenInfo.Supply)
+	require.Equal(t, milesAdmin, tokenInfo.Creator)
+
+	tokens, err := contract.ListTokens(memoryContext(stub, myOrg1Msp, myOrg1Clientid), 10, "")
+	require.NoError(t, err)
+	require.Equal(t, tokenInfo, tokens.Records[1])
+}
+
+func TestSnapshotRewards(t *testing.T) {
+	stub, submit := prepPlatform(t)
+	contract := chaincode.SmartContract{}
+	takeSnapshot := func(clientId string) (*chaincode.Snapshot, error) {
+		var snapshot *chaincode.Snapshot
+		err := submit(clientId, func(ctx *mocks.TransactionContext) error {
+			var err error
+			snapshot, err = contract.TakeSnapshot(ctx, 2)
+			return err
+		})
+		return snapshot, err
+	}
+	balanceOfAt := func(account string, snapshotId uint64) uint64 {
+		balance, err := contract.BalanceOfAt(memoryContext(stub, myOrg1Msp, myOrg1Clientid), account, 2, snapshotId)
+		require.NoError(t, err)
+		return balance
+	}
+
+	_, err := takeSnapshot(user1)
+	require.EqualError(t, err, fmt.Sprintf("%v is not the creator of token id 2", user1))
+
+	// Livin is held by its brand, user1 and the LP account
+	first, err := takeSnapshot(livinAdmin)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first.ID)
+	require.Equal(t, uint64(1010000), first.TotalSupply)
+
+	err = submit(user1, func(ctx *mocks.TransactionContext) error {
+		return contract.TransferFrom(ctx, user1, milesAdmin, 2, 5000)
+	})
+	require.NoError(t, err)
+	second, err := takeSnapshot(livinAdmin)
+	require.NoError(t, err)
+	err = submit(user1, func(ctx *mocks.TransactionContext) error {
+		return contract.TransferFrom(ctx, user1, milesAdmin, 2, 1000)
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, uint64(10000), balanceOfAt(user1, first.ID))
+	require.Equal(t, uint64(0), balanceOfAt(milesAdmin, first.ID))
+	require.Equal(t, uint64(800000), balanceOfAt(livinAdmin, first.ID))
+	require.Equal(t, uint64(5000), balanceOfAt(user1, second.ID))
+	require.Equal(t, uint64(5000), balanceOfAt(milesAdmin, second.ID))
+	requireBalance(t, stub, user1, 2, 4000)
+
+	// The platform rewards the holders of the first snapshot with 101000 BUMN
+	err = submit(platformAdmin, func(ctx *mocks.TransactionContext) error {
+		return contract.Mint(ctx, platformAdmin, 1, 101000)
+	})
+	require.NoError(t, err)
+	var distribution *chaincode.Distribution
+	expiry := stub.TxTimestamp.Unix() + 3600
+	err = submit(platformAdmin, func(ctx *mocks.TransactionContext) error {
+		var err error
+		distribution, err = contract.DistributeRewards(ctx, first.ID, 1, 101000, expiry)
+		return err
+	})
+	require.NoError(t, err)
+	require.Equal(t, "RewardsDistributed", stub.LastEvent().EventName)
+	requireBalance(t, stub, platformAdmin, 1, 0)
+
+	claim := func(clientId string) (*chaincode.RewardClaim, error) {
+		var claim *chaincode.RewardClaim
+		err := submit(clientId, func(ctx *mocks.TransactionContext) error {
+			var err error
+			claim, err = contract.ClaimReward(ctx, distribution.ID)
+			return err
+		})
+		return claim, err
+	}
+	_, err = claim(milesAdmin)
+	require.EqualError(t, err, fmt.Sprintf("%v has no reward in distribution %v", milesAdmin, distribution.ID))
+
+	userClaim, err := claim(user1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1000), userClaim.Amount)
+	require.Equal(t, "RewardClaimed", stub.LastEvent().EventName)
+	_, err = claim(user1)
+	require.EqualError(t, err, fmt.Sprintf("%v already claimed distribution %v", user1, distribution.ID))
+
+	_, err = claim(livinAdmin)
+	require.NoError(t, err)
+	requireBalance(t, stub, user1, 1, 1000)
+	requireBalance(t, stub, livinAdmin, 1, 80000)
+
+	distribution, err = contract.GetDistribution(memoryContext(stub, myOrg1Msp, myOrg1Clientid), distribution.ID)
+	require.NoError(t, err)
+	require.Equal(t, uint64(81000), distribution.Claimed)
+
+	claims, err := contract.RewardClaimsOf(memoryContext(stub, myOrg1Msp, myOrg1Clientid), user1)
+	require.NoError(t, err)
+	require.Equal(t, []*chaincode.RewardClaim{userClaim}, claims)
+
+	// The share of the LP account stays in escrow until the distribution expires
+	reclaim := func(clientId string) error {
+		return submit(clientId, func(ctx *mocks.TransactionContext) error {
+			_, err := contract.ReclaimRewards(ctx, distribution.ID)
+			return err
+		})
+	}
+	err = reclaim(platformAdmin)
+	require.EqualError(t, err, fmt.Sprintf("distribution %v has not expired", distribution.ID))
+
+	stub.TxTimestamp = stub.TxTimestamp.Add(2 * time.Hour)
+	_, err = claim(milesAdmin)
+	require.EqualError(t, err, fmt.Sprintf("distribution %v expired at %v", distribution.ID, expiry))
+	err = reclaim(user1)
+	require.EqualError(t, err, fmt.Sprintf("%v is not the distributor of distribution %v", user1, distribution.ID))
+
+	err = reclaim(platformAdmin)
+	require.NoError(t, err)
+	require.Equal(t, "RewardsReclaimed", stub.LastEvent().EventName)
+	requireBalance(t, stub, platformAdmin, 1, 20000)
+	distribution, err = contract.GetDistribution(memoryContext(stub, myOrg1Msp, myOrg1Clientid), distribution.ID)
+	require.NoError(t, err)
+	require.Equal(t, uint64(20000), distribution.Reclaimed)
+
+	err = reclaim(platformAdmin)
+	require.EqualError(t, err, fmt.Sprintf("distribution %v has no unclaimed rewards", distribution.ID))
+}
+
+func TestAllowance(t *testing.T) {
+	stub, submit := prepPlatform(t)
+	contract := chaincode.SmartContract{}
+	const merchant = "merchant"
+	now := stub.TxTimestamp.Unix()
+	allowanceOf := func() uint64 {
+		allowance, err := contract.AllowanceOf(memoryContext(stub, myOrg1Msp, myOrg1Clientid), user1, merchant, 2)
+		require.NoError(t, err)
+		return allowance
+	}
+	transfer := func(amount uint64) error {
+		return submit(merchant, func(ctx *mocks.TransactionContext) error {
+			return contract.TransferFrom(ctx, user1, merchant, 2, amount)
+		})
+	}
+
+	require.EqualError(t, transfer(1), "caller is not owner nor is approved")
+
+	err := submit(user1, func(ctx *mocks.TransactionContext) error {
+		return contract.ApproveAmount(ctx, merchant, 2, 3000, now+3600)
+	})
+	require.NoError(t, err)
+	require.Equal(t, "ApprovalForID", stub.LastEvent().EventName)
+	require.Equal(t, uint64(3000), allowanceOf())
+
+	// Transfers consume the allowance of the token id only
+	require.NoError(t, transfer(1000))
+	require.Equal(t, uint64(2000), allowanceOf())
+	err = submit(merchant, func(ctx *mocks.TransactionContext) error {
+		return contract.BatchTransferFrom(ctx, user1, merchant, []uint64{2, 2}, []uint64{1500, 1000})
+	})
+	require.EqualError(t, err, "operator has insufficient allowance for token 2, needed: 2500, allowance: 2000")
+	err = submit(merchant, func(ctx *mocks.TransactionContext) error {
+		return contract.BatchTransferFrom(ctx, user1, merchant, []uint64{2, 2}, []uint64{1500, 500})
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), allowanceOf())
+	require.EqualError(t, transfer(1), "caller is not owner nor is approved")
+	requireBalance(t, stub, merchant, 2, 3000)
+	requireBalance(t, stub, user1, 2, 7000)
+
+	// Allowances expire
+	err = submit(user1, func(ctx *mocks.TransactionContext) error {
+		return contract.ApproveAmount(ctx, merchant, 2, 1000, now+3600)
+	})
+	require.NoError(t, err)
+	stub.TxTimestamp = stub.TxTimestamp.Add(time.Hour)
+	require.Equal(t, uint64(0), allowanceOf())
+	require.EqualError(t, transfer(1), "caller is not owner nor is approved")
+
+	// Operators approved for all tokens are not limited by allowances
+	err = submit(user1, func(ctx *mocks.TransactionContext) error {
+		return contract.SetApprovalForAll(ctx, merchant, true)
+	})
+	require.NoError(t, err)
+	require.NoError(t, transfer(5000))
+	requireBalance(t, stub, merchant, 2, 8000)
+}
+
+func TestContractAccountReceiver(t *testing.T) {
+	stub, submit := prepPlatform(t)
+	contract := chaincode.SmartContract{}
+	const escrow = "escrow"
+	var received [][]string
+	stub.RegisterChaincode("escrowcc", func(args [][]byte, channel string) peer.Response {
+		call := make([]string, len(args))
+		for i, arg := range args {
+			call[i] = string(arg)
+		}
+		received = append(received, call)
+		if call[0] == "OnERC1155BatchReceived" {
+			return shim.Success([]byte(chaincode.ERC1155BatchReceived))
+		}
+		return shim.Success([]byte(chaincode.ERC1155Received))
+	})
+	stub.RegisterChaincode("rejectcc", func(args [][]byte, channel string) peer.Response {
+		return shim.Error("livin is not accepted")
+	})
+	stub.RegisterChaincode("mutecc", func(args [][]byte, channel string) peer.Response {
+		return shim.Success(nil)
+	})
+	register := func(clientId string, account string, chaincodeName string) error {
+		return submit(clientId, func(ctx *mocks.TransactionContext) error {
+			_, err := contract.RegisterContractAccount(ctx, account, chaincodeName, "")
+			return err
+		})
+	}
+	transfer := func(recipient string, amount uint64) error {
+		return submit(user1, func(ctx *mocks.TransactionContext) error {
+			return contract.TransferFrom(ctx, user1, recipient, 2, amount)
+		})
+	}
+
+	require.EqualError(t, register(user1, escrow, "escrowcc"), "client is not authorized to mint new tokens")
+	require.NoError(t, register(platformAdmin, escrow, "escrowcc"))
+
+	// The receiver chaincode acknowledges single and batch transfers
+	require.NoError(t, transfer(escrow, 1000))
+	err := submit(user1, func(ctx *mocks.TransactionContext) error {
+		return contract.BatchTransferFrom(ctx, user1, escrow, []uint64{2, 2}, []uint64{100, 200})
+	})
+	require.NoError(t, err)
+	require.Equal(t, [][]string{
+		{"OnERC1155Received", user1, user1, "2", "1000"},
+		{"OnERC1155BatchReceived", user1, user1, "[2,2]", "[100,200]"},
+	}, received)
+	requireBalance(t, stub, escrow, 2, 1300)
+
+	// Rejected and unacknowledged transfers are aborted
+	require.NoError(t, register(platformAdmin, "vault", "rejectcc"))
+	require.EqualError(t, transfer("vault", 1000), "receiver vault rejected the transfer: livin is not accepted")
+	require.NoError(t, register(platformAdmin, "vault", "mutecc"))
+	err = submit(user1, func(ctx *mocks.TransactionContext) error {
+		return contract.BatchTransferFromMultiRecipient(ctx, user1, []string{milesAdmin, "vault"}, []uint64{2, 2}, []uint64{100, 100})
+	})
+	require.EqualError(t, err, "receiver vault did not acknowledge the transfer")
+	requireBalance(t, stub, "vault", 2, 0)
+	requireBalance(t, stub, user1, 2, 8700)
+
+	// Accounts that are no longer registered receive tokens without callback
+	err = submit(platformAdmin, func(ctx *mocks.TransactionContext) error {
+		return contract.UnregisterContractAccount(ctx, "vault")
+	})
+	require.NoError(t, err)
+	require.NoError(t, transfer("vault", 1000))
+	requireBalance(t, stub, "vault", 2, 1000)
+	require.Len(t, received, 2)
+
+	// Mints, swap outputs sent with ExchangeFrom and captured holds must be accepted as well
+	require.NoError(t, register(platformAdmin, "vault", "rejectcc"))
+	mint := func(recipient string) error {
+		return submit(livinAdmin, func(ctx *mocks.TransactionContext) error {
+			return contract.Mint(ctx, recipient, 2, 10)
+		})
+	}
+	require.EqualError(t, mint("vault"), "receiver vault rejected the transfer: livin is not accepted")
+	require.NoError(t, mint(escrow))
+
+	exchangeFrom := func(recipient string) (*chaincode.ExchangeResult, error) {
+		var result *chaincode.ExchangeResult
+		err := submit(user1, func(ctx *mocks.TransactionContext) error {
+			var err error
+			result, err = contract.ExchangeFrom(ctx, user1, recipient, 2, 1, 100)
+			return err
+		})
+		return result, err
+	}
+	_, err = exchangeFrom("vault")
+	require.EqualError(t, err, "receiver vault rejected the transfer: livin is not accepted")
+	requireBalance(t, stub, "vault", 1, 0)
+	result, err := exchangeFrom(escrow)
+	require.NoError(t, err)
+
+	var hold *chaincode.Hold
+	err = submit(user1, func(ctx *mocks.TransactionContext) error {
+		var err error
+		hold, err = contract.Hold(ctx, user1, 2, 500, milesAdmin, stub.TxTimestamp.Unix()+3600)
+		return err
+	})
+	require.NoError(t, err)
+	capture := func(recipient string) error {
+		return submit(milesAdmin, func(ctx *mocks.TransactionContext) error {
+			_, err := contract.Capture(ctx, hold.ID, recipient, 500)
+			return err
+		})
+	}
+	require.EqualError(t, capture("vault"), "receiver vault rejected the transfer: livin is not accepted")
+	require.NoError(t, capture(escrow))
+
+	require.Equal(t, [][]string{
+		{"OnERC1155Received", livinAdmin, "0x0", "2", "10"},
+		{"OnERC1155Received", user1, user1, "1", fmt.Sprint(result.ToTokenAmount)},
+		{"OnERC1155Received", milesAdmin, user1, "2", "500"},
+	}, received[2:])
+	requireBalance(t, stub, escrow, 1, result.ToTokenAmount)
+	requireBalance(t, stub, escrow, 2, 1810)
+}
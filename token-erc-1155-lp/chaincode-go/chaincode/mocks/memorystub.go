@@ -0,0 +1,649 @@
+package mocks
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	"github.com/hyperledger/fabric-protos-go/peer"
+)
+
+const compositeKeyNamespace = "\x00"
+const minUnicodeRuneValue = 0
+const maxUnicodeRuneValue = utf8.MaxRune
+
+// InvokeHandler answers InvokeChaincode calls made to a chaincode registered with RegisterChaincode
+type InvokeHandler func(args [][]byte, channel string) peer.Response
+
+// MemoryStub is a ChaincodeStubInterface backed by maps, for unit tests that run
+// several transactions against the same world state.
+//
+// Between MockTransactionStart and MockTransactionEnd the stub behaves like a peer:
+// writes go to a write set that reads do not see, the write set is applied at the end
+// of the transaction and only the last event set by the transaction is kept.
+// Outside of a transaction writes are applied immediately, which is handy to set up state.
+//
+// Rich queries are not supported, since they need CouchDB.
+type MemoryStub struct {
+	ChannelID   string
+	Args        [][]byte
+	Creator     []byte
+	Transient   map[string][]byte
+	TxTimestamp time.Time
+
+	// Events holds the events of the committed transactions, in order
+	Events []*peer.ChaincodeEvent
+
+	state       map[string][]byte
+	collections map[string]map[string][]byte
+	history     map[string][]*queryresult.KeyModification
+	validation  map[string][]byte
+	chaincodes  map[string]InvokeHandler
+
+	txID       string
+	writes     map[string]*[]byte
+	privWrites map[string]map[string]*[]byte
+	event      *peer.ChaincodeEvent
+}
+
+var _ shim.ChaincodeStubInterface = (*MemoryStub)(nil)
+
+// NewMemoryStub returns a MemoryStub with an empty world state on channel mychannel
+func NewMemoryStub() *MemoryStub {
+	return &MemoryStub{
+		ChannelID:   "mychannel",
+		TxTimestamp: time.Unix(1600000000, 0),
+		state:       make(map[string][]byte),
+		collections: make(map[string]map[string][]byte),
+		history:     make(map[string][]*queryresult.KeyModification),
+		validation:  make(map[string][]byte),
+		chaincodes:  make(map[string]InvokeHandler),
+	}
+}
+
+// MockTransactionStart starts transaction txID. Writes are buffered until MockTransactionEnd.
+func (stub *MemoryStub) MockTransactionStart(txID string) {
+	stub.txID = txID
+	stub.writes = make(map[string]*[]byte)
+	stub.privWrites = make(map[string]map[string]*[]byte)
+	stub.event = nil
+}
+
+// MockTransactionEnd commits the write set and the event of the current transaction
+func (stub *MemoryStub) MockTransactionEnd() {
+	for _, key := range sortedWriteKeys(stub.writes) {
+		stub.commitWrite(key, stub.writes[key])
+	}
+	for collection, writes := range stub.privWrites {
+		for key, value := range writes {
+			stub.commitPrivateWrite(collection, key, value)
+		}
+	}
+	if stub.event != nil {
+		stub.Events = append(stub.Events, stub.event)
+	}
+	stub.MockTransactionAbort()
+}
+
+// MockTransactionAbort discards the write set and the event of the current transaction
+func (stub *MemoryStub) MockTransactionAbort() {
+	stub.txID = ""
+	stub.writes = nil
+	stub.privWrites = nil
+	stub.event = nil
+}
+
+// MockTransaction runs fn as transaction txID. The transaction is committed if fn
+// succeeds and discarded otherwise, like an invalid transaction on a peer.
+func (stub *MemoryStub) MockTransaction(txID string, fn func() error) error {
+	stub.MockTransactionStart(txID)
+	err := fn()
+	if err != nil {
+		stub.MockTransactionAbort()
+		return err
+	}
+	stub.MockTransactionEnd()
+	return nil
+}
+
+// RegisterChaincode makes InvokeChaincode calls to name answered by handler
+func (stub *MemoryStub) RegisterChaincode(name string, handler InvokeHandler) {
+	stub.chaincodes[name] = handler
+}
+
+// LastEvent returns the event of the last committed transaction that set one, or nil
+func (stub *MemoryStub) LastEvent() *peer.ChaincodeEvent {
+	if len(stub.Events) == 0 {
+		return nil
+	}
+	return stub.Events[len(stub.Events)-1]
+}
+
+// Keys returns the keys of the committed world state, sorted
+func (stub *MemoryStub) Keys() []string {
+	keys := make([]string, 0, len(stub.state))
+	for key := range stub.state {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (stub *MemoryStub) inTransaction() bool {
+	return stub.writes != nil
+}
+
+func (stub *MemoryStub) commitWrite(key string, value *[]byte) {
+	modification := &queryresult.KeyModification{
+		TxId:      stub.txID,
+		Timestamp: stub.timestamp(),
+		IsDelete:  value == nil,
+	}
+	if value == nil {
+		delete(stub.state, key)
+	} else {
+		stub.state[key] = *value
+		modification.Value = *value
+	}
+	stub.history[key] = append(stub.history[key], modification)
+}
+
+func (stub *MemoryStub) commitPrivateWrite(collection string, key string, value *[]byte) {
+	if stub.collections[collection] == nil {
+		stub.collections[collection] = make(map[string][]byte)
+	}
+	if value == nil {
+		delete(stub.collections[collection], key)
+	} else {
+		stub.collections[collection][key] = *value
+	}
+}
+
+func (stub *MemoryStub) timestamp() *timestamp.Timestamp {
+	return &timestamp.Timestamp{Seconds: stub.TxTimestamp.Unix(), Nanos: int32(stub.TxTimestamp.Nanosecond())}
+}
+
+// GetArgs returns the arguments of the invocation set in Args
+func (stub *MemoryStub) GetArgs() [][]byte {
+	return stub.Args
+}
+
+// GetStringArgs returns the arguments of the invocation as strings
+func (stub *MemoryStub) GetStringArgs() []string {
+	args := make([]string, len(stub.Args))
+	for i, arg := range stub.Args {
+		args[i] = string(arg)
+	}
+	return args
+}
+
+// GetFunctionAndParameters returns the first argument as the function name and the rest as its parameters
+func (stub *MemoryStub) GetFunctionAndParameters() (string, []string) {
+	args := stub.GetStringArgs()
+	if len(args) == 0 {
+		return "", []string{}
+	}
+	return args[0], args[1:]
+}
+
+// GetArgsSlice returns the arguments of the invocation concatenated
+func (stub *MemoryStub) GetArgsSlice() ([]byte, error) {
+	var argsSlice []byte
+	for _, arg := range stub.Args {
+		argsSlice = append(argsSlice, arg...)
+	}
+	return argsSlice, nil
+}
+
+// GetTxID returns the id of the current transaction
+func (stub *MemoryStub) GetTxID() string {
+	return stub.txID
+}
+
+// GetChannelID returns ChannelID
+func (stub *MemoryStub) GetChannelID() string {
+	return stub.ChannelID
+}
+
+// InvokeChaincode calls the handler registered for chaincodeName
+func (stub *MemoryStub) InvokeChaincode(chaincodeName string, args [][]byte, channel string) peer.Response {
+	handler, ok := stub.chaincodes[chaincodeName]
+	if !ok {
+		return shim.Error(fmt.Sprintf("chaincode %s is not registered", chaincodeName))
+	}
+	if channel == "" {
+		channel = stub.ChannelID
+	}
+	return handler(args, channel)
+}
+
+// GetState returns the committed value of key
+func (stub *MemoryStub) GetState(key string) ([]byte, error) {
+	return stub.state[key], nil
+}
+
+// PutState writes value to key
+func (stub *MemoryStub) PutState(key string, value []byte) error {
+	if key == "" {
+		return fmt.Errorf("key must not be an empty string")
+	}
+	return stub.write(key, &value)
+}
+
+// DelState deletes key
+func (stub *MemoryStub) DelState(key string) error {
+	return stub.write(key, nil)
+}
+
+func (stub *MemoryStub) write(key string, value *[]byte) error {
+	if !stub.inTransaction() {
+		stub.commitWrite(key, value)
+		return nil
+	}
+	stub.writes[key] = value
+	return nil
+}
+
+// SetStateValidationParameter sets the key-level endorsement policy of key
+func (stub *MemoryStub) SetStateValidationParameter(key string, ep []byte) error {
+	stub.validation[key] = ep
+	return nil
+}
+
+// GetStateValidationParameter returns the key-level endorsement policy of key
+func (stub *MemoryStub) GetStateValidationParameter(key string) ([]byte, error) {
+	return stub.validation[key], nil
+}
+
+// GetStateByRange iterates over the committed simple keys from startKey (inclusive) to endKey (exclusive)
+func (stub *MemoryStub) GetStateByRange(startKey string, endKey string) (shim.StateQueryIteratorInterface, error) {
+	err := validateSimpleKeys(startKey, endKey)
+	if err != nil {
+		return nil, err
+	}
+	return newMemoryIterator(rangeOf(stub.state, simpleKeyRange(startKey, endKey))), nil
+}
+
+// GetStateByRangeWithPagination iterates over a page of GetStateByRange.
+// The bookmark is the key the next page starts from.
+func (stub *MemoryStub) GetStateByRangeWithPagination(startKey string, endKey string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+	err := validateSimpleKeys(startKey, endKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	results, metadata := paginate(rangeOf(stub.state, simpleKeyRange(startKey, endKey)), pageSize, bookmark)
+	return newMemoryIterator(results), metadata, nil
+}
+
+// GetStateByPartialCompositeKey iterates over the committed composite keys starting with objectType and attributes
+func (stub *MemoryStub) GetStateByPartialCompositeKey(objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	keyRange, err := partialCompositeKeyRange(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	return newMemoryIterator(rangeOf(stub.state, keyRange)), nil
+}
+
+// GetStateByPartialCompositeKeyWithPagination iterates over a page of GetStateByPartialCompositeKey.
+// The bookmark is the key the next page starts from.
+func (stub *MemoryStub) GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+	keyRange, err := partialCompositeKeyRange(objectType, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	results, metadata := paginate(rangeOf(stub.state, keyRange), pageSize, bookmark)
+	return newMemoryIterator(results), metadata, nil
+}
+
+// CreateCompositeKey combines objectType and attributes like the peer does
+func (stub *MemoryStub) CreateCompositeKey(objectType string, attributes []string) (string, error) {
+	return shim.CreateCompositeKey(objectType, attributes)
+}
+
+// SplitCompositeKey splits a key created by CreateCompositeKey
+func (stub *MemoryStub) SplitCompositeKey(compositeKey string) (string, []string, error) {
+	if !strings.HasPrefix(compositeKey, compositeKeyNamespace) {
+		return "", nil, fmt.Errorf("%q is not a composite key", compositeKey)
+	}
+
+	componentIndex := 1
+	components := []string{}
+	for i := 1; i < len(compositeKey); i++ {
+		if compositeKey[i] == minUnicodeRuneValue {
+			components = append(components, compositeKey[componentIndex:i])
+			componentIndex = i + 1
+		}
+	}
+	if len(components) == 0 {
+		return "", nil, fmt.Errorf("%q is not a composite key", compositeKey)
+	}
+	return components[0], components[1:], nil
+}
+
+// GetQueryResult is not supported, rich queries need CouchDB
+func (stub *MemoryStub) GetQueryResult(query string) (shim.StateQueryIteratorInterface, error) {
+	return nil, fmt.Errorf("rich queries are not supported by MemoryStub")
+}
+
+// GetQueryResultWithPagination is not supported, rich queries need CouchDB
+func (stub *MemoryStub) GetQueryResultWithPagination(query string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+	return nil, nil, fmt.Errorf("rich queries are not supported by MemoryStub")
+}
+
+// GetHistoryForKey iterates over the committed modifications of key, newest first
+func (stub *MemoryStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	modifications := stub.history[key]
+	newestFirst := make([]*queryresult.KeyModification, len(modifications))
+	for i, modification := range modifications {
+		newestFirst[len(modifications)-1-i] = modification
+	}
+	return &memoryHistoryIterator{modifications: newestFirst}, nil
+}
+
+// GetPrivateData returns the committed value of key in collection
+func (stub *MemoryStub) GetPrivateData(collection string, key string) ([]byte, error) {
+	return stub.collections[collection][key], nil
+}
+
+// GetPrivateDataHash returns the SHA-256 hash of the committed value of key in collection
+func (stub *MemoryStub) GetPrivateDataHash(collection string, key string) ([]byte, error) {
+	value := stub.collections[collection][key]
+	if value == nil {
+		return nil, nil
+	}
+	hash := sha256.Sum256(value)
+	return hash[:], nil
+}
+
+// PutPrivateData writes value to key in collection
+func (stub *MemoryStub) PutPrivateData(collection string, key string, value []byte) error {
+	if collection == "" {
+		return fmt.Errorf("collection must not be an empty string")
+	}
+	if key == "" {
+		return fmt.Errorf("key must not be an empty string")
+	}
+	return stub.writePrivate(collection, key, &value)
+}
+
+// DelPrivateData deletes key from collection
+func (stub *MemoryStub) DelPrivateData(collection string, key string) error {
+	if collection == "" {
+		return fmt.Errorf("collection must not be an empty string")
+	}
+	return stub.writePrivate(collection, key, nil)
+}
+
+func (stub *MemoryStub) writePrivate(collection string, key string, value *[]byte) error {
+	if !stub.inTransaction() {
+		stub.commitPrivateWrite(collection, key, value)
+		return nil
+	}
+	if stub.privWrites[collection] == nil {
+		stub.privWrites[collection] = make(map[string]*[]byte)
+	}
+	stub.privWrites[collection][key] = value
+	return nil
+}
+
+// SetPrivateDataValidationParameter sets the key-level endorsement policy of key in collection
+func (stub *MemoryStub) SetPrivateDataValidationParameter(collection string, key string, ep []byte) error {
+	stub.validation[collection+compositeKeyNamespace+key] = ep
+	return nil
+}
+
+// GetPrivateDataValidationParameter returns the key-level endorsement policy of key in collection
+func (stub *MemoryStub) GetPrivateDataValidationParameter(collection string, key string) ([]byte, error) {
+	return stub.validation[collection+compositeKeyNamespace+key], nil
+}
+
+// GetPrivateDataByRange iterates over the committed simple keys of collection from startKey (inclusive) to endKey (exclusive)
+func (stub *MemoryStub) GetPrivateDataByRange(collection string, startKey string, endKey string) (shim.StateQueryIteratorInterface, error) {
+	err := validateSimpleKeys(startKey, endKey)
+	if err != nil {
+		return nil, err
+	}
+	return newMemoryIterator(rangeOf(stub.collections[collection], simpleKeyRange(startKey, endKey))), nil
+}
+
+// GetPrivateDataByPartialCompositeKey iterates over the committed composite keys of collection starting with objectType and keys
+func (stub *MemoryStub) GetPrivateDataByPartialCompositeKey(collection string, objectType string, keys []string) (shim.StateQueryIteratorInterface, error) {
+	keyRange, err := partialCompositeKeyRange(objectType, keys)
+	if err != nil {
+		return nil, err
+	}
+	return newMemoryIterator(rangeOf(stub.collections[collection], keyRange)), nil
+}
+
+// GetPrivateDataQueryResult is not supported, rich queries need CouchDB
+func (stub *MemoryStub) GetPrivateDataQueryResult(collection string, query string) (shim.StateQueryIteratorInterface, error) {
+	return nil, fmt.Errorf("rich queries are not supported by MemoryStub")
+}
+
+// GetCreator returns Creator
+func (stub *MemoryStub) GetCreator() ([]byte, error) {
+	return stub.Creator, nil
+}
+
+// GetTransient returns Transient
+func (stub *MemoryStub) GetTransient() (map[string][]byte, error) {
+	return stub.Transient, nil
+}
+
+// GetBinding returns nil, proposals are not simulated
+func (stub *MemoryStub) GetBinding() ([]byte, error) {
+	return nil, nil
+}
+
+// GetDecorations returns nil, proposals are not simulated
+func (stub *MemoryStub) GetDecorations() map[string][]byte {
+	return nil
+}
+
+// GetSignedProposal returns nil, proposals are not simulated
+func (stub *MemoryStub) GetSignedProposal() (*peer.SignedProposal, error) {
+	return nil, nil
+}
+
+// GetTxTimestamp returns TxTimestamp
+func (stub *MemoryStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return stub.timestamp(), nil
+}
+
+// SetEvent sets the event of the current transaction, replacing any event set before
+func (stub *MemoryStub) SetEvent(name string, payload []byte) error {
+	if name == "" {
+		return fmt.Errorf("event name can not be empty string")
+	}
+	event := &peer.ChaincodeEvent{TxId: stub.txID, EventName: name, Payload: payload}
+	if !stub.inTransaction() {
+		stub.Events = append(stub.Events, event)
+		return nil
+	}
+	stub.event = event
+	return nil
+}
+
+// keyRange is the range of keys from start (inclusive) to end (exclusive). An empty end is unbounded.
+type keyRange struct {
+	start string
+	end   string
+}
+
+func (r keyRange) contains(key string) bool {
+	return key >= r.start && (r.end == "" || key < r.end)
+}
+
+// simpleKeyRange excludes the composite keys, which start with 0x00, like the peer does
+func simpleKeyRange(startKey string, endKey string) keyRange {
+	if startKey == "" {
+		startKey = "\x01"
+	}
+	if endKey == "" {
+		endKey = string(maxUnicodeRuneValue)
+	}
+	return keyRange{start: startKey, end: endKey}
+}
+
+func partialCompositeKeyRange(objectType string, attributes []string) (keyRange, error) {
+	partialCompositeKey, err := shim.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return keyRange{}, err
+	}
+	return keyRange{start: partialCompositeKey, end: partialCompositeKey + string(maxUnicodeRuneValue)}, nil
+}
+
+func validateSimpleKeys(simpleKeys ...string) error {
+	for _, key := range simpleKeys {
+		if len(key) > 0 && key[0] == compositeKeyNamespace[0] {
+			return fmt.Errorf(`first character of the key [%s] contains a null character which is not allowed`, key)
+		}
+	}
+	return nil
+}
+
+// rangeOf returns the entries of values within r, sorted by key
+func rangeOf(values map[string][]byte, r keyRange) []*queryresult.KV {
+	results := []*queryresult.KV{}
+	for key, value := range values {
+		if r.contains(key) {
+			results = append(results, &queryresult.KV{Key: key, Value: value})
+		}
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Key < results[j].Key })
+	return results
+}
+
+// paginate returns the page of results starting at bookmark
+func paginate(results []*queryresult.KV, pageSize int32, bookmark string) ([]*queryresult.KV, *peer.QueryResponseMetadata) {
+	start := 0
+	if bookmark != "" {
+		start = sort.Search(len(results), func(i int) bool { return results[i].Key >= bookmark })
+	}
+	end := len(results)
+	if pageSize > 0 && start+int(pageSize) < end {
+		end = start + int(pageSize)
+	}
+
+	metadata := &peer.QueryResponseMetadata{FetchedRecordsCount: int32(end - start)}
+	if end < len(results) {
+		metadata.Bookmark = results[end].Key
+	}
+	return results[start:end], metadata
+}
+
+func sortedWriteKeys(writes map[string]*[]byte) []string {
+	keys := make([]string, 0, len(writes))
+	for key := range writes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// memoryIterator iterates over a snapshot of query results
+type memoryIterator struct {
+	results []*queryresult.KV
+}
+
+func newMemoryIterator(results []*queryresult.KV) *memoryIterator {
+	return &memoryIterator{results: results}
+}
+
+// HasNext returns true if there are more results
+func (it *memoryIterator) HasNext() bool {
+	return len(it.results) > 0
+}
+
+// Next returns the next result
+func (it *memoryIterator) Next() (*queryresult.KV, error) {
+	if len(it.results) == 0 {
+		return nil, fmt.Errorf("iterator has no more results")
+	}
+	next := it.results[0]
+	it.results = it.results[1:]
+	return next, nil
+}
+
+// Close releases the results
+func (it *memoryIterator) Close() error {
+	it.results = nil
+	return nil
+}
+
+// memoryHistoryIterator iterates over a snapshot of key modifications
+type memoryHistoryIterator struct {
+	modifications []*queryresult.KeyModification
+}
+
+// HasNext returns true if there are more modifications
+func (it *memoryHistoryIterator) HasNext() bool {
+	return len(it.modifications) > 0
+}
+
+// Next returns the next modification
+func (it *memoryHistoryIterator) Next() (*queryresult.KeyModification, error) {
+	if len(it.modifications) == 0 {
+		return nil, fmt.Errorf("iterator has no more results")
+	}
+	next := it.modifications[0]
+	it.modifications = it.modifications[1:]
+	return next, nil
+}
+
+// Close releases the modifications
+func (it *memoryHistoryIterator) Close() error {
+	it.modifications = nil
+	return nil
+}
+
+// FakeClientIdentity is a cid.ClientIdentity with fixed values
+type FakeClientIdentity struct {
+	ID          string
+	MSPID       string
+	Attributes  map[string]string
+	Certificate *x509.Certificate
+}
+
+var _ cid.ClientIdentity = (*FakeClientIdentity)(nil)
+
+// GetID returns ID
+func (identity *FakeClientIdentity) GetID() (string, error) {
+	return identity.ID, nil
+}
+
+// GetMSPID returns MSPID
+func (identity *FakeClientIdentity) GetMSPID() (string, error) {
+	return identity.MSPID, nil
+}
+
+// GetAttributeValue returns the attribute attrName from Attributes
+func (identity *FakeClientIdentity) GetAttributeValue(attrName string) (string, bool, error) {
+	value, found := identity.Attributes[attrName]
+	return value, found, nil
+}
+
+// AssertAttributeValue checks that the attribute attrName from Attributes equals attrValue
+func (identity *FakeClientIdentity) AssertAttributeValue(attrName string, attrValue string) error {
+	value, found := identity.Attributes[attrName]
+	if !found {
+		return fmt.Errorf("attribute '%s' was not found", attrName)
+	}
+	if value != attrValue {
+		return fmt.Errorf("attribute '%s' equals '%s' instead of '%s'", attrName, value, attrValue)
+	}
+	return nil
+}
+
+// GetX509Certificate returns Certificate
+func (identity *FakeClientIdentity) GetX509Certificate() (*x509.Certificate, error) {
+	return identity.Certificate, nil
+}
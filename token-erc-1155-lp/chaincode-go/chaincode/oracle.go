@@ -0,0 +1,263 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const lpPricePrefix = "lpprice"
+
+const lpLastPricePrefix = "lplastprice"
+
+// PriceObservation records the exchange rate of an LP at Timestamp, seconds since the Unix epoch.
+// ExchangeRate is the rate in effect from Timestamp on, the number of PairTokenID per TokenID
+// scaled by RateScale. PriceCumulative is the sum of the rate of every second since the first
+// observation of the pool. It wraps around on overflow, like the time weighted prices of
+// on-chain oracles, so only differences between observations are meaningful.
+type PriceObservation struct {
+	TokenID         uint64 `json:"token_id"`
+	PairTokenID     uint64 `json:"pair_token_id"`
+	Timestamp       int64  `json:"timestamp"`
+	ExchangeRate    uint64 `json:"exchange_rate"`
+	PriceCumulative uint64 `json:"price_cumulative"`
+	TxID            string `json:"tx_id"`
+}
+
+// PriceObservationQueryResult structure used for returning paginated price observations
+type PriceObservationQueryResult struct {
+	Records             []*PriceObservation `json:"records"`
+	FetchedRecordsCount int32               `json:"fetchedRecordsCount"`
+	Bookmark            string              `json:"bookmark"`
+}
+
+// TWAPResult is the time weighted average price of TokenID in the platform token over the
+// Window seconds from Start to End. Price is the number of platform tokens per TokenID, scaled by RateScale.
+type TWAPResult struct {
+	TokenID uint64 `json:"token_id"`
+	Window  int64  `json:"window"`
+	Start   int64  `json:"start"`
+	End     int64  `json:"end"`
+	Price   uint64 `json:"price"`
+}
+
+// TWAP returns the time weighted average price of tokenId in the platform token over the last
+// window seconds, from the observations of the LP between tokenId and the platform token.
+// Observations are recorded when the pool is created, when it is traded through, when its
+// liquidity changes and when its rate changes. The window must not start before the first observation.
+// Other chaincodes can call it with InvokeChaincode.
+func (s *SmartContract) TWAP(ctx contractapi.TransactionContextInterface, tokenId uint64, window int64) (*TWAPResult, error) {
+	if window <= 0 {
+		return nil, fmt.Errorf("window must be a positive number of seconds")
+	}
+
+	lp, err := s.GetLPByTokenID(ctx, tokenId)
+	if err != nil {
+		return nil, err
+	}
+
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transaction timestamp: %v", err)
+	}
+
+	result := &TWAPResult{
+		TokenID: tokenId,
+		Window:  window,
+		Start:   txTimestamp.GetSeconds() - window,
+		End:     txTimestamp.GetSeconds(),
+	}
+
+	last, err := readLastPriceObservation(ctx, lp)
+	if err != nil {
+		return nil, err
+	}
+	if last == nil {
+		return nil, fmt.Errorf("lp of token id %v and %v has no price observations", lp.TokenID, lp.PairTokenID)
+	}
+
+	// The latest observation at or before the start of the window
+	var first *PriceObservation
+	err = forEachPriceObservation(ctx, lp, func(observation *PriceObservation) bool {
+		if observation.Timestamp > result.Start {
+			return false
+		}
+		first = observation
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if first == nil {
+		return nil, fmt.Errorf("window of %v seconds starts before the first price observation of lp of token id %v and %v", window, lp.TokenID, lp.PairTokenID)
+	}
+
+	// Differences of cumulative prices are exact modulo 2^64
+	endCumulative := last.cumulativeAt(result.End)
+	startCumulative := first.cumulativeAt(result.Start)
+	result.Price = (endCumulative - startCumulative) / uint64(window)
+
+	// Pools created with the platform token first price the platform token
+	if lp.TokenID != tokenId {
+		result.Price, err = mulDivDown(RateScale, RateScale, result.Price)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// PriceObservations returns a page of the price observations of the LP between tokenId and
+// the platform token, oldest first. Pass an empty bookmark to get the first page.
+func (s *SmartContract) PriceObservations(ctx contractapi.TransactionContextInterface, tokenId uint64, pageSize int32, bookmark string) (*PriceObservationQueryResult, error) {
+	lp, err := s.GetLPByTokenID(ctx, tokenId)
+	if err != nil {
+		return nil, err
+	}
+
+	pair := newTokenPair(lp.TokenID, lp.PairTokenID)
+	priceIterator, responseMetadata, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination(lpPricePrefix, []string{strconv.FormatUint(pair.A, 10), strconv.FormatUint(pair.B, 10)}, pageSize, bookmark)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state for prefix %v: %v", lpPricePrefix, err)
+	}
+	defer priceIterator.Close()
+
+	observations := []*PriceObservation{}
+	for priceIterator.HasNext() {
+		queryResponse, err := priceIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the next state for prefix %v: %v", lpPricePrefix, err)
+		}
+
+		var observation PriceObservation
+		err = json.Unmarshal(queryResponse.Value, &observation)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode price observation %v: %v", queryResponse.Key, err)
+		}
+		observations = append(observations, &observation)
+	}
+
+	return &PriceObservationQueryResult{
+		Records:             observations,
+		FetchedRecordsCount: responseMetadata.FetchedRecordsCount,
+		Bookmark:            responseMetadata.Bookmark,
+	}, nil
+}
+
+// observePrice records the exchange rate of lp as of the end of the transaction. The rate of
+// the previous observation is accumulated up to now, so it must be called at most once per
+// transaction and pool, after any rate change.
+func observePrice(ctx contractapi.TransactionContextInterface, lp *LiquidityPool) error {
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return fmt.Errorf("failed to get transaction timestamp: %v", err)
+	}
+
+	last, err := readLastPriceObservation(ctx, lp)
+	if err != nil {
+		return err
+	}
+
+	observation := &PriceObservation{
+		TokenID:      lp.TokenID,
+		PairTokenID:  lp.PairTokenID,
+		Timestamp:    txTimestamp.GetSeconds(),
+		ExchangeRate: lp.ExchangeRate,
+		TxID:         ctx.GetStub().GetTxID(),
+	}
+	if last != nil {
+		if observation.Timestamp < last.Timestamp {
+			observation.Timestamp = last.Timestamp
+		}
+		observation.PriceCumulative = last.cumulativeAt(observation.Timestamp)
+	}
+
+	observationJSON, err := json.Marshal(observation)
+	if err != nil {
+		return fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+
+	pair := newTokenPair(lp.TokenID, lp.PairTokenID)
+	attributes := []string{strconv.FormatUint(pair.A, 10), strconv.FormatUint(pair.B, 10)}
+
+	// The timestamp is zero padded so that the observations of a pool sort by time
+	observationKey, err := ctx.GetStub().CreateCompositeKey(lpPricePrefix, append(attributes, fmt.Sprintf("%020d", observation.Timestamp), observation.TxID))
+	if err != nil {
+		return fmt.Errorf("failed to create the composite key for prefix %s: %v", lpPricePrefix, err)
+	}
+	lastKey, err := ctx.GetStub().CreateCompositeKey(lpLastPricePrefix, attributes)
+	if err != nil {
+		return fmt.Errorf("failed to create the composite key for prefix %s: %v", lpLastPricePrefix, err)
+	}
+
+	for _, key := range []string{observationKey, lastKey} {
+		err = ctx.GetStub().PutState(key, observationJSON)
+		if err != nil {
+			return fmt.Errorf("failed to put state: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// cumulativeAt returns the cumulative price at timestamp, which must not be before the observation
+// and must not be after the next observation of the pool
+func (observation *PriceObservation) cumulativeAt(timestamp int64) uint64 {
+	return observation.PriceCumulative + observation.ExchangeRate*uint64(timestamp-observation.Timestamp)
+}
+
+func readLastPriceObservation(ctx contractapi.TransactionContextInterface, lp *LiquidityPool) (*PriceObservation, error) {
+	pair := newTokenPair(lp.TokenID, lp.PairTokenID)
+	lastKey, err := ctx.GetStub().CreateCompositeKey(lpLastPricePrefix, []string{strconv.FormatUint(pair.A, 10), strconv.FormatUint(pair.B, 10)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the composite key for prefix %s: %v", lpLastPricePrefix, err)
+	}
+
+	observationBytes, err := ctx.GetStub().GetState(lastKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the last price observation of lp of token id %v and %v from world state: %v", lp.TokenID, lp.PairTokenID, err)
+	}
+	if observationBytes == nil {
+		return nil, nil
+	}
+
+	var observation PriceObservation
+	err = json.Unmarshal(observationBytes, &observation)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the last price observation of lp of token id %v and %v: %v", lp.TokenID, lp.PairTokenID, err)
+	}
+
+	return &observation, nil
+}
+
+// forEachPriceObservation calls fn with the price observations of lp, oldest first, until fn returns false
+func forEachPriceObservation(ctx contractapi.TransactionContextInterface, lp *LiquidityPool, fn func(observation *PriceObservation) bool) error {
+	pair := newTokenPair(lp.TokenID, lp.PairTokenID)
+	priceIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(lpPricePrefix, []string{strconv.FormatUint(pair.A, 10), strconv.FormatUint(pair.B, 10)})
+	if err != nil {
+		return fmt.Errorf("failed to get state for prefix %v: %v", lpPricePrefix, err)
+	}
+	defer priceIterator.Close()
+
+	for priceIterator.HasNext() {
+		queryResponse, err := priceIterator.Next()
+		if err != nil {
+			return fmt.Errorf("failed to get the next state for prefix %v: %v", lpPricePrefix, err)
+		}
+
+		var observation PriceObservation
+		err = json.Unmarshal(queryResponse.Value, &observation)
+		if err != nil {
+			return fmt.Errorf("failed to decode price observation %v: %v", queryResponse.Key, err)
+		}
+
+		if !fn(&observation) {
+			return nil
+		}
+	}
+
+	return nil
+}
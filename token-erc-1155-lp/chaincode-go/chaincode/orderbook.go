@@ -0,0 +1,488 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const orderPrefix = "order"
+
+const orderBookPrefix = "orderbook"
+
+const orderOwnerPrefix = "orderowner"
+
+const orderEscrowPrefix = "orderescrow"
+
+// Order is a limit order selling SellTokenID for BuyTokenID. Price is the minimum number
+// of BuyTokenID per SellTokenID, scaled by RateScale. Remaining is the part of Amount
+// that has not been filled and is held in escrow. The order cannot be filled from
+// Expiry on, seconds since the Unix epoch, unless Expiry is 0.
+type Order struct {
+	ID          string `json:"id"`
+	Owner       string `json:"owner"`
+	SellTokenID uint64 `json:"sell_token_id"`
+	BuyTokenID  uint64 `json:"buy_token_id"`
+	Amount      uint64 `json:"amount"`
+	Remaining   uint64 `json:"remaining"`
+	Price       uint64 `json:"price"`
+	Expiry      int64  `json:"expiry"`
+	CreatedAt   int64  `json:"created_at"`
+}
+
+// OrderFill is the part of a resting order that was filled by a new order.
+// The maker sold SellAmount of SellTokenID and received BuyAmount of BuyTokenID at Price, the price of the maker order.
+type OrderFill struct {
+	OrderID     string `json:"order_id"`
+	Maker       string `json:"maker"`
+	SellTokenID uint64 `json:"sell_token_id"`
+	SellAmount  uint64 `json:"sell_amount"`
+	BuyTokenID  uint64 `json:"buy_token_id"`
+	BuyAmount   uint64 `json:"buy_amount"`
+	Price       uint64 `json:"price"`
+}
+
+// PlaceOrderResult is the order placed by PlaceOrder, after matching, and the fills of the resting orders it matched
+type PlaceOrderResult struct {
+	Order *Order      `json:"order"`
+	Fills []OrderFill `json:"fills"`
+}
+
+// OrderBook lists the open orders between TokenID and PairTokenID, best price first.
+// Sells are the orders selling TokenID and Buys are the orders selling PairTokenID.
+type OrderBook struct {
+	TokenID     uint64   `json:"token_id"`
+	PairTokenID uint64   `json:"pair_token_id"`
+	Sells       []*Order `json:"sells"`
+	Buys        []*Order `json:"buys"`
+}
+
+// OrderEvent is emitted as OrderPlaced when an order rests in the book without being filled,
+// as OrderFilled when it fills resting orders and as OrderCancelled when it is cancelled.
+// Order is the order after the transaction, Fills lists the resting orders it filled.
+type OrderEvent struct {
+	Operator string      `json:"operator"`
+	Order    *Order      `json:"order"`
+	Fills    []OrderFill `json:"fills,omitempty"`
+}
+
+// PlaceOrder sells amount of sellId for buyId at a price of at least price buyId per sellId,
+// scaled by RateScale. The order is first matched against the resting orders selling buyId for
+// sellId, best price first, at their price. Whatever is not filled rests in the book until it
+// is filled, cancelled or expires at expiry, seconds since the Unix epoch, or never if expiry is 0.
+// The tokens of a resting order are held in escrow. Expired orders met while matching are
+// removed and refunded. This function emits an OrderFilled or OrderPlaced event.
+func (s *SmartContract) PlaceOrder(ctx contractapi.TransactionContextInterface, sellId uint64, buyId uint64, amount uint64, price uint64, expiry int64) (*PlaceOrderResult, error) {
+
+	// Get ID of submitting client identity
+	ownerId, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client id: %v", err)
+	}
+
+	if sellId == buyId {
+		return nil, fmt.Errorf("cannot trade token id %v for itself", sellId)
+	}
+	for _, id := range []uint64{sellId, buyId} {
+		tokenName, err := s.GetTokenName(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if tokenName == "" {
+			return nil, fmt.Errorf("token with id %v does not exist", id)
+		}
+	}
+	err = requireTransferable(ctx, []uint64{sellId, buyId})
+	if err != nil {
+		return nil, err
+	}
+
+	if amount == 0 {
+		return nil, fmt.Errorf("order amount must be a positive integer")
+	}
+	if price == 0 {
+		return nil, fmt.Errorf("order price must be a positive integer")
+	}
+
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transaction timestamp: %v", err)
+	}
+	now := txTimestamp.GetSeconds()
+	if expiry != 0 && expiry <= now {
+		return nil, fmt.Errorf("order expiry %v is not in the future", expiry)
+	}
+
+	order := &Order{
+		ID:          ctx.GetStub().GetTxID(),
+		Owner:       ownerId,
+		SellTokenID: sellId,
+		BuyTokenID:  buyId,
+		Amount:      amount,
+		Remaining:   amount,
+		Price:       price,
+		Expiry:      expiry,
+		CreatedAt:   now,
+	}
+
+	fills, err := s.matchOrder(ctx, order, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if order.Remaining != 0 {
+		err = saveOrder(ctx, order)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	eventName := "OrderFilled"
+	if len(fills) == 0 {
+		eventName = "OrderPlaced"
+	}
+	err = emitEvent(ctx, eventName, OrderEvent{Operator: ownerId, Order: order, Fills: fills})
+	if err != nil {
+		return nil, err
+	}
+
+	return &PlaceOrderResult{Order: order, Fills: fills}, nil
+}
+
+// CancelOrder removes order orderId from the book and refunds its remaining tokens to its owner.
+// Only the owner can cancel an order, but anyone can cancel an expired order.
+// This function emits an OrderCancelled event.
+func (s *SmartContract) CancelOrder(ctx contractapi.TransactionContextInterface, orderId string) (*Order, error) {
+
+	// Get ID of submitting client identity
+	operatorId, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client id: %v", err)
+	}
+
+	order, err := s.GetOrder(ctx, orderId)
+	if err != nil {
+		return nil, err
+	}
+
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transaction timestamp: %v", err)
+	}
+	if operatorId != order.Owner && !order.expired(txTimestamp.GetSeconds()) {
+		return nil, fmt.Errorf("%v is not the owner of order %v", operatorId, orderId)
+	}
+
+	err = payFromAccount(ctx, orderEscrowAccount(order.SellTokenID), order.SellTokenID, map[string]uint64{order.Owner: order.Remaining})
+	if err != nil {
+		return nil, err
+	}
+
+	err = deleteOrder(ctx, order)
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitEvent(ctx, "OrderCancelled", OrderEvent{Operator: operatorId, Order: order})
+	if err != nil {
+		return nil, err
+	}
+
+	return order, nil
+}
+
+// GetOrder returns the open order orderId
+func (s *SmartContract) GetOrder(ctx contractapi.TransactionContextInterface, orderId string) (*Order, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(orderPrefix, []string{orderId})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the composite key for prefix %s: %v", orderPrefix, err)
+	}
+
+	orderBytes, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read order %v from world state: %v", orderId, err)
+	}
+	if orderBytes == nil {
+		return nil, fmt.Errorf("order %v does not exist", orderId)
+	}
+
+	var order Order
+	err = json.Unmarshal(orderBytes, &order)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode order %v: %v", orderId, err)
+	}
+
+	return &order, nil
+}
+
+// OrderBook returns the open orders between tokenA and tokenB that have not expired, best price first
+func (s *SmartContract) OrderBook(ctx contractapi.TransactionContextInterface, tokenA uint64, tokenB uint64) (*OrderBook, error) {
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transaction timestamp: %v", err)
+	}
+
+	book := &OrderBook{TokenID: tokenA, PairTokenID: tokenB, Sells: []*Order{}, Buys: []*Order{}}
+	for _, side := range []struct {
+		sellId uint64
+		buyId  uint64
+		orders *[]*Order
+	}{{tokenA, tokenB, &book.Sells}, {tokenB, tokenA, &book.Buys}} {
+		err = s.forEachOrder(ctx, side.sellId, side.buyId, func(order *Order) (bool, error) {
+			if !order.expired(txTimestamp.GetSeconds()) {
+				*side.orders = append(*side.orders, order)
+			}
+			return true, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return book, nil
+}
+
+// OrdersOf returns the open orders of account, including expired orders that have not been cancelled yet
+func (s *SmartContract) OrdersOf(ctx contractapi.TransactionContextInterface, account string) ([]*Order, error) {
+	orderIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(orderOwnerPrefix, []string{account})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state for prefix %v: %v", orderOwnerPrefix, err)
+	}
+	defer orderIterator.Close()
+
+	orders := []*Order{}
+	for orderIterator.HasNext() {
+		queryResponse, err := orderIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the next state for prefix %v: %v", orderOwnerPrefix, err)
+		}
+
+		order, err := s.GetOrder(ctx, string(queryResponse.Value))
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+
+	return orders, nil
+}
+
+// matchOrder fills order against the resting orders selling its buy token for its sell token, at
+// their price, while their price crosses the price of order. It moves the tokens of the fills,
+// escrows the remaining amount of order and updates the resting orders.
+func (s *SmartContract) matchOrder(ctx contractapi.TransactionContextInterface, order *Order, now int64) ([]OrderFill, error) {
+
+	// A resting order selling the buy token at makerPrice sell tokens per buy token crosses
+	// if order gets at least its price, that is if makerPrice * order.Price <= RateScale * RateScale
+	maxMakerPrice, err := mulDivDown(RateScale, RateScale, order.Price)
+	if err != nil {
+		return nil, err
+	}
+
+	// A transaction does not see its own writes, so every account is paid once in each token
+	sellPayouts := make(map[string]uint64)
+	buyPayouts := make(map[string]uint64)
+	fills := []OrderFill{}
+
+	err = s.forEachOrder(ctx, order.BuyTokenID, order.SellTokenID, func(maker *Order) (bool, error) {
+		if maker.Price > maxMakerPrice || order.Remaining == 0 {
+			return false, nil
+		}
+		if maker.Owner == order.Owner {
+			return true, nil
+		}
+
+		if maker.expired(now) {
+			var err error
+			buyPayouts[maker.Owner], err = add(buyPayouts[maker.Owner], maker.Remaining)
+			if err != nil {
+				return false, err
+			}
+			return true, deleteOrder(ctx, maker)
+		}
+
+		// The maker sells as much as the remaining sell tokens of order pay for, rounded down,
+		// and order pays for it at the maker price, rounded up, but never above its own price.
+		// When no whole amount meets both prices, matching stops and order rests in the book.
+		affordable, err := mulDivDown(order.Remaining, RateScale, maker.Price)
+		if err != nil {
+			return false, err
+		}
+		fillAmount := maker.Remaining
+		if affordable < fillAmount {
+			fillAmount = affordable
+		}
+		if fillAmount == 0 {
+			return false, nil
+		}
+		cost, err := mulDivUp(fillAmount, maker.Price, RateScale)
+		if err != nil {
+			return false, err
+		}
+		maxCost, err := mulDivDown(fillAmount, RateScale, order.Price)
+		if err != nil {
+			return false, err
+		}
+		if cost > maxCost {
+			return false, nil
+		}
+
+		order.Remaining -= cost
+		maker.Remaining -= fillAmount
+
+		sellPayouts[maker.Owner], err = add(sellPayouts[maker.Owner], cost)
+		if err != nil {
+			return false, err
+		}
+		buyPayouts[order.Owner], err = add(buyPayouts[order.Owner], fillAmount)
+		if err != nil {
+			return false, err
+		}
+
+		fills = append(fills, OrderFill{
+			OrderID:     maker.ID,
+			Maker:       maker.Owner,
+			SellTokenID: maker.SellTokenID,
+			SellAmount:  fillAmount,
+			BuyTokenID:  maker.BuyTokenID,
+			BuyAmount:   cost,
+			Price:       maker.Price,
+		})
+
+		if maker.Remaining == 0 {
+			return true, deleteOrder(ctx, maker)
+		}
+		return true, saveOrder(ctx, maker)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The sell tokens go to the makers and whatever is left of order into escrow
+	sellPayouts[orderEscrowAccount(order.SellTokenID)] = order.Remaining
+	err = payFromAccount(ctx, order.Owner, order.SellTokenID, sellPayouts)
+	if err != nil {
+		return nil, err
+	}
+
+	err = payFromAccount(ctx, orderEscrowAccount(order.BuyTokenID), order.BuyTokenID, buyPayouts)
+	if err != nil {
+		return nil, err
+	}
+
+	return fills, nil
+}
+
+// forEachOrder calls fn with the orders selling sellId for buyId, lowest price first and
+// oldest first at the same price, until fn returns false or an error
+func (s *SmartContract) forEachOrder(ctx contractapi.TransactionContextInterface, sellId uint64, buyId uint64, fn func(order *Order) (bool, error)) error {
+	bookIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(orderBookPrefix, []string{strconv.FormatUint(sellId, 10), strconv.FormatUint(buyId, 10)})
+	if err != nil {
+		return fmt.Errorf("failed to get state for prefix %v: %v", orderBookPrefix, err)
+	}
+	defer bookIterator.Close()
+
+	for bookIterator.HasNext() {
+		queryResponse, err := bookIterator.Next()
+		if err != nil {
+			return fmt.Errorf("failed to get the next state for prefix %v: %v", orderBookPrefix, err)
+		}
+
+		order, err := s.GetOrder(ctx, string(queryResponse.Value))
+		if err != nil {
+			return err
+		}
+
+		next, err := fn(order)
+		if err != nil {
+			return err
+		}
+		if !next {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// expired returns whether order can no longer be filled at time now
+func (order *Order) expired(now int64) bool {
+	return order.Expiry != 0 && order.Expiry <= now
+}
+
+// orderKeys returns the key of order, its key in the book and its key in the orders of its owner.
+// The price and the creation time are zero padded so that the book sorts by price, then by time.
+func orderKeys(ctx contractapi.TransactionContextInterface, order *Order) (string, string, string, error) {
+	orderKey, err := ctx.GetStub().CreateCompositeKey(orderPrefix, []string{order.ID})
+	if err != nil {
+		return "", "", "", fmt.Errorf("failed to create the composite key for prefix %s: %v", orderPrefix, err)
+	}
+
+	bookKey, err := ctx.GetStub().CreateCompositeKey(orderBookPrefix, []string{
+		strconv.FormatUint(order.SellTokenID, 10),
+		strconv.FormatUint(order.BuyTokenID, 10),
+		fmt.Sprintf("%020d", order.Price),
+		fmt.Sprintf("%020d", order.CreatedAt),
+		order.ID,
+	})
+	if err != nil {
+		return "", "", "", fmt.Errorf("failed to create the composite key for prefix %s: %v", orderBookPrefix, err)
+	}
+
+	ownerKey, err := ctx.GetStub().CreateCompositeKey(orderOwnerPrefix, []string{order.Owner, order.ID})
+	if err != nil {
+		return "", "", "", fmt.Errorf("failed to create the composite key for prefix %s: %v", orderOwnerPrefix, err)
+	}
+
+	return orderKey, bookKey, ownerKey, nil
+}
+
+func saveOrder(ctx contractapi.TransactionContextInterface, order *Order) error {
+	orderKey, bookKey, ownerKey, err := orderKeys(ctx, order)
+	if err != nil {
+		return err
+	}
+
+	orderJSON, err := json.Marshal(order)
+	if err != nil {
+		return fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(orderKey, orderJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put state: %v", err)
+	}
+	err = ctx.GetStub().PutState(bookKey, []byte(order.ID))
+	if err != nil {
+		return fmt.Errorf("failed to put state: %v", err)
+	}
+	err = ctx.GetStub().PutState(ownerKey, []byte(order.ID))
+	if err != nil {
+		return fmt.Errorf("failed to put state: %v", err)
+	}
+
+	return nil
+}
+
+func deleteOrder(ctx contractapi.TransactionContextInterface, order *Order) error {
+	orderKey, bookKey, ownerKey, err := orderKeys(ctx, order)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range []string{orderKey, bookKey, ownerKey} {
+		err = ctx.GetStub().DelState(key)
+		if err != nil {
+			return fmt.Errorf("failed to delete the state of %v: %v", key, err)
+		}
+	}
+
+	return nil
+}
+
+// orderEscrowAccount returns the account that holds the tokens of the open orders selling tokenId
+func orderEscrowAccount(tokenId uint64) string {
+	return orderEscrowPrefix + strconv.FormatUint(tokenId, 10)
+}
@@ -0,0 +1,140 @@
+package chaincode
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Transfer policies of a token id, set when the token is created.
+// Tokens of a non-transferable id, like membership badges, can only be minted and burned.
+// Tokens of a clawback id can be transferred and taken back by the creator of the id with Clawback.
+const (
+	TransferPolicyTransferable    = "transferable"
+	TransferPolicyNonTransferable = "non_transferable"
+	TransferPolicyClawback        = "clawback"
+)
+
+// Clawback MUST emit when the creator of a clawback token id takes tokens back from an account.
+// The tokens are moved from From to the creator To.
+type Clawback struct {
+	Operator string `json:"operator"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	ID       uint64 `json:"id"`
+	Value    uint64 `json:"value"`
+	Reason   string `json:"reason"`
+}
+
+// Clawback moves amount of id from account back to the caller, who must be the creator of id.
+// It is only allowed for token ids created with the clawback transfer policy. Held funds of
+// the account cannot be clawed back until they are released. Accounts of the contract itself,
+// like LP accounts and escrows, back pools, orders and rewards and cannot be clawed back from.
+// This function emits a Clawback event.
+func (s *SmartContract) Clawback(ctx contractapi.TransactionContextInterface, account string, id uint64, amount uint64, reason string) error {
+
+	// Get ID of submitting client identity
+	operator, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to get client id: %v", err)
+	}
+
+	creator, err := s.GetTokenCreator(ctx, id)
+	if err != nil {
+		return err
+	}
+	if operator != creator {
+		return fmt.Errorf("%v is not the creator of token id %v", operator, id)
+	}
+
+	policy, err := transferPolicy(ctx, id)
+	if err != nil {
+		return err
+	}
+	if policy != TransferPolicyClawback {
+		return fmt.Errorf("token id %v does not allow clawback", id)
+	}
+
+	if account == creator {
+		return fmt.Errorf("transfer to self")
+	}
+	if isContractOwnedAccount(account) {
+		return fmt.Errorf("cannot claw back from contract account %v", account)
+	}
+	if amount == 0 {
+		return fmt.Errorf("amount must be a positive integer")
+	}
+	if reason == "" {
+		return fmt.Errorf("reason must not be empty")
+	}
+
+	err = removeBalance(ctx, account, []uint64{id}, []uint64{amount})
+	if err != nil {
+		return err
+	}
+
+	err = addBalance(ctx, account, creator, id, amount)
+	if err != nil {
+		return err
+	}
+
+	clawbackEvent := Clawback{Operator: operator, From: account, To: creator, ID: id, Value: amount, Reason: reason}
+	return emitEvent(ctx, "Clawback", clawbackEvent)
+}
+
+// isContractOwnedAccount returns whether account is held by the contract on behalf of others
+func isContractOwnedAccount(account string) bool {
+	for _, prefix := range []string{lpTokenBalancePrefix, orderEscrowPrefix, rewardEscrowPrefix} {
+		if strings.HasPrefix(account, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// validTransferPolicy returns the policy to store for policy, the empty policy is transferable
+func validTransferPolicy(policy string) (string, error) {
+	switch policy {
+	case "":
+		return TransferPolicyTransferable, nil
+	case TransferPolicyTransferable, TransferPolicyNonTransferable, TransferPolicyClawback:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown transfer policy %q, expected %v, %v or %v", policy, TransferPolicyTransferable, TransferPolicyNonTransferable, TransferPolicyClawback)
+	}
+}
+
+// transferPolicy returns the transfer policy of id. Tokens created before transfer
+// policies existed, or without a registry entry, are transferable.
+func transferPolicy(ctx contractapi.TransactionContextInterface, id uint64) (string, error) {
+	tokenInfo, err := readTokenInfo(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	if tokenInfo == nil || tokenInfo.TransferPolicy == "" {
+		return TransferPolicyTransferable, nil
+	}
+	return tokenInfo.TransferPolicy, nil
+}
+
+// requireTransferable returns an error if any of ids cannot be transferred between accounts
+func requireTransferable(ctx contractapi.TransactionContextInterface, ids []uint64) error {
+	checked := make(map[uint64]bool)
+	for _, id := range ids {
+		if checked[id] {
+			continue
+		}
+		checked[id] = true
+
+		policy, err := transferPolicy(ctx, id)
+		if err != nil {
+			return err
+		}
+		if policy == TransferPolicyNonTransferable {
+			return fmt.Errorf("token id %v is not transferable", id)
+		}
+	}
+
+	return nil
+}
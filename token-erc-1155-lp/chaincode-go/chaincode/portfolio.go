@@ -0,0 +1,103 @@
+package chaincode
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// PortfolioEntry is the balance of an account in one token id
+type PortfolioEntry struct {
+	TokenID   uint64 `json:"token_id"`
+	TokenName string `json:"token_name"`
+	Balance   uint64 `json:"balance"`
+}
+
+// PortfolioQueryResult structure used for returning a paginated portfolio.
+// Bookmark is opaque and has to be passed unchanged to get the next page.
+type PortfolioQueryResult struct {
+	Records             []*PortfolioEntry `json:"records"`
+	FetchedRecordsCount int32             `json:"fetchedRecordsCount"`
+	Bookmark            string            `json:"bookmark"`
+}
+
+// PortfolioOf returns the balance of account in every token id it holds. Pass an empty bookmark to get the first page.
+// The page size counts balance fragments, so a page may hold fewer token ids than pageSize.
+// Every token id is listed once, with its full balance, even if its fragments span several pages.
+func (s *SmartContract) PortfolioOf(ctx contractapi.TransactionContextInterface, account string, pageSize int32, bookmark string) (*PortfolioQueryResult, error) {
+
+	if account == "0x0" {
+		return nil, fmt.Errorf("balance query for the zero address")
+	}
+
+	// The bookmark is the last token id of the previous page followed by the bookmark of the fragment query.
+	// The fragments of that token id at the start of this page were already counted on the previous page.
+	lastIdString := ""
+	fragmentBookmark := ""
+	if bookmark != "" {
+		bookmarkParts := strings.SplitN(bookmark, "~", 2)
+		if len(bookmarkParts) != 2 {
+			return nil, fmt.Errorf("invalid bookmark %v", bookmark)
+		}
+		lastIdString, fragmentBookmark = bookmarkParts[0], bookmarkParts[1]
+	}
+
+	balanceIterator, responseMetadata, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination(balancePrefix, []string{account}, pageSize, fragmentBookmark)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state for prefix %v: %v", balancePrefix, err)
+	}
+	defer balanceIterator.Close()
+
+	entries := []*PortfolioEntry{}
+	for balanceIterator.HasNext() {
+		queryResponse, err := balanceIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the next state for prefix %v: %v", balancePrefix, err)
+		}
+
+		_, compositeKeyParts, err := ctx.GetStub().SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		// Fragments of a token id are adjacent, so a token id has been listed if it is the last one seen
+		idString := compositeKeyParts[1]
+		if idString == lastIdString {
+			continue
+		}
+		lastIdString = idString
+
+		id, err := strconv.ParseUint(idString, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		balance, err := balanceOfHelper(ctx, account, id)
+		if err != nil {
+			return nil, err
+		}
+		if balance == 0 {
+			continue
+		}
+
+		tokenName, err := s.GetTokenName(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, &PortfolioEntry{TokenID: id, TokenName: tokenName, Balance: balance})
+	}
+
+	nextBookmark := ""
+	if responseMetadata.Bookmark != "" {
+		nextBookmark = lastIdString + "~" + responseMetadata.Bookmark
+	}
+
+	return &PortfolioQueryResult{
+		Records:             entries,
+		FetchedRecordsCount: responseMetadata.FetchedRecordsCount,
+		Bookmark:            nextBookmark,
+	}, nil
+}
@@ -0,0 +1,66 @@
+package pricing
+
+import "fmt"
+
+// FeeConfig configures the fee a pool charges on every swap.
+// The fee is SwapFeeBps of the gross output, or the SwapFeeBps of the highest tier
+// whose MinAmount the gross output reaches, but never less than the minimum fee.
+// ProviderShareBps of every fee goes to the liquidity provider, the rest to the platform.
+type FeeConfig struct {
+	SwapFeeBps       uint64
+	Tiers            []FeeTier
+	ProviderShareBps uint64
+}
+
+// FeeTier applies SwapFeeBps to swaps whose gross output is at least MinAmount of the output token.
+// Tiers are expected in increasing order of MinAmount.
+type FeeTier struct {
+	MinAmount  uint64
+	SwapFeeBps uint64
+}
+
+// Validate checks that every fee rate and share is within BasisPoints
+func (config *FeeConfig) Validate() error {
+	if config.SwapFeeBps >= BasisPoints {
+		return fmt.Errorf("swap fee must be less than %v basis points", BasisPoints)
+	}
+	if config.ProviderShareBps > BasisPoints {
+		return fmt.Errorf("provider share must not exceed %v basis points", BasisPoints)
+	}
+	for _, tier := range config.Tiers {
+		if tier.SwapFeeBps >= BasisPoints {
+			return fmt.Errorf("swap fee of tier %v must be less than %v basis points", tier.MinAmount, BasisPoints)
+		}
+	}
+	return nil
+}
+
+// FeeBps returns the swap fee rate that applies to a gross output of grossAmount
+func (config *FeeConfig) FeeBps(grossAmount uint64) uint64 {
+	feeBps := config.SwapFeeBps
+	for _, tier := range config.Tiers {
+		if grossAmount >= tier.MinAmount {
+			feeBps = tier.SwapFeeBps
+		}
+	}
+	return feeBps
+}
+
+// Fee returns the platform and provider shares of the fee charged on grossAmount.
+// minimumFee is in the output token. The fee is rounded up, the provider share down.
+func (config *FeeConfig) Fee(grossAmount uint64, minimumFee uint64) (uint64, uint64, error) {
+	fee, err := MulDivUp(grossAmount, config.FeeBps(grossAmount), BasisPoints)
+	if err != nil {
+		return 0, 0, err
+	}
+	if fee < minimumFee {
+		fee = minimumFee
+	}
+
+	providerFee, err := MulDivDown(fee, config.ProviderShareBps, BasisPoints)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return fee - providerFee, providerFee, nil
+}
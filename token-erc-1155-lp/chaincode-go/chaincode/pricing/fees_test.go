@@ -0,0 +1,44 @@
+package pricing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFeeConfigFee(t *testing.T) {
+	config := &FeeConfig{
+		SwapFeeBps: 30,
+		Tiers: []FeeTier{
+			{MinAmount: 100000, SwapFeeBps: 20},
+			{MinAmount: 1000000, SwapFeeBps: 10},
+		},
+		ProviderShareBps: 2500,
+	}
+	require.NoError(t, config.Validate())
+
+	tests := []struct {
+		grossAmount uint64
+		minimumFee  uint64
+		platformFee uint64
+		providerFee uint64
+		description string
+	}{
+		{10000, 5, 23, 7, "base rate of 0.3%"},
+		{1000, 5, 4, 1, "flat minimum"},
+		{1001, 1, 3, 1, "percentage is rounded up"},
+		{100000, 5, 150, 50, "first tier"},
+		{2000000, 5, 1500, 500, "second tier"},
+	}
+
+	for _, tt := range tests {
+		platformFee, providerFee, err := config.Fee(tt.grossAmount, tt.minimumFee)
+		require.NoError(t, err, tt.description)
+		require.Equal(t, tt.platformFee, platformFee, tt.description)
+		require.Equal(t, tt.providerFee, providerFee, tt.description)
+	}
+
+	require.Error(t, (&FeeConfig{SwapFeeBps: BasisPoints}).Validate())
+	require.Error(t, (&FeeConfig{ProviderShareBps: BasisPoints + 1}).Validate())
+	require.Error(t, (&FeeConfig{Tiers: []FeeTier{{SwapFeeBps: BasisPoints}}}).Validate())
+}
@@ -0,0 +1,58 @@
+package pricing
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// RateScale is the fixed-point scale of exchange rates. A rate of 10 platform
+// tokens per pool token is stored as 10 * RateScale.
+const RateScale uint64 = 100000000
+
+// BasisPoints is the denominator of fee rates and fee shares
+const BasisPoints uint64 = 10000
+
+// Add returns a + b, or an error if the sum overflows uint64
+func Add(a uint64, b uint64) (uint64, error) {
+	if a > math.MaxUint64-b {
+		return 0, fmt.Errorf("math: addition overflow occurred %d + %d", a, b)
+	}
+	return a + b, nil
+}
+
+// Sub returns a - b, or an error if b is greater than a
+func Sub(a uint64, b uint64) (uint64, error) {
+	if b > a {
+		return 0, fmt.Errorf("math: subtraction underflow occurred %d - %d", a, b)
+	}
+	return a - b, nil
+}
+
+// MulDivDown returns floor(a * b / d). Amounts paid out of a pool are rounded down.
+func MulDivDown(a uint64, b uint64, d uint64) (uint64, error) {
+	return mulDiv(a, b, d, false)
+}
+
+// MulDivUp returns ceil(a * b / d). Amounts charged by a pool are rounded up.
+func MulDivUp(a uint64, b uint64, d uint64) (uint64, error) {
+	return mulDiv(a, b, d, true)
+}
+
+func mulDiv(a uint64, b uint64, d uint64, roundUp bool) (uint64, error) {
+	if d == 0 {
+		return 0, fmt.Errorf("math: division by zero")
+	}
+
+	product := new(big.Int).Mul(new(big.Int).SetUint64(a), new(big.Int).SetUint64(b))
+	quotient, remainder := new(big.Int).QuoRem(product, new(big.Int).SetUint64(d), new(big.Int))
+	if roundUp && remainder.Sign() > 0 {
+		quotient.Add(quotient, big.NewInt(1))
+	}
+
+	if !quotient.IsUint64() {
+		return 0, fmt.Errorf("math: multiplication overflow occurred %d * %d / %d", a, b, d)
+	}
+
+	return quotient.Uint64(), nil
+}
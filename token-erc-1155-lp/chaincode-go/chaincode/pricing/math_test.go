@@ -0,0 +1,43 @@
+package pricing
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMulDivRounding(t *testing.T) {
+	tests := []struct {
+		a, b, d  uint64
+		down, up uint64
+	}{
+		{3000, 10 * RateScale, RateScale, 30000, 30000},
+		{3000, RateScale, 10 * RateScale, 300, 300},
+		{1000, RateScale, 3 * RateScale, 333, 334},
+		{1, RateScale / 2, RateScale, 0, 1},
+		{math.MaxUint64, RateScale, RateScale, math.MaxUint64, math.MaxUint64},
+	}
+
+	for _, tt := range tests {
+		down, err := MulDivDown(tt.a, tt.b, tt.d)
+		require.NoError(t, err)
+		require.Equal(t, tt.down, down)
+
+		up, err := MulDivUp(tt.a, tt.b, tt.d)
+		require.NoError(t, err)
+		require.Equal(t, tt.up, up)
+	}
+
+	_, err := MulDivDown(math.MaxUint64, 2, 1)
+	require.Error(t, err)
+
+	_, err = MulDivDown(1, 1, 0)
+	require.Error(t, err)
+
+	_, err = Add(math.MaxUint64, 1)
+	require.Error(t, err)
+
+	_, err = Sub(1, 2)
+	require.Error(t, err)
+}
@@ -0,0 +1,121 @@
+// Package pricing computes the quotes, fees and reserve updates of the liquidity pools.
+// It has no dependency on Fabric, so that the chaincode and off-chain tools price swaps identically.
+package pricing
+
+import "fmt"
+
+// Pool holds the reserves of a liquidity pool between TokenID and PairTokenID.
+// ExchangeRate is the number of PairTokenID per TokenID, scaled by RateScale.
+type Pool struct {
+	TokenID          uint64
+	PairTokenID      uint64
+	TokenReserve     uint64
+	PairTokenReserve uint64
+	ExchangeRate     uint64
+}
+
+// Quote is the result of swapping FromTokenAmount of FromTokenID through a pool.
+// ToTokenAmount is what the swapper receives after the fees, which are charged in ToTokenID.
+// ExchangeRate is the number of ToTokenID per FromTokenID of the pool, scaled by RateScale.
+type Quote struct {
+	FromTokenID     uint64
+	FromTokenAmount uint64
+	ToTokenID       uint64
+	ToTokenAmount   uint64
+	ExchangeRate    uint64
+	PlatformFee     uint64
+	ProviderFee     uint64
+}
+
+// Swap computes the swap of amount of fromTokenId through pool and updates its reserves.
+// The fee of config is charged in the token received from the pool, minimumFee is in that token.
+// The amount paid out by the pool is rounded down and the fee is rounded up, so that rounding
+// never takes value out of the pool. The reserves are left unchanged if an error is returned.
+func (pool *Pool) Swap(config *FeeConfig, fromTokenId uint64, amount uint64, minimumFee uint64) (*Quote, error) {
+	quote := &Quote{
+		FromTokenID:     fromTokenId,
+		FromTokenAmount: amount,
+	}
+
+	var grossExchangeAmount uint64
+	var tokenReserve, pairTokenReserve uint64
+	var err error
+
+	switch fromTokenId {
+	case pool.TokenID:
+		// Token -> Pair token
+		quote.ToTokenID = pool.PairTokenID
+		quote.ExchangeRate = pool.ExchangeRate
+
+		grossExchangeAmount, err = MulDivDown(amount, pool.ExchangeRate, RateScale)
+		if err != nil {
+			return nil, err
+		}
+
+		tokenReserve, err = Add(pool.TokenReserve, amount)
+		if err != nil {
+			return nil, err
+		}
+		pairTokenReserve, err = Sub(pool.PairTokenReserve, grossExchangeAmount)
+		if err != nil {
+			return nil, fmt.Errorf("lp of token id %v and %v has insufficient liquidity of token id %v: %v", pool.TokenID, pool.PairTokenID, quote.ToTokenID, err)
+		}
+	case pool.PairTokenID:
+		// Pair token -> Token
+		quote.ToTokenID = pool.TokenID
+
+		quote.ExchangeRate, err = MulDivDown(RateScale, RateScale, pool.ExchangeRate)
+		if err != nil {
+			return nil, err
+		}
+
+		grossExchangeAmount, err = MulDivDown(amount, RateScale, pool.ExchangeRate)
+		if err != nil {
+			return nil, err
+		}
+
+		pairTokenReserve, err = Add(pool.PairTokenReserve, amount)
+		if err != nil {
+			return nil, err
+		}
+		tokenReserve, err = Sub(pool.TokenReserve, grossExchangeAmount)
+		if err != nil {
+			return nil, fmt.Errorf("lp of token id %v and %v has insufficient liquidity of token id %v: %v", pool.TokenID, pool.PairTokenID, quote.ToTokenID, err)
+		}
+	default:
+		return nil, fmt.Errorf("lp of token id %v and %v cannot exchange token id %v", pool.TokenID, pool.PairTokenID, fromTokenId)
+	}
+
+	quote.PlatformFee, quote.ProviderFee, err = config.Fee(grossExchangeAmount, minimumFee)
+	if err != nil {
+		return nil, err
+	}
+	fee := quote.PlatformFee + quote.ProviderFee
+
+	// Check if amount covers the fee
+	if grossExchangeAmount < fee {
+		return nil, fmt.Errorf(
+			"amount %v of tokenId %v to exchange does not cover fee %v of tokenId %v",
+			amount, fromTokenId, fee, quote.ToTokenID,
+		)
+	}
+	quote.ToTokenAmount = grossExchangeAmount - fee
+
+	pool.TokenReserve = tokenReserve
+	pool.PairTokenReserve = pairTokenReserve
+
+	return quote, nil
+}
+
+// Convert returns the value of amount of the other token of pool in tokenId at the
+// exchange rate of pool, rounded up
+func (pool *Pool) Convert(amount uint64, tokenId uint64) (uint64, error) {
+	switch tokenId {
+	case pool.TokenID:
+		return MulDivUp(amount, RateScale, pool.ExchangeRate)
+	case pool.PairTokenID:
+		return MulDivUp(amount, pool.ExchangeRate, RateScale)
+	default:
+		return 0, fmt.Errorf("lp of token id %v and %v cannot price token id %v", pool.TokenID, pool.PairTokenID, tokenId)
+	}
+}
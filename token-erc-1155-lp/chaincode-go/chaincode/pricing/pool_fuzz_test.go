@@ -0,0 +1,70 @@
+//go:build go1.18
+// +build go1.18
+
+package pricing
+
+import (
+	"testing"
+)
+
+// FuzzSwap checks that a swap never takes value out of a pool: the pool receives the input,
+// pays out no more than the input is worth at its exchange rate, and the fee is part of the payout.
+func FuzzSwap(f *testing.F) {
+	f.Add(uint64(200000), uint64(2000000), 10*RateScale, true, uint64(3000), uint64(30), uint64(2500), uint64(1000))
+	f.Add(uint64(202700), uint64(1973005), 10*RateScale, false, uint64(3005), uint64(0), uint64(0), uint64(100))
+	f.Add(uint64(1), uint64(1), uint64(1), true, uint64(1), uint64(9999), uint64(10000), uint64(0))
+
+	f.Fuzz(func(t *testing.T, tokenReserve uint64, pairTokenReserve uint64, exchangeRate uint64, fromToken bool, amount uint64, swapFeeBps uint64, providerShareBps uint64, minimumFee uint64) {
+		if exchangeRate == 0 {
+			t.Skip()
+		}
+
+		config := &FeeConfig{SwapFeeBps: swapFeeBps % BasisPoints, ProviderShareBps: providerShareBps % (BasisPoints + 1)}
+		pool := Pool{TokenID: 2, PairTokenID: 1, TokenReserve: tokenReserve, PairTokenReserve: pairTokenReserve, ExchangeRate: exchangeRate}
+		before := pool
+
+		fromTokenId := pool.PairTokenID
+		if fromToken {
+			fromTokenId = pool.TokenID
+		}
+
+		quote, err := pool.Swap(config, fromTokenId, amount, minimumFee)
+		if err != nil {
+			if pool != before {
+				t.Fatalf("reserves changed by a failed swap: %+v -> %+v", before, pool)
+			}
+			return
+		}
+
+		fee := quote.PlatformFee + quote.ProviderFee
+		gross := quote.ToTokenAmount + fee
+		if fee < minimumFee {
+			t.Fatalf("fee %v is below the minimum fee %v", fee, minimumFee)
+		}
+
+		var inputReserveBefore, inputReserveAfter, outputReserveBefore, outputReserveAfter uint64
+		var maximumGross uint64
+		if fromToken {
+			inputReserveBefore, inputReserveAfter = before.TokenReserve, pool.TokenReserve
+			outputReserveBefore, outputReserveAfter = before.PairTokenReserve, pool.PairTokenReserve
+			maximumGross, err = MulDivDown(amount, exchangeRate, RateScale)
+		} else {
+			inputReserveBefore, inputReserveAfter = before.PairTokenReserve, pool.PairTokenReserve
+			outputReserveBefore, outputReserveAfter = before.TokenReserve, pool.TokenReserve
+			maximumGross, err = MulDivDown(amount, RateScale, exchangeRate)
+		}
+		if err != nil {
+			t.Fatalf("swap succeeded although its gross amount overflows: %v", err)
+		}
+
+		if inputReserveAfter-inputReserveBefore != amount {
+			t.Fatalf("input reserve grew by %v instead of %v", inputReserveAfter-inputReserveBefore, amount)
+		}
+		if outputReserveBefore-outputReserveAfter != gross {
+			t.Fatalf("output reserve shrank by %v instead of the gross amount %v", outputReserveBefore-outputReserveAfter, gross)
+		}
+		if gross > maximumGross {
+			t.Fatalf("pool paid %v for an input worth %v", gross, maximumGross)
+		}
+	})
+}
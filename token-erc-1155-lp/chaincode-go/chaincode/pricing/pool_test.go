@@ -0,0 +1,102 @@
+package pricing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSwap(t *testing.T) {
+	// The flat platform fee of 1000 platform tokens, all of which goes to the platform
+	flatFee := &FeeConfig{}
+
+	tests := []struct {
+		description      string
+		pool             Pool
+		config           *FeeConfig
+		fromTokenId      uint64
+		amount           uint64
+		minimumFee       uint64
+		toTokenAmount    uint64
+		platformFee      uint64
+		providerFee      uint64
+		tokenReserve     uint64
+		pairTokenReserve uint64
+		err              string
+	}{
+		{
+			description: "1 Livin = 10 BUMN, Livin to BUMN",
+			pool:        Pool{TokenID: 2, PairTokenID: 1, TokenReserve: 200000, PairTokenReserve: 2000000, ExchangeRate: 10 * RateScale},
+			config:      flatFee, fromTokenId: 2, amount: 3000, minimumFee: 1000,
+			toTokenAmount: 29000, platformFee: 1000, tokenReserve: 203000, pairTokenReserve: 1970000,
+		},
+		{
+			description: "1 Livin = 10 BUMN, BUMN to Livin rounds the output down",
+			pool:        Pool{TokenID: 2, PairTokenID: 1, TokenReserve: 203000, PairTokenReserve: 1970000, ExchangeRate: 10 * RateScale},
+			config:      flatFee, fromTokenId: 1, amount: 3005, minimumFee: 100,
+			toTokenAmount: 200, platformFee: 100, tokenReserve: 202700, pairTokenReserve: 1973005,
+		},
+		{
+			description: "percentage fee split with the provider",
+			pool:        Pool{TokenID: 3, PairTokenID: 1, TokenReserve: 150000, PairTokenReserve: 3000000, ExchangeRate: 200 * RateScale},
+			config:      &FeeConfig{SwapFeeBps: 30, ProviderShareBps: 5000}, fromTokenId: 1, amount: 30000, minimumFee: 0,
+			toTokenAmount: 149, platformFee: 1, providerFee: 0, tokenReserve: 149850, pairTokenReserve: 3030000,
+		},
+		{
+			description: "amount does not cover the fee",
+			pool:        Pool{TokenID: 2, PairTokenID: 1, TokenReserve: 200000, PairTokenReserve: 2000000, ExchangeRate: 10 * RateScale},
+			config:      flatFee, fromTokenId: 2, amount: 99, minimumFee: 1000,
+			err: "amount 99 of tokenId 2 to exchange does not cover fee 1000 of tokenId 1",
+		},
+		{
+			description: "insufficient liquidity",
+			pool:        Pool{TokenID: 2, PairTokenID: 1, TokenReserve: 200000, PairTokenReserve: 2000000, ExchangeRate: 10 * RateScale},
+			config:      flatFee, fromTokenId: 2, amount: 1000000,
+			err: "lp of token id 2 and 1 has insufficient liquidity of token id 1: math: subtraction underflow occurred 2000000 - 10000000",
+		},
+		{
+			description: "token outside the pool",
+			pool:        Pool{TokenID: 2, PairTokenID: 1, TokenReserve: 200000, PairTokenReserve: 2000000, ExchangeRate: 10 * RateScale},
+			config:      flatFee, fromTokenId: 3, amount: 1000,
+			err: "lp of token id 2 and 1 cannot exchange token id 3",
+		},
+	}
+
+	for _, tt := range tests {
+		pool := tt.pool
+		quote, err := pool.Swap(tt.config, tt.fromTokenId, tt.amount, tt.minimumFee)
+		if tt.err != "" {
+			require.EqualError(t, err, tt.err, tt.description)
+			require.Equal(t, tt.pool, pool, tt.description)
+			continue
+		}
+
+		require.NoError(t, err, tt.description)
+		require.Equal(t, tt.toTokenAmount, quote.ToTokenAmount, tt.description)
+		require.Equal(t, tt.platformFee, quote.PlatformFee, tt.description)
+		require.Equal(t, tt.providerFee, quote.ProviderFee, tt.description)
+		require.Equal(t, tt.tokenReserve, pool.TokenReserve, tt.description)
+		require.Equal(t, tt.pairTokenReserve, pool.PairTokenReserve, tt.description)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	pool := &Pool{TokenID: 3, PairTokenID: 1, ExchangeRate: 200 * RateScale}
+
+	// 1000 platform tokens are worth 5 MilesPoin
+	amount, err := pool.Convert(1000, 3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), amount)
+
+	// Rounded up
+	amount, err = pool.Convert(1001, 3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), amount)
+
+	amount, err = pool.Convert(5, 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1000), amount)
+
+	_, err = pool.Convert(5, 2)
+	require.Error(t, err)
+}
@@ -0,0 +1,270 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const lpRatePrefix = "lprate"
+
+// rateChangeTimelock is the number of seconds between the proposal of a rate change and
+// the earliest time it can be applied, which leaves the platform time to veto it
+const rateChangeTimelock = 2 * secondsPerDay
+
+// RateChange is a proposed exchange rate of an LP. It can be applied from EffectiveAt on,
+// seconds since the Unix epoch, unless the platform vetoes it first.
+type RateChange struct {
+	ExchangeRate uint64 `json:"exchange_rate"`
+	ProposedBy   string `json:"proposed_by"`
+	ProposedAt   int64  `json:"proposed_at"`
+	EffectiveAt  int64  `json:"effective_at"`
+	TxID         string `json:"tx_id"`
+}
+
+// RateRecord is an exchange rate that was applied to the LP of TokenID and PairTokenID.
+// AppliedAt is the timestamp of transaction TxID in seconds since the Unix epoch.
+type RateRecord struct {
+	TokenID      uint64 `json:"token_id"`
+	PairTokenID  uint64 `json:"pair_token_id"`
+	ExchangeRate uint64 `json:"exchange_rate"`
+	AppliedAt    int64  `json:"applied_at"`
+	TxID         string `json:"tx_id"`
+}
+
+// RateChanged is emitted as RateChangeProposed, RateChangeApplied and RateChangeVetoed.
+// ExchangeRate is the proposed rate and PreviousRate the rate of the pool when the event was emitted.
+type RateChanged struct {
+	Operator     string `json:"operator"`
+	TokenID      uint64 `json:"token_id"`
+	PairTokenID  uint64 `json:"pair_token_id"`
+	ExchangeRate uint64 `json:"exchange_rate"`
+	PreviousRate uint64 `json:"previous_rate"`
+	EffectiveAt  int64  `json:"effective_at"`
+}
+
+// ProposeRateChange proposes exchangeRate as the new rate of the LP between tokenA and tokenB.
+// exchangeRate is the number of PairTokenID per TokenID of the pool, scaled by RateScale.
+// Only the creator of the LP can propose a rate. The rate can be applied with ApplyRateChange
+// once rateChangeTimelock has passed, a new proposal replaces the pending one and restarts the timelock.
+// This function emits a RateChangeProposed event.
+func (s *SmartContract) ProposeRateChange(ctx contractapi.TransactionContextInterface, tokenA uint64, tokenB uint64, exchangeRate uint64) (*LiquidityPool, error) {
+
+	// Get ID of submitting client identity
+	proposerId, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client id: %v", err)
+	}
+
+	lp, err := s.GetLP(ctx, tokenA, tokenB)
+	if err != nil {
+		return nil, err
+	}
+
+	if proposerId != lp.CreatorID {
+		return nil, fmt.Errorf("%v is not the liquidity provider of lp of token id %v and %v", proposerId, lp.TokenID, lp.PairTokenID)
+	}
+
+	if exchangeRate == 0 {
+		return nil, fmt.Errorf("exchange rate must be a positive integer")
+	}
+
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transaction timestamp: %v", err)
+	}
+
+	lp.PendingRate = &RateChange{
+		ExchangeRate: exchangeRate,
+		ProposedBy:   proposerId,
+		ProposedAt:   txTimestamp.GetSeconds(),
+		EffectiveAt:  txTimestamp.GetSeconds() + rateChangeTimelock,
+		TxID:         ctx.GetStub().GetTxID(),
+	}
+
+	err = s.saveLPState(ctx, lp)
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitRateChanged(ctx, "RateChangeProposed", proposerId, lp, lp.PendingRate)
+	if err != nil {
+		return nil, err
+	}
+
+	return lp, nil
+}
+
+// ApplyRateChange sets the exchange rate of the LP between tokenA and tokenB to its pending
+// rate once the timelock of the proposal has passed. Anyone can apply a due rate change.
+// This function emits a RateChangeApplied event.
+func (s *SmartContract) ApplyRateChange(ctx contractapi.TransactionContextInterface, tokenA uint64, tokenB uint64) (*LiquidityPool, error) {
+
+	// Get ID of submitting client identity
+	operatorId, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client id: %v", err)
+	}
+
+	lp, err := s.GetLP(ctx, tokenA, tokenB)
+	if err != nil {
+		return nil, err
+	}
+
+	pendingRate := lp.PendingRate
+	if pendingRate == nil {
+		return nil, fmt.Errorf("lp of token id %v and %v has no pending rate change", lp.TokenID, lp.PairTokenID)
+	}
+
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transaction timestamp: %v", err)
+	}
+	if txTimestamp.GetSeconds() < pendingRate.EffectiveAt {
+		return nil, fmt.Errorf("rate change of lp of token id %v and %v cannot be applied before %v", lp.TokenID, lp.PairTokenID, pendingRate.EffectiveAt)
+	}
+
+	err = emitRateChanged(ctx, "RateChangeApplied", operatorId, lp, pendingRate)
+	if err != nil {
+		return nil, err
+	}
+
+	lp.ExchangeRate = pendingRate.ExchangeRate
+	lp.PendingRate = nil
+
+	err = s.saveLPState(ctx, lp)
+	if err != nil {
+		return nil, err
+	}
+
+	err = recordRate(ctx, lp)
+	if err != nil {
+		return nil, err
+	}
+
+	err = observePrice(ctx, lp)
+	if err != nil {
+		return nil, err
+	}
+
+	return lp, nil
+}
+
+// VetoRateChange discards the pending rate change of the LP between tokenA and tokenB.
+// Only the creator of the platform token can veto a rate change. This function emits a RateChangeVetoed event.
+func (s *SmartContract) VetoRateChange(ctx contractapi.TransactionContextInterface, tokenA uint64, tokenB uint64) (*LiquidityPool, error) {
+
+	// Get ID of submitting client identity
+	operatorId, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client id: %v", err)
+	}
+
+	lp, err := s.GetLP(ctx, tokenA, tokenB)
+	if err != nil {
+		return nil, err
+	}
+
+	platformId, err := s.platformID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if operatorId != platformId {
+		return nil, fmt.Errorf("%v is not the platform and cannot veto rate changes", operatorId)
+	}
+
+	pendingRate := lp.PendingRate
+	if pendingRate == nil {
+		return nil, fmt.Errorf("lp of token id %v and %v has no pending rate change", lp.TokenID, lp.PairTokenID)
+	}
+	lp.PendingRate = nil
+
+	err = s.saveLPState(ctx, lp)
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitRateChanged(ctx, "RateChangeVetoed", operatorId, lp, pendingRate)
+	if err != nil {
+		return nil, err
+	}
+
+	return lp, nil
+}
+
+// RateHistory returns every exchange rate applied to the LPs of tokenId, ordered by pool and then by time.
+// The first record of a pool is the rate it was created with.
+func (s *SmartContract) RateHistory(ctx contractapi.TransactionContextInterface, tokenId uint64) ([]*RateRecord, error) {
+	rateIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(lpRatePrefix, []string{strconv.FormatUint(tokenId, 10)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state for prefix %v: %v", lpRatePrefix, err)
+	}
+	defer rateIterator.Close()
+
+	records := []*RateRecord{}
+	for rateIterator.HasNext() {
+		queryResponse, err := rateIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the next state for prefix %v: %v", lpRatePrefix, err)
+		}
+
+		var record RateRecord
+		err = json.Unmarshal(queryResponse.Value, &record)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode rate record %v: %v", queryResponse.Key, err)
+		}
+		records = append(records, &record)
+	}
+
+	return records, nil
+}
+
+// recordRate adds the current exchange rate of lp to the rate history of both its tokens
+func recordRate(ctx contractapi.TransactionContextInterface, lp *LiquidityPool) error {
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return fmt.Errorf("failed to get transaction timestamp: %v", err)
+	}
+
+	record := RateRecord{
+		TokenID:      lp.TokenID,
+		PairTokenID:  lp.PairTokenID,
+		ExchangeRate: lp.ExchangeRate,
+		AppliedAt:    txTimestamp.GetSeconds(),
+		TxID:         ctx.GetStub().GetTxID(),
+	}
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+
+	// The timestamp is zero padded so that the records of a pool sort by time
+	appliedAt := fmt.Sprintf("%020d", record.AppliedAt)
+	for _, tokens := range [][2]uint64{{lp.TokenID, lp.PairTokenID}, {lp.PairTokenID, lp.TokenID}} {
+		key, err := ctx.GetStub().CreateCompositeKey(lpRatePrefix, []string{strconv.FormatUint(tokens[0], 10), strconv.FormatUint(tokens[1], 10), appliedAt, record.TxID})
+		if err != nil {
+			return fmt.Errorf("failed to create the composite key for prefix %s: %v", lpRatePrefix, err)
+		}
+
+		err = ctx.GetStub().PutState(key, recordJSON)
+		if err != nil {
+			return fmt.Errorf("failed to put state: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func emitRateChanged(ctx contractapi.TransactionContextInterface, eventName string, operatorId string, lp *LiquidityPool, rateChange *RateChange) error {
+	rateEvent := RateChanged{
+		Operator:     operatorId,
+		TokenID:      lp.TokenID,
+		PairTokenID:  lp.PairTokenID,
+		ExchangeRate: rateChange.ExchangeRate,
+		PreviousRate: lp.ExchangeRate,
+		EffectiveAt:  rateChange.EffectiveAt,
+	}
+	return emitEvent(ctx, eventName, rateEvent)
+}
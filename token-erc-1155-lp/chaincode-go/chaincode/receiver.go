@@ -0,0 +1,233 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const contractAccountPrefix = "contractaccount"
+
+// Acknowledgements that receiver chaincodes return from OnERC1155Received and OnERC1155BatchReceived
+// to accept a transfer. They are the function selectors of the ERC-1155 receiver interface.
+const (
+	ERC1155Received      = "0xf23a6e61"
+	ERC1155BatchReceived = "0xbc197c81"
+)
+
+// ContractAccount is an account that belongs to a chaincode. Transfers, mints, swap outputs
+// sent with ExchangeFrom and captured holds are only credited to the account if ChaincodeName
+// acknowledges them, see TransferFrom and BatchTransferFrom.
+// Channel is the channel of the chaincode, empty for the channel of this chaincode.
+type ContractAccount struct {
+	Account       string `json:"account"`
+	ChaincodeName string `json:"chaincode_name"`
+	Channel       string `json:"channel"`
+	RegisteredBy  string `json:"registered_by"`
+}
+
+// RegisterContractAccount registers account as a contract account whose transfers are acknowledged by
+// chaincodeName on channel. It can be called by the account itself or by the minter organization,
+// which registers accounts that are not client identities, like escrow accounts of other contracts.
+func (s *SmartContract) RegisterContractAccount(ctx contractapi.TransactionContextInterface, account string, chaincodeName string, channel string) (*ContractAccount, error) {
+	operator, err := authorizeContractAccount(ctx, account)
+	if err != nil {
+		return nil, err
+	}
+
+	if account == "" || account == "0x0" {
+		return nil, fmt.Errorf("contract account must not be the zero address")
+	}
+	if chaincodeName == "" {
+		return nil, fmt.Errorf("chaincode name must not be empty")
+	}
+
+	contractAccount := &ContractAccount{
+		Account:       account,
+		ChaincodeName: chaincodeName,
+		Channel:       channel,
+		RegisteredBy:  operator,
+	}
+
+	contractAccountKey, err := ctx.GetStub().CreateCompositeKey(contractAccountPrefix, []string{account})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the composite key for prefix %s: %v", contractAccountPrefix, err)
+	}
+	contractAccountJSON, err := json.Marshal(contractAccount)
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+	err = ctx.GetStub().PutState(contractAccountKey, contractAccountJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to put state: %v", err)
+	}
+
+	return contractAccount, nil
+}
+
+// UnregisterContractAccount turns account back into a plain account. It can be called by the
+// account itself or by the minter organization.
+func (s *SmartContract) UnregisterContractAccount(ctx contractapi.TransactionContextInterface, account string) error {
+	_, err := authorizeContractAccount(ctx, account)
+	if err != nil {
+		return err
+	}
+
+	contractAccount, err := readContractAccount(ctx, account)
+	if err != nil {
+		return err
+	}
+	if contractAccount == nil {
+		return fmt.Errorf("%v is not a contract account", account)
+	}
+
+	contractAccountKey, err := ctx.GetStub().CreateCompositeKey(contractAccountPrefix, []string{account})
+	if err != nil {
+		return fmt.Errorf("failed to create the composite key for prefix %s: %v", contractAccountPrefix, err)
+	}
+	err = ctx.GetStub().DelState(contractAccountKey)
+	if err != nil {
+		return fmt.Errorf("failed to delete the state of %v: %v", contractAccountKey, err)
+	}
+
+	return nil
+}
+
+// GetContractAccount returns the registration of contract account account
+func (s *SmartContract) GetContractAccount(ctx contractapi.TransactionContextInterface, account string) (*ContractAccount, error) {
+	contractAccount, err := readContractAccount(ctx, account)
+	if err != nil {
+		return nil, err
+	}
+	if contractAccount == nil {
+		return nil, fmt.Errorf("%v is not a contract account", account)
+	}
+
+	return contractAccount, nil
+}
+
+// authorizeContractAccount returns the caller if it is account or a member of the minter organization
+func authorizeContractAccount(ctx contractapi.TransactionContextInterface, account string) (string, error) {
+
+	// Get ID of submitting client identity
+	operator, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return "", fmt.Errorf("failed to get client id: %v", err)
+	}
+
+	if operator != account {
+		err = authorizationHelper(ctx)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return operator, nil
+}
+
+// readContractAccount returns the registration of account, or nil if it is not a contract account
+func readContractAccount(ctx contractapi.TransactionContextInterface, account string) (*ContractAccount, error) {
+	contractAccountKey, err := ctx.GetStub().CreateCompositeKey(contractAccountPrefix, []string{account})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the composite key for prefix %s: %v", contractAccountPrefix, err)
+	}
+
+	contractAccountBytes, err := ctx.GetStub().GetState(contractAccountKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read contract account %v from world state: %v", account, err)
+	}
+	if contractAccountBytes == nil {
+		return nil, nil
+	}
+
+	var contractAccount ContractAccount
+	err = json.Unmarshal(contractAccountBytes, &contractAccount)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode contract account %v: %v", account, err)
+	}
+
+	return &contractAccount, nil
+}
+
+// checkOnERC1155Received calls OnERC1155Received(operator, from, id, value) of the chaincode of
+// recipient if it is a contract account, and returns an error unless it acknowledges the transfer
+func checkOnERC1155Received(ctx contractapi.TransactionContextInterface, operator string, from string, recipient string, id uint64, value uint64) error {
+	args := [][]byte{
+		[]byte("OnERC1155Received"),
+		[]byte(operator),
+		[]byte(from),
+		[]byte(strconv.FormatUint(id, 10)),
+		[]byte(strconv.FormatUint(value, 10)),
+	}
+	return invokeReceiver(ctx, recipient, args, ERC1155Received)
+}
+
+// checkOnERC1155BatchReceived calls OnERC1155BatchReceived(operator, from, ids, values) of the chaincode
+// of recipient if it is a contract account, and returns an error unless it acknowledges the transfer.
+// ids and values are passed as JSON arrays.
+func checkOnERC1155BatchReceived(ctx contractapi.TransactionContextInterface, operator string, from string, recipient string, ids []uint64, values []uint64) error {
+	idsJSON, err := json.Marshal(ids)
+	if err != nil {
+		return fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+	valuesJSON, err := json.Marshal(values)
+	if err != nil {
+		return fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+
+	args := [][]byte{
+		[]byte("OnERC1155BatchReceived"),
+		[]byte(operator),
+		[]byte(from),
+		idsJSON,
+		valuesJSON,
+	}
+	return invokeReceiver(ctx, recipient, args, ERC1155BatchReceived)
+}
+
+// checkMultiRecipientReceived calls OnERC1155BatchReceived of every recipient that is a contract
+// account with the ids and values sent to it, in the order of the first transfer to each recipient
+func checkMultiRecipientReceived(ctx contractapi.TransactionContextInterface, operator string, from string, recipients []string, ids []uint64, values []uint64) error {
+	var order []string
+	recipientIds := make(map[string][]uint64)
+	recipientValues := make(map[string][]uint64)
+	for i, recipient := range recipients {
+		if _, ok := recipientIds[recipient]; !ok {
+			order = append(order, recipient)
+		}
+		recipientIds[recipient] = append(recipientIds[recipient], ids[i])
+		recipientValues[recipient] = append(recipientValues[recipient], values[i])
+	}
+
+	for _, recipient := range order {
+		err := checkOnERC1155BatchReceived(ctx, operator, from, recipient, recipientIds[recipient], recipientValues[recipient])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func invokeReceiver(ctx contractapi.TransactionContextInterface, recipient string, args [][]byte, acknowledgement string) error {
+	contractAccount, err := readContractAccount(ctx, recipient)
+	if err != nil {
+		return err
+	}
+	if contractAccount == nil {
+		return nil
+	}
+
+	response := ctx.GetStub().InvokeChaincode(contractAccount.ChaincodeName, args, contractAccount.Channel)
+	if response.GetStatus() != shim.OK {
+		return fmt.Errorf("receiver %v rejected the transfer: %v", recipient, response.GetMessage())
+	}
+	if string(response.GetPayload()) != acknowledgement {
+		return fmt.Errorf("receiver %v did not acknowledge the transfer", recipient)
+	}
+
+	return nil
+}
@@ -0,0 +1,404 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const tokenInfoPrefix = "tokenId~info"
+
+const lastTokenIdKey = "lastTokenId"
+
+const tokenSupplyPrefix = "tokenId~supply"
+
+// TokenInfo describes a registered token id.
+// CreatedAt is the timestamp of the CreateToken transaction in seconds since the Unix epoch,
+// Supply is the amount that has been minted and not burned.
+// The entry is written once when the token id is registered. Creator and Supply change later,
+// they are stored under keys of their own and filled in when the entry is read, so that minting
+// and burning do not conflict with the transfers that read the entry.
+// Minting is refused once Supply would exceed MaxSupply, unless MaxSupply is 0.
+// TransferPolicy is one of the TransferPolicy constants, empty for tokens created before policies existed.
+type TokenInfo struct {
+	ID             uint64 `json:"id"`
+	Name           string `json:"name"`
+	Symbol         string `json:"symbol"`
+	Creator        string `json:"creator"`
+	CreatedAt      int64  `json:"created_at"`
+	Supply         uint64 `json:"supply"`
+	MaxSupply      uint64 `json:"max_supply"`
+	TransferPolicy string `json:"transfer_policy,omitempty"`
+}
+
+// TokenQueryResult structure used for returning paginated token infos
+type TokenQueryResult struct {
+	Records             []*TokenInfo `json:"records"`
+	FetchedRecordsCount int32        `json:"fetchedRecordsCount"`
+	Bookmark            string       `json:"bookmark"`
+}
+
+// TokenOwnershipTransferred MUST emit when the creator of a token id, who is allowed to mint it, changes
+type TokenOwnershipTransferred struct {
+	ID            uint64 `json:"id"`
+	PreviousOwner string `json:"previous_owner"`
+	NewOwner      string `json:"new_owner"`
+}
+
+// GetTokenInfo returns the registry entry of token id
+func (s *SmartContract) GetTokenInfo(ctx contractapi.TransactionContextInterface, id uint64) (*TokenInfo, error) {
+	tokenInfo, err := readTokenInfo(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if tokenInfo == nil {
+		return nil, fmt.Errorf("token with id %v is not registered", id)
+	}
+
+	err = s.fillTokenInfo(ctx, tokenInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	return tokenInfo, nil
+}
+
+// ListTokens returns a page of registered tokens. Pass an empty bookmark to get the first page.
+func (s *SmartContract) ListTokens(ctx contractapi.TransactionContextInterface, pageSize int32, bookmark string) (*TokenQueryResult, error) {
+	tokenIterator, responseMetadata, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination(tokenInfoPrefix, []string{}, pageSize, bookmark)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state for prefix %v: %v", tokenInfoPrefix, err)
+	}
+	defer tokenIterator.Close()
+
+	tokenInfos := []*TokenInfo{}
+	for tokenIterator.HasNext() {
+		queryResponse, err := tokenIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the next state for prefix %v: %v", tokenInfoPrefix, err)
+		}
+
+		var tokenInfo TokenInfo
+		err = json.Unmarshal(queryResponse.Value, &tokenInfo)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode token info %v: %v", queryResponse.Key, err)
+		}
+		err = s.fillTokenInfo(ctx, &tokenInfo)
+		if err != nil {
+			return nil, err
+		}
+		tokenInfos = append(tokenInfos, &tokenInfo)
+	}
+
+	return &TokenQueryResult{
+		Records:             tokenInfos,
+		FetchedRecordsCount: responseMetadata.FetchedRecordsCount,
+		Bookmark:            responseMetadata.Bookmark,
+	}, nil
+}
+
+// TransferTokenOwnership makes newOwner the creator of token id, who is allowed to mint it.
+// Only the current creator can transfer the ownership.
+// This function emits a TokenOwnershipTransferred event.
+func (s *SmartContract) TransferTokenOwnership(ctx contractapi.TransactionContextInterface, id uint64, newOwner string) error {
+	err := s.AuthorizedToMint(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if newOwner == "" || newOwner == "0x0" {
+		return fmt.Errorf("transfer ownership to the zero address")
+	}
+
+	tokenInfo, err := s.GetTokenInfo(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	creatorKey, err := ctx.GetStub().CreateCompositeKey(creatorPrefix, []string{strconv.FormatUint(id, 10)})
+	if err != nil {
+		return fmt.Errorf("failed to create the composite key for prefix %s: %v", creatorPrefix, err)
+	}
+
+	err = ctx.GetStub().PutState(creatorKey, []byte(newOwner))
+	if err != nil {
+		return err
+	}
+
+	ownershipEvent := TokenOwnershipTransferred{id, tokenInfo.Creator, newOwner}
+
+	return emitEvent(ctx, "TokenOwnershipTransferred", ownershipEvent)
+}
+
+// MigrateTokenRegistry creates the registry entries of token ids that were created before
+// the registry existed. Their supply is the sum of all balances of the token id and their
+// symbol is empty. It returns the number of token ids that were registered.
+func (s *SmartContract) MigrateTokenRegistry(ctx contractapi.TransactionContextInterface) (int, error) {
+
+	// Check minter authorization - this sample assumes Org1 is the central banker with privilege to migrate state
+	err := authorizationHelper(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// Sum the balances of every token id
+	supplies := make(map[uint64]uint64)
+
+	balanceIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(balancePrefix, []string{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get state for prefix %v: %v", balancePrefix, err)
+	}
+	defer balanceIterator.Close()
+
+	for balanceIterator.HasNext() {
+		queryResponse, err := balanceIterator.Next()
+		if err != nil {
+			return 0, fmt.Errorf("failed to get the next state for prefix %v: %v", balancePrefix, err)
+		}
+
+		_, compositeKeyParts, err := ctx.GetStub().SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return 0, err
+		}
+		id, err := strconv.ParseUint(compositeKeyParts[1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+
+		balance, err := parseAmount(queryResponse.Value)
+		if err != nil {
+			return 0, err
+		}
+		supplies[id], err = add(supplies[id], balance)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	migrated := 0
+
+	creatorIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(creatorPrefix, []string{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get state for prefix %v: %v", creatorPrefix, err)
+	}
+	defer creatorIterator.Close()
+
+	for creatorIterator.HasNext() {
+		queryResponse, err := creatorIterator.Next()
+		if err != nil {
+			return 0, fmt.Errorf("failed to get the next state for prefix %v: %v", creatorPrefix, err)
+		}
+
+		_, compositeKeyParts, err := ctx.GetStub().SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return 0, err
+		}
+		id, err := strconv.ParseUint(compositeKeyParts[0], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		tokenInfo, err := readTokenInfo(ctx, id)
+		if err != nil {
+			return 0, err
+		}
+		if tokenInfo != nil {
+			continue
+		}
+
+		tokenName, err := s.GetTokenName(ctx, id)
+		if err != nil {
+			return 0, err
+		}
+
+		tokenInfo = &TokenInfo{
+			ID:      id,
+			Name:    tokenName,
+			Creator: string(queryResponse.Value),
+		}
+		err = saveTokenInfo(ctx, tokenInfo)
+		if err != nil {
+			return 0, err
+		}
+		err = saveSupply(ctx, id, supplies[id])
+		if err != nil {
+			return 0, err
+		}
+		migrated++
+	}
+
+	return migrated, nil
+}
+
+// allocateTokenID returns the token id after the last allocated one that is not taken by a
+// token created with an explicit id, and records it as the last allocated token id
+func (s *SmartContract) allocateTokenID(ctx contractapi.TransactionContextInterface) (uint64, error) {
+	tokenId, err := readLastTokenID(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		tokenId, err = add(tokenId, 1)
+		if err != nil {
+			return 0, err
+		}
+
+		creator, err := s.GetTokenCreator(ctx, tokenId)
+		if err != nil {
+			return 0, err
+		}
+		if creator == "" {
+			break
+		}
+	}
+
+	err = ctx.GetStub().PutState(lastTokenIdKey, []byte(strconv.FormatUint(tokenId, 10)))
+	if err != nil {
+		return 0, err
+	}
+
+	return tokenId, nil
+}
+
+// readLastTokenID returns the last token id allocated by CreateToken
+func readLastTokenID(ctx contractapi.TransactionContextInterface) (uint64, error) {
+	lastTokenIdBytes, err := ctx.GetStub().GetState(lastTokenIdKey)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read last token id from world state: %v", err)
+	}
+	if lastTokenIdBytes == nil {
+		return 0, nil
+	}
+
+	return strconv.ParseUint(string(lastTokenIdBytes), 10, 64)
+}
+
+// readTokenInfo returns the registry entry of token id, or nil if it is not registered
+func readTokenInfo(ctx contractapi.TransactionContextInterface, id uint64) (*TokenInfo, error) {
+	tokenInfoKey, err := ctx.GetStub().CreateCompositeKey(tokenInfoPrefix, []string{strconv.FormatUint(id, 10)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the composite key for prefix %s: %v", tokenInfoPrefix, err)
+	}
+
+	tokenInfoBytes, err := ctx.GetStub().GetState(tokenInfoKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token id %v info from world state: %v", id, err)
+	}
+	if tokenInfoBytes == nil {
+		return nil, nil
+	}
+
+	var tokenInfo TokenInfo
+	err = json.Unmarshal(tokenInfoBytes, &tokenInfo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode token id %v info: %v", id, err)
+	}
+
+	return &tokenInfo, nil
+}
+
+func saveTokenInfo(ctx contractapi.TransactionContextInterface, tokenInfo *TokenInfo) error {
+	tokenInfoKey, err := ctx.GetStub().CreateCompositeKey(tokenInfoPrefix, []string{strconv.FormatUint(tokenInfo.ID, 10)})
+	if err != nil {
+		return fmt.Errorf("failed to create the composite key for prefix %s: %v", tokenInfoPrefix, err)
+	}
+
+	tokenInfoJSON, err := json.Marshal(tokenInfo)
+	if err != nil {
+		return fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+
+	return ctx.GetStub().PutState(tokenInfoKey, tokenInfoJSON)
+}
+
+// fillTokenInfo sets the current creator and supply of tokenInfo
+func (s *SmartContract) fillTokenInfo(ctx contractapi.TransactionContextInterface, tokenInfo *TokenInfo) error {
+	creator, err := s.GetTokenCreator(ctx, tokenInfo.ID)
+	if err != nil {
+		return err
+	}
+	if creator != "" {
+		tokenInfo.Creator = creator
+	}
+
+	tokenInfo.Supply, err = readSupply(ctx, tokenInfo)
+	return err
+}
+
+// readSupply returns the supply of the token id of tokenInfo. Entries registered before the
+// supply had a key of its own hold the supply themselves until it changes.
+func readSupply(ctx contractapi.TransactionContextInterface, tokenInfo *TokenInfo) (uint64, error) {
+	supplyKey, err := ctx.GetStub().CreateCompositeKey(tokenSupplyPrefix, []string{strconv.FormatUint(tokenInfo.ID, 10)})
+	if err != nil {
+		return 0, fmt.Errorf("failed to create the composite key for prefix %s: %v", tokenSupplyPrefix, err)
+	}
+
+	supplyBytes, err := ctx.GetStub().GetState(supplyKey)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read token id %v supply from world state: %v", tokenInfo.ID, err)
+	}
+	if supplyBytes == nil {
+		return tokenInfo.Supply, nil
+	}
+
+	return parseAmount(supplyBytes)
+}
+
+func saveSupply(ctx contractapi.TransactionContextInterface, id uint64, supply uint64) error {
+	supplyKey, err := ctx.GetStub().CreateCompositeKey(tokenSupplyPrefix, []string{strconv.FormatUint(id, 10)})
+	if err != nil {
+		return fmt.Errorf("failed to create the composite key for prefix %s: %v", tokenSupplyPrefix, err)
+	}
+
+	return ctx.GetStub().PutState(supplyKey, []byte(strconv.FormatUint(supply, 10)))
+}
+
+// changeSupply increases or decreases the supply of every token id by the matching amount
+func changeSupply(ctx contractapi.TransactionContextInterface, ids []uint64, amounts []uint64, increase bool) error {
+	// Group amount by token id because the supply of a token id can only be written once per transaction
+	amountByID := make(map[uint64]uint64)
+	for i := 0; i < len(amounts); i++ {
+		var err error
+		amountByID[ids[i]], err = add(amountByID[ids[i]], amounts[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, id := range sortedKeys(amountByID) {
+		tokenInfo, err := readTokenInfo(ctx, id)
+		if err != nil {
+			return err
+		}
+		if tokenInfo == nil {
+			return fmt.Errorf("token with id %v is not registered", id)
+		}
+
+		supply, err := readSupply(ctx, tokenInfo)
+		if err != nil {
+			return err
+		}
+
+		if increase {
+			supply, err = add(supply, amountByID[id])
+		} else {
+			supply, err = sub(supply, amountByID[id])
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update supply of token id %v: %v", id, err)
+		}
+
+		if increase && tokenInfo.MaxSupply != 0 && supply > tokenInfo.MaxSupply {
+			return fmt.Errorf("minting %v of token id %v exceeds its max supply of %v", amountByID[id], id, tokenInfo.MaxSupply)
+		}
+
+		err = saveSupply(ctx, id, supply)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,523 @@
+package chaincode
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"erc1155/chaincode/pricing"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// maxRouteHops is the maximum number of liquidity pools a route found by FindBestRoute may go through
+const maxRouteHops = 4
+
+// poolGraph maps token ids to the token ids they can be exchanged for in a single hop, as far as they have been looked up
+type poolGraph map[uint64][]uint64
+
+// tokenPair identifies a liquidity pool by its ordered token ids
+type tokenPair struct {
+	A uint64
+	B uint64
+}
+
+func newTokenPair(tokenA uint64, tokenB uint64) tokenPair {
+	if tokenA > tokenB {
+		return tokenPair{tokenB, tokenA}
+	}
+	return tokenPair{tokenA, tokenB}
+}
+
+// routeState holds the liquidity pools read while quoting a route, so that a pool
+// used by several hops is only read once and its reserves are updated in order
+type routeState struct {
+	platformTokenId uint64
+	platformFee     uint64
+	lps             map[tokenPair]*LiquidityPool
+	// committed caches the pools as read from the world state, shared by forks
+	committed map[tokenPair]LiquidityPool
+}
+
+// ExchangeBestRoute swaps amount of fromTokenId into toTokenId along the route that
+// yields the largest output, going through at most maxRouteHops liquidity pools.
+func (s *SmartContract) ExchangeBestRoute(ctx contractapi.TransactionContextInterface, fromTokenId uint64, toTokenId uint64, amount uint64) (*ExchangeResult, error) {
+	path, err := s.FindBestRoute(ctx, fromTokenId, toTokenId, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.ExchangeAlongPath(ctx, path, amount)
+}
+
+// ExchangeAlongPath swaps amount of path[0] into path[len(path)-1], going through
+// the liquidity pool of every consecutive pair of token ids in path.
+// Every pool charges its fee in the token received from that hop.
+// Intermediate tokens stay in the pool accounts, only the first token is taken
+// from the caller and only the last token is sent to the caller.
+func (s *SmartContract) ExchangeAlongPath(ctx contractapi.TransactionContextInterface, path []uint64, amount uint64) (*ExchangeResult, error) {
+
+	// Get ID of submitting client identity
+	exchangerId, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client id: %v", err)
+	}
+
+	return s.exchangeAlongPath(ctx, exchangerId, exchangerId, exchangerId, path, amount)
+}
+
+// ExchangeFrom swaps amount of fromTokenId of owner into toTokenId along the route that yields
+// the largest output and sends the output to recipient. The caller must be owner or an operator
+// approved by owner with SetApprovalForAll. The daily outflow caps per user apply to owner.
+func (s *SmartContract) ExchangeFrom(ctx contractapi.TransactionContextInterface, owner string, recipient string, fromTokenId uint64, toTokenId uint64, amount uint64) (*ExchangeResult, error) {
+
+	// Get ID of submitting client identity
+	operator, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client id: %v", err)
+	}
+
+	// Check whether operator is owner or approved
+	if operator != owner {
+		approved, err := _isApprovedForAll(ctx, owner, operator)
+		if err != nil {
+			return nil, err
+		}
+		if !approved {
+			return nil, fmt.Errorf("caller is not owner nor is approved")
+		}
+	}
+
+	if recipient == "0x0" {
+		return nil, fmt.Errorf("transfer to the zero address")
+	}
+
+	path, err := s.FindBestRoute(ctx, fromTokenId, toTokenId, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.exchangeAlongPath(ctx, operator, owner, recipient, path, amount)
+}
+
+// exchangeAlongPath swaps amount of path[0] of owner into path[len(path)-1] for recipient,
+// on behalf of operator. See ExchangeAlongPath.
+func (s *SmartContract) exchangeAlongPath(ctx contractapi.TransactionContextInterface, operator string, owner string, recipient string, path []uint64, amount uint64) (*ExchangeResult, error) {
+	state, err := s.newRouteState(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := s.quotePath(ctx, state, path, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.recordOutflows(ctx, state, owner, result)
+	if err != nil {
+		return nil, err
+	}
+
+	// Send fromToken amount from owner to LP
+	err = addToLP(ctx, owner, result.FromTokenID, result.FromTokenAmount)
+	if err != nil {
+		return nil, err
+	}
+
+	// Send the output of the last hop to the recipient. The fees of every hop stay in
+	// the LP token accounts and accrue to the pool they were charged by.
+	err = payFromLP(ctx, result.ToTokenID, map[string]uint64{recipient: result.ToTokenAmount})
+	if err != nil {
+		return nil, err
+	}
+
+	// Contract accounts must accept the output, it is sent on behalf of owner
+	err = checkOnERC1155Received(ctx, operator, owner, recipient, result.ToTokenID, result.ToTokenAmount)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, hop := range result.Hops {
+		lp, err := state.lpForPair(ctx, s, hop.FromTokenID, hop.ToTokenID)
+		if err != nil {
+			return nil, err
+		}
+		stats, err := readPoolFeeStats(ctx, lp)
+		if err != nil {
+			return nil, err
+		}
+		err = stats.accrue(hop)
+		if err != nil {
+			return nil, err
+		}
+		err = savePoolFeeStats(ctx, stats)
+		if err != nil {
+			return nil, err
+		}
+		err = observePrice(ctx, lp)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = state.save(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	swapEvent := Swap{
+		Operator:        operator,
+		Owner:           owner,
+		Recipient:       recipient,
+		FromTokenID:     result.FromTokenID,
+		FromTokenAmount: result.FromTokenAmount,
+		ToTokenID:       result.ToTokenID,
+		ToTokenAmount:   result.ToTokenAmount,
+		Fee:             result.PlatformFee,
+		ExchangeRate:    result.ExchangeRate,
+		Route:           result.Path,
+		Hops:            result.Hops,
+	}
+	err = emitEvent(ctx, "Swap", swapEvent)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// FindBestRoute returns the path of token ids from fromTokenId to toTokenId that
+// yields the largest output for amount, going through at most maxRouteHops
+// liquidity pools. Among routes with the same output the shortest one is chosen.
+func (s *SmartContract) FindBestRoute(ctx contractapi.TransactionContextInterface, fromTokenId uint64, toTokenId uint64, amount uint64) ([]uint64, error) {
+	if fromTokenId == toTokenId {
+		return nil, fmt.Errorf("cannot exchange token id %v for itself", fromTokenId)
+	}
+
+	graph := make(poolGraph)
+
+	baseState, err := s.newRouteState(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var bestPath []uint64
+	var bestAmount uint64
+	var lastErr error
+
+	// Depth first search over every simple path. Neighbours are sorted, so the result is deterministic.
+	path := []uint64{fromTokenId}
+	visited := map[uint64]bool{fromTokenId: true}
+
+	var search func(tokenId uint64) error
+	search = func(tokenId uint64) error {
+		if tokenId == toTokenId {
+			result, err := s.quotePath(ctx, baseState.fork(), path, amount)
+			if err != nil {
+				lastErr = err
+				return nil
+			}
+			if bestPath == nil || result.ToTokenAmount > bestAmount ||
+				(result.ToTokenAmount == bestAmount && len(path) < len(bestPath)) {
+				bestPath = append([]uint64(nil), path...)
+				bestAmount = result.ToTokenAmount
+			}
+			return nil
+		}
+
+		if len(path) > maxRouteHops {
+			return nil
+		}
+
+		neighbours, err := graph.neighbours(ctx, tokenId)
+		if err != nil {
+			return err
+		}
+
+		for _, next := range neighbours {
+			if visited[next] {
+				continue
+			}
+			visited[next] = true
+			path = append(path, next)
+			err := search(next)
+			if err != nil {
+				return err
+			}
+			path = path[:len(path)-1]
+			visited[next] = false
+		}
+		return nil
+	}
+
+	err = search(fromTokenId)
+	if err != nil {
+		return nil, err
+	}
+
+	if bestPath == nil {
+		if lastErr != nil {
+			return nil, lastErr
+		}
+		return nil, fmt.Errorf("no route from token id %v to token id %v", fromTokenId, toTokenId)
+	}
+
+	return bestPath, nil
+}
+
+// QuoteExchange returns the result ExchangeAlongPath would have for path and amount without executing it
+func (s *SmartContract) QuoteExchange(ctx contractapi.TransactionContextInterface, path []uint64, amount uint64) (*ExchangeResult, error) {
+	state, err := s.newRouteState(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.quotePath(ctx, state, path, amount)
+}
+
+func (s *SmartContract) newRouteState(ctx contractapi.TransactionContextInterface) (*routeState, error) {
+	platformTokenId, err := s.GetPlatformTokenID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	platformFee, err := s.GetPlatformFeeAmount(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &routeState{
+		platformTokenId: platformTokenId,
+		platformFee:     platformFee,
+		lps:             make(map[tokenPair]*LiquidityPool),
+		committed:       make(map[tokenPair]LiquidityPool),
+	}, nil
+}
+
+// fork returns a state that reads the same committed pools but updates its own copies of them
+func (rs *routeState) fork() *routeState {
+	return &routeState{
+		platformTokenId: rs.platformTokenId,
+		platformFee:     rs.platformFee,
+		lps:             make(map[tokenPair]*LiquidityPool),
+		committed:       rs.committed,
+	}
+}
+
+// lpForPair returns the liquidity pool that exchanges tokenA for tokenB
+func (rs *routeState) lpForPair(ctx contractapi.TransactionContextInterface, s *SmartContract, tokenA uint64, tokenB uint64) (*LiquidityPool, error) {
+	pair := newTokenPair(tokenA, tokenB)
+
+	if lp, ok := rs.lps[pair]; ok {
+		return lp, nil
+	}
+
+	committedLp, err := rs.committedLP(ctx, s, pair)
+	if err != nil {
+		return nil, err
+	}
+
+	lp := committedLp
+	rs.lps[pair] = &lp
+
+	return &lp, nil
+}
+
+// committedLP returns the liquidity pool of pair as stored in the world state
+func (rs *routeState) committedLP(ctx contractapi.TransactionContextInterface, s *SmartContract, pair tokenPair) (LiquidityPool, error) {
+	if lp, ok := rs.committed[pair]; ok {
+		return lp, nil
+	}
+
+	lp, err := s.GetLP(ctx, pair.A, pair.B)
+	if err != nil {
+		return LiquidityPool{}, err
+	}
+	rs.committed[pair] = *lp
+
+	return *lp, nil
+}
+
+// convertPlatformAmount converts an amount of platform tokens into tokenId, rounded up.
+// Tokens other than the platform token are converted at the exchange rate of the
+// pool between that token and the platform token.
+func (rs *routeState) convertPlatformAmount(ctx contractapi.TransactionContextInterface, s *SmartContract, amount uint64, tokenId uint64) (uint64, error) {
+	if tokenId == rs.platformTokenId || amount == 0 {
+		return amount, nil
+	}
+
+	lp, err := rs.committedLP(ctx, s, newTokenPair(tokenId, rs.platformTokenId))
+	if err != nil {
+		return 0, fmt.Errorf("failed to price %v platform tokens in token id %v: %v", amount, tokenId, err)
+	}
+
+	return lp.pricingPool().Convert(amount, tokenId)
+}
+
+// save writes every liquidity pool touched by the route to the world state, in pair order
+func (rs *routeState) save(ctx contractapi.TransactionContextInterface, s *SmartContract) error {
+	pairs := make([]tokenPair, 0, len(rs.lps))
+	for pair := range rs.lps {
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].A != pairs[j].A {
+			return pairs[i].A < pairs[j].A
+		}
+		return pairs[i].B < pairs[j].B
+	})
+
+	for _, pair := range pairs {
+		err := s.saveLPState(ctx, rs.lps[pair])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// quotePath computes every hop of path for amount and updates the reserves of
+// the pools held by state. Nothing is written to the world state.
+func (s *SmartContract) quotePath(ctx contractapi.TransactionContextInterface, state *routeState, path []uint64, amount uint64) (*ExchangeResult, error) {
+	if len(path) < 2 {
+		return nil, fmt.Errorf("path must contain at least two token ids")
+	}
+
+	if amount == 0 {
+		return nil, fmt.Errorf("exchange amount must be a positive integer")
+	}
+
+	seen := make(map[uint64]bool)
+	for _, tokenId := range path {
+		if seen[tokenId] {
+			return nil, fmt.Errorf("path must not contain token id %v more than once", tokenId)
+		}
+		seen[tokenId] = true
+	}
+
+	result := &ExchangeResult{
+		FromTokenID:     path[0],
+		FromTokenAmount: amount,
+		ToTokenID:       path[len(path)-1],
+		Path:            path,
+	}
+
+	hopAmount := amount
+	for i := 0; i < len(path)-1; i++ {
+		lp, err := state.lpForPair(ctx, s, path[i], path[i+1])
+		if err != nil {
+			return nil, err
+		}
+		if lp.Paused {
+			return nil, fmt.Errorf("lp of token id %v and %v is paused", lp.TokenID, lp.PairTokenID)
+		}
+
+		feeConfig := lp.feeConfig(state.platformFee)
+		minimumFee, err := state.convertPlatformAmount(ctx, s, feeConfig.MinimumFee, path[i+1])
+		if err != nil {
+			return nil, err
+		}
+
+		hop, err := quoteHop(lp, feeConfig, path[i], hopAmount, minimumFee)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Hops = append(result.Hops, *hop)
+		hopAmount = hop.ToTokenAmount
+	}
+
+	var err error
+	lastHop := result.Hops[len(result.Hops)-1]
+	result.ToTokenAmount = lastHop.ToTokenAmount
+	result.PlatformFee, err = add(lastHop.PlatformFee, lastHop.ProviderFee)
+	if err != nil {
+		return nil, err
+	}
+
+	result.ExchangeRate, err = mulDivDown(result.ToTokenAmount, RateScale, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// quoteHop computes the swap of amount of fromTokenId through lp and updates its reserves.
+// The fee of feeConfig is charged in the token received from the pool, minimumFee is
+// already converted into that token. See pricing.Pool.Swap for the rounding rules.
+func quoteHop(lp *LiquidityPool, feeConfig *PoolFeeConfig, fromTokenId uint64, amount uint64, minimumFee uint64) (*ExchangeHop, error) {
+	pool := lp.pricingPool()
+
+	quote, err := pool.Swap(feeConfig.pricingConfig(), fromTokenId, amount, minimumFee)
+	if err != nil {
+		return nil, err
+	}
+
+	lp.TokenSupply = pool.TokenReserve
+	lp.TokenPlatformSupply = pool.PairTokenReserve
+
+	return &ExchangeHop{
+		LPTokenID:       lp.TokenID,
+		LPPairTokenID:   lp.PairTokenID,
+		FromTokenID:     quote.FromTokenID,
+		FromTokenAmount: quote.FromTokenAmount,
+		ToTokenID:       quote.ToTokenID,
+		ToTokenAmount:   quote.ToTokenAmount,
+		ExchangeRate:    quote.ExchangeRate,
+		PlatformFee:     quote.PlatformFee,
+		ProviderFee:     quote.ProviderFee,
+	}, nil
+}
+
+// pricingPool returns the reserves and the exchange rate of lp
+func (lp *LiquidityPool) pricingPool() *pricing.Pool {
+	return &pricing.Pool{
+		TokenID:          lp.TokenID,
+		PairTokenID:      lp.PairTokenID,
+		TokenReserve:     lp.TokenSupply,
+		PairTokenReserve: lp.TokenPlatformSupply,
+		ExchangeRate:     lp.ExchangeRate,
+	}
+}
+
+// neighbours returns the tokens tokenId can be exchanged for in a single hop, sorted.
+// Only the pools of the tokens a route search visits are looked up, through the index
+// of indexLP, so that finding a route does not read every pool.
+func (graph poolGraph) neighbours(ctx contractapi.TransactionContextInterface, tokenId uint64) ([]uint64, error) {
+	if neighbours, ok := graph[tokenId]; ok {
+		return neighbours, nil
+	}
+
+	indexIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(lpPairIndexPrefix, []string{strconv.FormatUint(tokenId, 10)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state for prefix %v: %v", lpPairIndexPrefix, err)
+	}
+	defer indexIterator.Close()
+
+	neighbours := []uint64{}
+	for indexIterator.HasNext() {
+		queryResponse, err := indexIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the next state for prefix %v: %v", lpPairIndexPrefix, err)
+		}
+
+		_, compositeKeyParts, err := ctx.GetStub().SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return nil, err
+		}
+		if len(compositeKeyParts) != 2 {
+			return nil, fmt.Errorf("invalid lp index key %v", queryResponse.Key)
+		}
+		pairTokenId, err := strconv.ParseUint(compositeKeyParts[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		neighbours = append(neighbours, pairTokenId)
+	}
+
+	sort.Slice(neighbours, func(i, j int) bool { return neighbours[i] < neighbours[j] })
+	graph[tokenId] = neighbours
+	return neighbours, nil
+}
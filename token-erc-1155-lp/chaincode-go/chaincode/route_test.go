@@ -0,0 +1,44 @@
+package chaincode
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuoteHop(t *testing.T) {
+	const platformTokenId = 1
+
+	// 1 Livin = 10 BUMN
+	lp := &LiquidityPool{TokenID: 2, PairTokenID: platformTokenId, TokenSupply: 200000, TokenPlatformSupply: 2000000, ExchangeRate: 10 * RateScale}
+
+	// Pools without a fee configuration charge the flat platform fee
+	feeConfig := lp.feeConfig(1000)
+
+	hop, err := quoteHop(lp, feeConfig, 2, 3000, 1000)
+	require.NoError(t, err)
+	require.Equal(t, uint64(platformTokenId), hop.ToTokenID)
+	require.Equal(t, uint64(29000), hop.ToTokenAmount)
+	require.Equal(t, uint64(1000), hop.PlatformFee)
+	require.Equal(t, uint64(0), hop.ProviderFee)
+	require.Equal(t, uint64(203000), lp.TokenSupply)
+	require.Equal(t, uint64(1970000), lp.TokenPlatformSupply)
+
+	// The output is rounded down
+	hop, err = quoteHop(lp, feeConfig, platformTokenId, 3005, 101)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), hop.ToTokenID)
+	require.Equal(t, uint64(101), hop.PlatformFee)
+	require.Equal(t, uint64(199), hop.ToTokenAmount)
+	require.Equal(t, uint64(202700), lp.TokenSupply)
+	require.Equal(t, uint64(1973005), lp.TokenPlatformSupply)
+
+	_, err = quoteHop(lp, feeConfig, platformTokenId, 1000, 101)
+	require.Error(t, err)
+
+	_, err = quoteHop(lp, feeConfig, 2, 1000000, 0)
+	require.Error(t, err)
+
+	_, err = quoteHop(lp, feeConfig, 3, 1000, 0)
+	require.Error(t, err)
+}
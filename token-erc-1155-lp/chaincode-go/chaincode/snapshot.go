@@ -0,0 +1,591 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const snapshotPrefix = "snapshot"
+
+const lastSnapshotIdKey = "lastSnapshotId"
+
+const tokenSnapshotPrefix = "tokenId~snapshot"
+
+const snapshotBalancePrefix = "snapshotbalance"
+
+const distributionPrefix = "distribution"
+
+const rewardClaimPrefix = "rewardclaim"
+
+const rewardEscrowPrefix = "rewardescrow"
+
+// Snapshot records the balances of TokenID at TakenAt, seconds since the Unix epoch.
+// Balances are not copied when the snapshot is taken. The balance of an account is recorded
+// the first time it changes after the snapshot, see BalanceOfAt.
+type Snapshot struct {
+	ID          uint64 `json:"id"`
+	TokenID     uint64 `json:"token_id"`
+	TotalSupply uint64 `json:"total_supply"`
+	TakenBy     string `json:"taken_by"`
+	TakenAt     int64  `json:"taken_at"`
+}
+
+// Distribution is a reward of Total RewardTokenID shared by the holders of TokenID at snapshot
+// SnapshotID, pro rata to their balance. Claimed is what holders have claimed so far.
+// Shares can be claimed until Expiry, seconds since the Unix epoch, or without time limit if
+// Expiry is 0. Shares of accounts that cannot claim, like LP accounts, stay in escrow until
+// the distributor reclaims them after Expiry. Reclaimed is what the distributor took back.
+type Distribution struct {
+	ID            string `json:"id"`
+	SnapshotID    uint64 `json:"snapshot_id"`
+	TokenID       uint64 `json:"token_id"`
+	RewardTokenID uint64 `json:"reward_token_id"`
+	Total         uint64 `json:"total"`
+	Claimed       uint64 `json:"claimed"`
+	Reclaimed     uint64 `json:"reclaimed"`
+	Distributor   string `json:"distributor"`
+	CreatedAt     int64  `json:"created_at"`
+	Expiry        int64  `json:"expiry"`
+}
+
+// RewardClaim is the share of distribution DistributionID claimed by Account at ClaimedAt
+type RewardClaim struct {
+	DistributionID string `json:"distribution_id"`
+	Account        string `json:"account"`
+	RewardTokenID  uint64 `json:"reward_token_id"`
+	Amount         uint64 `json:"amount"`
+	ClaimedAt      int64  `json:"claimed_at"`
+}
+
+// SnapshotTaken MUST emit when TakeSnapshot records a snapshot
+type SnapshotTaken struct {
+	Operator string    `json:"operator"`
+	Snapshot *Snapshot `json:"snapshot"`
+}
+
+// RewardEvent is emitted as RewardsDistributed when a distribution is funded, as
+// RewardClaimed when a holder claims its share and as RewardsReclaimed when the distributor
+// takes back what was not claimed. Claim is only set for RewardClaimed.
+type RewardEvent struct {
+	Operator     string        `json:"operator"`
+	Distribution *Distribution `json:"distribution"`
+	Claim        *RewardClaim  `json:"claim,omitempty"`
+}
+
+// TakeSnapshot records the balances of id as of this transaction and returns the snapshot.
+// Only the creator of id can take a snapshot of it. Snapshot ids are shared by all token ids
+// and increase with every snapshot. This function emits a SnapshotTaken event.
+func (s *SmartContract) TakeSnapshot(ctx contractapi.TransactionContextInterface, id uint64) (*Snapshot, error) {
+
+	// Get ID of submitting client identity
+	operator, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client id: %v", err)
+	}
+
+	creator, err := s.GetTokenCreator(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if operator != creator {
+		return nil, fmt.Errorf("%v is not the creator of token id %v", operator, id)
+	}
+
+	totalSupply, err := s.TotalSupply(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transaction timestamp: %v", err)
+	}
+
+	lastSnapshotId, err := readLastSnapshotID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	snapshotId, err := add(lastSnapshotId, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &Snapshot{
+		ID:          snapshotId,
+		TokenID:     id,
+		TotalSupply: totalSupply,
+		TakenBy:     operator,
+		TakenAt:     txTimestamp.GetSeconds(),
+	}
+
+	snapshotKey, err := ctx.GetStub().CreateCompositeKey(snapshotPrefix, []string{strconv.FormatUint(snapshotId, 10)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the composite key for prefix %s: %v", snapshotPrefix, err)
+	}
+	snapshotJSON, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+	err = ctx.GetStub().PutState(snapshotKey, snapshotJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to put state: %v", err)
+	}
+
+	snapshotIdBytes := []byte(strconv.FormatUint(snapshotId, 10))
+	err = ctx.GetStub().PutState(lastSnapshotIdKey, snapshotIdBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to put state: %v", err)
+	}
+
+	tokenSnapshotKey, err := ctx.GetStub().CreateCompositeKey(tokenSnapshotPrefix, []string{strconv.FormatUint(id, 10)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the composite key for prefix %s: %v", tokenSnapshotPrefix, err)
+	}
+	err = ctx.GetStub().PutState(tokenSnapshotKey, snapshotIdBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to put state: %v", err)
+	}
+
+	err = emitEvent(ctx, "SnapshotTaken", SnapshotTaken{Operator: operator, Snapshot: snapshot})
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+// GetSnapshot returns snapshot snapshotId
+func (s *SmartContract) GetSnapshot(ctx contractapi.TransactionContextInterface, snapshotId uint64) (*Snapshot, error) {
+	snapshotKey, err := ctx.GetStub().CreateCompositeKey(snapshotPrefix, []string{strconv.FormatUint(snapshotId, 10)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the composite key for prefix %s: %v", snapshotPrefix, err)
+	}
+
+	snapshotBytes, err := ctx.GetStub().GetState(snapshotKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot %v from world state: %v", snapshotId, err)
+	}
+	if snapshotBytes == nil {
+		return nil, fmt.Errorf("snapshot %v does not exist", snapshotId)
+	}
+
+	var snapshot Snapshot
+	err = json.Unmarshal(snapshotBytes, &snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot %v: %v", snapshotId, err)
+	}
+
+	return &snapshot, nil
+}
+
+// BalanceOfAt returns the balance of account in id when snapshot snapshotId was taken
+func (s *SmartContract) BalanceOfAt(ctx contractapi.TransactionContextInterface, account string, id uint64, snapshotId uint64) (uint64, error) {
+	snapshot, err := s.GetSnapshot(ctx, snapshotId)
+	if err != nil {
+		return 0, err
+	}
+	if snapshot.TokenID != id {
+		return 0, fmt.Errorf("snapshot %v is a snapshot of token id %v", snapshotId, snapshot.TokenID)
+	}
+
+	return balanceOfAt(ctx, account, id, snapshotId)
+}
+
+// DistributeRewards shares total of rewardId among the holders of the token of snapshot snapshotId,
+// pro rata to their balance at the snapshot. The total is taken from the caller and held in escrow
+// until the holders claim their share with ClaimReward, which they can do until expiry, seconds since
+// the Unix epoch, or without time limit if expiry is 0. The ID of the distribution is the ID of the
+// transaction. This function emits a RewardsDistributed event.
+func (s *SmartContract) DistributeRewards(ctx contractapi.TransactionContextInterface, snapshotId uint64, rewardId uint64, total uint64, expiry int64) (*Distribution, error) {
+
+	// Get ID of submitting client identity
+	operator, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client id: %v", err)
+	}
+
+	snapshot, err := s.GetSnapshot(ctx, snapshotId)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot.TotalSupply == 0 {
+		return nil, fmt.Errorf("snapshot %v has no holders", snapshotId)
+	}
+
+	if total == 0 {
+		return nil, fmt.Errorf("reward total must be a positive integer")
+	}
+
+	err = requireTransferable(ctx, []uint64{rewardId})
+	if err != nil {
+		return nil, err
+	}
+
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transaction timestamp: %v", err)
+	}
+	if expiry != 0 && expiry <= txTimestamp.GetSeconds() {
+		return nil, fmt.Errorf("distribution expiry %v is not in the future", expiry)
+	}
+
+	distribution := &Distribution{
+		ID:            ctx.GetStub().GetTxID(),
+		SnapshotID:    snapshotId,
+		TokenID:       snapshot.TokenID,
+		RewardTokenID: rewardId,
+		Total:         total,
+		Distributor:   operator,
+		CreatedAt:     txTimestamp.GetSeconds(),
+		Expiry:        expiry,
+	}
+
+	err = removeBalance(ctx, operator, []uint64{rewardId}, []uint64{total})
+	if err != nil {
+		return nil, err
+	}
+	err = addBalance(ctx, operator, rewardEscrowAccount(distribution.ID), rewardId, total)
+	if err != nil {
+		return nil, err
+	}
+
+	err = saveDistribution(ctx, distribution)
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitEvent(ctx, "RewardsDistributed", RewardEvent{Operator: operator, Distribution: distribution})
+	if err != nil {
+		return nil, err
+	}
+
+	return distribution, nil
+}
+
+// GetDistribution returns reward distribution distributionId
+func (s *SmartContract) GetDistribution(ctx contractapi.TransactionContextInterface, distributionId string) (*Distribution, error) {
+	distributionKey, err := ctx.GetStub().CreateCompositeKey(distributionPrefix, []string{distributionId})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the composite key for prefix %s: %v", distributionPrefix, err)
+	}
+
+	distributionBytes, err := ctx.GetStub().GetState(distributionKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read distribution %v from world state: %v", distributionId, err)
+	}
+	if distributionBytes == nil {
+		return nil, fmt.Errorf("distribution %v does not exist", distributionId)
+	}
+
+	var distribution Distribution
+	err = json.Unmarshal(distributionBytes, &distribution)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode distribution %v: %v", distributionId, err)
+	}
+
+	return &distribution, nil
+}
+
+// ClaimReward pays the caller its share of distribution distributionId, which is the total of the
+// distribution times the balance of the caller at the snapshot divided by the supply at the snapshot,
+// rounded down. Each holder can claim once, until the distribution expires. This function emits
+// a RewardClaimed event.
+func (s *SmartContract) ClaimReward(ctx contractapi.TransactionContextInterface, distributionId string) (*RewardClaim, error) {
+
+	// Get ID of submitting client identity
+	account, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client id: %v", err)
+	}
+
+	distribution, err := s.GetDistribution(ctx, distributionId)
+	if err != nil {
+		return nil, err
+	}
+
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transaction timestamp: %v", err)
+	}
+	if distribution.expired(txTimestamp.GetSeconds()) {
+		return nil, fmt.Errorf("distribution %v expired at %v", distributionId, distribution.Expiry)
+	}
+
+	claimKey, err := ctx.GetStub().CreateCompositeKey(rewardClaimPrefix, []string{account, distributionId})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the composite key for prefix %s: %v", rewardClaimPrefix, err)
+	}
+	claimBytes, err := ctx.GetStub().GetState(claimKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the reward claim of %v from world state: %v", account, err)
+	}
+	if claimBytes != nil {
+		return nil, fmt.Errorf("%v already claimed distribution %v", account, distributionId)
+	}
+
+	snapshot, err := s.GetSnapshot(ctx, distribution.SnapshotID)
+	if err != nil {
+		return nil, err
+	}
+	balance, err := balanceOfAt(ctx, account, snapshot.TokenID, snapshot.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	share, err := mulDivDown(distribution.Total, balance, snapshot.TotalSupply)
+	if err != nil {
+		return nil, err
+	}
+	if share == 0 {
+		return nil, fmt.Errorf("%v has no reward in distribution %v", account, distributionId)
+	}
+
+	claim := &RewardClaim{
+		DistributionID: distributionId,
+		Account:        account,
+		RewardTokenID:  distribution.RewardTokenID,
+		Amount:         share,
+		ClaimedAt:      txTimestamp.GetSeconds(),
+	}
+
+	err = payFromAccount(ctx, rewardEscrowAccount(distributionId), distribution.RewardTokenID, map[string]uint64{account: share})
+	if err != nil {
+		return nil, err
+	}
+
+	distribution.Claimed, err = add(distribution.Claimed, share)
+	if err != nil {
+		return nil, err
+	}
+	err = saveDistribution(ctx, distribution)
+	if err != nil {
+		return nil, err
+	}
+
+	claimJSON, err := json.Marshal(claim)
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+	err = ctx.GetStub().PutState(claimKey, claimJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to put state: %v", err)
+	}
+
+	err = emitEvent(ctx, "RewardClaimed", RewardEvent{Operator: account, Distribution: distribution, Claim: claim})
+	if err != nil {
+		return nil, err
+	}
+
+	return claim, nil
+}
+
+// ReclaimRewards pays the distributor of distribution distributionId what is left in its escrow
+// once the distribution expired: the shares that were not claimed and the rounding remainders.
+// Only the distributor can reclaim, and distributions without expiry cannot be reclaimed.
+// This function emits a RewardsReclaimed event.
+func (s *SmartContract) ReclaimRewards(ctx contractapi.TransactionContextInterface, distributionId string) (*Distribution, error) {
+
+	// Get ID of submitting client identity
+	operator, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client id: %v", err)
+	}
+
+	distribution, err := s.GetDistribution(ctx, distributionId)
+	if err != nil {
+		return nil, err
+	}
+	if operator != distribution.Distributor {
+		return nil, fmt.Errorf("%v is not the distributor of distribution %v", operator, distributionId)
+	}
+
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transaction timestamp: %v", err)
+	}
+	if !distribution.expired(txTimestamp.GetSeconds()) {
+		return nil, fmt.Errorf("distribution %v has not expired", distributionId)
+	}
+
+	escrow := rewardEscrowAccount(distributionId)
+	unclaimed, err := balanceOfHelper(ctx, escrow, distribution.RewardTokenID)
+	if err != nil {
+		return nil, err
+	}
+	if unclaimed == 0 {
+		return nil, fmt.Errorf("distribution %v has no unclaimed rewards", distributionId)
+	}
+
+	err = payFromAccount(ctx, escrow, distribution.RewardTokenID, map[string]uint64{operator: unclaimed})
+	if err != nil {
+		return nil, err
+	}
+
+	distribution.Reclaimed, err = add(distribution.Reclaimed, unclaimed)
+	if err != nil {
+		return nil, err
+	}
+	err = saveDistribution(ctx, distribution)
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitEvent(ctx, "RewardsReclaimed", RewardEvent{Operator: operator, Distribution: distribution})
+	if err != nil {
+		return nil, err
+	}
+
+	return distribution, nil
+}
+
+// RewardClaimsOf returns the rewards claimed by account
+func (s *SmartContract) RewardClaimsOf(ctx contractapi.TransactionContextInterface, account string) ([]*RewardClaim, error) {
+	claimIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(rewardClaimPrefix, []string{account})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state for prefix %v: %v", rewardClaimPrefix, err)
+	}
+	defer claimIterator.Close()
+
+	claims := []*RewardClaim{}
+	for claimIterator.HasNext() {
+		queryResponse, err := claimIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the next state for prefix %v: %v", rewardClaimPrefix, err)
+		}
+
+		var claim RewardClaim
+		err = json.Unmarshal(queryResponse.Value, &claim)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode reward claim %v: %v", queryResponse.Key, err)
+		}
+		claims = append(claims, &claim)
+	}
+
+	return claims, nil
+}
+
+func (distribution *Distribution) expired(now int64) bool {
+	return distribution.Expiry != 0 && distribution.Expiry <= now
+}
+
+func saveDistribution(ctx contractapi.TransactionContextInterface, distribution *Distribution) error {
+	distributionKey, err := ctx.GetStub().CreateCompositeKey(distributionPrefix, []string{distribution.ID})
+	if err != nil {
+		return fmt.Errorf("failed to create the composite key for prefix %s: %v", distributionPrefix, err)
+	}
+
+	distributionJSON, err := json.Marshal(distribution)
+	if err != nil {
+		return fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(distributionKey, distributionJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put state: %v", err)
+	}
+
+	return nil
+}
+
+func readLastSnapshotID(ctx contractapi.TransactionContextInterface) (uint64, error) {
+	lastSnapshotIdBytes, err := ctx.GetStub().GetState(lastSnapshotIdKey)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read last snapshot id from world state: %v", err)
+	}
+	if lastSnapshotIdBytes == nil {
+		return 0, nil
+	}
+
+	return strconv.ParseUint(string(lastSnapshotIdBytes), 10, 64)
+}
+
+// rewardEscrowAccount is the account that holds the unclaimed rewards of a distribution
+func rewardEscrowAccount(distributionId string) string {
+	return rewardEscrowPrefix + distributionId
+}
+
+// recordSnapshotBalance records the balance of account in id at the latest snapshot of id,
+// unless it was recorded already. It must be called before the balance changes. A transaction
+// does not see its own writes, so the balance read is the balance before the transaction,
+// which is the balance at the snapshot when the snapshot was taken by an earlier transaction.
+func recordSnapshotBalance(ctx contractapi.TransactionContextInterface, account string, id uint64) error {
+	idString := strconv.FormatUint(id, 10)
+	tokenSnapshotKey, err := ctx.GetStub().CreateCompositeKey(tokenSnapshotPrefix, []string{idString})
+	if err != nil {
+		return fmt.Errorf("failed to create the composite key for prefix %s: %v", tokenSnapshotPrefix, err)
+	}
+
+	snapshotIdBytes, err := ctx.GetStub().GetState(tokenSnapshotKey)
+	if err != nil {
+		return fmt.Errorf("failed to read the latest snapshot of token id %v from world state: %v", id, err)
+	}
+	if snapshotIdBytes == nil {
+		return nil
+	}
+	snapshotId, err := strconv.ParseUint(string(snapshotIdBytes), 10, 64)
+	if err != nil {
+		return fmt.Errorf("failed to parse the latest snapshot id of token id %v: %v", id, err)
+	}
+
+	// The snapshot id is zero padded so that the records of an account sort by snapshot
+	balanceKey, err := ctx.GetStub().CreateCompositeKey(snapshotBalancePrefix, []string{idString, account, fmt.Sprintf("%020d", snapshotId)})
+	if err != nil {
+		return fmt.Errorf("failed to create the composite key for prefix %s: %v", snapshotBalancePrefix, err)
+	}
+
+	recordedBytes, err := ctx.GetStub().GetState(balanceKey)
+	if err != nil {
+		return fmt.Errorf("failed to read the snapshot balance of %v from world state: %v", account, err)
+	}
+	if recordedBytes != nil {
+		return nil
+	}
+
+	balance, err := balanceOfHelper(ctx, account, id)
+	if err != nil {
+		return err
+	}
+
+	err = ctx.GetStub().PutState(balanceKey, []byte(strconv.FormatUint(balance, 10)))
+	if err != nil {
+		return fmt.Errorf("failed to put state: %v", err)
+	}
+
+	return nil
+}
+
+// balanceOfAt returns the balance of account in id at snapshot snapshotId. The first balance
+// recorded at or after the snapshot is the balance at the snapshot, as the balance has not
+// changed in between. If no balance was recorded, the balance has not changed since the snapshot.
+func balanceOfAt(ctx contractapi.TransactionContextInterface, account string, id uint64, snapshotId uint64) (uint64, error) {
+	balanceIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(snapshotBalancePrefix, []string{strconv.FormatUint(id, 10), account})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get state for prefix %v: %v", snapshotBalancePrefix, err)
+	}
+	defer balanceIterator.Close()
+
+	for balanceIterator.HasNext() {
+		queryResponse, err := balanceIterator.Next()
+		if err != nil {
+			return 0, fmt.Errorf("failed to get the next state for prefix %v: %v", snapshotBalancePrefix, err)
+		}
+
+		_, attributes, err := ctx.GetStub().SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return 0, fmt.Errorf("failed to split composite key %v: %v", queryResponse.Key, err)
+		}
+		recordedId, err := strconv.ParseUint(attributes[2], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse snapshot id of %v: %v", queryResponse.Key, err)
+		}
+
+		if recordedId >= snapshotId {
+			return parseAmount(queryResponse.Value)
+		}
+	}
+
+	return balanceOfHelper(ctx, account, id)
+}
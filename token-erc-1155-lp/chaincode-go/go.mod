@@ -3,6 +3,7 @@ module erc1155
 go 1.16
 
 require (
+	github.com/golang/protobuf v1.5.0
 	github.com/hyperledger/fabric-chaincode-go v0.0.0-20200424173110-d7076418f212
 	github.com/hyperledger/fabric-contract-api-go v1.1.1
 	github.com/hyperledger/fabric-protos-go v0.0.0-20200424173316-dd554ba3746e
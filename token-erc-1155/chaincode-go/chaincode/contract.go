@@ -17,6 +17,7 @@ import (
 )
 
 const uriKey = "uri"
+const tokenURIPrefix = "tokenId~uri"
 
 const balancePrefix = "account~tokenId~sender"
 const approvalPrefix = "account~operator"
@@ -94,9 +95,7 @@ type ApprovalForAll struct {
 }
 
 // URI MUST emit when the URI is updated for a token ID.
-// Note: This event is not used in this contract implementation because in this implementation,
-// only the programmatic way of setting URI is used. The URI should contain {id} as part of it
-// and the clients MUST replace this with the actual token ID.
+// The URI may contain {id}, which URI replaces with the hexadecimal token ID.
 type URI struct {
 	Value string `json:"value"`
 	ID    uint64 `json:"id"`
@@ -538,8 +537,8 @@ func (s *SmartContract) ClientAccountID(ctx contractapi.TransactionContextInterf
 	return clientAccountID, nil
 }
 
-// SetURI set the URI value
-// This function triggers URI event for each token id
+// SetURI sets the URI of the token ids that have no URI of their own.
+// The uri should contain {id}, which URI replaces with the token ID.
 func (s *SmartContract) SetURI(ctx contractapi.TransactionContextInterface, uri string) error {
 
 	// Check minter authorization - this sample assumes Org1 is the central banker with privilege to mint new tokens
@@ -560,19 +559,61 @@ func (s *SmartContract) SetURI(ctx contractapi.TransactionContextInterface, uri
 	return nil
 }
 
-// URI returns the URI
+// SetTokenURI sets the URI of token id, overriding the URI set by SetURI.
+// This function triggers a URI event.
+func (s *SmartContract) SetTokenURI(ctx contractapi.TransactionContextInterface, id uint64, uri string) error {
+
+	// Check minter authorization - this sample assumes Org1 is the central banker with privilege to mint new tokens
+	err := authorizationHelper(ctx)
+	if err != nil {
+		return err
+	}
+
+	if uri == "" {
+		return fmt.Errorf("failed to set uri of token id %v, uri is empty", id)
+	}
+
+	tokenURIKey, err := ctx.GetStub().CreateCompositeKey(tokenURIPrefix, []string{strconv.FormatUint(id, 10)})
+	if err != nil {
+		return fmt.Errorf("failed to create the composite key for prefix %s: %v", tokenURIPrefix, err)
+	}
+
+	err = ctx.GetStub().PutState(tokenURIKey, []byte(uri))
+	if err != nil {
+		return fmt.Errorf("failed to set uri of token id %v: %v", id, err)
+	}
+
+	uriEvent := URI{Value: uri, ID: id}
+	return emitURI(ctx, uriEvent)
+}
+
+// URI returns the URI of token id, falling back to the URI set by SetURI.
+// {id} in the URI is replaced with the token ID in lowercase hexadecimal,
+// zero-padded to 64 characters as described in the ERC-1155 metadata extension.
 func (s *SmartContract) URI(ctx contractapi.TransactionContextInterface, id uint64) (string, error) {
 
-	uriBytes, err := ctx.GetStub().GetState(uriKey)
+	tokenURIKey, err := ctx.GetStub().CreateCompositeKey(tokenURIPrefix, []string{strconv.FormatUint(id, 10)})
 	if err != nil {
-		return "", fmt.Errorf("failed to get uri: %v", err)
+		return "", fmt.Errorf("failed to create the composite key for prefix %s: %v", tokenURIPrefix, err)
+	}
+
+	uriBytes, err := ctx.GetStub().GetState(tokenURIKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to get uri of token id %v: %v", id, err)
 	}
 
 	if uriBytes == nil {
-		return "", fmt.Errorf("no uri is set: %v", err)
+		uriBytes, err = ctx.GetStub().GetState(uriKey)
+		if err != nil {
+			return "", fmt.Errorf("failed to get uri: %v", err)
+		}
 	}
 
-	return string(uriBytes), nil
+	if uriBytes == nil {
+		return "", fmt.Errorf("no uri is set for token id %v", id)
+	}
+
+	return strings.ReplaceAll(string(uriBytes), "{id}", fmt.Sprintf("%064x", id)), nil
 }
 
 func (s *SmartContract) BroadcastTokenExistance(ctx contractapi.TransactionContextInterface, id uint64) error {
@@ -796,6 +837,19 @@ func emitTransferBatchMultiRecipient(ctx contractapi.TransactionContextInterface
 	return nil
 }
 
+func emitURI(ctx contractapi.TransactionContextInterface, uriEvent URI) error {
+	uriEventJSON, err := json.Marshal(uriEvent)
+	if err != nil {
+		return fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+	err = ctx.GetStub().SetEvent("URI", uriEventJSON)
+	if err != nil {
+		return fmt.Errorf("failed to set event: %v", err)
+	}
+
+	return nil
+}
+
 // balanceOfHelper returns the balance of the given account
 func balanceOfHelper(ctx contractapi.TransactionContextInterface, account string, id uint64) (uint64, error) {
 
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"strconv"
 
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
@@ -36,6 +37,13 @@ type event struct {
 	Value int    `json:"value"`
 }
 
+// batchEvent provides an organized struct for emitting TransferBatch events
+type batchEvent struct {
+	From   string   `json:"from"`
+	To     []string `json:"to"`
+	Values []int    `json:"values"`
+}
+
 // Mint creates new tokens and adds them to minter's account balance
 // This function triggers a Transfer event
 func (s *SmartContract) Mint(ctx contractapi.TransactionContextInterface, amount int) error {
@@ -228,6 +236,79 @@ func (s *SmartContract) Transfer(ctx contractapi.TransactionContextInterface, re
 	return nil
 }
 
+// BatchTransfer transfers amounts[i] tokens from client account to recipients[i] in one step.
+// A transaction does not read its own writes, so several Transfer calls in one transaction, for example
+// by a chaincode settling a payment through InvokeChaincode, would each debit the original balance.
+// BatchTransfer debits the client account once with the total and credits every recipient once.
+// The batch must not be empty. It is not part of ERC-20 and is only implemented by this token,
+// for the marketplace of token-erc-721.
+// This function triggers a TransferBatch event
+func (s *SmartContract) BatchTransfer(ctx contractapi.TransactionContextInterface, recipients []string, amounts []int) error {
+
+	if len(recipients) == 0 {
+		return fmt.Errorf("batch transfer requires at least one recipient")
+	}
+
+	if len(recipients) != len(amounts) {
+		return fmt.Errorf("recipients and amounts must have the same length")
+	}
+
+	// Get ID of submitting client identity
+	clientID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to get client id: %v", err)
+	}
+
+	// Sum the amounts per recipient, as a balance can only be updated once per transaction
+	var order []string
+	credits := make(map[string]int)
+	total := 0
+	for i, recipient := range recipients {
+		if recipient == clientID {
+			return fmt.Errorf("cannot transfer to and from same client account")
+		}
+		if amounts[i] < 0 {
+			return fmt.Errorf("transfer amount cannot be negative")
+		}
+		if _, ok := credits[recipient]; !ok {
+			order = append(order, recipient)
+		}
+		credits[recipient], err = add(credits[recipient], amounts[i])
+		if err != nil {
+			return err
+		}
+		total, err = add(total, amounts[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	err = debitHelper(ctx, clientID, total)
+	if err != nil {
+		return fmt.Errorf("failed to transfer: %v", err)
+	}
+
+	for _, recipient := range order {
+		err = creditHelper(ctx, recipient, credits[recipient])
+		if err != nil {
+			return fmt.Errorf("failed to transfer: %v", err)
+		}
+	}
+
+	// Emit the TransferBatch event
+	transferBatchEvent := batchEvent{clientID, recipients, amounts}
+	transferBatchEventJSON, err := json.Marshal(transferBatchEvent)
+	if err != nil {
+		return fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+	err = ctx.GetStub().SetEvent("TransferBatch", transferBatchEventJSON)
+	if err != nil {
+		return fmt.Errorf("failed to set event: %v", err)
+	}
+
+	return nil
+}
+
 // BalanceOf returns the balance of the given account
 func (s *SmartContract) BalanceOf(ctx contractapi.TransactionContextInterface, account string) (int, error) {
 	balanceBytes, err := ctx.GetStub().GetState(account)
@@ -443,49 +524,75 @@ func transferHelper(ctx contractapi.TransactionContextInterface, from string, to
 		return fmt.Errorf("transfer amount cannot be negative")
 	}
 
-	fromCurrentBalanceBytes, err := ctx.GetStub().GetState(from)
+	err := debitHelper(ctx, from, value)
+	if err != nil {
+		return err
+	}
+
+	return creditHelper(ctx, to, value)
+}
+
+// debitHelper takes value from the balance of account
+func debitHelper(ctx contractapi.TransactionContextInterface, account string, value int) error {
+
+	currentBalanceBytes, err := ctx.GetStub().GetState(account)
 	if err != nil {
-		return fmt.Errorf("failed to read client account %s from world state: %v", from, err)
+		return fmt.Errorf("failed to read client account %s from world state: %v", account, err)
 	}
 
-	if fromCurrentBalanceBytes == nil {
-		return fmt.Errorf("client account %s has no balance", from)
+	if currentBalanceBytes == nil {
+		return fmt.Errorf("client account %s has no balance", account)
 	}
 
-	fromCurrentBalance, _ := strconv.Atoi(string(fromCurrentBalanceBytes)) // Error handling not needed since Itoa() was used when setting the account balance, guaranteeing it was an integer.
+	currentBalance, _ := strconv.Atoi(string(currentBalanceBytes)) // Error handling not needed since Itoa() was used when setting the account balance, guaranteeing it was an integer.
 
-	if fromCurrentBalance < value {
-		return fmt.Errorf("client account %s has insufficient funds", from)
+	if currentBalance < value {
+		return fmt.Errorf("client account %s has insufficient funds", account)
 	}
 
-	toCurrentBalanceBytes, err := ctx.GetStub().GetState(to)
+	updatedBalance := currentBalance - value
+	err = ctx.GetStub().PutState(account, []byte(strconv.Itoa(updatedBalance)))
 	if err != nil {
-		return fmt.Errorf("failed to read recipient account %s from world state: %v", to, err)
+		return err
 	}
 
-	var toCurrentBalance int
-	// If recipient current balance doesn't yet exist, we'll create it with a current balance of 0
-	if toCurrentBalanceBytes == nil {
-		toCurrentBalance = 0
-	} else {
-		toCurrentBalance, _ = strconv.Atoi(string(toCurrentBalanceBytes)) // Error handling not needed since Itoa() was used when setting the account balance, guaranteeing it was an integer.
+	log.Printf("client %s balance updated from %d to %d", account, currentBalance, updatedBalance)
+
+	return nil
+}
+
+// creditHelper adds value to the balance of account
+func creditHelper(ctx contractapi.TransactionContextInterface, account string, value int) error {
+
+	currentBalanceBytes, err := ctx.GetStub().GetState(account)
+	if err != nil {
+		return fmt.Errorf("failed to read recipient account %s from world state: %v", account, err)
 	}
 
-	fromUpdatedBalance := fromCurrentBalance - value
-	toUpdatedBalance := toCurrentBalance + value
+	var currentBalance int
+	// If recipient current balance doesn't yet exist, we'll create it with a current balance of 0
+	if currentBalanceBytes != nil {
+		currentBalance, _ = strconv.Atoi(string(currentBalanceBytes)) // Error handling not needed since Itoa() was used when setting the account balance, guaranteeing it was an integer.
+	}
 
-	err = ctx.GetStub().PutState(from, []byte(strconv.Itoa(fromUpdatedBalance)))
+	updatedBalance, err := add(currentBalance, value)
 	if err != nil {
 		return err
 	}
-
-	err = ctx.GetStub().PutState(to, []byte(strconv.Itoa(toUpdatedBalance)))
+	err = ctx.GetStub().PutState(account, []byte(strconv.Itoa(updatedBalance)))
 	if err != nil {
 		return err
 	}
 
-	log.Printf("client %s balance updated from %d to %d", from, fromCurrentBalance, fromUpdatedBalance)
-	log.Printf("recipient %s balance updated from %d to %d", to, toCurrentBalance, toUpdatedBalance)
+	log.Printf("recipient %s balance updated from %d to %d", account, currentBalance, updatedBalance)
 
 	return nil
 }
+
+// add returns the sum of two non-negative amounts, or an error if it overflows
+func add(a int, b int) (int, error) {
+	if a > math.MaxInt64-b {
+		return 0, fmt.Errorf("addition overflow: %d + %d", a, b)
+	}
+	return a + b, nil
+}
@@ -0,0 +1,128 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/stretchr/testify/require"
+)
+
+const sender = "eDUwOTo6Q049c2VuZGVy"
+
+// MemoryStub keeps the world state of a transaction in memory
+type MemoryStub struct {
+	shim.ChaincodeStubInterface
+	state  map[string][]byte
+	writes map[string]int
+	events map[string][]byte
+}
+
+func (ms *MemoryStub) GetState(key string) ([]byte, error) {
+	return ms.state[key], nil
+}
+
+func (ms *MemoryStub) PutState(key string, value []byte) error {
+	ms.state[key] = value
+	ms.writes[key]++
+	return nil
+}
+
+func (ms *MemoryStub) SetEvent(name string, payload []byte) error {
+	ms.events[name] = payload
+	return nil
+}
+
+type MockClientIdentity struct {
+	cid.ClientIdentity
+	id string
+}
+
+func (ci *MockClientIdentity) GetID() (string, error) {
+	return ci.id, nil
+}
+
+type MockContext struct {
+	contractapi.TransactionContextInterface
+	stub     *MemoryStub
+	identity *MockClientIdentity
+}
+
+func (mc *MockContext) GetStub() shim.ChaincodeStubInterface {
+	return mc.stub
+}
+
+func (mc *MockContext) GetClientIdentity() cid.ClientIdentity {
+	return mc.identity
+}
+
+// setupContext returns a context of sender, who holds balance tokens
+func setupContext(balance int) (*MockContext, *MemoryStub) {
+	ms := &MemoryStub{
+		state:  map[string][]byte{sender: []byte(strconv.Itoa(balance))},
+		writes: map[string]int{},
+		events: map[string][]byte{},
+	}
+	return &MockContext{stub: ms, identity: &MockClientIdentity{id: sender}}, ms
+}
+
+func TestBatchTransfer(t *testing.T) {
+	ctx, ms := setupContext(100)
+	s := new(SmartContract)
+
+	// Each balance is written once, amounts to the same recipient are added up
+	err := s.BatchTransfer(ctx, []string{"bob", "carol", "bob"}, []int{10, 20, 5})
+	require.NoError(t, err)
+	require.Equal(t, "65", string(ms.state[sender]))
+	require.Equal(t, "15", string(ms.state["bob"]))
+	require.Equal(t, "20", string(ms.state["carol"]))
+	require.Equal(t, map[string]int{sender: 1, "bob": 1, "carol": 1}, ms.writes)
+
+	expected, _ := json.Marshal(batchEvent{sender, []string{"bob", "carol", "bob"}, []int{10, 20, 5}})
+	require.Equal(t, expected, ms.events["TransferBatch"])
+}
+
+func TestBatchTransferInsufficientFunds(t *testing.T) {
+	ctx, ms := setupContext(100)
+	s := new(SmartContract)
+
+	err := s.BatchTransfer(ctx, []string{"bob", "carol"}, []int{60, 41})
+	require.EqualError(t, err, "failed to transfer: client account "+sender+" has insufficient funds")
+	require.Empty(t, ms.writes)
+	require.Empty(t, ms.events)
+}
+
+func TestBatchTransferOverflow(t *testing.T) {
+	ctx, ms := setupContext(100)
+	s := new(SmartContract)
+
+	err := s.BatchTransfer(ctx, []string{"bob", "carol"}, []int{math.MaxInt64, 1})
+	require.EqualError(t, err, "addition overflow: 9223372036854775807 + 1")
+
+	// The credit of a recipient cannot overflow its balance either
+	ms.state["bob"] = []byte(strconv.Itoa(math.MaxInt64))
+	err = s.BatchTransfer(ctx, []string{"bob"}, []int{1})
+	require.EqualError(t, err, "failed to transfer: addition overflow: 9223372036854775807 + 1")
+}
+
+func TestBatchTransferInvalid(t *testing.T) {
+	ctx, ms := setupContext(100)
+	s := new(SmartContract)
+
+	err := s.BatchTransfer(ctx, []string{}, []int{})
+	require.EqualError(t, err, "batch transfer requires at least one recipient")
+
+	err = s.BatchTransfer(ctx, []string{"bob"}, []int{1, 2})
+	require.EqualError(t, err, "recipients and amounts must have the same length")
+
+	err = s.BatchTransfer(ctx, []string{"bob", sender}, []int{1, 2})
+	require.EqualError(t, err, "cannot transfer to and from same client account")
+
+	err = s.BatchTransfer(ctx, []string{"bob"}, []int{-1})
+	require.EqualError(t, err, "transfer amount cannot be negative")
+	require.Empty(t, ms.writes)
+}
@@ -42,6 +42,54 @@ func _readNFT(ctx contractapi.TransactionContextInterface, tokenId string) (*Nft
 	return nft, nil
 }
 
+// _transferNFT assigns nft to a new owner, moves the balance record and removes the listing of the
+// previous owner, it does not check authorization
+func _transferNFT(ctx contractapi.TransactionContextInterface, nft *Nft, from string, to string) error {
+	// Clear the approved client for this non-fungible token
+	nft.Approved = ""
+
+	// Overwrite a non-fungible token to assign a new owner.
+	nft.Owner = to
+	nftKey, err := ctx.GetStub().CreateCompositeKey(nftPrefix, []string{nft.TokenId})
+	if err != nil {
+		return fmt.Errorf("failed to CreateCompositeKey: %v", err)
+	}
+
+	nftBytes, err := json.Marshal(nft)
+	if err != nil {
+		return fmt.Errorf("failed to marshal approval: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(nftKey, nftBytes)
+	if err != nil {
+		return fmt.Errorf("failed to PutState nftBytes %s: %v", nftBytes, err)
+	}
+
+	// Remove a composite key from the balance of the current owner
+	balanceKeyFrom, err := ctx.GetStub().CreateCompositeKey(balancePrefix, []string{from, nft.TokenId})
+	if err != nil {
+		return fmt.Errorf("failed to CreateCompositeKey from: %v", err)
+	}
+
+	err = ctx.GetStub().DelState(balanceKeyFrom)
+	if err != nil {
+		return fmt.Errorf("failed to DelState balanceKeyFrom %s: %v", nftBytes, err)
+	}
+
+	// Save a composite key to count the balance of a new owner
+	balanceKeyTo, err := ctx.GetStub().CreateCompositeKey(balancePrefix, []string{to, nft.TokenId})
+	if err != nil {
+		return fmt.Errorf("failed to CreateCompositeKey to: %v", err)
+	}
+	err = ctx.GetStub().PutState(balanceKeyTo, []byte{0})
+	if err != nil {
+		return fmt.Errorf("failed to PutState balanceKeyTo %s: %v", balanceKeyTo, err)
+	}
+
+	// A listing is made by the previous owner, it must not survive the token coming back to them
+	return _deleteListing(ctx, nft.TokenId)
+}
+
 func _nftExists(ctx contractapi.TransactionContextInterface, tokenId string) bool {
 	nftKey, err := ctx.GetStub().CreateCompositeKey(nftPrefix, []string{tokenId})
 	if err != nil {
@@ -271,45 +319,9 @@ func (c *TokenERC721Contract) TransferFrom(ctx contractapi.TransactionContextInt
 		return false, fmt.Errorf("the from is not the current owner")
 	}
 
-	// Clear the approved client for this non-fungible token
-	nft.Approved = ""
-
-	// Overwrite a non-fungible token to assign a new owner.
-	nft.Owner = to
-	nftKey, err := ctx.GetStub().CreateCompositeKey(nftPrefix, []string{tokenId})
+	err = _transferNFT(ctx, nft, from, to)
 	if err != nil {
-		return false, fmt.Errorf("failed to CreateCompositeKey: %v", err)
-	}
-
-	nftBytes, err := json.Marshal(nft)
-	if err != nil {
-		return false, fmt.Errorf("failed to marshal approval: %v", err)
-	}
-
-	err = ctx.GetStub().PutState(nftKey, nftBytes)
-	if err != nil {
-		return false, fmt.Errorf("failed to PutState nftBytes %s: %v", nftBytes, err)
-	}
-
-	// Remove a composite key from the balance of the current owner
-	balanceKeyFrom, err := ctx.GetStub().CreateCompositeKey(balancePrefix, []string{from, tokenId})
-	if err != nil {
-		return false, fmt.Errorf("failed to CreateCompositeKey from: %v", err)
-	}
-
-	err = ctx.GetStub().DelState(balanceKeyFrom)
-	if err != nil {
-		return false, fmt.Errorf("failed to DelState balanceKeyFrom %s: %v", nftBytes, err)
-	}
-
-	// Save a composite key to count the balance of a new owner
-	balanceKeyTo, err := ctx.GetStub().CreateCompositeKey(balancePrefix, []string{to, tokenId})
-	if err != nil {
-		return false, fmt.Errorf("failed to CreateCompositeKey to: %v", err)
-	}
-	err = ctx.GetStub().PutState(balanceKeyTo, []byte{0})
-	if err != nil {
-		return false, fmt.Errorf("failed to PutState balanceKeyTo %s: %v", balanceKeyTo, err)
+		return false, err
 	}
 
 	// Emit the Transfer event
@@ -398,6 +410,78 @@ func (c *TokenERC721Contract) TotalSupply(ctx contractapi.TransactionContextInte
 
 }
 
+// TokensOfOwner returns a page of the non-fungible tokens owned by an owner
+// param {String} owner An owner for whom to query the tokens
+// param {Number} pageSize The maximum number of tokens to return
+// param {String} bookmark The bookmark returned with the previous page, empty for the first page
+// returns {Object} Return the tokens and the bookmark of the next page
+func (c *TokenERC721Contract) TokensOfOwner(ctx contractapi.TransactionContextInterface, owner string, pageSize int32, bookmark string) (*NftQueryResult, error) {
+	// The balance records balancePrefix.owner.tokenId index the tokens by owner
+	iterator, responseMetadata, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination(balancePrefix, []string{owner}, pageSize, bookmark)
+	if err != nil {
+		return nil, fmt.Errorf("failed to GetStateByPartialCompositeKeyWithPagination: %v", err)
+	}
+	defer iterator.Close()
+
+	nfts := []*Nft{}
+	for iterator.HasNext() {
+		queryResponse, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the next balance record: %v", err)
+		}
+
+		_, attributes, err := ctx.GetStub().SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to SplitCompositeKey %s: %v", queryResponse.Key, err)
+		}
+
+		nft, err := _readNFT(ctx, attributes[1])
+		if err != nil {
+			return nil, fmt.Errorf("failed to _readNFT: %v", err)
+		}
+		nfts = append(nfts, nft)
+	}
+
+	return &NftQueryResult{
+		Records:             nfts,
+		FetchedRecordsCount: responseMetadata.FetchedRecordsCount,
+		Bookmark:            responseMetadata.Bookmark,
+	}, nil
+}
+
+// AllTokens returns a page of all non-fungible tokens tracked by this contract
+// param {Number} pageSize The maximum number of tokens to return
+// param {String} bookmark The bookmark returned with the previous page, empty for the first page
+// returns {Object} Return the tokens and the bookmark of the next page
+func (c *TokenERC721Contract) AllTokens(ctx contractapi.TransactionContextInterface, pageSize int32, bookmark string) (*NftQueryResult, error) {
+	iterator, responseMetadata, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination(nftPrefix, []string{}, pageSize, bookmark)
+	if err != nil {
+		return nil, fmt.Errorf("failed to GetStateByPartialCompositeKeyWithPagination: %v", err)
+	}
+	defer iterator.Close()
+
+	nfts := []*Nft{}
+	for iterator.HasNext() {
+		queryResponse, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the next nft: %v", err)
+		}
+
+		nft := new(Nft)
+		err = json.Unmarshal(queryResponse.Value, nft)
+		if err != nil {
+			return nil, fmt.Errorf("failed to Unmarshal nftBytes: %v", err)
+		}
+		nfts = append(nfts, nft)
+	}
+
+	return &NftQueryResult{
+		Records:             nfts,
+		FetchedRecordsCount: responseMetadata.FetchedRecordsCount,
+		Bookmark:            responseMetadata.Bookmark,
+	}, nil
+}
+
 // ============== ERC721 enumeration extension ===============
 // Set optional information for a token.
 // param {String} name The name of the token
@@ -560,6 +644,23 @@ func (c *TokenERC721Contract) Burn(ctx contractapi.TransactionContextInterface,
 		return false, fmt.Errorf("failed to DelState balanceKey %s: %v", balanceKey, err)
 	}
 
+	// Remove the royalty record, so that a token minted again with the same ID starts without one
+	royaltyKey, err := ctx.GetStub().CreateCompositeKey(royaltyPrefix, []string{tokenId})
+	if err != nil {
+		return false, fmt.Errorf("failed to CreateCompositeKey royaltyKey: %v", err)
+	}
+
+	err = ctx.GetStub().DelState(royaltyKey)
+	if err != nil {
+		return false, fmt.Errorf("failed to DelState royaltyKey %s: %v", royaltyKey, err)
+	}
+
+	// Remove the listing, so that a token minted again with the same ID is not for sale
+	err = _deleteListing(ctx, tokenId)
+	if err != nil {
+		return false, err
+	}
+
 	// Emit the Transfer event
 	transferEvent := new(Transfer)
 	transferEvent.From = owner
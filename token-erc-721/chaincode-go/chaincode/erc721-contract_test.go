@@ -2,12 +2,14 @@ package chaincode
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"testing"
 
 	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
 	"github.com/hyperledger/fabric-chaincode-go/shim"
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
 	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	"github.com/hyperledger/fabric-protos-go/peer"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -26,6 +28,16 @@ func (ms *MockStub) GetStateByPartialCompositeKey(objectType string, keys []stri
 	return args.Get(0).(shim.StateQueryIteratorInterface), args.Error(1)
 }
 
+func (ms *MockStub) GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+	args := ms.Called(objectType, keys, pageSize, bookmark)
+	return args.Get(0).(shim.StateQueryIteratorInterface), args.Get(1).(*peer.QueryResponseMetadata), args.Error(2)
+}
+
+func (ms *MockStub) SplitCompositeKey(compositeKey string) (string, []string, error) {
+	args := ms.Called(compositeKey)
+	return args.String(0), args.Get(1).([]string), args.Error(2)
+}
+
 func (ms *MockStub) GetState(key string) ([]byte, error) {
 	args := ms.Called(key)
 	return args.Get(0).([]byte), args.Error(1)
@@ -50,6 +62,11 @@ func (ms *MockStub) CreateCompositeKey(objectType string, attributes []string) (
 	return args.Get(0).(string), args.Error(1)
 }
 
+func (ms *MockStub) InvokeChaincode(chaincodeName string, args [][]byte, channel string) peer.Response {
+	callArgs := ms.Called(chaincodeName, args, channel)
+	return callArgs.Get(0).(peer.Response)
+}
+
 type MockClientIdentity struct {
 	cid.ClientIdentity
 	mock.Mock
@@ -67,7 +84,7 @@ func (mci *MockClientIdentity) GetMSPID() (string, error) {
 
 func (mc *MockContext) GetStub() shim.ChaincodeStubInterface {
 	args := mc.Called()
-	return args.Get(0).(*MockStub)
+	return args.Get(0).(shim.ChaincodeStubInterface)
 }
 
 type MockContext struct {
@@ -80,6 +97,30 @@ func (mc *MockContext) GetClientIdentity() cid.ClientIdentity {
 	return args.Get(0).(*MockClientIdentity)
 }
 
+// MemoryStub keeps the world state in memory and leaves the other calls to the mock
+type MemoryStub struct {
+	*MockStub
+	state map[string][]byte
+}
+
+func (ms *MemoryStub) GetState(key string) ([]byte, error) {
+	return ms.state[key], nil
+}
+
+func (ms *MemoryStub) PutState(key string, value []byte) error {
+	ms.state[key] = value
+	return nil
+}
+
+func (ms *MemoryStub) DelState(key string) error {
+	delete(ms.state, key)
+	return nil
+}
+
+func (ms *MemoryStub) SetEvent(key string, value []byte) error {
+	return nil
+}
+
 type MockIterator struct {
 	shim.StateQueryIteratorInterface
 	queryresult.KV
@@ -89,6 +130,30 @@ func (it *MockIterator) HasNext() bool {
 	return false
 }
 
+func (it *MockIterator) Close() error {
+	return nil
+}
+
+// MockPageIterator iterates over a page of query results
+type MockPageIterator struct {
+	shim.StateQueryIteratorInterface
+	results []*queryresult.KV
+}
+
+func (it *MockPageIterator) HasNext() bool {
+	return len(it.results) > 0
+}
+
+func (it *MockPageIterator) Next() (*queryresult.KV, error) {
+	result := it.results[0]
+	it.results = it.results[1:]
+	return result, nil
+}
+
+func (it *MockPageIterator) Close() error {
+	return nil
+}
+
 func setupStub() (*MockContext, *MockStub) {
 	balancePrefix := "balance"
 	approvalPrefix := "approval"
@@ -112,6 +177,9 @@ func setupStub() (*MockContext, *MockStub) {
 	ms.On("CreateCompositeKey", balancePrefix, []string{owner, mockTokenId}).Return(balancePrefix+owner+mockTokenId, nil)
 	ms.On("CreateCompositeKey", balancePrefix, []string{operator, mockTokenId}).Return(balancePrefix+operator+mockTokenId, nil)
 	ms.On("CreateCompositeKey", balancePrefix, []string{owner, "102"}).Return(balancePrefix+owner+mockTokenId, nil)
+	ms.On("CreateCompositeKey", "royalty", []string{mockTokenId}).Return("royalty101", nil)
+	ms.On("CreateCompositeKey", "royalty", []string{"102"}).Return("royalty102", nil)
+	ms.On("CreateCompositeKey", "listing", []string{mockTokenId}).Return("listing101", nil)
 
 	ms.On("GetState", "nft101").Return([]byte(nftStr), nil)
 	ms.On("GetState", "nft102").Return([]uint8{}, nil)
@@ -162,6 +230,36 @@ func TestTotalSupply(t *testing.T) {
 
 }
 
+func TestTokensOfOwner(t *testing.T) {
+	ctx, ms := setupStub()
+	c := new(TokenERC721Contract)
+
+	iterator := &MockPageIterator{results: []*queryresult.KV{{Key: "balance" + owner + "101", Value: []byte{0}}}}
+	ms.On("GetStateByPartialCompositeKeyWithPagination", "balance", []string{owner}, int32(10), "").Return(iterator, &peer.QueryResponseMetadata{FetchedRecordsCount: 1, Bookmark: "next"}, nil)
+	ms.On("SplitCompositeKey", "balance"+owner+"101").Return("balance", []string{owner, "101"}, nil)
+
+	result, err := c.TokensOfOwner(ctx, owner, 10, "")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), result.FetchedRecordsCount)
+	assert.Equal(t, "next", result.Bookmark)
+	assert.Len(t, result.Records, 1)
+	assert.Equal(t, "101", result.Records[0].TokenId)
+	assert.Equal(t, owner, result.Records[0].Owner)
+}
+
+func TestAllTokens(t *testing.T) {
+	ctx, ms := setupStub()
+	c := new(TokenERC721Contract)
+
+	nftStr := "{\"tokenId\":\"101\",\"owner\":\"" + owner + "\",\"tokenURI\":\"https://example.com/nft101.json\",\"approved\":\"\"}"
+	iterator := &MockPageIterator{results: []*queryresult.KV{{Key: "nft101", Value: []byte(nftStr)}}}
+	ms.On("GetStateByPartialCompositeKeyWithPagination", "nft", []string{}, int32(10), "").Return(iterator, &peer.QueryResponseMetadata{FetchedRecordsCount: 1, Bookmark: ""}, nil)
+
+	result, err := c.AllTokens(ctx, 10, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []*Nft{{TokenId: "101", Owner: owner, TokenURI: "https://example.com/nft101.json"}}, result.Records)
+}
+
 func TestOwnerOf(t *testing.T) {
 	ctx, _ := setupStub()
 	c := new(TokenERC721Contract)
@@ -207,12 +305,13 @@ func TestGetApproved(t *testing.T) {
 }
 
 func TestTransferFrom(t *testing.T) {
-	ctx, _ := setupStub()
+	ctx, ms := setupStub()
 	c := new(TokenERC721Contract)
 
 	transfer, _ := c.TransferFrom(ctx, owner, operator, "101")
 
 	assert.Equal(t, true, transfer)
+	ms.AssertCalled(t, "DelState", "listing101")
 }
 
 func TestName(t *testing.T) {
@@ -267,11 +366,13 @@ func TestMintWithTokenURI(t *testing.T) {
 }
 
 func TestBurn(t *testing.T) {
-	ctx, _ := setupStub()
+	ctx, ms := setupStub()
 	c := new(TokenERC721Contract)
 
 	burn, _ := c.Burn(ctx, "101")
 	assert.Equal(t, true, burn)
+	ms.AssertCalled(t, "DelState", "royalty101")
+	ms.AssertCalled(t, "DelState", "listing101")
 }
 
 func TestClientAccoundId(t *testing.T) {
@@ -280,3 +381,137 @@ func TestClientAccoundId(t *testing.T) {
 	client, _ := c.ClientAccountID(ctx)
 	assert.Equal(t, owner, client)
 }
+
+// setupBuyer returns a context of the operator client on the stub of setupStub
+func setupBuyer(ms *MockStub) *MockContext {
+	return setupClient(ms, operator, "Org2MSP")
+}
+
+// setupClient returns a context of client from the organization mspID
+func setupClient(stub shim.ChaincodeStubInterface, client string, mspID string) *MockContext {
+	mci := new(MockClientIdentity)
+	mci.On("GetID").Return(base64.StdEncoding.EncodeToString([]byte(client)), nil)
+	mci.On("GetMSPID").Return(mspID, nil)
+
+	mc := new(MockContext)
+	mc.On("GetStub").Return(stub)
+	mc.On("GetClientIdentity").Return(mci)
+	return mc
+}
+
+func TestMintWithRoyalty(t *testing.T) {
+	ctx, ms := setupStub()
+	c := new(TokenERC721Contract)
+
+	_, err := c.MintWithRoyalty(ctx, "102", "https://example.com/nft102.json", "creatorAccount", 10001)
+	assert.EqualError(t, err, "royalty basis points must be between 0 and 10000")
+
+	mint, err := c.MintWithRoyalty(ctx, "102", "https://example.com/nft102.json", "creatorAccount", 500)
+	assert.NoError(t, err)
+	assert.Equal(t, owner, mint.Owner)
+	ms.AssertCalled(t, "PutState", "royalty102", []byte("{\"tokenId\":\"102\",\"receiver\":\"creatorAccount\",\"basisPoints\":500}"))
+}
+
+func TestRoyaltyInfo(t *testing.T) {
+	ctx, ms := setupStub()
+	c := new(TokenERC721Contract)
+
+	ms.On("GetState", "royalty101").Return([]byte("{\"tokenId\":\"101\",\"receiver\":\"creatorAccount\",\"basisPoints\":250}"), nil)
+
+	payment, err := c.RoyaltyInfo(ctx, "101", 1999)
+	assert.NoError(t, err)
+	assert.Equal(t, &RoyaltyPayment{Receiver: "creatorAccount", RoyaltyAmount: 49}, payment)
+
+	_, err = c.RoyaltyInfo(ctx, "102", 1999)
+	assert.EqualError(t, err, "the token 102 does not exist")
+}
+
+func TestListForSale(t *testing.T) {
+	ctx, ms := setupStub()
+	c := new(TokenERC721Contract)
+
+	ms.On("SetEvent", "ListedForSale", mock.AnythingOfType("[]uint8")).Return(nil)
+
+	listing, err := c.ListForSale(ctx, "101", 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, &Listing{TokenId: "101", Seller: owner, SellerAccount: base64.StdEncoding.EncodeToString([]byte(owner)), Price: 1000}, listing)
+
+	// Only the owner can list a token
+	_, err = c.ListForSale(setupBuyer(ms), "101", 1000)
+	assert.EqualError(t, err, "non-fungible token 101 is not owned by "+operator)
+}
+
+func TestCancelListing(t *testing.T) {
+	ctx, ms := setupStub()
+	c := new(TokenERC721Contract)
+
+	listingStr := "{\"tokenId\":\"101\",\"seller\":\"" + owner + "\",\"sellerAccount\":\"sellerAccount\",\"price\":1000}"
+	ms.On("GetState", "listing101").Return([]byte(listingStr), nil)
+	ms.On("SetEvent", "ListingCancelled", mock.AnythingOfType("[]uint8")).Return(nil)
+
+	_, err := c.CancelListing(setupBuyer(ms), "101")
+	assert.EqualError(t, err, "the sender is not the seller nor the current owner")
+
+	cancelled, err := c.CancelListing(ctx, "101")
+	assert.NoError(t, err)
+	assert.Equal(t, true, cancelled)
+	ms.AssertCalled(t, "DelState", "listing101")
+}
+
+func TestBuy(t *testing.T) {
+	_, ms := setupStub()
+	c := new(TokenERC721Contract)
+	ctx := setupBuyer(ms)
+
+	listingStr := "{\"tokenId\":\"101\",\"seller\":\"" + owner + "\",\"sellerAccount\":\"sellerAccount\",\"price\":1000}"
+	ms.On("GetState", "listing101").Return([]byte(listingStr), nil)
+	ms.On("GetState", "marketplace").Return([]byte("{\"chaincode\":\"inpoin\",\"feeReceiver\":\"platformAccount\",\"feeBasisPoints\":250}"), nil)
+	ms.On("GetState", "royalty101").Return([]byte("{\"tokenId\":\"101\",\"receiver\":\"creatorAccount\",\"basisPoints\":500}"), nil)
+	ms.On("SetEvent", "Sale", mock.AnythingOfType("[]uint8")).Return(nil)
+
+	// The price must match the listing
+	_, err := c.Buy(ctx, "101", 900)
+	assert.EqualError(t, err, "the token 101 is listed for 1000, not 900")
+
+	// The seller, the royalty receiver and the platform are paid in a single BatchTransfer
+	settlement := [][]byte{[]byte("BatchTransfer"), []byte("[\"sellerAccount\",\"creatorAccount\",\"platformAccount\"]"), []byte("[925,50,25]")}
+	ms.On("InvokeChaincode", "inpoin", settlement, "").Return(shim.Error("client account has insufficient funds")).Once()
+	_, err = c.Buy(ctx, "101", 1000)
+	assert.EqualError(t, err, "failed to pay through inpoin: client account has insufficient funds")
+	ms.AssertNotCalled(t, "DelState", "listing101")
+
+	ms.On("InvokeChaincode", "inpoin", settlement, "").Return(shim.Success(nil)).Once()
+	sale, err := c.Buy(ctx, "101", 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, &Sale{From: owner, To: operator, TokenId: "101", Price: 1000, RoyaltyReceiver: "creatorAccount", RoyaltyAmount: 50, Fee: 25}, sale)
+	saleBytes, _ := json.Marshal(sale)
+	ms.AssertCalled(t, "SetEvent", "Sale", saleBytes)
+	ms.AssertNotCalled(t, "SetEvent", "Transfer", mock.Anything)
+	ms.AssertCalled(t, "DelState", balancePrefix+owner+"101")
+	ms.AssertCalled(t, "PutState", balancePrefix+operator+"101", []byte{0})
+	ms.AssertCalled(t, "DelState", "listing101")
+}
+
+func TestTransferRemovesListing(t *testing.T) {
+	_, ms := setupStub()
+	c := new(TokenERC721Contract)
+
+	nftBytes, _ := ms.GetState("nft101")
+	mem := &MemoryStub{MockStub: ms, state: map[string][]byte{"nft101": nftBytes}}
+	ms.On("CreateCompositeKey", approvalPrefix, []string{operator, operator}).Return(approvalPrefix+operator+operator, nil)
+
+	seller := setupClient(mem, owner, "Org1MSP")
+	buyer := setupClient(mem, operator, "Org2MSP")
+
+	_, err := c.ListForSale(seller, "101", 1000)
+	assert.NoError(t, err)
+
+	// The token leaves the seller and comes back, the old listing must not be bought
+	_, err = c.TransferFrom(seller, owner, operator, "101")
+	assert.NoError(t, err)
+	_, err = c.TransferFrom(buyer, operator, owner, "101")
+	assert.NoError(t, err)
+
+	_, err = c.Buy(buyer, "101", 1000)
+	assert.EqualError(t, err, "the token 101 is not listed for sale")
+}
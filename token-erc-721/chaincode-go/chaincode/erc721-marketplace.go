@@ -0,0 +1,491 @@
+package chaincode
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Define objectType names for prefix
+const royaltyPrefix = "royalty"
+const listingPrefix = "listing"
+
+// Define key name for the marketplace configuration
+const marketplaceKey = "marketplace"
+
+// Royalties and fees are expressed in basis points, hundredths of a percent
+const maxBasisPoints = 10000
+
+// ============== EIP-2981 royalty extension ===============
+
+// MintWithRoyalty mints a new non-fungible token like MintWithTokenURI and records its royalty
+// param {String} tokenId Unique ID of the non-fungible token to be minted
+// param {String} tokenURI URI containing metadata of the minted non-fungible token
+// param {String} receiver ERC-20 account that receives the royalty of every sale
+// param {Number} basisPoints Share of the sale price paid as royalty, in hundredths of a percent
+// returns {Object} Return the non-fungible token object
+
+func (c *TokenERC721Contract) MintWithRoyalty(ctx contractapi.TransactionContextInterface, tokenId string, tokenURI string, receiver string, basisPoints int) (*Nft, error) {
+	if basisPoints < 0 || basisPoints > maxBasisPoints {
+		return nil, fmt.Errorf("royalty basis points must be between 0 and %d", maxBasisPoints)
+	}
+	if basisPoints > 0 && receiver == "" {
+		return nil, fmt.Errorf("royalty receiver must not be empty")
+	}
+
+	nft, err := c.MintWithTokenURI(ctx, tokenId, tokenURI)
+	if err != nil {
+		return nil, err
+	}
+
+	if basisPoints == 0 {
+		return nft, nil
+	}
+
+	royalty := new(Royalty)
+	royalty.TokenId = tokenId
+	royalty.Receiver = receiver
+	royalty.BasisPoints = basisPoints
+
+	royaltyKey, err := ctx.GetStub().CreateCompositeKey(royaltyPrefix, []string{tokenId})
+	if err != nil {
+		return nil, fmt.Errorf("failed to CreateCompositeKey royaltyKey: %v", err)
+	}
+
+	royaltyBytes, err := json.Marshal(royalty)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal royalty: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(royaltyKey, royaltyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to PutState royaltyBytes %s: %v", royaltyBytes, err)
+	}
+
+	return nft, nil
+}
+
+// RoyaltyInfo returns the receiver and the amount of the royalty owed for a sale of a non-fungible token
+// param {String} tokenId Unique ID of the non-fungible token
+// param {Number} salePrice The sale price of the non-fungible token
+// returns {Object} Return the royalty receiver and amount, an empty receiver and 0 if the token has no royalty
+
+func (c *TokenERC721Contract) RoyaltyInfo(ctx contractapi.TransactionContextInterface, tokenId string, salePrice int) (*RoyaltyPayment, error) {
+	if salePrice < 0 {
+		return nil, fmt.Errorf("sale price cannot be negative")
+	}
+
+	if !_nftExists(ctx, tokenId) {
+		return nil, fmt.Errorf("the token %s does not exist", tokenId)
+	}
+
+	royalty, err := _readRoyalty(ctx, tokenId)
+	if err != nil {
+		return nil, err
+	}
+
+	royaltyAmount, err := _basisPointsOf(salePrice, royalty.BasisPoints)
+	if err != nil {
+		return nil, err
+	}
+
+	payment := new(RoyaltyPayment)
+	payment.Receiver = royalty.Receiver
+	payment.RoyaltyAmount = royaltyAmount
+	return payment, nil
+}
+
+// ============== Marketplace ===============
+
+// SetMarketplace configures the ERC-20 chaincode that settles sales and the platform fee.
+// The ERC-20 chaincode must be deployed on the same channel and implement BatchTransfer.
+// Of the ERC-20 chaincodes in this repository only the Inpoin token implements BatchTransfer.
+// param {String} chaincodeName Name of the ERC-20 chaincode, for example the Inpoin token
+// param {String} feeReceiver ERC-20 account that receives the platform fee
+// param {Number} feeBasisPoints Share of every sale price paid as platform fee, in hundredths of a percent
+// returns {Boolean} Return whether the configuration was successful or not
+
+func (c *TokenERC721Contract) SetMarketplace(ctx contractapi.TransactionContextInterface, chaincodeName string, feeReceiver string, feeBasisPoints int) (bool, error) {
+	// Check authorization - this sample assumes Org1 is the platform operator with privilege to configure the marketplace
+	clientMSPID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return false, fmt.Errorf("failed to get clientMSPID: %v", err)
+	} else if clientMSPID != "Org1MSP" {
+		return false, fmt.Errorf("client is not authorized to configure the marketplace")
+	}
+
+	if chaincodeName == "" {
+		return false, fmt.Errorf("chaincode name must not be empty")
+	}
+	if feeBasisPoints < 0 || feeBasisPoints > maxBasisPoints {
+		return false, fmt.Errorf("fee basis points must be between 0 and %d", maxBasisPoints)
+	}
+	if feeBasisPoints > 0 && feeReceiver == "" {
+		return false, fmt.Errorf("fee receiver must not be empty")
+	}
+
+	marketplace := new(Marketplace)
+	marketplace.Chaincode = chaincodeName
+	marketplace.FeeReceiver = feeReceiver
+	marketplace.FeeBasisPoints = feeBasisPoints
+
+	marketplaceBytes, err := json.Marshal(marketplace)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal marketplace: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(marketplaceKey, marketplaceBytes)
+	if err != nil {
+		return false, fmt.Errorf("failed to PutState marketplaceKey %s: %v", marketplaceKey, err)
+	}
+
+	return true, nil
+}
+
+// GetMarketplace returns the configuration of the marketplace
+// returns {Object} Return the marketplace configuration
+
+func (c *TokenERC721Contract) GetMarketplace(ctx contractapi.TransactionContextInterface) (*Marketplace, error) {
+	return _readMarketplace(ctx)
+}
+
+// ListForSale offers a non-fungible token of the caller for sale, replacing any previous listing of the token.
+// The proceeds are paid to the ERC-20 account of the caller, which is its client ID.
+// param {String} tokenId Unique ID of the non-fungible token
+// param {Number} price The price of the non-fungible token in the ERC-20 token of the marketplace
+// returns {Object} Return the listing
+
+func (c *TokenERC721Contract) ListForSale(ctx contractapi.TransactionContextInterface, tokenId string, price int) (*Listing, error) {
+	if price <= 0 {
+		return nil, fmt.Errorf("price must be a positive integer")
+	}
+	if price > math.MaxInt/maxBasisPoints {
+		return nil, fmt.Errorf("price must not exceed %d", math.MaxInt/maxBasisPoints)
+	}
+
+	sellerAccount, seller, err := _readClientID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	nft, err := _readNFT(ctx, tokenId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to _readNFT : %v", err)
+	}
+	if nft.Owner != seller {
+		return nil, fmt.Errorf("non-fungible token %s is not owned by %s", tokenId, seller)
+	}
+
+	listing := new(Listing)
+	listing.TokenId = tokenId
+	listing.Seller = seller
+	listing.SellerAccount = sellerAccount
+	listing.Price = price
+
+	listingKey, err := ctx.GetStub().CreateCompositeKey(listingPrefix, []string{tokenId})
+	if err != nil {
+		return nil, fmt.Errorf("failed to CreateCompositeKey listingKey: %v", err)
+	}
+
+	listingBytes, err := json.Marshal(listing)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal listing: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(listingKey, listingBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to PutState listingBytes %s: %v", listingBytes, err)
+	}
+
+	err = ctx.GetStub().SetEvent("ListedForSale", listingBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to SetEvent listingBytes %s: %v", listingBytes, err)
+	}
+
+	return listing, nil
+}
+
+// CancelListing withdraws a non-fungible token from sale. It can be called by the seller,
+// or by the current owner if the token changed hands since it was listed.
+// param {String} tokenId Unique ID of the non-fungible token
+// returns {Boolean} Return whether the cancellation was successful or not
+
+func (c *TokenERC721Contract) CancelListing(ctx contractapi.TransactionContextInterface, tokenId string) (bool, error) {
+	_, sender, err := _readClientID(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	listing, err := _readListing(ctx, tokenId)
+	if err != nil {
+		return false, err
+	}
+
+	if listing.Seller != sender {
+		nft, err := _readNFT(ctx, tokenId)
+		if err != nil {
+			return false, fmt.Errorf("failed to _readNFT : %v", err)
+		}
+		if nft.Owner != sender {
+			return false, fmt.Errorf("the sender is not the seller nor the current owner")
+		}
+	}
+
+	err = _deleteListing(ctx, tokenId)
+	if err != nil {
+		return false, err
+	}
+
+	listingBytes, err := json.Marshal(listing)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal listing: %v", err)
+	}
+
+	err = ctx.GetStub().SetEvent("ListingCancelled", listingBytes)
+	if err != nil {
+		return false, fmt.Errorf("failed to SetEvent listingBytes %s: %v", listingBytes, err)
+	}
+
+	return true, nil
+}
+
+// GetListing returns the listing of a non-fungible token
+// param {String} tokenId Unique ID of the non-fungible token
+// returns {Object} Return the listing
+
+func (c *TokenERC721Contract) GetListing(ctx contractapi.TransactionContextInterface, tokenId string) (*Listing, error) {
+	return _readListing(ctx, tokenId)
+}
+
+// Buy purchases a listed non-fungible token. In the same transaction the caller pays the price through
+// BatchTransfer of the ERC-20 chaincode of the marketplace, split into the royalty, the platform fee and
+// the proceeds of the seller, and receives the token. Shares owed to the caller itself are not transferred.
+// This function triggers a Sale event instead of a Transfer event. The Sale event carries the from, to and
+// tokenId fields of a Transfer event, so listeners that track ownership must also handle Sale.
+// param {String} tokenId Unique ID of the non-fungible token
+// param {Number} price The price the caller agrees to pay, it must equal the listed price
+// returns {Object} Return the sale
+
+func (c *TokenERC721Contract) Buy(ctx contractapi.TransactionContextInterface, tokenId string, price int) (*Sale, error) {
+	buyerAccount, buyer, err := _readClientID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	listing, err := _readListing(ctx, tokenId)
+	if err != nil {
+		return nil, err
+	}
+	if listing.Price != price {
+		return nil, fmt.Errorf("the token %s is listed for %d, not %d", tokenId, listing.Price, price)
+	}
+
+	// A listing is only valid as long as the seller owns the token
+	nft, err := _readNFT(ctx, tokenId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to _readNFT : %v", err)
+	}
+	if nft.Owner != listing.Seller {
+		return nil, fmt.Errorf("the listing of token %s is no longer valid", tokenId)
+	}
+	if buyer == listing.Seller {
+		return nil, fmt.Errorf("the seller cannot buy its own token")
+	}
+
+	marketplace, err := _readMarketplace(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	royalty, err := _readRoyalty(ctx, tokenId)
+	if err != nil {
+		return nil, err
+	}
+	royaltyAmount, err := _basisPointsOf(price, royalty.BasisPoints)
+	if err != nil {
+		return nil, err
+	}
+	fee, err := _basisPointsOf(price, marketplace.FeeBasisPoints)
+	if err != nil {
+		return nil, err
+	}
+	if royaltyAmount+fee > price {
+		return nil, fmt.Errorf("royalty %d and fee %d exceed the price %d", royaltyAmount, fee, price)
+	}
+
+	// Pay everyone in a single BatchTransfer, as the balance of the buyer can only be debited once per transaction
+	var recipients []string
+	var amounts []int
+	payees := []string{listing.SellerAccount, royalty.Receiver, marketplace.FeeReceiver}
+	payments := []int{price - royaltyAmount - fee, royaltyAmount, fee}
+	for i, payee := range payees {
+		if payments[i] == 0 || payee == buyerAccount {
+			continue
+		}
+		recipients = append(recipients, payee)
+		amounts = append(amounts, payments[i])
+	}
+
+	if len(recipients) > 0 {
+		err = _settle(ctx, marketplace.Chaincode, recipients, amounts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Transferring the token also removes its listing
+	err = _transferNFT(ctx, nft, listing.Seller, buyer)
+	if err != nil {
+		return nil, err
+	}
+
+	// Emit the Sale event, it takes the place of the Transfer event of the token
+	sale := new(Sale)
+	sale.From = listing.Seller
+	sale.To = buyer
+	sale.TokenId = tokenId
+	sale.Price = price
+	sale.RoyaltyReceiver = royalty.Receiver
+	sale.RoyaltyAmount = royaltyAmount
+	sale.Fee = fee
+
+	saleBytes, err := json.Marshal(sale)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal saleBytes: %v", err)
+	}
+
+	err = ctx.GetStub().SetEvent("Sale", saleBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to SetEvent saleBytes %s: %v", saleBytes, err)
+	}
+
+	return sale, nil
+}
+
+// _settle transfers amounts of the ERC-20 token of chaincodeName from the caller to recipients
+func _settle(ctx contractapi.TransactionContextInterface, chaincodeName string, recipients []string, amounts []int) error {
+	recipientsBytes, err := json.Marshal(recipients)
+	if err != nil {
+		return fmt.Errorf("failed to marshal recipients: %v", err)
+	}
+	amountsBytes, err := json.Marshal(amounts)
+	if err != nil {
+		return fmt.Errorf("failed to marshal amounts: %v", err)
+	}
+
+	args := [][]byte{[]byte("BatchTransfer"), recipientsBytes, amountsBytes}
+	response := ctx.GetStub().InvokeChaincode(chaincodeName, args, "")
+	if response.GetStatus() != shim.OK {
+		return fmt.Errorf("failed to pay through %s: %s", chaincodeName, response.GetMessage())
+	}
+
+	return nil
+}
+
+// _readClientID returns the client ID of the caller, which is its ERC-20 account, and its decoded form used as NFT owner
+func _readClientID(ctx contractapi.TransactionContextInterface) (string, string, error) {
+	clientID64, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to GetClientIdentity: %v", err)
+	}
+
+	clientIDBytes, err := base64.StdEncoding.DecodeString(clientID64)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to DecodeString clientID64: %v", err)
+	}
+
+	return clientID64, string(clientIDBytes), nil
+}
+
+// _basisPointsOf returns the share of amount given in basis points, rounded down
+func _basisPointsOf(amount int, basisPoints int) (int, error) {
+	if amount > math.MaxInt/maxBasisPoints {
+		return 0, fmt.Errorf("amount %d is too large", amount)
+	}
+	return amount * basisPoints / maxBasisPoints, nil
+}
+
+// _readRoyalty returns the royalty record of a token, with no receiver and 0 basis points if it has none
+func _readRoyalty(ctx contractapi.TransactionContextInterface, tokenId string) (*Royalty, error) {
+	royaltyKey, err := ctx.GetStub().CreateCompositeKey(royaltyPrefix, []string{tokenId})
+	if err != nil {
+		return nil, fmt.Errorf("failed to CreateCompositeKey royaltyKey: %v", err)
+	}
+
+	royaltyBytes, err := ctx.GetStub().GetState(royaltyKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to GetState royaltyKey %s: %v", royaltyKey, err)
+	}
+
+	royalty := new(Royalty)
+	royalty.TokenId = tokenId
+	if len(royaltyBytes) == 0 {
+		return royalty, nil
+	}
+
+	err = json.Unmarshal(royaltyBytes, royalty)
+	if err != nil {
+		return nil, fmt.Errorf("failed to Unmarshal royaltyBytes: %v", err)
+	}
+
+	return royalty, nil
+}
+
+func _readMarketplace(ctx contractapi.TransactionContextInterface) (*Marketplace, error) {
+	marketplaceBytes, err := ctx.GetStub().GetState(marketplaceKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to GetState marketplaceKey %s: %v", marketplaceKey, err)
+	}
+	if len(marketplaceBytes) == 0 {
+		return nil, fmt.Errorf("the marketplace is not configured")
+	}
+
+	marketplace := new(Marketplace)
+	err = json.Unmarshal(marketplaceBytes, marketplace)
+	if err != nil {
+		return nil, fmt.Errorf("failed to Unmarshal marketplaceBytes: %v", err)
+	}
+
+	return marketplace, nil
+}
+
+func _readListing(ctx contractapi.TransactionContextInterface, tokenId string) (*Listing, error) {
+	listingKey, err := ctx.GetStub().CreateCompositeKey(listingPrefix, []string{tokenId})
+	if err != nil {
+		return nil, fmt.Errorf("failed to CreateCompositeKey listingKey: %v", err)
+	}
+
+	listingBytes, err := ctx.GetStub().GetState(listingKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to GetState listingKey %s: %v", listingKey, err)
+	}
+	if len(listingBytes) == 0 {
+		return nil, fmt.Errorf("the token %s is not listed for sale", tokenId)
+	}
+
+	listing := new(Listing)
+	err = json.Unmarshal(listingBytes, listing)
+	if err != nil {
+		return nil, fmt.Errorf("failed to Unmarshal listingBytes: %v", err)
+	}
+
+	return listing, nil
+}
+
+func _deleteListing(ctx contractapi.TransactionContextInterface, tokenId string) error {
+	listingKey, err := ctx.GetStub().CreateCompositeKey(listingPrefix, []string{tokenId})
+	if err != nil {
+		return fmt.Errorf("failed to CreateCompositeKey listingKey: %v", err)
+	}
+
+	err = ctx.GetStub().DelState(listingKey)
+	if err != nil {
+		return fmt.Errorf("failed to DelState listingKey %s: %v", listingKey, err)
+	}
+
+	return nil
+}
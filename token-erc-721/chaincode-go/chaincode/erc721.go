@@ -23,3 +23,53 @@ type Transfer struct {
 	To      string `json:"to"`
 	TokenId string `json:"tokenId"`
 }
+
+// NftQueryResult structure used for returning paginated non-fungible tokens
+type NftQueryResult struct {
+	Records             []*Nft `json:"records"`
+	FetchedRecordsCount int32  `json:"fetchedRecordsCount"`
+	Bookmark            string `json:"bookmark"`
+}
+
+// Royalty is the EIP-2981 royalty record of a non-fungible token. BasisPoints is the share of
+// every sale price, in hundredths of a percent, that is paid to the ERC-20 account Receiver.
+type Royalty struct {
+	TokenId     string `json:"tokenId"`
+	Receiver    string `json:"receiver"`
+	BasisPoints int    `json:"basisPoints"`
+}
+
+// RoyaltyPayment is the royalty owed for a sale, as returned by RoyaltyInfo
+type RoyaltyPayment struct {
+	Receiver      string `json:"receiver"`
+	RoyaltyAmount int    `json:"royaltyAmount"`
+}
+
+// Marketplace configures the settlement of sales. Prices are paid in the ERC-20 token of the
+// chaincode Chaincode, and FeeBasisPoints of every price goes to the ERC-20 account FeeReceiver.
+type Marketplace struct {
+	Chaincode      string `json:"chaincode"`
+	FeeReceiver    string `json:"feeReceiver"`
+	FeeBasisPoints int    `json:"feeBasisPoints"`
+}
+
+// Listing offers a non-fungible token for sale. Seller is the owner of the token and
+// SellerAccount the ERC-20 account that receives the proceeds.
+type Listing struct {
+	TokenId       string `json:"tokenId"`
+	Seller        string `json:"seller"`
+	SellerAccount string `json:"sellerAccount"`
+	Price         int    `json:"price"`
+}
+
+// Sale records a purchase of a non-fungible token and how its price was paid out.
+// From, To and TokenId match the fields of Transfer, which Sale replaces for a purchase.
+type Sale struct {
+	From            string `json:"from"`
+	To              string `json:"to"`
+	TokenId         string `json:"tokenId"`
+	Price           int    `json:"price"`
+	RoyaltyReceiver string `json:"royaltyReceiver"`
+	RoyaltyAmount   int    `json:"royaltyAmount"`
+	Fee             int    `json:"fee"`
+}